@@ -186,6 +186,7 @@ func init() {
 		disasmCommand,
 		runCommand,
 		stateTestCommand,
+		substateTestCommand,
 		stateTransitionCommand,
 	}
 	cli.CommandHelpTemplate = flags.OriginCommandHelpTemplate
@@ -0,0 +1,89 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/substate"
+	"github.com/ethereum/go-ethereum/tests"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+var SubstateForkFlag = cli.StringFlag{
+	Name:  "fork",
+	Usage: "Fork of the generated state tests, the fork of the block on mainnet if empty",
+}
+
+var substateTestCommand = cli.Command{
+	Action:    substateTestCmd,
+	Name:      "substatetest",
+	Usage:     "converts exported substates into state tests",
+	ArgsUsage: "<file>",
+	Flags: []cli.Flag{
+		SubstateForkFlag,
+	},
+	Description: `
+The substatetest command reads substates in the JSON lines format of
+SubstateDB.ExportJSONL and writes them as state tests named
+<block>_<tx> to the standard output, which the statetest command runs.`,
+}
+
+func substateTestCmd(ctx *cli.Context) error {
+	if len(ctx.Args().First()) == 0 {
+		return errors.New("path-to-substates argument required")
+	}
+	file, err := os.Open(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fixtures := make(map[string]*tests.StateTest)
+	dec := json.NewDecoder(file)
+	for {
+		var line substate.TransactionJSON
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid substate after %d converted substates: %v", len(fixtures), err)
+		}
+		if line.Substate == nil {
+			return fmt.Errorf("substate %v_%v has no value", line.Block, line.Transaction)
+		}
+		s := &substate.Substate{}
+		s.SetJSON(line.Substate)
+		test, err := tests.StateTestFromSubstate(s, ctx.String(SubstateForkFlag.Name))
+		if err != nil {
+			return fmt.Errorf("substate %v_%v: %v", line.Block, line.Transaction, err)
+		}
+		fixtures[fmt.Sprintf("%v_%v", line.Block, line.Transaction)] = test
+	}
+	out, err := json.MarshalIndent(fixtures, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
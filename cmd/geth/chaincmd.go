@@ -38,6 +38,7 @@ import (
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/substate"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -101,6 +102,10 @@ The dumpgenesis command dumps the genesis block configuration in JSON format to
 			utils.MetricsInfluxDBBucketFlag,
 			utils.MetricsInfluxDBOrganizationFlag,
 			utils.TxLookupLimitFlag,
+			utils.RecordSubstateFlag,
+			substate.SubstateDirFlag,
+			substate.SubstateCacheFlag,
+			substate.SubstateHandlesFlag,
 		},
 		Category: "BLOCKCHAIN COMMANDS",
 		Description: `
@@ -108,7 +113,10 @@ The import command imports blocks from an RLP-encoded form. The form can be one
 with several RLP-encoded blocks, or several files can be used.
 
 If only one file is used, import error will result in failure. If several files are used,
-processing will proceed even if an individual RLP-file import failure occurs.`,
+processing will proceed even if an individual RLP-file import failure occurs.
+
+If --record-substate is set, the substates of all imported transactions are recorded
+into the substate DB in --substatedir.`,
 	}
 	exportCommand = cli.Command{
 		Action:    utils.MigrateFlags(exportChain),
@@ -239,9 +247,22 @@ func importChain(ctx *cli.Context) error {
 	stack, _ := makeConfigNode(ctx)
 	defer stack.Close()
 
+	recordSubstate := ctx.GlobalBool(utils.RecordSubstateFlag.Name)
+	if recordSubstate {
+		substate.SetSubstateFlags(ctx)
+		substate.OpenSubstateDB()
+		defer substate.CloseSubstateDB()
+	}
+
 	chain, db := utils.MakeChain(ctx, stack)
 	defer db.Close()
 
+	var substateRecorder *core.SubstateRecorder
+	if recordSubstate {
+		substateRecorder = core.NewSubstateRecorder(substate.StaticSubstateDB())
+		chain.AddTransactionHook(substateRecorder)
+	}
+
 	// Start periodically gathering memory profiles
 	var peakMemAlloc, peakMemSys uint64
 	go func() {
@@ -278,6 +299,15 @@ func importChain(ctx *cli.Context) error {
 	chain.Stop()
 	fmt.Printf("Import done in %v.\n\n", time.Since(start))
 
+	if substateRecorder != nil {
+		if err := substateRecorder.Close(); err != nil {
+			utils.Fatalf("Failed to write substates: %v", err)
+		}
+		stats := substateRecorder.Stats()
+		fmt.Printf("Substates:     %d in %d blocks, %.3f MB\n", stats.Substates, stats.Blocks, float64(stats.SubstateBytes)/1024/1024)
+		fmt.Printf("Bytecode:      %d written, %d skipped, %.3f MB\n\n", stats.Codes, stats.CodeHits, float64(stats.CodeBytes)/1024/1024)
+	}
+
 	// Output pre-compaction stats mostly to see the import trashing
 	showLeveldbStats(db)
 
@@ -448,7 +478,7 @@ func dump(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	state, err := state.New(root, state.NewDatabase(db), nil)
+	state, err := state.New(root, state.NewDatabase(db), nil, nil)
 	if err != nil {
 		return err
 	}
@@ -222,6 +222,10 @@ var (
 		Usage: "Number of recent blocks to maintain transactions index for (default = about one year, 0 = entire chain)",
 		Value: ethconfig.Defaults.TxLookupLimit,
 	}
+	RecordSubstateFlag = cli.BoolFlag{
+		Name:  "record-substate",
+		Usage: "Record transaction substates into the substate DB (see --substatedir)",
+	}
 	LightKDFFlag = cli.BoolFlag{
 		Name:  "lightkdf",
 		Usage: "Reduce key-derivation RAM & CPU usage at some expense of KDF strength",
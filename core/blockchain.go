@@ -207,6 +207,9 @@ type BlockChain struct {
 	processor  Processor // Block transaction processor interface
 	vmConfig   vm.Config
 
+	hooks        []TransactionHook // Post-processing hooks of transactions and blocks
+	substateHook SubstateHook      // Hook providing the substate recorder of processed blocks, nil if not recording
+
 	shouldPreserve  func(*types.Block) bool        // Function used to determine whether should preserve the given block.
 	terminateInsert func(common.Hash, uint64) bool // Testing hook used to terminate ancient receipt chain insertion.
 }
@@ -281,7 +284,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 	}
 	// Make sure the state associated with the block is available
 	head := bc.CurrentBlock()
-	if _, err := state.New(head.Root(), bc.stateCache, bc.snaps); err != nil {
+	if _, err := state.New(head.Root(), bc.stateCache, bc.snaps, nil); err != nil {
 		// Head state is missing, before the state recovery, find out the
 		// disk layer point of snapshot(if it's enabled). Make sure the
 		// rewound point is lower than disk layer.
@@ -520,7 +523,7 @@ func (bc *BlockChain) SetHeadBeyondRoot(head uint64, root common.Hash) (uint64,
 					if root != (common.Hash{}) && !beyondRoot && newHeadBlock.Root() == root {
 						beyondRoot, rootNumber = true, newHeadBlock.NumberU64()
 					}
-					if _, err := state.New(newHeadBlock.Root(), bc.stateCache, bc.snaps); err != nil {
+					if _, err := state.New(newHeadBlock.Root(), bc.stateCache, bc.snaps, nil); err != nil {
 						log.Trace("Block state missing, rewinding further", "number", newHeadBlock.NumberU64(), "hash", newHeadBlock.Hash())
 						if pivot == nil || newHeadBlock.NumberU64() > *pivot {
 							parent := bc.GetBlock(newHeadBlock.ParentHash(), newHeadBlock.NumberU64()-1)
@@ -681,6 +684,43 @@ func (bc *BlockChain) Processor() Processor {
 	return bc.processor
 }
 
+// AddTransactionHook registers a post-processing hook of transactions in the
+// state processor of the chain. The chain post-processes a block only after
+// it was validated and written.
+func (bc *BlockChain) AddTransactionHook(hook TransactionHook) {
+	if substateHook, ok := hook.(SubstateHook); ok && bc.substateHook == nil {
+		bc.substateHook = substateHook
+	}
+	bc.hooks = append(bc.hooks, hook)
+	bc.processor.(*StateProcessor).AddTransactionHook(hook)
+}
+
+// postBlock post-processes a written block with the registered hooks.
+func (bc *BlockChain) postBlock(block *types.Block) error {
+	for _, hook := range bc.hooks {
+		if err := hook.PostBlock(block); err != nil {
+			return fmt.Errorf("could not post-process block %d [%v]: %w", block.NumberU64(), block.Hash().Hex(), err)
+		}
+	}
+	return nil
+}
+
+// discardBlock drops the post-processing state of a rejected block.
+func (bc *BlockChain) discardBlock(block *types.Block) {
+	for _, hook := range bc.hooks {
+		hook.DiscardBlock(block)
+	}
+}
+
+// newStateRecorder returns the substate recorder for the statedb of a block
+// to be processed, or nil if no registered hook reads substates.
+func (bc *BlockChain) newStateRecorder() state.SubstateRecorder {
+	if bc.substateHook == nil {
+		return nil
+	}
+	return bc.substateHook.NewStateRecorder()
+}
+
 // State returns a new mutable state based on the current HEAD block.
 func (bc *BlockChain) State() (*state.StateDB, error) {
 	return bc.StateAt(bc.CurrentBlock().Root())
@@ -688,7 +728,7 @@ func (bc *BlockChain) State() (*state.StateDB, error) {
 
 // StateAt returns a new mutable state based on a particular point in time.
 func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
-	return state.New(root, bc.stateCache, bc.snaps)
+	return state.New(root, bc.stateCache, bc.snaps, nil)
 }
 
 // StateCache returns the caching database underpinning the blockchain instance.
@@ -1833,7 +1873,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		if parent == nil {
 			parent = bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
 		}
-		statedb, err := state.New(parent.Root, bc.stateCache, bc.snaps)
+		statedb, err := state.New(parent.Root, bc.stateCache, bc.snaps, bc.newStateRecorder())
 		if err != nil {
 			return it.index, err
 		}
@@ -1846,7 +1886,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		var followupInterrupt uint32
 		if !bc.cacheConfig.TrieCleanNoPrefetch {
 			if followup, err := it.peek(); followup != nil && err == nil {
-				throwaway, _ := state.New(parent.Root, bc.stateCache, bc.snaps)
+				throwaway, _ := state.New(parent.Root, bc.stateCache, bc.snaps, nil)
 
 				go func(start time.Time, followup *types.Block, throwaway *state.StateDB, interrupt *uint32) {
 					bc.prefetcher.Prefetch(followup, throwaway, bc.vmConfig, &followupInterrupt)
@@ -1862,6 +1902,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		substart := time.Now()
 		receipts, logs, usedGas, err := bc.processor.Process(block, statedb, bc.vmConfig)
 		if err != nil {
+			bc.discardBlock(block)
 			bc.reportBlock(block, receipts, err)
 			atomic.StoreUint32(&followupInterrupt, 1)
 			return it.index, err
@@ -1882,6 +1923,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		// Validate the state using the default validator
 		substart = time.Now()
 		if err := bc.validator.ValidateState(block, statedb, receipts, usedGas); err != nil {
+			bc.discardBlock(block)
 			bc.reportBlock(block, receipts, err)
 			atomic.StoreUint32(&followupInterrupt, 1)
 			return it.index, err
@@ -1899,6 +1941,10 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		status, err := bc.writeBlockWithState(block, receipts, logs, statedb, false)
 		atomic.StoreUint32(&followupInterrupt, 1)
 		if err != nil {
+			bc.discardBlock(block)
+			return it.index, err
+		}
+		if err := bc.postBlock(block); err != nil {
 			return it.index, err
 		}
 		// Update the metrics touched during block commit
@@ -27,7 +27,6 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rlp"
-	"github.com/ethereum/go-ethereum/substate"
 )
 
 var emptyCodeHash = crypto.Keccak256(nil)
@@ -183,7 +182,7 @@ func (s *stateObject) getTrie(db Database) Trie {
 
 // GetState retrieves a value from the account storage trie.
 func (s *stateObject) GetState(db Database, key common.Hash) common.Hash {
-	if substate.RecordReplay {
+	if s.db.substateRecorder != nil {
 		// mark keys touched by GetState
 		if _, exist := s.AccessedStorage[key]; !exist {
 			s.AccessedStorage[key] = struct{}{}
@@ -335,7 +334,7 @@ func (s *stateObject) finalise(prefetch bool) {
 		s.dirtyStorage = make(Storage)
 	}
 
-	if substate.RecordReplay {
+	if s.db.substateRecorder != nil {
 		// clear stateObject.AccessedStorage
 		s.AccessedStorage = make(map[common.Hash]struct{})
 	}
@@ -479,7 +478,7 @@ func (s *stateObject) deepCopy(db *StateDB) *stateObject {
 	stateObject.dirtyCode = s.dirtyCode
 	stateObject.deleted = s.deleted
 
-	if substate.RecordReplay {
+	if s.db.substateRecorder != nil {
 		// deepCopy stateObject.AccessedStorage
 		stateObject.AccessedStorage = make(map[common.Hash]struct{})
 		for key := range s.AccessedStorage {
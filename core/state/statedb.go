@@ -120,18 +120,17 @@ type StateDB struct {
 	SnapshotStorageReads time.Duration
 	SnapshotCommits      time.Duration
 
-	// record-replay: SubstatePreAlloc, SubstatePostAlloc, SubstateBlockHashes of StateDB
-	SubstatePreAlloc    substate.SubstateAlloc
-	SubstatePostAlloc   substate.SubstateAlloc
-	SubstateBlockHashes map[uint64]common.Hash
+	// record-replay: collects the substate of transactions, nil if not recording
+	substateRecorder SubstateRecorder
 }
 
-// New creates a new state from a given trie.
-func New(root common.Hash, db Database, snaps *snapshot.Tree) (*StateDB, error) {
-	return NewWithSnapLayers(root, db, snaps, 128)
+// New creates a new state from a given trie. If recorder is not nil, the
+// substate of each transaction is collected in recorder.
+func New(root common.Hash, db Database, snaps *snapshot.Tree, recorder SubstateRecorder) (*StateDB, error) {
+	return NewWithSnapLayers(root, db, snaps, 128, recorder)
 }
 
-func NewWithSnapLayers(root common.Hash, db Database, snaps *snapshot.Tree, layers int) (*StateDB, error) {
+func NewWithSnapLayers(root common.Hash, db Database, snaps *snapshot.Tree, layers int, recorder SubstateRecorder) (*StateDB, error) {
 	tr, err := db.OpenTrie(root)
 	if err != nil {
 		return nil, err
@@ -150,6 +149,7 @@ func NewWithSnapLayers(root common.Hash, db Database, snaps *snapshot.Tree, laye
 		accessList:          newAccessList(),
 		hasher:              crypto.NewKeccakState(),
 		snapMaxLayers:       layers,
+		substateRecorder:    recorder,
 	}
 	if sdb.snaps != nil {
 		if sdb.snap = sdb.snaps.Snapshot(root); sdb.snap != nil {
@@ -158,14 +158,9 @@ func NewWithSnapLayers(root common.Hash, db Database, snaps *snapshot.Tree, laye
 			sdb.snapStorage = make(map[common.Hash]map[common.Hash][]byte)
 		}
 	}
-
-	if substate.RecordReplay {
-		// init StateDB.Substate*
-		sdb.SubstatePreAlloc = make(substate.SubstateAlloc)
-		sdb.SubstatePostAlloc = make(substate.SubstateAlloc)
-		sdb.SubstateBlockHashes = make(map[uint64]common.Hash)
+	if sdb.substateRecorder != nil {
+		sdb.substateRecorder.Reset()
 	}
-
 	return sdb, nil
 }
 
@@ -519,21 +514,23 @@ func (s *StateDB) deleteStateObject(obj *stateObject) {
 func (s *StateDB) getStateObject(addr common.Address) *stateObject {
 	if obj := s.getDeletedStateObject(addr); obj != nil && !obj.deleted {
 
-		if substate.RecordReplay {
-			// insert the account in StateDB.SubstatePreAlloc
-			if _, exist := s.SubstatePreAlloc[addr]; !exist {
-				s.SubstatePreAlloc[addr] = substate.NewSubstateAccount(obj.Nonce(), obj.Balance(), obj.Code(s.db))
+		if s.substateRecorder != nil {
+			// insert the account in the input alloc
+			inputAlloc := s.substateRecorder.InputAlloc()
+			if _, exist := inputAlloc[addr]; !exist {
+				inputAlloc[addr] = substate.NewSubstateAccount(obj.Nonce(), obj.Balance(), obj.Code(s.db))
 			}
 		}
 
 		return obj
 	}
 
-	if substate.RecordReplay {
-		// insert empty account in StateDB.SubstatePreAlloc
+	if s.substateRecorder != nil {
+		// insert empty account in the input alloc
 		// This will prevent insertion of new account created in txs
-		if _, exist := s.SubstatePreAlloc[addr]; !exist {
-			s.SubstatePreAlloc[addr] = nil
+		inputAlloc := s.substateRecorder.InputAlloc()
+		if _, exist := inputAlloc[addr]; !exist {
+			inputAlloc[addr] = nil
 		}
 	}
 
@@ -746,20 +743,9 @@ func (s *StateDB) Copy() *StateDB {
 		state.preimages[hash] = preimage
 	}
 
-	if substate.RecordReplay {
-		// copy StateDB.Substate*
-		state.SubstatePreAlloc = make(substate.SubstateAlloc)
-		state.SubstatePostAlloc = make(substate.SubstateAlloc)
-		state.SubstateBlockHashes = make(map[uint64]common.Hash)
-		for addr, account := range s.SubstatePreAlloc {
-			state.SubstatePreAlloc[addr] = account.Copy()
-		}
-		for addr, account := range s.SubstatePostAlloc {
-			state.SubstatePostAlloc[addr] = account.Copy()
-		}
-		for num64, bhash := range s.SubstateBlockHashes {
-			state.SubstateBlockHashes[num64] = bhash
-		}
+	if s.substateRecorder != nil {
+		// copy the substate collected so far
+		state.substateRecorder = s.substateRecorder.Copy()
 	}
 
 	// Do we need to copy the access list? In practice: No. At the start of a
@@ -837,11 +823,13 @@ func (s *StateDB) GetRefund() uint64 {
 // into the tries just yet. Only IntermediateRoot or Commit will do that.
 func (s *StateDB) Finalise(deleteEmptyObjects bool) {
 
-	if substate.RecordReplay {
+	if s.substateRecorder != nil {
 		// copy original storage values to Prestate and Poststate
-		for addr, sa := range s.SubstatePreAlloc {
+		inputAlloc := s.substateRecorder.InputAlloc()
+		outputAlloc := s.substateRecorder.OutputAlloc()
+		for addr, sa := range inputAlloc {
 			if sa == nil {
-				delete(s.SubstatePreAlloc, addr)
+				delete(inputAlloc, addr)
 				continue
 			}
 
@@ -849,7 +837,7 @@ func (s *StateDB) Finalise(deleteEmptyObjects bool) {
 			for key := range obj.AccessedStorage {
 				sa.Storage[key] = obj.GetCommittedState(s.db, key)
 			}
-			s.SubstatePostAlloc[addr] = sa.Copy()
+			outputAlloc[addr] = sa.Copy()
 		}
 	}
 
@@ -877,18 +865,18 @@ func (s *StateDB) Finalise(deleteEmptyObjects bool) {
 				delete(s.snapAccounts, obj.addrHash)       // Clear out any previously updated account data (may be recreated via a ressurrect)
 				delete(s.snapStorage, obj.addrHash)        // Clear out any previously updated storage data (may be recreated via a ressurrect)
 			}
-			if substate.RecordReplay {
-				// delete account from StateDB.SubstatePostAlloc
-				delete(s.SubstatePostAlloc, addr)
+			if s.substateRecorder != nil {
+				// delete account from the output alloc
+				delete(s.substateRecorder.OutputAlloc(), addr)
 			}
 		} else {
-			if substate.RecordReplay {
-				// copy dirty account to StateDB.SubstatePostAlloc
+			if s.substateRecorder != nil {
+				// copy dirty account to the output alloc
 				sa := substate.NewSubstateAccount(obj.Nonce(), obj.Balance(), obj.Code(s.db))
 				for key := range obj.AccessedStorage {
 					sa.Storage[key] = obj.GetState(s.db, key)
 				}
-				s.SubstatePostAlloc[addr] = sa
+				s.substateRecorder.OutputAlloc()[addr] = sa
 			}
 			obj.finalise(true) // Prefetch slots in the background
 		}
@@ -974,11 +962,9 @@ func (s *StateDB) Prepare(thash common.Hash, ti int) {
 	s.thash = thash
 	s.txIndex = ti
 
-	if substate.RecordReplay {
-		// reset StateDB.Substate* and stateObject.Substate*
-		s.SubstatePreAlloc = make(substate.SubstateAlloc)
-		s.SubstatePostAlloc = make(substate.SubstateAlloc)
-		s.SubstateBlockHashes = make(map[uint64]common.Hash)
+	if s.substateRecorder != nil {
+		// reset the substate recorder and stateObject.AccessedStorage
+		s.substateRecorder.Reset()
 		for _, obj := range s.stateObjects {
 			obj.AccessedStorage = make(map[common.Hash]struct{})
 		}
@@ -1131,5 +1117,22 @@ func (s *StateDB) SlotInAccessList(addr common.Address, slot common.Hash) (addre
 }
 
 func (s *StateDB) GetSubstatePostAlloc() substate.SubstateAlloc {
-	return s.SubstatePostAlloc
+	if s.substateRecorder == nil {
+		return nil
+	}
+	return s.substateRecorder.OutputAlloc()
+}
+
+// SubstateRecorder returns the recorder collecting the substate of the
+// transaction in process, or nil if the StateDB does not record substates.
+func (s *StateDB) SubstateRecorder() SubstateRecorder {
+	return s.substateRecorder
+}
+
+// RecordBlockHash records a block hash read by the transaction in process.
+// It is a no-op if the StateDB does not record substates.
+func (s *StateDB) RecordBlockHash(num uint64, hash common.Hash) {
+	if s.substateRecorder != nil {
+		s.substateRecorder.BlockHashes()[num] = hash
+	}
 }
@@ -0,0 +1,101 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+// SubstateRecorder holds the substate of the transaction in process collected
+// by a StateDB. A StateDB created without a recorder collects nothing.
+type SubstateRecorder interface {
+	// Reset discards the substate of the previous transaction. It is called
+	// by StateDB.Prepare before a transaction is executed.
+	Reset()
+
+	// InputAlloc returns the accounts accessed by the transaction as they
+	// were before the transaction. A nil account marks an address that did
+	// not exist before the transaction.
+	InputAlloc() substate.SubstateAlloc
+
+	// OutputAlloc returns the accounts accessed by the transaction as they
+	// are after the transaction.
+	OutputAlloc() substate.SubstateAlloc
+
+	// BlockHashes returns the block hashes read by the transaction.
+	BlockHashes() map[uint64]common.Hash
+
+	// Copy returns an independent deep copy of the recorder.
+	Copy() SubstateRecorder
+}
+
+// AllocRecorder is the default SubstateRecorder that keeps the substate of
+// a transaction in memory.
+type AllocRecorder struct {
+	inputAlloc  substate.SubstateAlloc
+	outputAlloc substate.SubstateAlloc
+	blockHashes map[uint64]common.Hash
+}
+
+// NewAllocRecorder creates an empty AllocRecorder.
+func NewAllocRecorder() *AllocRecorder {
+	r := &AllocRecorder{}
+	r.Reset()
+	return r
+}
+
+// Reset implements SubstateRecorder.
+func (r *AllocRecorder) Reset() {
+	r.inputAlloc = make(substate.SubstateAlloc)
+	r.outputAlloc = make(substate.SubstateAlloc)
+	r.blockHashes = make(map[uint64]common.Hash)
+}
+
+// InputAlloc implements SubstateRecorder.
+func (r *AllocRecorder) InputAlloc() substate.SubstateAlloc {
+	return r.inputAlloc
+}
+
+// OutputAlloc implements SubstateRecorder.
+func (r *AllocRecorder) OutputAlloc() substate.SubstateAlloc {
+	return r.outputAlloc
+}
+
+// BlockHashes implements SubstateRecorder.
+func (r *AllocRecorder) BlockHashes() map[uint64]common.Hash {
+	return r.blockHashes
+}
+
+// Copy implements SubstateRecorder.
+func (r *AllocRecorder) Copy() SubstateRecorder {
+	cpy := NewAllocRecorder()
+	for addr, account := range r.inputAlloc {
+		if account == nil {
+			cpy.inputAlloc[addr] = nil
+			continue
+		}
+		cpy.inputAlloc[addr] = account.Copy()
+	}
+	for addr, account := range r.outputAlloc {
+		cpy.outputAlloc[addr] = account.Copy()
+	}
+	for num64, bhash := range r.blockHashes {
+		cpy.blockHashes[num64] = bhash
+	}
+	return cpy
+}
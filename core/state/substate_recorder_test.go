@@ -0,0 +1,96 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+// Tests that only a StateDB created with a recorder collects substates, so
+// that recording and non-recording instances can be used side by side.
+func TestSubstateRecorder(t *testing.T) {
+	var (
+		addr  = common.BytesToAddress([]byte{0x01})
+		fresh = common.BytesToAddress([]byte{0x02})
+		key   = common.BytesToHash([]byte{0x03})
+		value = common.BytesToHash([]byte{0x04})
+	)
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	state, _ := New(common.Hash{}, db, nil, nil)
+	state.SetBalance(addr, big.NewInt(42))
+	state.SetState(addr, key, value)
+	root, _ := state.Commit(false)
+
+	for _, recording := range []bool{true, false} {
+		recording := recording
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			var recorder SubstateRecorder
+			if recording {
+				recorder = NewAllocRecorder()
+			}
+			state, _ := New(root, db, nil, recorder)
+			state.Prepare(common.Hash{0x01}, 0)
+			state.AddBalance(addr, big.NewInt(1))
+			state.GetState(addr, key)
+			state.SetBalance(fresh, big.NewInt(1))
+			state.RecordBlockHash(7, common.Hash{0x07})
+			state.Finalise(true)
+
+			if !recording {
+				if state.SubstateRecorder() != nil || state.GetSubstatePostAlloc() != nil {
+					t.Fatalf("non-recording statedb collected a substate")
+				}
+				return
+			}
+			input := recorder.InputAlloc()
+			if len(input) != 1 || input[addr] == nil {
+				t.Fatalf("wrong input alloc: %v", input)
+			}
+			if have := input[addr].Balance; have.Cmp(big.NewInt(42)) != 0 {
+				t.Errorf("wrong input balance: have %v, want 42", have)
+			}
+			if have := input[addr].Storage[key]; have != value {
+				t.Errorf("wrong input storage: have %x, want %x", have, value)
+			}
+			output := recorder.OutputAlloc()
+			if have := output[addr].Balance; have.Cmp(big.NewInt(43)) != 0 {
+				t.Errorf("wrong output balance: have %v, want 43", have)
+			}
+			if _, found := output[fresh]; !found {
+				t.Errorf("created account missing in output alloc")
+			}
+			if have := recorder.BlockHashes()[7]; have != (common.Hash{0x07}) {
+				t.Errorf("wrong block hash: have %x", have)
+			}
+
+			cpy := state.Copy()
+			state.Prepare(common.Hash{0x02}, 1)
+			if len(recorder.InputAlloc()) != 0 {
+				t.Errorf("input alloc not reset by Prepare")
+			}
+			if len(cpy.SubstateRecorder().InputAlloc()) != 1 {
+				t.Errorf("copied statedb shares the substate recorder")
+			}
+		})
+	}
+}
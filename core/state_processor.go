@@ -38,6 +38,8 @@ type StateProcessor struct {
 	config *params.ChainConfig // Chain configuration options
 	bc     *BlockChain         // Canonical block chain
 	engine consensus.Engine    // Consensus engine used for block rewards
+
+	hooks []TransactionHook // Post-processing hooks of transactions
 }
 
 // NewStateProcessor initialises a new StateProcessor.
@@ -49,6 +51,12 @@ func NewStateProcessor(config *params.ChainConfig, bc *BlockChain, engine consen
 	}
 }
 
+// AddTransactionHook registers a hook that is called after each transaction
+// processed by Process. Blocks are post-processed by the chain.
+func (p *StateProcessor) AddTransactionHook(hook TransactionHook) {
+	p.hooks = append(p.hooks, hook)
+}
+
 // Process processes the state changes according to the Ethereum rules by running
 // the transaction messages using the statedb and applying any rewards to both
 // the processor (coinbase) and any included uncles.
@@ -85,6 +93,11 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 		}
 		receipts = append(receipts, receipt)
 		allLogs = append(allLogs, receipt.Logs...)
+		for _, hook := range p.hooks {
+			if err := hook.PostTransaction(block, i, msg, receipt, statedb); err != nil {
+				return nil, nil, 0, fmt.Errorf("could not post-process tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+			}
+		}
 	}
 	// Finalize the block, applying any consensus engine specific extras (e.g. block rewards)
 	p.engine.Finalize(p.bc, header, statedb, block.Transactions(), block.Uncles())
@@ -0,0 +1,127 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+// SubstateRecorder is a SubstateHook that records the substate of every
+// processed transaction in a substate DB. Substates of a block are buffered
+// and committed together once the chain wrote the block, substates of
+// rejected blocks are dropped. The recorder must be closed to write the
+// substates of the last blocks.
+type SubstateRecorder struct {
+	writer  *substate.SubstateWriter
+	pending []*substate.Transaction // substates of the block in process
+}
+
+// NewSubstateRecorder creates a recorder that writes substates into db.
+func NewSubstateRecorder(db *substate.SubstateDB) *SubstateRecorder {
+	return &SubstateRecorder{
+		writer: db.NewSubstateWriter(substate.DefaultWriterBatchSize, substate.DefaultWriterCodeCacheSize),
+	}
+}
+
+// PostTransaction builds the substate of a transaction from the allocs
+// collected by the statedb, the block, the message and the receipt.
+// Transactions processed with a statedb without recorder, e.g. to regenerate
+// the state of a block, are skipped.
+func (r *SubstateRecorder) PostTransaction(block *types.Block, txIndex int, msg types.Message, receipt *types.Receipt, statedb *state.StateDB) error {
+	recorder := statedb.SubstateRecorder()
+	if recorder == nil {
+		return nil
+	}
+	if txIndex == 0 {
+		// drop substates of a previous block that failed processing
+		r.pending = nil
+	}
+
+	// The allocs are copied because finalising the block (e.g. block
+	// rewards) still modifies the allocs of the last transaction.
+	s := substate.NewSubstate(
+		copySubstateAlloc(recorder.InputAlloc()),
+		copySubstateAlloc(recorder.OutputAlloc()),
+		substate.NewSubstateEnv(block, recorder.BlockHashes()),
+		substate.NewSubstateMessage(&msg),
+		substate.NewSubstateResult(receipt),
+	)
+	r.pending = append(r.pending, &substate.Transaction{
+		Block:       block.NumberU64(),
+		Transaction: txIndex,
+		Substate:    s,
+	})
+	return nil
+}
+
+// NewStateRecorder implements SubstateHook.
+func (r *SubstateRecorder) NewStateRecorder() state.SubstateRecorder {
+	return state.NewAllocRecorder()
+}
+
+// PostBlock commits the buffered substates of a written block to the
+// substate DB.
+func (r *SubstateRecorder) PostBlock(block *types.Block) error {
+	defer func() { r.pending = nil }()
+
+	ctx := context.Background()
+	for _, tx := range r.pending {
+		if tx.Block != block.NumberU64() {
+			continue
+		}
+		err := r.writer.PutSubstate(ctx, tx.Block, tx.Transaction, tx.Substate)
+		if err != nil {
+			r.writer.Discard()
+			return err
+		}
+	}
+	if err := r.writer.CommitBlock(ctx); err != nil {
+		r.writer.Discard()
+		return err
+	}
+	return nil
+}
+
+// DiscardBlock drops the buffered substates of a rejected block.
+func (r *SubstateRecorder) DiscardBlock(block *types.Block) {
+	r.pending = nil
+	r.writer.Discard()
+}
+
+// Stats returns the amount of substate data written so far.
+func (r *SubstateRecorder) Stats() substate.SubstateWriterStats {
+	return r.writer.Stats()
+}
+
+// Close writes all committed blocks that are not written yet.
+func (r *SubstateRecorder) Close() error {
+	return r.writer.Flush()
+}
+
+func copySubstateAlloc(alloc substate.SubstateAlloc) substate.SubstateAlloc {
+	cpy := make(substate.SubstateAlloc, len(alloc))
+	for addr, account := range alloc {
+		if account != nil {
+			cpy[addr] = account.Copy()
+		}
+	}
+	return cpy
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+// Tests that the substate recorder stores the substate of every transaction
+// imported into the chain.
+func TestSubstateRecorder(t *testing.T) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   GenesisAlloc{address: {Balance: big.NewInt(1000000000000000)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		genesis = gspec.MustCommit(gendb)
+		signer  = types.LatestSigner(gspec.Config)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 3, func(i int, block *BlockGen) {
+		for j := 0; j < i; j++ {
+			tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x01}, big.NewInt(1000), params.TxGas, block.header.BaseFee, nil), signer, key)
+			if err != nil {
+				panic(err)
+			}
+			block.AddTx(tx)
+		}
+	})
+
+	db := rawdb.NewMemoryDatabase()
+	gspec.MustCommit(db)
+	chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	defer chain.Stop()
+
+	substateDB := substate.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer substateDB.Close()
+	recorder := NewSubstateRecorder(substateDB)
+	chain.AddTransactionHook(recorder)
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert block %d: %v", n, err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("failed to close recorder: %v", err)
+	}
+	if stats := recorder.Stats(); stats.Blocks != 3 || stats.Substates != 3 {
+		t.Fatalf("wrong recorder stats: have %d blocks and %d substates, want 3 and 3", stats.Blocks, stats.Substates)
+	}
+	for _, block := range blocks {
+		for i := 0; i < len(block.Transactions()); i++ {
+			s := substateDB.GetSubstate(block.NumberU64(), i)
+			if s == nil {
+				t.Fatalf("substate %v_%v not recorded", block.NumberU64(), i)
+			}
+			if s.Result.Status != types.ReceiptStatusSuccessful {
+				t.Errorf("substate %v_%v: wrong status %d", block.NumberU64(), i, s.Result.Status)
+			}
+			if _, found := s.InputAlloc[address]; !found {
+				t.Errorf("substate %v_%v: sender missing in input alloc", block.NumberU64(), i)
+			}
+		}
+		if substateDB.HasSubstate(block.NumberU64(), len(block.Transactions())) {
+			t.Errorf("unexpected substate %v_%v", block.NumberU64(), len(block.Transactions()))
+		}
+	}
+}
+
+// Tests that the substates of a block failing validation are not recorded and
+// that blocks processed without substate recording, e.g. to regenerate their
+// state, are skipped by the recorder.
+func TestSubstateRecorderSkipsRejectedBlocks(t *testing.T) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   GenesisAlloc{address: {Balance: big.NewInt(1000000000000000)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		genesis = gspec.MustCommit(gendb)
+		signer  = types.LatestSigner(gspec.Config)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 2, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x01}, big.NewInt(1000), params.TxGas, block.header.BaseFee, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+
+	db := rawdb.NewMemoryDatabase()
+	gspec.MustCommit(db)
+	chain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	defer chain.Stop()
+
+	substateDB := substate.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer substateDB.Close()
+	recorder := NewSubstateRecorder(substateDB)
+	chain.AddTransactionHook(recorder)
+
+	// the second block has a wrong state root and fails validation
+	header := blocks[1].Header()
+	header.Root = common.Hash{0x01}
+	invalid := types.NewBlockWithHeader(header).WithBody(blocks[1].Transactions(), blocks[1].Uncles())
+	if _, err := chain.InsertChain(types.Blocks{blocks[0], invalid}); err == nil {
+		t.Fatalf("inserted block with wrong state root")
+	}
+
+	// state regeneration processes blocks without recorder
+	statedb, err := chain.StateAt(genesis.Root())
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	if _, _, _, err := chain.Processor().Process(blocks[0], statedb, vm.Config{}); err != nil {
+		t.Fatalf("failed to process block without substate recording: %v", err)
+	}
+
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("failed to close recorder: %v", err)
+	}
+	if stats := recorder.Stats(); stats.Blocks != 1 || stats.Substates != 1 {
+		t.Fatalf("wrong recorder stats: have %d blocks and %d substates, want 1 and 1", stats.Blocks, stats.Substates)
+	}
+	if !substateDB.HasSubstate(1, 0) {
+		t.Fatalf("substate of valid block not recorded")
+	}
+	if substateDB.HasSubstate(2, 0) {
+		t.Fatalf("substate of invalid block recorded")
+	}
+}
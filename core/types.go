@@ -49,3 +49,29 @@ type Processor interface {
 	// the processor (coinbase) and any included uncles.
 	Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, uint64, error)
 }
+
+// TransactionHook is an interface for post-processing transactions in the
+// state processor, e.g. to record their substates.
+type TransactionHook interface {
+	// PostTransaction is called after the transaction with index txIndex of
+	// the block was applied to the statedb.
+	PostTransaction(block *types.Block, txIndex int, msg types.Message, receipt *types.Receipt, statedb *state.StateDB) error
+
+	// PostBlock is called by the chain once the processed block was validated
+	// and written.
+	PostBlock(block *types.Block) error
+
+	// DiscardBlock is called by the chain instead of PostBlock if the block
+	// failed processing, validation or writing.
+	DiscardBlock(block *types.Block)
+}
+
+// SubstateHook is a TransactionHook that reads the substates collected by the
+// statedb. Blocks are processed with a recording statedb if such a hook is
+// registered.
+type SubstateHook interface {
+	TransactionHook
+
+	// NewStateRecorder returns the recorder passed to the statedb of a block.
+	NewStateRecorder() state.SubstateRecorder
+}
@@ -17,27 +17,14 @@
 package vm
 
 import (
-	"context"
-	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
-	"log"
 	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 )
 
-// Basic-block profiling flag controlled by cli
-var BasicBlockProfiling bool
-
-// Maximal number of records per SQLITE3 transaction for writing
-const BasicBlockMaxNumRecords = 1000
-
-// Buffer size for micro-profiling channel
-var BasicBlockProfilingBufferSize int
-
-// Name of SQLITE3 database
-var BasicBlockProfilingDB string
-
 // Basic-block data record for a single smart contract invocation
 type BasicBlockProfileData struct {
 	Contract            common.Address      // contract in hex format
@@ -56,9 +43,6 @@ type BasicBlockProfileStatistic struct {
 	basicBlockFrequency map[BasicBlockKey]uint64 // basic block statistics
 }
 
-// Basic-Block Profiling channel
-var bbpChannel chan *BasicBlockProfileData = make(chan *BasicBlockProfileData, BasicBlockProfilingBufferSize)
-
 // Create new micro-profiling statistic
 func NewBasicBlockProfileStatistic() *BasicBlockProfileStatistic {
 	p := new(BasicBlockProfileStatistic)
@@ -66,110 +50,169 @@ func NewBasicBlockProfileStatistic() *BasicBlockProfileStatistic {
 	return p
 }
 
-// The data collector checks for a stopping signal and processes
-// the workers' records via a channel. A data collector is a background task.
-func BasicBlockProfilingCollector(ctx context.Context, done chan struct{}, bbps *BasicBlockProfileStatistic) {
-	defer close(done)
-	for {
-		select {
+// BasicBlockProfileCollector is the profiler of the basic-block profiling.
+// It sends a basic-block data record for every execution of contract code to
+// one of its shards, each aggregating the records it receives in a background
+// goroutine. A collector is started before and stopped after profiling.
+type BasicBlockProfileCollector struct {
+	config   ProfileCollectorConfig
+	channels []chan *BasicBlockProfileData
+	shards   []*BasicBlockProfileStatistic
+	next     uint32 // shard of the next record
+	wg       sync.WaitGroup
+	lock     sync.RWMutex // held for writing while starting and stopping
+	running  bool
+}
 
-		// receive a new data record from a worker?
-		case bbpd := <-bbpChannel:
-			for addr, bb := range bbpd.BasicBlockFrequency {
-				bkey := BasicBlockKey{Contract: bbpd.Contract.String(), Address: addr, Instructions: hex.EncodeToString(bb.Instructions)}
-				bbps.basicBlockFrequency[bkey] += bb.Frequency
-			}
+// NewBasicBlockProfileCollector creates a collector with the given
+// configuration.
+func NewBasicBlockProfileCollector(config ProfileCollectorConfig) *BasicBlockProfileCollector {
+	if config.Shards < 1 {
+		config.Shards = 1
+	}
+	return &BasicBlockProfileCollector{config: config}
+}
 
-		// receive stop signal?
-		case <-ctx.Done():
-			if len(bbpChannel) == 0 {
-				return
+// Start starts the shards aggregating the data records. A running collector
+// is not restarted.
+func (c *BasicBlockProfileCollector) Start() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.running {
+		return
+	}
+	c.running = true
+	c.channels = make([]chan *BasicBlockProfileData, c.config.Shards)
+	c.shards = make([]*BasicBlockProfileStatistic, c.config.Shards)
+	for i := range c.channels {
+		channel, bbps := make(chan *BasicBlockProfileData, c.config.BufferSize), NewBasicBlockProfileStatistic()
+		c.channels[i], c.shards[i] = channel, bbps
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for bbpd := range channel {
+				bbps.add(bbpd)
 			}
+		}()
+	}
+}
+
+// Stop waits for the records processed so far to be aggregated and returns
+// the statistic of all of them. Records processed after Stop are rejected.
+func (c *BasicBlockProfileCollector) Stop() *BasicBlockProfileStatistic {
+	c.lock.Lock()
+	if c.running {
+		c.running = false
+		for _, channel := range c.channels {
+			close(channel)
 		}
 	}
+	c.lock.Unlock()
+	c.wg.Wait()
+	res := NewBasicBlockProfileStatistic()
+	for _, bbps := range c.shards {
+		res.Merge(bbps)
+	}
+	return res
 }
 
-// put micro profiling data into the processing queue
-func ProcessBasicBlockProfileData(bbpd *BasicBlockProfileData) {
-	bbpChannel <- bbpd
+// Process puts a basic-block data record into the processing queue of a
+// shard. It fails if the collector is not running.
+func (c *BasicBlockProfileCollector) Process(bbpd *BasicBlockProfileData) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if !c.running {
+		return ErrProfileCollectorNotRunning
+	}
+	shard := atomic.AddUint32(&c.next, 1) % uint32(len(c.channels))
+	c.channels[shard] <- bbpd
+	return nil
 }
 
-// Merge two basic-block profiling statistics
-func (bbps *BasicBlockProfileStatistic) Merge(src *BasicBlockProfileStatistic) {
-	// update opcode frequency
-	for bb, freq := range src.basicBlockFrequency {
-		bbps.basicBlockFrequency[bb] += freq
+func (c *BasicBlockProfileCollector) Enter(contract *Contract) FrameProfile {
+	return &basicBlockFrame{
+		collector: c,
+		code:      contract.Code,
+		data: BasicBlockProfileData{
+			Contract:            profiledCodeAddress(contract),
+			BasicBlockFrequency: map[uint]BasicBlock{},
+		},
 	}
 }
 
-// dump basic block frequency stats into a SQLITE3 database
-func (bbps *BasicBlockProfileStatistic) Dump() {
-	// Dump basic-block frequency statistics into a SQLITE3 database
+type basicBlockFrame struct {
+	collector *BasicBlockProfileCollector
+	code      []byte
+	data      BasicBlockProfileData
+}
 
-	// open sqlite3 database
-	db, err := sql.Open("sqlite3", BasicBlockProfilingDB) // Open the created SQLite File
-	if err != nil {
-		log.Fatal(err.Error())
+func (f *basicBlockFrame) BasicBlock(pc uint64) {
+	bb, found := f.data.BasicBlockFrequency[uint(pc)]
+	if !found {
+		bb.Instructions = getBasicBlockInstructions(f.code, pc)
 	}
-	defer db.Close()
+	bb.Frequency++
+	f.data.BasicBlockFrequency[uint(pc)] = bb
+}
 
-	// drop basic-block frequency table
-	const dropBasicBlockFrequency string = `DROP TABLE IF EXISTS BasicBlockFrequency;`
-	_, err = db.Exec(dropBasicBlockFrequency)
-	if err != nil {
-		log.Fatalln(err.Error())
+func (f *basicBlockFrame) Instruction(pc uint64, op OpCode, gas uint64, duration time.Duration) {}
+
+func (f *basicBlockFrame) Exit() {
+	// records of frames exiting while the collector is not running are dropped
+	f.collector.Process(&f.data)
+}
+
+// getBasicBlockInstructions returns the instructions of the basic block
+// starting at pc, without the parameters of PUSHx.
+func getBasicBlockInstructions(code []byte, pc uint64) []byte {
+	instructions := []byte{}
+	for idx := pc; idx < uint64(len(code)); idx++ {
+		op := OpCode(code[idx])
+		instructions = append(instructions, byte(op))
+		if op == JUMP || op == JUMPI || op == STOP || op == RETURN || op == REVERT || op == SELFDESTRUCT {
+			break
+		}
+		if op.IsPush() {
+			idx += uint64(op - PUSH1 + 1)
+		}
 	}
+	return instructions
+}
 
-	// create new table
-	const createBasicBlockFrequency string = `
-	CREATE TABLE BasicBlockFrequency (
-	 contract TEXT,
-	 address NUMERIC,
-	 instructions TEXT,
-	 frequency NUMERIC
-	);`
-	_, err = db.Exec(createBasicBlockFrequency)
-	if err != nil {
-		log.Fatalln(err.Error())
+// add a data record to the statistic
+func (bbps *BasicBlockProfileStatistic) add(bbpd *BasicBlockProfileData) {
+	for addr, bb := range bbpd.BasicBlockFrequency {
+		bkey := BasicBlockKey{Contract: bbpd.Contract.String(), Address: addr, Instructions: hex.EncodeToString(bb.Instructions)}
+		bbps.basicBlockFrequency[bkey] += bb.Frequency
 	}
+}
 
-	// switch synchronous mode off, enable memory journaling,
-	// and start a new transaction
-	_, err = db.Exec("PRAGMA synchronous = OFF;PRAGMA journal_mode = MEMORY;BEGIN TRANSACTION")
-	if err != nil {
-		log.Fatalln(err.Error())
+// Merge two basic-block profiling statistics
+func (bbps *BasicBlockProfileStatistic) Merge(src *BasicBlockProfileStatistic) {
+	// update opcode frequency
+	for bb, freq := range src.basicBlockFrequency {
+		bbps.basicBlockFrequency[bb] += freq
 	}
+}
 
-	// prepare the insert statement for faster inserts
-	insertFrequency := `INSERT INTO BasicBlockFrequency(contract, address, instructions, frequency) VALUES (?, ?, ?, ?)`
-	statement, err := db.Prepare(insertFrequency)
+// dump basic block frequency stats of a run into a SQLITE3 database
+func (bbps *BasicBlockProfileStatistic) Dump(name string, run ProfilingRun) error {
+	db, err := openProfilingDB(name, &run)
 	if err != nil {
-		log.Fatalln(err.Error())
+		return err
 	}
+	defer db.Close()
 
-	// populate all values into the DB
-	ctr := 1
-	for bkey, freq := range bbps.basicBlockFrequency {
-		// commit dataset when record threshold is reached
-		if ctr >= BasicBlockMaxNumRecords {
-			ctr = 1
-			_, err = db.Exec("END TRANSACTION; BEGIN TRANSACTION;")
-			if err != nil {
-				log.Fatalln(err.Error())
+	err = dumpProfileTable(db, &run, "BasicBlockFrequency", "contract TEXT NOT NULL, address NUMERIC NOT NULL, instructions TEXT NOT NULL, frequency NUMERIC NOT NULL", "contract, address, instructions", func(insert func(...interface{}) error) error {
+		for bkey, freq := range bbps.basicBlockFrequency {
+			if err := insert(bkey.Contract, bkey.Address, bkey.Instructions, freq); err != nil {
+				return err
 			}
-		} else {
-			ctr++
-		}
-		_, err = statement.Exec(bkey.Contract, bkey.Address, bkey.Instructions, freq)
-		if err != nil {
-			log.Fatalln(err.Error())
 		}
-
-	}
-
-	// end transaction
-	_, err = db.Exec("END TRANSACTION;")
+		return nil
+	})
 	if err != nil {
-		log.Fatalln(err.Error())
+		return err
 	}
+	return db.Close()
 }
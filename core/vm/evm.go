@@ -131,6 +131,9 @@ type EVM struct {
 	callGasTemp uint64
 	// An optional override to intercept EVM calls.
 	CallContext CallContext
+	// profiling is the profiling of the innermost code executed, see
+	// StartProfiling.
+	profiling *Profiling
 }
 
 // NewEVM returns a new EVM. The returned EVM is not thread safe and should
@@ -63,6 +63,39 @@ var (
 // JumpTable contains the EVM opcodes supported at a given fork.
 type JumpTable [256]*operation
 
+// LookupInstructionSet returns the instruction set of the hard-fork active
+// under rules.
+func LookupInstructionSet(rules params.Rules) JumpTable {
+	switch {
+	case rules.IsLondon:
+		return londonInstructionSet
+	case rules.IsBerlin:
+		return berlinInstructionSet
+	case rules.IsIstanbul:
+		return istanbulInstructionSet
+	case rules.IsConstantinople:
+		return constantinopleInstructionSet
+	case rules.IsByzantium:
+		return byzantiumInstructionSet
+	case rules.IsEIP158:
+		return spuriousDragonInstructionSet
+	case rules.IsEIP150:
+		return tangerineWhistleInstructionSet
+	case rules.IsHomestead:
+		return homesteadInstructionSet
+	}
+	return frontierInstructionSet
+}
+
+// ConstantGas returns the static gas of op and whether op is defined in the
+// instruction set.
+func (jt *JumpTable) ConstantGas(op OpCode) (uint64, bool) {
+	if jt[op] == nil {
+		return 0, false
+	}
+	return jt[op].constantGas, true
+}
+
 // newLondonInstructionSet returns the frontier, homestead, byzantium,
 // contantinople, istanbul, petersburg, berlin and london instructions.
 func newLondonInstructionSet() JumpTable {
@@ -2,48 +2,94 @@ package lfvm
 
 import (
 	"fmt"
-	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
+	lru "github.com/hashicorp/golang-lru"
 )
 
+// DefaultConversionCacheSize is the number of converted contracts kept in
+// the cache of Convert.
+const DefaultConversionCacheSize = 4096
+
+// Converted code depends on the code only, so contracts are cached by their
+// code hash. Conversions with and without super instructions differ.
 type cache_key struct {
-	addr            common.Address
-	contract_length int
+	code_hash               common.Hash
+	with_super_instructions bool
+}
+
+var cache, _ = lru.New(DefaultConversionCacheSize)
+
+var (
+	cacheHitCounter  = metrics.NewRegisteredCounter("lfvm/convert/cache/hit", nil)
+	cacheMissCounter = metrics.NewRegisteredCounter("lfvm/convert/cache/miss", nil)
+)
+
+// SetConversionCacheSize changes the number of converted contracts kept in
+// the cache. The least recently used contracts are evicted first.
+func SetConversionCacheSize(size int) {
+	cache.Resize(size)
 }
 
-var mu = sync.Mutex{}
-var cache = map[cache_key]Code{}
+// ClearConversionCache removes all converted contracts from the cache.
+func ClearConversionCache() {
+	cache.Purge()
+	traced_cache.Purge()
+}
 
-func Convert(addr common.Address, code []byte, with_super_instructions bool) (Code, error) {
-	key := cache_key{addr, len(code)}
-	mu.Lock()
-	res, exists := cache[key]
-	if exists {
-		mu.Unlock()
-		return res, nil
+// Convert converts code to the long-form instruction set. code_hash is the
+// Keccak256 hash of code; it is computed if it is the zero hash. Converted
+// code is cached by its hash, so the result must not be modified.
+func Convert(code []byte, code_hash common.Hash, with_super_instructions bool) (Code, error) {
+	if code_hash == (common.Hash{}) {
+		code_hash = crypto.Keccak256Hash(code)
+	}
+	key := cache_key{code_hash, with_super_instructions}
+	if res, exists := cache.Get(key); exists {
+		cacheHitCounter.Inc(1)
+		return res.(Code), nil
 	}
-	mu.Unlock()
+	cacheMissCounter.Inc(1)
 	res, error := convert(code, with_super_instructions)
 	if error != nil {
 		return nil, error
 	}
-	mu.Lock()
-	cache[key] = res
-	mu.Unlock()
+	cache.Add(key, res)
 	return res, nil
 }
 
 func convert(code []byte, with_super_instructions bool) (Code, error) {
+	res, _, err := convertWithPcMap(code, with_super_instructions)
+	return res, err
+}
+
+// convertWithPcMap converts code and maps the position of each converted
+// instruction to the position of the EVM instruction it was converted from.
+// With super instructions, the enabled generated super instructions are used
+// as well.
+func convertWithPcMap(code []byte, with_super_instructions bool) (Code, []int32, error) {
+	var generated []*super_instruction
+	if with_super_instructions {
+		generated = enabledSuperInstructions()
+	}
+	return convertWithSuperInstructions(code, with_super_instructions, generated)
+}
+
+// convertWithSuperInstructions converts code using the given generated super
+// instructions, which are matched before the hand-picked ones.
+func convertWithSuperInstructions(code []byte, with_super_instructions bool, generated []*super_instruction) (Code, []int32, error) {
 	res := make([]Instruction, 0, len(code))
+	pc_map := make([]int32, 0, len(code))
 
 	// Convert each individual instruction.
 	for i := 0; i < len(code); {
 		// Handle jump destinations
 		if code[i] == byte(vm.JUMPDEST) {
 			if len(res) > i {
-				return nil, fmt.Errorf("unable to convert code, encountered targe block larger than input")
+				return nil, nil, fmt.Errorf("unable to convert code, encountered targe block larger than input")
 			}
 			// Jump to the next jump destination and fill space with noops
 			if len(res) < i {
@@ -53,22 +99,35 @@ func convert(code []byte, with_super_instructions bool) (Code, error) {
 				res = append(res, Instruction{opcode: NOOP})
 			}
 			res = append(res, Instruction{opcode: JUMPDEST})
+			for len(pc_map) < len(res) {
+				pc_map = append(pc_map, int32(i))
+			}
 			i++
 			continue
 		}
 
 		// Convert instructions
-		instructions, inc, err := toInstructions(i, code, with_super_instructions)
+		instructions, inc, err := toInstructions(i, code, with_super_instructions, generated)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		res = append(res, instructions...)
+		for len(pc_map) < len(res) {
+			pc_map = append(pc_map, int32(i))
+		}
 		i += inc + 1
 	}
-	return res, nil
+	return res, pc_map, nil
 }
 
-func toInstructions(pos int, code []byte, with_super_instructions bool) ([]Instruction, int, error) {
+func toInstructions(pos int, code []byte, with_super_instructions bool, generated []*super_instruction) ([]Instruction, int, error) {
+	// Convert generated super instructions.
+	for _, si := range generated {
+		if res, inc, ok := si.convert(pos, code); ok {
+			return res, inc, nil
+		}
+	}
+
 	// Convert super instructions.
 	if with_super_instructions {
 		if len(code) > pos+7 {
@@ -82,7 +141,7 @@ func toInstructions(pos int, code []byte, with_super_instructions bool) ([]Instr
 			op7 := vm.OpCode(code[pos+7])
 			if op0 == vm.PUSH1 && op2 == vm.PUSH4 && op7 == vm.DUP3 {
 				return []Instruction{
-					{opcode: PUSH1_PUSH4_DUP3, arg: uint16(op1)},
+					{opcode: PUSH1_PUSH4_DUP3, arg: uint16(op1) << 8},
 					{opcode: DATA, arg: uint16(op3)<<8 | uint16(op4)},
 					{opcode: DATA, arg: uint16(op5)<<8 | uint16(op6)},
 				}, 7, nil
@@ -0,0 +1,64 @@
+package lfvm
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestConvertCachesByCodeHash(t *testing.T) {
+	defer ClearConversionCache()
+
+	// same length, e.g. a contract redeployed with CREATE2 after SELFDESTRUCT
+	code1 := []byte{byte(vm.PUSH1), 1, byte(vm.STOP)}
+	code2 := []byte{byte(vm.PUSH1), 2, byte(vm.STOP)}
+
+	res1, err := Convert(code1, crypto.Keccak256Hash(code1), false)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	res2, err := Convert(code2, crypto.Keccak256Hash(code2), false)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if res1[0].arg == res2[0].arg {
+		t.Fatalf("wrong conversion of code with the same length: %v, %v", res1, res2)
+	}
+
+	// the hash is computed if missing
+	res, err := Convert(code2, common.Hash{}, false)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if &res[0] != &res2[0] {
+		t.Fatalf("converted code not cached")
+	}
+	if !cache.Contains(cache_key{crypto.Keccak256Hash(code2), false}) || cache.Contains(cache_key{crypto.Keccak256Hash(code2), true}) {
+		t.Fatalf("wrong cache keys: %v", cache.Keys())
+	}
+}
+
+func TestConvertCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	defer SetConversionCacheSize(DefaultConversionCacheSize)
+	defer ClearConversionCache()
+
+	SetConversionCacheSize(2)
+	codes := [][]byte{
+		{byte(vm.PUSH1), 1, byte(vm.STOP)},
+		{byte(vm.PUSH1), 2, byte(vm.STOP)},
+		{byte(vm.PUSH1), 3, byte(vm.STOP)},
+	}
+	for _, code := range codes {
+		if _, err := Convert(code, crypto.Keccak256Hash(code), false); err != nil {
+			t.Fatalf("failed to convert: %v", err)
+		}
+	}
+	if n := cache.Len(); n != 2 {
+		t.Fatalf("wrong cache size: have %d, want 2", n)
+	}
+	if cache.Contains(cache_key{crypto.Keccak256Hash(codes[0]), false}) {
+		t.Fatalf("least recently used code not evicted")
+	}
+}
@@ -6,268 +6,281 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/holiman/uint256"
 )
 
-const UNKNOWN_GAS_PRICE = 999999
+// UNDEFINED_GAS_PRICE is the static gas price of instructions that are not
+// defined in the instruction set of a hard-fork. Such instructions are
+// rejected as invalid instructions.
+const UNDEFINED_GAS_PRICE = math.MaxUint64
 
-var static_gas_prices = [NUM_OPCODES]uint64{}
+// fork identifies the instruction set of a range of hard-forks, in the same
+// way vm.LookupInstructionSet does.
+type fork int
 
-func init() {
-	for i := 0; i < int(NUM_OPCODES); i++ {
-		static_gas_prices[i] = getStaticGasPriceInternal(OpCode(i))
+const (
+	frontier fork = iota
+	homestead
+	tangerine_whistle
+	spurious_dragon
+	byzantium
+	constantinople
+	istanbul
+	berlin
+	london
+
+	num_forks
+)
+
+func getFork(rules params.Rules) fork {
+	switch {
+	case rules.IsLondon:
+		return london
+	case rules.IsBerlin:
+		return berlin
+	case rules.IsIstanbul:
+		return istanbul
+	case rules.IsConstantinople:
+		return constantinople
+	case rules.IsByzantium:
+		return byzantium
+	case rules.IsEIP158:
+		return spurious_dragon
+	case rules.IsEIP150:
+		return tangerine_whistle
+	case rules.IsHomestead:
+		return homestead
 	}
+	return frontier
 }
 
-func getStaticGasPrice(op OpCode) uint64 {
-	var res uint64
-	if int(op) < len(static_gas_prices) {
-		res = static_gas_prices[int(op)]
-		if res != UNKNOWN_GAS_PRICE {
-			return res
-		}
-	}
-	res = getStaticGasPriceInternal(op)
-	if res == UNKNOWN_GAS_PRICE {
-		panic(fmt.Sprintf("static gas price for %v unknown", op))
+// getRules returns chain rules selecting the instruction set of f.
+func (f fork) getRules() params.Rules {
+	return params.Rules{
+		IsHomestead:      f >= homestead,
+		IsEIP150:         f >= tangerine_whistle,
+		IsEIP155:         f >= spurious_dragon,
+		IsEIP158:         f >= spurious_dragon,
+		IsByzantium:      f >= byzantium,
+		IsConstantinople: f >= constantinople,
+		IsPetersburg:     f >= constantinople,
+		IsIstanbul:       f >= istanbul,
+		IsBerlin:         f >= berlin,
+		IsLondon:         f >= london,
 	}
-	return res
 }
 
-func getStaticGasPriceInternal(op OpCode) uint64 {
-	price := getStaticGasPriceInternal
-	if PUSH1 <= op && op <= PUSH32 {
-		return 3
-	}
-	if DUP1 <= op && op <= DUP16 {
-		return 3
-	}
-	if SWAP1 <= op && op <= SWAP16 {
-		return 3
-	}
-	if LT <= op && op <= SAR {
-		return 3
-	}
-	if COINBASE <= op && op <= CHAINID {
-		return 2
-	}
-	switch op {
-	case POP:
-		return 2
-	case ADD:
-		return 3
-	case SUB:
-		return 3
-	case MUL:
-		return 5
-	case DIV:
-		return 5
-	case SDIV:
-		return 5
-	case MOD:
-		return 5
-	case SMOD:
-		return 5
-	case ADDMOD:
-		return 8
-	case MULMOD:
-		return 8
-	case EXP:
-		return 10
-	case SIGNEXTEND:
-		return 5
-	case SHA3:
-		return 30
-	case ADDRESS:
-		return 2
-	case BALANCE:
-		return 700 // Should be 100 for warm access, 2600 for cold access
-	case ORIGIN:
-		return 2
-	case CALLER:
-		return 2
-	case CALLVALUE:
-		return 2
-	case CALLDATALOAD:
-		return 3
-	case CALLDATASIZE:
-		return 2
-	case CALLDATACOPY:
-		return 3
-	case CODESIZE:
-		return 2
-	case CODECOPY:
-		return 3
-	case GASPRICE:
-		return 2
-	case EXTCODESIZE:
-		return 700 // This seems to be different than documented on evm.codes (it should be 100)
-	case EXTCODECOPY:
-		return 100
-	case RETURNDATASIZE:
-		return 2
-	case RETURNDATACOPY:
-		return 3
-	case EXTCODEHASH:
-		return 700 // Should be 100 for warm access, 2600 for cold access
-	case BLOCKHASH:
-		return 20
-	case SELFBALANCE:
-		return 5
-	case BASEFEE:
-		return 2
-	case MLOAD:
-		return 3
-	case MSTORE:
-		return 3
-	case MSTORE8:
-		return 3
-	case SLOAD:
-		return 800 // This is supposed to be 100 for warm and 2100 for cold accesses
-	case SSTORE:
-		return 0 // Costs are handled in gasSStore(..) function below
-	case JUMP:
-		return 8
-	case JUMPI:
-		return 10
-	case JUMPDEST:
-		return 1
-	case JUMP_TO:
-		return 0
-	case PC:
-		return 2
-	case MSIZE:
-		return 2
-	case GAS:
-		return 2
-	case LOG0:
-		return 375
-	case LOG1:
-		return 750
-	case LOG2:
-		return 1125
-	case LOG3:
-		return 1500
-	case LOG4:
-		return 1875
-	case CREATE:
-		return 32000
-	case CREATE2:
-		return 32000
-	case CALL:
-		return 700 // Should be 100 according to evm.code
-	case CALLCODE:
-		return 100
-	case STATICCALL:
-		return 700 // Should be 100 according to evm.code
-	case RETURN:
-		return 0
-	case STOP:
-		return 0
-	case REVERT:
-		return 0
-	case INVALID:
-		return 0
-	case DELEGATECALL:
-		return 700 // Should be 100 according to evm.code
-	case SELFDESTRUCT:
-		return 0 // should be 5000 according to evm.code
+// The static gas prices of all instructions for every fork, derived from the
+// constant gas of the instruction sets of the EVM.
+var static_gas_prices = [num_forks][NUM_OPCODES]uint64{}
 
-		// --- Super instructions ---
-	case PUSH1_ADD:
-		return price(PUSH1) + price(ADD)
-	case PUSH1_SHL:
-		return price(PUSH1) + price(SHL)
-	case PUSH1_DUP1:
-		return price(PUSH1) + price(DUP1)
-	case PUSH2_JUMP:
-		return price(PUSH2) + price(JUMP)
-	case PUSH2_JUMPI:
-		return price(PUSH2) + price(JUMPI)
-	case SWAP1_POP:
-		return price(SWAP1) + price(POP)
-	case SWAP2_POP:
-		return price(SWAP2) + price(POP)
-	case DUP2_MSTORE:
-		return price(DUP2) + price(MSTORE)
-	case DUP2_LT:
-		return price(DUP2) + price(LT)
-	case POP_JUMP:
-		return price(POP) + price(JUMP)
-	case POP_POP:
-		return price(POP) + price(POP)
-	case SWAP2_SWAP1:
-		return price(SWAP2) + price(SWAP1)
-	case PUSH1_PUSH1:
-		return price(PUSH1) + price(PUSH1)
-	case ISZERO_PUSH2_JUMPI:
-		return price(ISZERO) + price(PUSH2) + price(JUMPI)
-	case PUSH1_PUSH4_DUP3:
-		return price(PUSH1) + price(PUSH4) + price(DUP3)
-	case SWAP2_SWAP1_POP_JUMP:
-		return price(SWAP2) + price(SWAP1) + price(POP) + price(JUMP)
-	case SWAP1_POP_SWAP2_SWAP1:
-		return price(SWAP1) + price(POP) + price(SWAP2) + price(SWAP1)
-	case POP_SWAP2_SWAP1_POP:
-		return price(POP) + price(SWAP2) + price(SWAP1) + price(POP)
-	case AND_SWAP1_POP_SWAP2_SWAP1:
-		return price(AND) + price(SWAP1) + price(POP) + price(SWAP2) + price(SWAP1)
-	case PUSH1_PUSH1_PUSH1_SHL_SUB:
-		return 3*price(PUSH1) + price(SHL) + price(SUB)
+// The EVM instructions the super instructions are composed of.
+var super_instructions = map[OpCode][]OpCode{
+	PUSH1_ADD:                 {PUSH1, ADD},
+	PUSH1_SHL:                 {PUSH1, SHL},
+	PUSH1_DUP1:                {PUSH1, DUP1},
+	PUSH2_JUMP:                {PUSH2, JUMP},
+	PUSH2_JUMPI:               {PUSH2, JUMPI},
+	SWAP1_POP:                 {SWAP1, POP},
+	SWAP2_POP:                 {SWAP2, POP},
+	DUP2_MSTORE:               {DUP2, MSTORE},
+	DUP2_LT:                   {DUP2, LT},
+	POP_JUMP:                  {POP, JUMP},
+	POP_POP:                   {POP, POP},
+	SWAP2_SWAP1:               {SWAP2, SWAP1},
+	PUSH1_PUSH1:               {PUSH1, PUSH1},
+	ISZERO_PUSH2_JUMPI:        {ISZERO, PUSH2, JUMPI},
+	PUSH1_PUSH4_DUP3:          {PUSH1, PUSH4, DUP3},
+	SWAP2_SWAP1_POP_JUMP:      {SWAP2, SWAP1, POP, JUMP},
+	SWAP1_POP_SWAP2_SWAP1:     {SWAP1, POP, SWAP2, SWAP1},
+	POP_SWAP2_SWAP1_POP:       {POP, SWAP2, SWAP1, POP},
+	AND_SWAP1_POP_SWAP2_SWAP1: {AND, SWAP1, POP, SWAP2, SWAP1},
+	PUSH1_PUSH1_PUSH1_SHL_SUB: {PUSH1, PUSH1, PUSH1, SHL, SUB},
+}
+
+// The EVM instructions the regular long-form instructions are converted from.
+var op_2_evm_op = func() map[OpCode]vm.OpCode {
+	res := map[OpCode]vm.OpCode{JUMPDEST: vm.JUMPDEST}
+	for evm_op, op := range op_2_op {
+		if op != INVALID {
+			res[op] = evm_op
+		}
+	}
+	for i := 0; i < 32; i++ {
+		res[PUSH1+OpCode(i)] = vm.PUSH1 + vm.OpCode(i)
 	}
+	return res
+}()
 
-	return UNKNOWN_GAS_PRICE
+func init() {
+	for f := frontier; f < num_forks; f++ {
+		jt := vm.LookupInstructionSet(f.getRules())
+		price := func(op OpCode) uint64 {
+			if gas, defined := jt.ConstantGas(op_2_evm_op[op]); defined {
+				return gas
+			}
+			return UNDEFINED_GAS_PRICE
+		}
+		for i := 0; i < int(NUM_OPCODES); i++ {
+			op := OpCode(i)
+			switch {
+			case op == JUMP_TO || op == SUPER || op == DATA || op == NOOP || op == INVALID:
+				static_gas_prices[f][op] = 0
+			case super_instructions[op] != nil:
+				var sum uint64
+				for _, part := range super_instructions[op] {
+					if price(part) == UNDEFINED_GAS_PRICE {
+						sum = UNDEFINED_GAS_PRICE
+						break
+					}
+					sum += price(part)
+				}
+				static_gas_prices[f][op] = sum
+			default:
+				if _, found := op_2_evm_op[op]; !found {
+					panic(fmt.Sprintf("static gas price for %v unknown", op))
+				}
+				static_gas_prices[f][op] = price(op)
+			}
+		}
+	}
 }
 
-// callGas returns the actual gas cost of the call.
+// callGas returns the gas passed to the callee of a call.
 //
-// The cost of gas was changed during the homestead price change HF.
-// As part of EIP 150 (TangerineWhistle), the returned gas is gas - base * 63 / 64.
-func callGas(availableGas, base uint64, callCost *uint256.Int) uint64 {
-	//fmt.Printf("LFVM: Computing call gas from available gas %v, base %v, and call gas parameter %v\n", availableGas, base, callCost)
-	availableGas = availableGas - base
-	gas := availableGas - availableGas/64
-	if !callCost.IsUint64() || gas < callCost.Uint64() {
-		return gas
-	}
-	return callCost.Uint64()
+// As part of EIP 150 (TangerineWhistle), the gas is capped at all but one
+// 64th of the gas available after charging base.
+func callGas(rules *params.Rules, availableGas, base uint64, callCost *uint256.Int) (uint64, error) {
+	if rules.IsEIP150 {
+		availableGas = availableGas - base
+		gas := availableGas - availableGas/64
+		if !callCost.IsUint64() || gas < callCost.Uint64() {
+			return gas, nil
+		}
+	}
+	if !callCost.IsUint64() {
+		return 0, vm.ErrGasUintOverflow
+	}
+	return callCost.Uint64(), nil
 }
 
-func gasCall(c *context, memorySize uint64) uint64 {
-	var (
-		gas            uint64
-		transfersValue = !c.stack.Back(2).IsZero()
-		address        = common.Address(c.stack.Back(1).Bytes20())
-	)
-	if transfersValue && c.evm.StateDB.Empty(address) {
-		gas += params.CallNewAccountGas
+// chargeCall charges the dynamic gas of a call to address and returns the gas
+// passed to the callee. The memory is expanded to cover the arguments and the
+// result, and base are the costs of value transfers.
+func chargeCall(c *context, address common.Address, base uint64, provided_gas *uint256.Int, args_offset, args_size, ret_offset, ret_size *uint256.Int) (uint64, bool) {
+	if !chargeColdAccountAccess(c, address) {
+		return 0, false
 	}
-	if transfersValue {
-		gas += params.CallValueTransferGas
+	if !c.memory.ExpandFor(args_offset, args_size, c) || !c.memory.ExpandFor(ret_offset, ret_size, c) {
+		return 0, false
 	}
-	/*
-		memoryGas, err := memoryGasCost(c.memory, memorySize)
-		if err != nil {
-			return 0, err
-		}
-	*/
-	var memoryGas uint64
-	var overflow bool
-	if gas, overflow = math.SafeAdd(gas, memoryGas); overflow {
-		panic("Overflow in gas computation!")
+	gas, err := callGas(&c.rules, c.contract.Gas, base, provided_gas)
+	if err != nil {
+		c.SignalError(err)
+		return 0, false
+	}
+	total, overflow := math.SafeAdd(base, gas)
+	if overflow {
+		c.SignalError(vm.ErrGasUintOverflow)
+		return 0, false
 	}
+	return gas, c.UseGas(total)
+}
 
-	call_gas := callGas(c.contract.Gas, gas, c.stack.Back(0))
-	if gas, overflow = math.SafeAdd(gas, call_gas); overflow {
-		panic("Overflow in gas computation!")
+// chargeColdAccountAccess charges the EIP-2929 surcharge for the first access
+// to address in a transaction, assuming the warm access is charged as static
+// gas of the instruction.
+func chargeColdAccountAccess(c *context, address common.Address) bool {
+	if !c.rules.IsBerlin || c.stateDB.AddressInAccessList(address) {
+		return true
 	}
-	return gas
+	c.stateDB.AddAddressToAccessList(address)
+	return c.UseGas(params.ColdAccountAccessCostEIP2929 - params.WarmStorageReadCostEIP2929)
+}
+
+// gasSLoad returns the dynamic costs of an SLOAD operation. Before Berlin
+// the costs are covered by the static gas price.
+func gasSLoad(c *context, slot common.Hash) uint64 {
+	if !c.rules.IsBerlin {
+		return 0
+	}
+	if _, present := c.stateDB.SlotInAccessList(c.contract.Address(), slot); !present {
+		c.stateDB.AddSlotToAccessList(c.contract.Address(), slot)
+		return params.ColdSloadCostEIP2929
+	}
+	return params.WarmStorageReadCostEIP2929
 }
 
 // Computes the costs for an SSTORE operation
 func gasSStore(c *context) (uint64, error) {
-	return gasSStoreEIP2200(c)
+	switch {
+	case c.rules.IsLondon:
+		return gasSStoreEIP2929(c, params.SstoreClearsScheduleRefundEIP3529)
+	case c.rules.IsBerlin:
+		return gasSStoreEIP2929(c, params.SstoreClearsScheduleRefundEIP2200)
+	case c.rules.IsIstanbul:
+		return gasSStoreEIP2200(c)
+	case c.rules.IsConstantinople && !c.rules.IsPetersburg:
+		return gasSStoreEIP1283(c), nil
+	}
+	return gasSStoreLegacy(c), nil
+}
+
+// gasSStoreLegacy only takes the current value of the slot into account.
+func gasSStoreLegacy(c *context) uint64 {
+	var (
+		y, x    = c.stack.Back(1), c.stack.Back(0)
+		current = c.stateDB.GetState(c.contract.Address(), x.Bytes32())
+	)
+	switch {
+	case current == (common.Hash{}) && y.Sign() != 0: // 0 => non 0
+		return params.SstoreSetGas
+	case current != (common.Hash{}) && y.Sign() == 0: // non 0 => 0
+		c.stateDB.AddRefund(params.SstoreRefundGas)
+		return params.SstoreClearGas
+	default: // non 0 => non 0 (or 0 => 0)
+		return params.SstoreResetGas
+	}
+}
+
+// gasSStoreEIP1283 computes net gas costs as defined by EIP-1283, which was
+// only active in Constantinople and removed by Petersburg.
+func gasSStoreEIP1283(c *context) uint64 {
+	var (
+		y, x    = c.stack.Back(1), c.stack.Back(0)
+		current = c.stateDB.GetState(c.contract.Address(), x.Bytes32())
+	)
+	value := common.Hash(y.Bytes32())
+	if current == value { // noop
+		return params.NetSstoreNoopGas
+	}
+	original := c.stateDB.GetCommittedState(c.contract.Address(), x.Bytes32())
+	if original == current {
+		if original == (common.Hash{}) { // create slot
+			return params.NetSstoreInitGas
+		}
+		if value == (common.Hash{}) { // delete slot
+			c.stateDB.AddRefund(params.NetSstoreClearRefund)
+		}
+		return params.NetSstoreCleanGas // write existing slot
+	}
+	if original != (common.Hash{}) {
+		if current == (common.Hash{}) { // recreate slot
+			c.stateDB.SubRefund(params.NetSstoreClearRefund)
+		} else if value == (common.Hash{}) { // delete slot
+			c.stateDB.AddRefund(params.NetSstoreClearRefund)
+		}
+	}
+	if original == value {
+		if original == (common.Hash{}) { // reset to original inexistent slot
+			c.stateDB.AddRefund(params.NetSstoreResetClearRefund)
+		} else { // reset to original existing slot
+			c.stateDB.AddRefund(params.NetSstoreResetRefund)
+		}
+	}
+	return params.NetSstoreDirtyGas // dirty update
 }
 
 // 0. If *gasleft* is less than or equal to 2300, fail the current call.
@@ -337,15 +350,82 @@ func gasSStoreEIP2200(c *context) (uint64, error) {
 	return params.SloadGasEIP2200, nil // dirty update (2.2)
 }
 
-func gasSelfdestruct(c *context) uint64 {
-	gas := params.SelfdestructGasEIP150
-	var address = common.Address(c.stack.Back(0).Bytes20())
+// gasSStoreEIP2929 extends the EIP-2200 rules by the costs of cold slots
+// (EIP-2929) and takes the refund for clearing a slot, which was reduced by
+// EIP-3529.
+func gasSStoreEIP2929(c *context, clearing_refund uint64) (uint64, error) {
+	if c.contract.Gas <= params.SstoreSentryGasEIP2200 {
+		c.status = OUT_OF_GAS
+		return 0, errors.New("not enough gas for reentrancy sentry")
+	}
+	var (
+		y, x    = c.stack.Back(1), c.stack.Back(0)
+		slot    = common.Hash(x.Bytes32())
+		current = c.stateDB.GetState(c.contract.Address(), slot)
+		cost    = uint64(0)
+	)
+	if _, present := c.stateDB.SlotInAccessList(c.contract.Address(), slot); !present {
+		cost = params.ColdSloadCostEIP2929
+		c.stateDB.AddSlotToAccessList(c.contract.Address(), slot)
+	}
+	value := common.Hash(y.Bytes32())
 
+	if current == value { // noop (1)
+		return cost + params.WarmStorageReadCostEIP2929, nil
+	}
+	original := c.stateDB.GetCommittedState(c.contract.Address(), slot)
+	if original == current {
+		if original == (common.Hash{}) { // create slot (2.1.1)
+			return cost + params.SstoreSetGasEIP2200, nil
+		}
+		if value == (common.Hash{}) { // delete slot (2.1.2b)
+			c.stateDB.AddRefund(clearing_refund)
+		}
+		return cost + (params.SstoreResetGasEIP2200 - params.ColdSloadCostEIP2929), nil // write existing slot (2.1.2)
+	}
+	if original != (common.Hash{}) {
+		if current == (common.Hash{}) { // recreate slot (2.2.1.1)
+			c.stateDB.SubRefund(clearing_refund)
+		} else if value == (common.Hash{}) { // delete slot (2.2.1.2)
+			c.stateDB.AddRefund(clearing_refund)
+		}
+	}
+	if original == value {
+		if original == (common.Hash{}) { // reset to original inexistent slot (2.2.2.1)
+			c.stateDB.AddRefund(params.SstoreSetGasEIP2200 - params.WarmStorageReadCostEIP2929)
+		} else { // reset to original existing slot (2.2.2.2)
+			c.stateDB.AddRefund((params.SstoreResetGasEIP2200 - params.ColdSloadCostEIP2929) - params.WarmStorageReadCostEIP2929)
+		}
+	}
+	return cost + params.WarmStorageReadCostEIP2929, nil // dirty update (2.2)
+}
+
+// gasSelfdestruct returns the dynamic costs of a SELFDESTRUCT operation. The
+// base price introduced by EIP-150 is part of the static gas price since
+// Berlin (EIP-2929).
+func gasSelfdestruct(c *context) uint64 {
+	var (
+		gas     uint64
+		address = common.Address(c.stack.Back(0).Bytes20())
+	)
+	if c.rules.IsBerlin {
+		if !c.stateDB.AddressInAccessList(address) {
+			c.stateDB.AddAddressToAccessList(address)
+			gas = params.ColdAccountAccessCostEIP2929
+		}
+	} else if c.rules.IsEIP150 {
+		gas = params.SelfdestructGasEIP150
+	}
 	// if beneficiary needs to be created
-	if c.stateDB.Empty(address) && c.stateDB.GetBalance(c.contract.Address()).Sign() != 0 {
+	if c.rules.IsEIP158 {
+		if c.stateDB.Empty(address) && c.stateDB.GetBalance(c.contract.Address()).Sign() != 0 {
+			gas += params.CreateBySelfdestructGas
+		}
+	} else if c.rules.IsEIP150 && !c.stateDB.Exist(address) {
 		gas += params.CreateBySelfdestructGas
 	}
-	if !c.stateDB.HasSuicided(c.contract.Address()) {
+	// EIP-3529 removes the refund
+	if !c.rules.IsLondon && !c.stateDB.HasSuicided(c.contract.Address()) {
 		c.stateDB.AddRefund(params.SelfdestructRefundGas)
 	}
 	return gas
@@ -0,0 +1,101 @@
+package lfvm
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+type callResult struct {
+	ret    string
+	gas    uint64
+	failed bool
+	refund uint64
+}
+
+func callWithInterpreter(code []byte, config *params.ChainConfig, number uint64, interpreter string) callResult {
+	return callWithInput(code, nil, config, number, interpreter)
+}
+
+func callWithInput(code, input []byte, config *params.ChainConfig, number uint64, interpreter string) callResult {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil, nil)
+	address := common.BytesToAddress([]byte("contract"))
+	statedb.SetCode(address, code)
+
+	ret, gas, err := runtime.Call(address, input, &runtime.Config{
+		ChainConfig: config,
+		BlockNumber: new(big.Int).SetUint64(number),
+		GasLimit:    1000000,
+		State:       statedb,
+		EVMConfig:   vm.Config{InterpreterImpl: interpreter},
+	})
+	return callResult{common.Bytes2Hex(ret), gas, err != nil, statedb.GetRefund()}
+}
+
+func TestGasMatchesEvmInAllForks(t *testing.T) {
+	codes := map[string][]byte{
+		"state": {
+			byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+			byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.POP),
+			byte(vm.PUSH1), 5, byte(vm.SLOAD), byte(vm.POP),
+			byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+			byte(vm.PUSH2), 0x12, 0x34, byte(vm.BALANCE), byte(vm.POP),
+			byte(vm.PUSH2), 0x12, 0x34, byte(vm.EXTCODESIZE), byte(vm.POP),
+			byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0x40, byte(vm.PUSH2), 0x12, 0x35, byte(vm.EXTCODECOPY),
+			byte(vm.PUSH4), 0xff, 0xff, 0xff, 0xff, byte(vm.PUSH1), 2, byte(vm.EXP), byte(vm.POP),
+			byte(vm.PUSH1), 7, byte(vm.PUSH1), 5, byte(vm.PUSH1), 3, byte(vm.ADDMOD), byte(vm.POP),
+			byte(vm.PUSH2), 0xab, 0xcd, byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0, byte(vm.LOG1),
+			byte(vm.PUSH2), 0x12, 0x38, byte(vm.SELFDESTRUCT),
+		},
+		"calls": {
+			byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0x80, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH2), 0x12, 0x36, byte(vm.GAS), byte(vm.CALL), byte(vm.POP),
+			byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH2), 0x12, 0x36, byte(vm.GAS), byte(vm.CALLCODE), byte(vm.POP),
+			byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CREATE), byte(vm.POP),
+			byte(vm.MSIZE), byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0, byte(vm.RETURN),
+		},
+		"delegatecall": {byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH2), 0x12, 0x36, byte(vm.GAS), byte(vm.DELEGATECALL)},
+		"staticcall":   {byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH2), 0x12, 0x36, byte(vm.GAS), byte(vm.STATICCALL)},
+		"revert":       {byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)},
+		"shl":          {byte(vm.PUSH1), 1, byte(vm.PUSH1), 1, byte(vm.SHL)},
+		"extcodehash":  {byte(vm.PUSH2), 0x12, 0x34, byte(vm.EXTCODEHASH)},
+		"chainid":      {byte(vm.CHAINID)},
+		"basefee":      {byte(vm.BASEFEE)},
+	}
+	type block struct {
+		config *params.ChainConfig
+		number uint64
+	}
+	forks := map[string]block{
+		"Frontier":          {params.MainnetChainConfig, 1},
+		"Homestead":         {params.MainnetChainConfig, 1150000},
+		"Tangerine Whistle": {params.MainnetChainConfig, 2463000},
+		"Spurious Dragon":   {params.MainnetChainConfig, 2675000},
+		"Byzantium":         {params.MainnetChainConfig, 4370000},
+		"Constantinople":    {params.RopstenChainConfig, 4230000},
+		"Petersburg":        {params.MainnetChainConfig, 7280000},
+		"Istanbul":          {params.MainnetChainConfig, 9069000},
+		"Berlin":            {params.MainnetChainConfig, 12244000},
+		"London":            {params.MainnetChainConfig, 12965000},
+	}
+	for fork, b := range forks {
+		for name, code := range codes {
+			want := callWithInterpreter(code, b.config, b.number, "geth")
+			for _, interpreter := range []string{"lfvm", "lfvm-si"} {
+				if have := callWithInterpreter(code, b.config, b.number, interpreter); have != want {
+					t.Errorf("%s in %s: %s has wrong result: have %+v, want %+v", name, fork, interpreter, have, want)
+				}
+			}
+		}
+	}
+
+	// instructions are rejected before their hard-fork
+	if result := callWithInterpreter(codes["chainid"], params.MainnetChainConfig, 7280000, "lfvm"); !result.failed || result.gas != 0 {
+		t.Errorf("CHAINID not rejected before Istanbul: %+v", result)
+	}
+}
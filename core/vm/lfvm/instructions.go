@@ -1,6 +1,7 @@
 package lfvm
 
 import (
+	"math"
 	"math/big"
 	"math/bits"
 
@@ -14,6 +15,9 @@ import (
 
 var (
 	big0 = big.NewInt(0)
+
+	word_size = uint256.NewInt(32)
+	byte_size = uint256.NewInt(1)
 )
 
 func opStop(c *context) {
@@ -25,14 +29,18 @@ func opRevert(c *context) {
 	//fmt.Printf("REVERT\n")
 	c.result_offset = *c.stack.pop()
 	c.result_size = *c.stack.pop()
-	c.status = REVERTED
+	if c.memory.ExpandFor(&c.result_offset, &c.result_size, c) {
+		c.status = REVERTED
+	}
 }
 
 func opReturn(c *context) {
 	//fmt.Printf("RETURN\n")
 	c.result_offset = *c.stack.pop()
 	c.result_size = *c.stack.pop()
-	c.status = RETURNED
+	if c.memory.ExpandFor(&c.result_offset, &c.result_size, c) {
+		c.status = RETURNED
+	}
 }
 func opInvalid(c *context) {
 	//fmt.Printf("INVALID\n")
@@ -44,7 +52,7 @@ func opPc(c *context) {
 }
 
 func checkJumpDest(c *context) {
-	if int(c.pc+1) >= len(c.code) || c.code[c.pc+1].opcode != JUMPDEST {
+	if c.pc+1 < 0 || int(c.pc+1) >= len(c.code) || c.code[c.pc+1].opcode != JUMPDEST {
 		c.SignalError(vm.ErrInvalidJump)
 	}
 	// Skip the interpretation of the JUMPDEST instruction
@@ -52,10 +60,19 @@ func checkJumpDest(c *context) {
 	c.UseGas(1)
 }
 
+// jumpDestination returns the position of destination in the code, or -1
+// if it is beyond any code.
+func jumpDestination(destination *uint256.Int) int32 {
+	if !destination.IsUint64() || destination.Uint64() > math.MaxInt32 {
+		return -1
+	}
+	return int32(destination.Uint64())
+}
+
 func opJump(c *context) {
 	destination := c.stack.pop()
 	// Update the PC to the jump destination -1 since interpreter will increase PC by 1 afterward.
-	c.pc = int32(destination.Uint64()) - 1
+	c.pc = jumpDestination(destination) - 1
 	checkJumpDest(c)
 }
 
@@ -65,7 +82,7 @@ func opJumpi(c *context) {
 	//fmt.Printf("JUMPI %v %v\n", destination, condition)
 	if !condition.IsZero() {
 		// Update the PC to the jump destination -1 since interpreter will increase PC by 1 afterward.
-		c.pc = int32(destination.Uint64()) - 1
+		c.pc = jumpDestination(destination) - 1
 		checkJumpDest(c)
 	}
 }
@@ -160,33 +177,32 @@ func opMstore(c *context) {
 	var addr = c.stack.pop()
 	var value = c.stack.pop()
 
-	offset := int(addr.Uint64())
-	c.memory.EnsureCapacity(offset, 32, c)
-	if c.status == RUNNING {
-		c.memory.SetWord(offset, value)
+	if !c.memory.ExpandFor(addr, word_size, c) {
+		return
 	}
+	c.memory.SetWord(int(addr.Uint64()), value)
 }
 
 func opMstore8(c *context) {
 	var addr = c.stack.pop()
 	var value = c.stack.pop()
 
-	offset := int(addr.Uint64())
-	c.memory.EnsureCapacity(offset, 1, c)
-	if c.status == RUNNING {
-		c.memory.SetByte(offset, byte(value.Uint64()))
+	if !c.memory.ExpandFor(addr, byte_size, c) {
+		return
 	}
+	c.memory.SetByte(int(addr.Uint64()), byte(value.Uint64()))
 }
 
 func opMload(c *context) {
 	var trg = c.stack.peek()
 	var addr = *trg
 
-	offset := int(addr.Uint64())
-	c.memory.EnsureCapacity(offset, 32, c)
+	if !c.memory.ExpandFor(&addr, word_size, c) {
+		return
+	}
 
 	//fmt.Printf("MLOAD [%v]\n", addr)
-	c.memory.CopyWord(offset, trg)
+	c.memory.CopyWord(int(addr.Uint64()), trg)
 }
 
 func opMsize(c *context) {
@@ -209,6 +225,9 @@ func opSstore(c *context) {
 
 func opSload(c *context) {
 	var top = c.stack.peek()
+	if !c.UseGas(gasSLoad(c, top.Bytes32())) {
+		return
+	}
 	top.SetBytes32(c.stateDB.GetState(c.contract.Address(), top.Bytes32()).Bytes())
 }
 
@@ -231,12 +250,15 @@ func opCallDatasize(c *context) {
 func opCallDataload(c *context) {
 	//fmt.Printf("CALLDATALOAD\n")
 	top := c.stack.peek()
-	offset := top.Uint64()
+	offset, overflow := top.Uint64WithOverflow()
+	if overflow {
+		offset = math.MaxUint64
+	}
 
 	var value [32]byte
 	for i := 0; i < 32; i++ {
-		pos := i + int(offset)
-		if pos < len(c.data) {
+		pos := offset + uint64(i)
+		if pos >= offset && pos < uint64(len(c.data)) {
 			value[i] = c.data[pos]
 		} else {
 			value[i] = 0
@@ -255,6 +277,9 @@ func opCallDataCopy(c *context) {
 	if overflow {
 		dataOffset64 = 0xffffffffffffffff
 	}
+	if !c.memory.ExpandFor(memOffset, length, c) {
+		return
+	}
 	memOffset64 := memOffset.Uint64()
 	length64 := length.Uint64()
 
@@ -265,7 +290,6 @@ func opCallDataCopy(c *context) {
 		return
 	}
 
-	c.memory.EnsureCapacity(int(memOffset64), int(length64), c)
 	c.memory.Set(memOffset64, length64, getData(c.data, dataOffset64, length64))
 }
 
@@ -414,6 +438,13 @@ func opMul(c *context) {
 	b.Mul(a, b)
 }
 
+func opAddMod(c *context) {
+	a := c.stack.pop()
+	b := c.stack.pop()
+	n := c.stack.peek()
+	n.AddMod(a, b, n)
+}
+
 func opMulMod(c *context) {
 	a := c.stack.pop()
 	b := c.stack.pop()
@@ -447,7 +478,11 @@ func opSMod(c *context) {
 
 func opExp(c *context) {
 	base, exponent := c.stack.pop(), c.stack.peek()
-	if !c.UseGas(uint64(50 * exponent.ByteLen())) {
+	byte_price := params.ExpByteFrontier
+	if c.rules.IsEIP158 {
+		byte_price = params.ExpByteEIP158
+	}
+	if !c.UseGas(params.ExpGas + byte_price*uint64(exponent.ByteLen())) {
 		return
 	}
 	exponent.Exp(base, exponent)
@@ -456,7 +491,9 @@ func opExp(c *context) {
 func opSha3(c *context) {
 	offset, size := c.stack.pop(), c.stack.peek()
 
-	c.memory.EnsureCapacity(int(offset.Uint64()), int(size.Uint64()), c)
+	if !c.memory.ExpandFor(offset, size, c) {
+		return
+	}
 	data := c.memory.GetSlice(int64(offset.Uint64()), int64(size.Uint64()))
 
 	// charge dynamic gas price
@@ -503,6 +540,11 @@ func opGasLimit(c *context) {
 	c.stack.pushEmpty().SetUint64(c.evm.Context.GasLimit)
 }
 
+func opBaseFee(c *context) {
+	v, _ := uint256.FromBig(c.evm.Context.BaseFee)
+	c.stack.push(v)
+}
+
 func opGasPrice(c *context) {
 	v, _ := uint256.FromBig(c.evm.GasPrice)
 	c.stack.push(v)
@@ -511,6 +553,9 @@ func opGasPrice(c *context) {
 func opBalance(c *context) {
 	slot := c.stack.peek()
 	address := common.Address(slot.Bytes20())
+	if !chargeColdAccountAccess(c, address) {
+		return
+	}
 	slot.SetFromBig(c.evm.StateDB.GetBalance(address))
 }
 
@@ -579,6 +624,10 @@ func opCodeCopy(c *context) {
 		uint64CodeOffset = 0xffffffffffffffff
 	}
 
+	if !c.memory.ExpandFor(memOffset, length, c) {
+		return
+	}
+
 	// Charge for length of copied code
 	words := (length.Uint64() + 31) / 32
 	if !c.UseGas(3 * words) {
@@ -586,29 +635,24 @@ func opCodeCopy(c *context) {
 	}
 
 	codeCopy := getData(c.contract.Code, uint64CodeOffset, length.Uint64())
-	c.memory.EnsureCapacity(int(memOffset.Uint64()), int(length.Uint64()), c)
 	c.memory.Set(memOffset.Uint64(), length.Uint64(), codeCopy)
 }
 
 func opExtcodesize(c *context) {
 	top := c.stack.peek()
-	addr := top.Bytes20()
+	addr := common.Address(top.Bytes20())
+	if !chargeColdAccountAccess(c, addr) {
+		return
+	}
 	top.SetUint64(uint64(c.stateDB.GetCodeSize(addr)))
-	// Charge extra for cold locations.
-	/*
-		if !c.evm.StateDB.AddressInAccessList(addr) {
-			fmt.Printf("Reducing gas from %v to %v\n", c.contract.Gas, c.contract.Gas-2500)
-			c.contract.Gas -= 2500
-				if c.interpreter == nil {
-					c.evm.StateDB.AddAddressToAccessList(addr)
-				}
-		}
-	*/
 }
 
 func opExtcodehash(c *context) {
 	slot := c.stack.peek()
 	address := common.Address(slot.Bytes20())
+	if !chargeColdAccountAccess(c, address) {
+		return
+	}
 	if c.evm.StateDB.Empty(address) {
 		slot.Clear()
 	} else {
@@ -620,10 +664,13 @@ func opCreate(c *context) {
 	var (
 		value        = c.stack.pop()
 		offset, size = c.stack.pop(), c.stack.pop()
-		input        = c.memory.GetSlice(int64(offset.Uint64()), int64(size.Uint64()))
-		gas          = c.contract.Gas
 	)
-	if true /*c.evm.chainRules.IsEIP150*/ {
+	if !c.memory.ExpandFor(offset, size, c) {
+		return
+	}
+	input := c.memory.GetSlice(int64(offset.Uint64()), int64(size.Uint64()))
+	gas := c.contract.Gas
+	if c.rules.IsEIP150 {
 		gas -= gas / 64
 	}
 
@@ -636,8 +683,9 @@ func opCreate(c *context) {
 
 	res, addr, returnGas, suberr := c.evm.Create(c.contract, input, gas, bigVal)
 
+	// Frontier ignores running out of gas while storing the code
 	success := c.stack.pushEmpty()
-	if suberr != nil && suberr != vm.ErrCodeStoreOutOfGas {
+	if suberr != nil && (c.rules.IsHomestead || suberr != vm.ErrCodeStoreOutOfGas) {
 		success.Clear()
 	} else {
 		success.SetBytes(addr.Bytes())
@@ -658,7 +706,9 @@ func opCreate2(c *context) {
 		salt         = c.stack.pop()
 	)
 
-	c.memory.EnsureCapacity(int(offset.Uint64()), int(size.Uint64()), c)
+	if !c.memory.ExpandFor(offset, size, c) {
+		return
+	}
 
 	input := c.memory.GetSlice(int64(offset.Uint64()), int64(size.Uint64()))
 
@@ -724,56 +774,43 @@ func opExtCodeCopy(c *context) {
 		uint64CodeOffset = 0xffffffffffffffff
 	}
 	addr := common.Address(a.Bytes20())
-	codeCopy := getData(c.evm.StateDB.GetCode(addr), uint64CodeOffset, length.Uint64())
-	c.memory.Set(memOffset.Uint64(), length.Uint64(), codeCopy)
-
-}
+	if !chargeColdAccountAccess(c, addr) || !c.memory.ExpandFor(memOffset, length, c) {
+		return
+	}
 
-func neededMemorySize(offset, size *uint256.Int) uint64 {
-	if size.IsZero() {
-		return 0
+	// Charge for length of copied code
+	words := (length.Uint64() + 31) / 32
+	if !c.UseGas(3 * words) {
+		return
 	}
-	return offset.Uint64() + size.Uint64()
+
+	codeCopy := getData(c.evm.StateDB.GetCode(addr), uint64CodeOffset, length.Uint64())
+	c.memory.Set(memOffset.Uint64(), length.Uint64(), codeCopy)
 }
 
 func opCall(c *context) {
 	stack := c.stack
 	// Pop call parameters.
 	provided_gas, addr, value, inOffset, inSize, retOffset, retSize := stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop()
-
-	// Compute and charge gas price for call
-	arg_memory_size := neededMemorySize(inOffset, inSize)
-	ret_memory_size := neededMemorySize(retOffset, retSize)
-	needed_memory_size := arg_memory_size
-	if ret_memory_size > arg_memory_size {
-		needed_memory_size = ret_memory_size
-	}
-	base_gas := c.memory.ExpansionCosts(int(needed_memory_size))
-
-	// Consider value transfere fees for base costs
-	if !value.IsZero() {
-		base_gas += params.CallValueTransferGas
-	}
-
-	gas := callGas(c.contract.Gas, base_gas, provided_gas)
-
-	// We need to check the existence of the target account before removing
-	// the gas price for the other cost factors to make sure that the read
-	// in the state DB is always happening. This is the current EVM behaviour,
-	// and not doing it would be identified by the replay tool as an error.
 	toAddr := common.Address(addr.Bytes20())
 
 	// Charge for transfering value to a new address
-	if !value.IsZero() && !c.stateDB.Exist(toAddr) && !c.UseGas(params.CallNewAccountGas) {
-		return
+	var base_gas uint64
+	if c.rules.IsEIP158 {
+		if !value.IsZero() && c.stateDB.Empty(toAddr) {
+			base_gas += params.CallNewAccountGas
+		}
+	} else if !c.stateDB.Exist(toAddr) {
+		base_gas += params.CallNewAccountGas
 	}
 
 	// Charge value-transfere fees
-	if !value.IsZero() && !c.UseGas(params.CallValueTransferGas) {
-		return
+	if !value.IsZero() {
+		base_gas += params.CallValueTransferGas
 	}
 
-	if !c.UseGas(gas) {
+	gas, ok := chargeCall(c, toAddr, base_gas, provided_gas, inOffset, inSize, retOffset, retSize)
+	if !ok {
 		return
 	}
 
@@ -790,91 +827,82 @@ func opCall(c *context) {
 	}
 
 	ret, returnGas, err := c.evm.Call(c.contract, toAddr, args, gas, bigVal)
+	finishCall(c, retOffset, retSize, ret, returnGas, err)
+}
 
-	if err == nil || err == vm.ErrExecutionReverted {
-		c.memory.EnsureCapacity(int(retOffset.Uint64()), int(retSize.Uint64()), c)
-		c.memory.Set(retOffset.Uint64(), retSize.Uint64(), ret)
+func opCallCode(c *context) {
+	stack := c.stack
+	// Pop call parameters.
+	provided_gas, addr, value, inOffset, inSize, retOffset, retSize := stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop()
+	toAddr := common.Address(addr.Bytes20())
+
+	var base_gas uint64
+	if !value.IsZero() {
+		base_gas += params.CallValueTransferGas
 	}
 
-	success := stack.pushEmpty()
-	if err != nil {
-		success.Clear()
-	} else {
-		success.SetOne()
+	gas, ok := chargeCall(c, toAddr, base_gas, provided_gas, inOffset, inSize, retOffset, retSize)
+	if !ok {
+		return
 	}
-	c.contract.Gas += returnGas
-	c.return_data = ret
+
+	// Get the arguments from the memory.
+	args := c.memory.GetSlice(int64(inOffset.Uint64()), int64(inSize.Uint64()))
+
+	var bigVal = big0
+	if !value.IsZero() {
+		gas += params.CallStipend
+		bigVal = value.ToBig()
+	}
+
+	ret, returnGas, err := c.evm.CallCode(c.contract, toAddr, args, gas, bigVal)
+	finishCall(c, retOffset, retSize, ret, returnGas, err)
 }
 
 func opStaticCall(c *context) {
 	stack := c.stack
 	// Pop call parameters.
 	provided_gas, addr, inOffset, inSize, retOffset, retSize := stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop()
+	toAddr := common.Address(addr.Bytes20())
 
-	// Compute and charge gas price for call
-	arg_memory_size := neededMemorySize(inOffset, inSize)
-	ret_memory_size := neededMemorySize(retOffset, retSize)
-	needed_memory_size := arg_memory_size
-	if ret_memory_size > arg_memory_size {
-		needed_memory_size = ret_memory_size
-	}
-	base_gas := c.memory.ExpansionCosts(int(needed_memory_size))
-	gas := callGas(c.contract.Gas, base_gas, provided_gas)
-	if !c.UseGas(gas) {
+	gas, ok := chargeCall(c, toAddr, 0, provided_gas, inOffset, inSize, retOffset, retSize)
+	if !ok {
 		return
 	}
 
-	toAddr := common.Address(addr.Bytes20())
 	// Get arguments from the memory.
 	args := c.memory.GetSlice(int64(inOffset.Uint64()), int64(inSize.Uint64()))
 
 	ret, returnGas, err := c.evm.StaticCall(c.contract, toAddr, args, gas)
-
-	if err == nil || err == vm.ErrExecutionReverted {
-		c.memory.EnsureCapacity(int(retOffset.Uint64()), int(retSize.Uint64()), c)
-		c.memory.Set(retOffset.Uint64(), retSize.Uint64(), ret)
-	}
-
-	success := stack.pushEmpty()
-	if err != nil {
-		success.Clear()
-	} else {
-		success.SetOne()
-	}
-	c.contract.Gas += returnGas
-	c.return_data = ret
+	finishCall(c, retOffset, retSize, ret, returnGas, err)
 }
 
 func opDelegateCall(c *context) {
 	stack := c.stack
 	// Pop call parameters.
 	provided_gas, addr, inOffset, inSize, retOffset, retSize := stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop()
+	toAddr := common.Address(addr.Bytes20())
 
-	// Compute and charge gas price for call
-	arg_memory_size := neededMemorySize(inOffset, inSize)
-	ret_memory_size := neededMemorySize(retOffset, retSize)
-	needed_memory_size := arg_memory_size
-	if ret_memory_size > arg_memory_size {
-		needed_memory_size = ret_memory_size
-	}
-	base_gas := c.memory.ExpansionCosts(int(needed_memory_size))
-	gas := callGas(c.contract.Gas, base_gas, provided_gas)
-	if !c.UseGas(gas) {
+	gas, ok := chargeCall(c, toAddr, 0, provided_gas, inOffset, inSize, retOffset, retSize)
+	if !ok {
 		return
 	}
 
-	toAddr := common.Address(addr.Bytes20())
 	// Get arguments from the memory.
 	args := c.memory.GetSlice(int64(inOffset.Uint64()), int64(inSize.Uint64()))
 
 	ret, returnGas, err := c.evm.DelegateCall(c.contract, toAddr, args, gas)
+	finishCall(c, retOffset, retSize, ret, returnGas, err)
+}
 
+// finishCall copies the result of a call into the memory, which was expanded
+// when charging the call, and pushes the success flag.
+func finishCall(c *context, retOffset, retSize *uint256.Int, ret []byte, returnGas uint64, err error) {
 	if err == nil || err == vm.ErrExecutionReverted {
-		c.memory.EnsureCapacity(int(retOffset.Uint64()), int(retSize.Uint64()), c)
 		c.memory.Set(retOffset.Uint64(), retSize.Uint64(), ret)
 	}
 
-	success := stack.pushEmpty()
+	success := c.stack.pushEmpty()
 	if err != nil {
 		success.Clear()
 	} else {
@@ -909,7 +937,9 @@ func opReturnDataCopy(c *context) {
 		return
 	}
 
-	c.memory.EnsureCapacity(int(memOffset.Uint64()), int(length.Uint64()), c)
+	if !c.memory.ExpandFor(memOffset, length, c) {
+		return
+	}
 
 	words := (length.Uint64() + 31) / 32
 	if !c.UseGas(3 * words) {
@@ -928,18 +958,17 @@ func opLog(c *context, size int) {
 		topics[i] = addr.Bytes32()
 	}
 
-	// charge for log size
-	if !c.UseGas(8 * mSize.Uint64()) {
+	// Expand memory if needed
+	if !c.memory.ExpandFor(mStart, mSize, c) {
 		return
 	}
 
-	// Expand memory if needed
-	start := int(mStart.Uint64())
-	log_size := int(mSize.Uint64())
-	c.memory.EnsureCapacity(start, log_size, c)
-	if c.status != RUNNING {
+	// charge for log size
+	if !c.UseGas(params.LogGas + uint64(size)*params.LogTopicGas + params.LogDataGas*mSize.Uint64()) {
 		return
 	}
+	start := int(mStart.Uint64())
+	log_size := int(mSize.Uint64())
 	d := c.memory.GetSlice(int64(start), int64(log_size))
 
 	// make a copy of the data to disconnect from memory
@@ -1024,11 +1053,10 @@ func opDup2_Mstore(c *context) {
 	var value = c.stack.pop()
 	var addr = c.stack.peek()
 
-	offset := int(addr.Uint64())
-	c.memory.EnsureCapacity(offset, 32, c)
-	if c.status == RUNNING {
-		c.memory.SetWord(offset, value)
+	if !c.memory.ExpandFor(addr, word_size, c) {
+		return
 	}
+	c.memory.SetWord(int(addr.Uint64()), value)
 }
 
 func opDup2_Lt(c *context) {
@@ -1062,8 +1090,9 @@ func opSwap2_Swap1_Pop_Jump(c *context) {
 	top := c.stack.pop()
 	c.stack.pop()
 	trg := c.stack.peek()
-	c.pc = int32(trg.Uint64()) - 1
+	c.pc = jumpDestination(trg) - 1
 	*trg = *top
+	checkJumpDest(c)
 }
 
 func opSwap1_Pop_Swap2_Swap1(c *context) {
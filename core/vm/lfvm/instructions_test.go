@@ -1,7 +1,11 @@
 package lfvm
 
 import (
+	"bytes"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
 )
 
 func TestPushN(t *testing.T) {
@@ -189,3 +193,42 @@ func TestPush4(t *testing.T) {
 		t.Errorf("expected %d for 4th byte, got %d", 0x78, got[3])
 	}
 }
+
+func TestInstructionsMatchEvmBeyondLimits(t *testing.T) {
+	// 2^64, truncated to 0 by a conversion to uint64
+	beyond64 := []byte{byte(vm.PUSH9), 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	codes := map[string][]byte{
+		"jump beyond 32 bit": {
+			byte(vm.PUSH5), 1, 0, 0, 0, 7, byte(vm.JUMP),
+			byte(vm.JUMPDEST), // 7
+			byte(vm.STOP),
+		},
+		"jump of super instruction to no JUMPDEST": {
+			byte(vm.PUSH1), 10, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+			byte(vm.SWAP2), byte(vm.SWAP1), byte(vm.POP), byte(vm.JUMP),
+			byte(vm.STOP), // 10
+		},
+		"return charges memory": {byte(vm.PUSH2), 0x10, 0x00, byte(vm.PUSH1), 0, byte(vm.RETURN)},
+		"revert charges memory": {byte(vm.PUSH2), 0x10, 0x00, byte(vm.PUSH1), 0, byte(vm.REVERT)},
+		"return beyond 64 bit":  append(append([]byte{}, beyond64...), byte(vm.PUSH1), 0, byte(vm.RETURN)),
+		"revert beyond 64 bit":  append(append([]byte{}, beyond64...), byte(vm.PUSH1), 0, byte(vm.REVERT)),
+		"mstore beyond 64 bit":  append(append([]byte{byte(vm.PUSH1), 1}, beyond64...), byte(vm.MSTORE)),
+		"sha3 beyond 64 bit":    append(append([]byte{byte(vm.PUSH1), 32}, beyond64...), byte(vm.SHA3)),
+		"log beyond 64 bit":     append(append([]byte{byte(vm.PUSH1), 32}, beyond64...), byte(vm.LOG0)),
+		"calldatacopy beyond 64 bit": append(append([]byte{byte(vm.PUSH1), 32, byte(vm.PUSH1), 0}, beyond64...),
+			byte(vm.CALLDATACOPY)),
+		"codecopy beyond 64 bit": append(append([]byte{byte(vm.PUSH1), 32, byte(vm.PUSH1), 0}, beyond64...),
+			byte(vm.CODECOPY)),
+		"calldataload beyond 64 bit": append(append([]byte{}, beyond64...),
+			byte(vm.CALLDATALOAD), byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.RETURN)),
+	}
+	input := bytes.Repeat([]byte{0xff}, 32)
+	for name, code := range codes {
+		want := callWithInput(code, input, params.MainnetChainConfig, 12965000, "geth")
+		for _, interpreter := range []string{"lfvm", "lfvm-si"} {
+			if have := callWithInput(code, input, params.MainnetChainConfig, 12965000, interpreter); have != want {
+				t.Errorf("%s: %s has wrong result: have %+v, want %+v", name, interpreter, have, want)
+			}
+		}
+	}
+}
@@ -2,13 +2,17 @@ package lfvm
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"hash"
+	"io"
+	"os"
 	"sort"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/holiman/uint256"
 )
 
@@ -35,7 +39,11 @@ type keccakState interface {
 
 type context struct {
 	// Context instances
-	evm *vm.EVM
+	evm   *vm.EVM
+	rules params.Rules
+
+	// Static gas prices of the instruction set of the hard-fork
+	static_gas *[NUM_OPCODES]uint64
 
 	// Execution state
 	pc      int32
@@ -48,6 +56,7 @@ type context struct {
 	// Inputs
 	contract *vm.Contract
 	code     Code
+	pc_map   []int32 // EVM program counters of code, only set for tracing
 	data     []byte
 	callsize uint256.Int
 
@@ -77,8 +86,20 @@ func (c *context) SignalError(err error) {
 	c.err = err
 }
 
-func Run(evm *vm.EVM, cfg vm.Config, contract *vm.Contract, code Code, data []byte, readOnly bool, state vm.StateDB, with_shadow_vm, with_statistics bool) ([]byte, error) {
-	if evm.Depth == 0 {
+func Run(evm *vm.EVM, cfg vm.Config, contract *vm.Contract, code Code, data []byte, readOnly bool, state vm.StateDB, with_super_instructions, with_shadow_vm, with_statistics bool) ([]byte, error) {
+	var shadow_log io.Writer
+	if with_shadow_vm {
+		shadow_log = os.Stdout
+	}
+	return runCode(evm, cfg, contract, code, data, readOnly, state, with_super_instructions, shadow_log, with_statistics)
+}
+
+// runCode runs code like Run. If shadow_log is not nil, the code is run
+// with a shadow EVM and the steps of both are written to shadow_log.
+func runCode(evm *vm.EVM, cfg vm.Config, contract *vm.Contract, code Code, data []byte, readOnly bool, state vm.StateDB, with_super_instructions bool, shadow_log io.Writer, with_statistics bool) ([]byte, error) {
+	with_shadow_vm := shadow_log != nil
+	// the shadow values are shared by all shadow runs, not touched otherwise
+	if with_shadow_vm && evm.Depth == 0 {
 		ClearShadowValues()
 	}
 	// Increment the call depth which is restricted to 1024
@@ -99,8 +120,10 @@ func Run(evm *vm.EVM, cfg vm.Config, contract *vm.Contract, code Code, data []by
 		// Introduce an interceptor for recursive EVM calls
 		main_evm.CallContext = &CaptureCallContext{evm, &shadow_call_context}
 
-		// Start shadow interceptor
-		shadow_interpreter = vm.NewEVMInterpreter(&shadow_evm, cfg).Start(&shadow_contract, data, readOnly)
+		// Start shadow interceptor, which is not profiled
+		shadow_cfg := cfg
+		shadow_cfg.Profilers = nil
+		shadow_interpreter = vm.NewEVMInterpreter(&shadow_evm, shadow_cfg).Start(&shadow_contract, data, readOnly)
 
 		defer func() {
 			shadow_interpreter.Stop()
@@ -108,8 +131,11 @@ func Run(evm *vm.EVM, cfg vm.Config, contract *vm.Contract, code Code, data []by
 	}
 
 	// Set up execution context.
+	rules := evm.ChainConfig().Rules(evm.Context.BlockNumber)
 	var ctxt = context{
 		evm:         &main_evm,
+		rules:       rules,
+		static_gas:  &static_gas_prices[getFork(rules)],
 		contract:    contract,
 		code:        code,
 		data:        data,
@@ -123,9 +149,29 @@ func Run(evm *vm.EVM, cfg vm.Config, contract *vm.Contract, code Code, data []by
 		ReturnStack(ctxt.stack)
 	}()
 
+	tracing := cfg.Debug && cfg.Tracer != nil && ctxt.interpreter == nil
+	// like the EVM, do not profile contracts without code
+	profiling := len(cfg.Profilers) > 0 && ctxt.interpreter == nil && !tracing && len(contract.Code) > 0
+	if tracing || profiling {
+		// profiled instructions are timed one by one, without super instructions
+		var err error
+		if ctxt.code, ctxt.pc_map, err = convertForTracing(contract.Code, contract.CodeHash, tracing && with_super_instructions); err != nil {
+			return nil, err
+		}
+	}
+
 	// Run interpreter.
 	if ctxt.interpreter != nil {
-		runWithShadowInterpreter(&ctxt)
+		runWithShadowInterpreter(&ctxt, shadow_log)
+	} else if tracing {
+		runWithTracer(&ctxt, cfg.Tracer)
+	} else if profiling {
+		// profilers see the input of the contract, like in the EVM
+		contract.Input = data
+		// nested calls use the interpreter's EVM, not main_evm
+		p := vm.StartProfiling(evm, cfg.Profilers, contract)
+		defer p.Stop()
+		runWithProfiling(&ctxt, p)
 	} else if with_statistics {
 		runWithStatistics(&ctxt)
 	} else {
@@ -138,8 +184,9 @@ func Run(evm *vm.EVM, cfg vm.Config, contract *vm.Contract, code Code, data []by
 		offset := ctxt.result_offset.Uint64()
 		size := ctxt.result_size.Uint64()
 		res = make([]byte, size)
-		ctxt.memory.EnsureCapacity(int(offset), int(size), &ctxt)
-		ctxt.memory.CopyData(int(offset), res[:])
+		if size > 0 {
+			ctxt.memory.CopyData(int(offset), res[:])
+		}
 	}
 
 	// Handle return status
@@ -172,60 +219,86 @@ func run(c *context) {
 	}
 }
 
-func runWithShadowInterpreter(c *context) {
+func runWithShadowInterpreter(c *context, log io.Writer) {
+	if err := compareWithShadowInterpreter(c, log); err != nil {
+		panic(err.Error())
+	}
+}
+
+// compareWithShadowInterpreter runs the interpreter in lock-step with the
+// shadow EVM and returns an error on the first divergence of their states.
+// Each step of the interpreter is matched by a step of the shadow EVM for
+// each EVM instruction it covers, including the JUMPDEST at the destination
+// of a jump.
+func compareWithShadowInterpreter(c *context, log io.Writer) error {
 	count := 0
 	for c.status == RUNNING {
-		for c.code[c.pc].opcode == JUMP_TO {
+		for int(c.pc) < len(c.code) && c.code[c.pc].opcode == JUMP_TO {
 			step(c)
 		}
 		count++
 
 		// Make a step in this interpreter.
-		fmt.Printf("%5d - %v\n", count, c.code[c.pc].opcode)
+		instruction := Instruction{opcode: STOP}
+		if int(c.pc) < len(c.code) {
+			instruction = c.code[c.pc]
+		}
+		parts := getParts(instruction)
+		steps := len(parts)
+		fmt.Fprintf(log, "%5d - %v\n", count, instruction.opcode)
 		step(c)
+		if last := parts[len(parts)-1]; (last == JUMP || last == JUMPI) && c.status == RUNNING && c.code[c.pc-1].opcode == JUMPDEST {
+			// the JUMPDEST at the destination was executed by the jump
+			steps++
+		}
 
-		// Make a step in the shadow interpreter
-		fmt.Printf("%5d - % 92v\n", count, c.interpreter.GetCurrentOpCode())
-		c.interpreter.Step()
+		// Make the corresponding steps in the shadow interpreter
+		for i := 0; i < steps; i++ {
+			fmt.Fprintf(log, "%5d - % 92v\n", count, c.interpreter.GetCurrentOpCode())
+			c.interpreter.Step()
+		}
 
 		// Compare states and look for missalignments.
 		if (c.status != RUNNING) != (c.interpreter.IsDone()) {
-			fmt.Printf("Left done:  %t\n", c.status != RUNNING)
-			fmt.Printf("Right done: %t\n", c.interpreter.IsDone())
-			panic("One side terminated while other hasn't")
+			fmt.Fprintf(log, "Left done:  %t\n", c.status != RUNNING)
+			fmt.Fprintf(log, "Right done: %t\n", c.interpreter.IsDone())
+			return errors.New("One side terminated while other hasn't")
 		}
 		if c.status != RUNNING {
 			continue
 		}
 		if c.contract.Gas != c.interpreter.Contract.Gas {
-			fmt.Printf("Left:  %v\n", c.contract.Gas)
-			fmt.Printf("Right: %v\n", c.interpreter.Contract.Gas)
-			fmt.Printf("Diff:  %v\n", int64(c.contract.Gas)-int64(c.interpreter.Contract.Gas))
-			panic("Gas value diverged!")
+			fmt.Fprintf(log, "Left:  %v\n", c.contract.Gas)
+			fmt.Fprintf(log, "Right: %v\n", c.interpreter.Contract.Gas)
+			fmt.Fprintf(log, "Diff:  %v\n", int64(c.contract.Gas)-int64(c.interpreter.Contract.Gas))
+			return errors.New("Gas value diverged!")
 		}
 		if c.stack.len() != c.interpreter.Stack.Len() {
-			fmt.Printf("Left:  %d\n", c.stack.len())
-			fmt.Printf("Right: %d\n", c.interpreter.Stack.Len())
-			panic("Stack length diverged!")
+			fmt.Fprintf(log, "Left:  %d\n", c.stack.len())
+			fmt.Fprintf(log, "Right: %d\n", c.interpreter.Stack.Len())
+			return errors.New("Stack length diverged!")
 		}
-		if c.stack.len() > 0 && *c.stack.peek() != *c.interpreter.Stack.Back(0) {
-			fmt.Printf("Left:  %v\n", *c.stack.peek())
-			fmt.Printf("Right: %v\n", *c.interpreter.Stack.Back(0))
-			panic("Stack top value divereged!")
+		// compare all slots, sequences like SWAP2_SWAP1 reach below the top
+		for i := 0; i < c.stack.len(); i++ {
+			if *c.stack.Back(i) != *c.interpreter.Stack.Back(i) {
+				fmt.Fprintf(log, "Slot:  %d\n", i)
+				fmt.Fprintf(log, "Left:  %v\n", *c.stack.Back(i))
+				fmt.Fprintf(log, "Right: %v\n", *c.interpreter.Stack.Back(i))
+				return fmt.Errorf("Stack value %d below the top diverged!", i)
+			}
 		}
 		if c.memory.Len() != c.interpreter.Memory.Len() {
-			fmt.Printf("Left:  %v\n", c.memory.Len())
-			fmt.Printf("Right: %v\n", c.interpreter.Memory.Len())
-			panic("Memory size divereged!")
+			fmt.Fprintf(log, "Left:  %v\n", c.memory.Len())
+			fmt.Fprintf(log, "Right: %v\n", c.interpreter.Memory.Len())
+			return errors.New("Memory size divereged!")
 		}
 		if !bytes.Equal(c.memory.Data(), c.interpreter.Memory.Data()) {
-			fmt.Printf("Left:\n")
-			c.memory.Print()
-			fmt.Printf("Right:\n")
-			c.interpreter.Memory.Print()
-			panic("Memory content divereged!")
+			fmt.Fprintf(log, "Left:  %x\n", c.memory.Data())
+			fmt.Fprintf(log, "Right: %x\n", c.interpreter.Memory.Data())
+			return errors.New("Memory content divereged!")
 		}
 	}
+	return nil
 }
 
 type entry struct {
@@ -343,6 +416,11 @@ func PrintCollectedInstructionStatistics() {
 	global_statistics.Print()
 }
 
+// runWithStatistics counts the sequences of lfvm instructions executed,
+// including the super instructions of lfvm-si-stats. Unlike a
+// vm.NGramProfiler, which sees the EVM opcodes of code converted without
+// super instructions, it counts the instructions lfvm dispatches, by which
+// generated super instructions are ranked.
 func runWithStatistics(c *context) {
 	stats := stats_collector{stats: newStatistics()}
 	for c.status == RUNNING {
@@ -363,7 +441,13 @@ func step(c *context) {
 	//fmt.Printf("%v\n", c.stack)
 	//fmt.Printf("0x%04x - %5d - %v\n", c.pc, c.contract.Gas, instruction)
 	// Consume static gas price for instruction before execution
-	if !c.UseGas(getGasPrice(c)) {
+	price := getGasPrice(c)
+	if price == UNDEFINED_GAS_PRICE {
+		// the instruction is not supported by the hard-fork
+		opInvalid(c)
+		return
+	}
+	if !c.UseGas(price) {
 		return
 	}
 	// Execute instruction
@@ -420,6 +504,8 @@ func step(c *context) {
 		opSub(c)
 	case MUL:
 		opMul(c)
+	case ADDMOD:
+		opAddMod(c)
 	case MULMOD:
 		opMulMod(c)
 	case DIV:
@@ -620,8 +706,12 @@ func step(c *context) {
 		opGasLimit(c)
 	case GASPRICE:
 		opGasPrice(c)
+	case BASEFEE:
+		opBaseFee(c)
 	case CALL:
 		opCall(c)
+	case CALLCODE:
+		opCallCode(c)
 	case STATICCALL:
 		opStaticCall(c)
 	case DELEGATECALL:
@@ -695,6 +785,8 @@ func step(c *context) {
 		opAnd_Swap1_Pop_Swap2_Swap1(c)
 	case PUSH1_PUSH1_PUSH1_SHL_SUB:
 		opPush1_Push1_Push1_Shl_Sub(c)
+	case SUPER:
+		opSuper(c)
 	default:
 		panic(fmt.Sprintf("Unsupported operation: %v", c.code[c.pc].opcode))
 	}
@@ -704,5 +796,5 @@ func step(c *context) {
 func getGasPrice(c *context) uint64 {
 	// Idea: handle static gas price in static dispatch above (saves an array lookup)
 	op := c.code[c.pc].opcode
-	return getStaticGasPrice(op)
+	return c.static_gas[op]
 }
@@ -2,6 +2,11 @@ package lfvm
 
 import "github.com/ethereum/go-ethereum/core/vm"
 
+// EVMInterpreter runs contracts converted into the long-form of the EVM,
+// optionally with super instructions fusing frequent instruction sequences.
+// Tracers see each EVM instruction of a super instruction. Profiled code is
+// converted without super instructions, since profilers time instructions
+// one by one.
 type EVMInterpreter struct {
 	evm                     *vm.EVM
 	cfg                     vm.Config
@@ -21,6 +26,9 @@ func init() {
 	vm.RegisterInterpreterFactory("lfvm-dbg", func(evm *vm.EVM, cfg vm.Config) vm.EVMInterpreter {
 		return &EVMInterpreter{evm: evm, cfg: cfg, with_shadow_evm: true}
 	})
+	vm.RegisterInterpreterFactory("lfvm-si-dbg", func(evm *vm.EVM, cfg vm.Config) vm.EVMInterpreter {
+		return &EVMInterpreter{evm: evm, cfg: cfg, with_super_instructions: true, with_shadow_evm: true}
+	})
 	vm.RegisterInterpreterFactory("lfvm-stats", func(evm *vm.EVM, cfg vm.Config) vm.EVMInterpreter {
 		return &EVMInterpreter{evm: evm, cfg: cfg, with_statistics: true}
 	})
@@ -30,10 +38,15 @@ func init() {
 }
 
 func (e *EVMInterpreter) Run(contract *vm.Contract, input []byte, readOnly bool) (ret []byte, err error) {
-	converted, err := Convert(contract.Address(), contract.Code, e.with_super_instructions)
-	if err != nil {
-		panic(err)
-		//return nil, err
+	var converted Code
+	// traced and profiled code is converted by Run
+	traced := e.cfg.Debug && e.cfg.Tracer != nil || len(e.cfg.Profilers) > 0
+	if !traced || e.with_shadow_evm {
+		converted, err = Convert(contract.Code, contract.CodeHash, e.with_super_instructions)
+		if err != nil {
+			panic(err)
+			//return nil, err
+		}
 	}
-	return Run(e.evm, e.cfg, contract, converted, input, readOnly, e.evm.StateDB, e.with_shadow_evm, e.with_statistics)
+	return Run(e.evm, e.cfg, contract, converted, input, readOnly, e.evm.StateDB, e.with_super_instructions, e.with_shadow_evm, e.with_statistics)
 }
@@ -3,9 +3,13 @@ package lfvm
 import (
 	"fmt"
 
+	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/holiman/uint256"
 )
 
+// The largest memory size whose expansion costs fit into 64 bits.
+const max_memory_size = 0x1FFFFFFFE0
+
 type Memory struct {
 	store             []byte
 	total_memory_cost uint64
@@ -47,6 +51,21 @@ func (m *Memory) EnsureCapacity(offset, size int, c *context) {
 	}
 }
 
+// ExpandFor expands the memory to cover size bytes at offset and charges the
+// expansion costs. It returns false if the execution can not continue.
+func (m *Memory) ExpandFor(offset, size *uint256.Int, c *context) bool {
+	if size.IsZero() {
+		return true
+	}
+	end, overflow := new(uint256.Int).AddOverflow(offset, size)
+	if overflow || !end.IsUint64() || end.Uint64() > max_memory_size {
+		c.SignalError(vm.ErrGasUintOverflow)
+		return false
+	}
+	m.EnsureCapacity(int(offset.Uint64()), int(size.Uint64()), c)
+	return c.status == RUNNING
+}
+
 func (m *Memory) Len() int {
 	return len(m.store)
 }
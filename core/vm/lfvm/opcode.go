@@ -202,6 +202,10 @@ const (
 	AND_SWAP1_POP_SWAP2_SWAP1
 	PUSH1_PUSH1_PUSH1_SHL_SUB
 
+	// Super-instruction generated from instruction statistics, its argument
+	// selects the sequence of instructions, see super_instruction.go.
+	SUPER
+
 	// Special no-instrictions op codes
 	DATA
 	NOOP
@@ -320,6 +324,7 @@ var op_to_string = map[OpCode]string{
 	MSTORE:  "MSTORE",
 	MSTORE8: "MSTORE8",
 	MLOAD:   "MLOAD",
+	MSIZE:   "MSIZE",
 
 	SLOAD:  "SLOAD",
 	SSTORE: "SSTORE",
@@ -390,6 +395,8 @@ var op_to_string = map[OpCode]string{
 	AND_SWAP1_POP_SWAP2_SWAP1: "AND_SWAP1_POP_SWAP2_SWAP1",
 	PUSH1_PUSH1_PUSH1_SHL_SUB: "PUSH1_PUSH1_PUSH1_SHL_SUB",
 
+	SUPER: "SUPER",
+
 	DATA:    "DATA",
 	NOOP:    "NOOP",
 	INVALID: "INVALID",
@@ -403,6 +410,20 @@ func (o OpCode) String() string {
 	return str
 }
 
+func (o OpCode) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+func (o *OpCode) UnmarshalText(text []byte) error {
+	for op, str := range op_to_string {
+		if str == string(text) {
+			*o = op
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown instruction %q", text)
+}
+
 func (o OpCode) HasArgument() bool {
 	if PUSH1 <= o && o <= PUSH32 {
 		return true
@@ -418,6 +439,8 @@ func (o OpCode) HasArgument() bool {
 		return true
 	case PUSH1_PUSH4_DUP3:
 		return true
+	case SUPER:
+		return true
 	}
 	return false
 }
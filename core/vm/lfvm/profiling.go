@@ -0,0 +1,38 @@
+package lfvm
+
+import "github.com/ethereum/go-ethereum/core/vm"
+
+// runWithProfiling runs the interpreter and reports every EVM instruction,
+// including the JUMPDEST executed as part of a jump, to the profilers of the
+// VM config. Like traced code, profiled code is converted without super
+// instructions and with a map to EVM program counters.
+func runWithProfiling(c *context, profiling *vm.Profiling) {
+	for c.status == RUNNING {
+		// JUMP_TO is not an EVM instruction
+		for int(c.pc) < len(c.code) && c.code[c.pc].opcode == JUMP_TO {
+			step(c)
+		}
+
+		// the EVM stops at the end of the code
+		pc, op := uint64(len(c.contract.Code)), vm.STOP
+		if int(c.pc) < len(c.code) {
+			pc = uint64(c.pc_map[c.pc])
+			op = vm.OpCode(c.contract.Code[pc])
+		}
+		profiling.BeginInstruction(pc, op, c.contract.Gas)
+
+		next := c.pc + 1
+		step(c)
+
+		if err := stepError(c); err != nil && c.status != REVERTED {
+			continue
+		}
+		// a jump executes the JUMPDEST at its destination in the same step
+		if (op == vm.JUMP || op == vm.JUMPI) && c.pc != next {
+			profiling.EndInstruction(c.contract.Gas + 1)
+			dest := c.pc - 1
+			profiling.BeginInstruction(uint64(c.pc_map[dest]), vm.JUMPDEST, c.contract.Gas+1)
+		}
+		profiling.EndInstruction(c.contract.Gas)
+	}
+}
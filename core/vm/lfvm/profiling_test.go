@@ -0,0 +1,179 @@
+package lfvm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+)
+
+// profileRecorder records the events reported to a profiler.
+type profileRecorder struct {
+	events []string
+	frames int
+	exits  int
+}
+
+func (r *profileRecorder) Enter(contract *vm.Contract) vm.FrameProfile {
+	r.frames++
+	return r
+}
+
+func (r *profileRecorder) BasicBlock(pc uint64) {
+	r.events = append(r.events, fmt.Sprintf("block %d", pc))
+}
+
+func (r *profileRecorder) Instruction(pc uint64, op vm.OpCode, gas uint64, duration time.Duration) {
+	r.events = append(r.events, fmt.Sprintf("%d %v gas=%d", pc, op, gas))
+}
+
+func (r *profileRecorder) Exit() {
+	r.exits++
+}
+
+func TestProfilersReceiveEvmInstructions(t *testing.T) {
+	codes := map[string][]byte{
+		"jumps": {
+			byte(vm.PUSH1), 0x02, byte(vm.PUSH1), 0x03, // PUSH1_PUSH1 with super instructions
+			byte(vm.ADD),
+			byte(vm.PUSH2), 0x00, 0x0a, byte(vm.JUMP), // PUSH2_JUMP
+			byte(vm.INVALID),
+			byte(vm.JUMPDEST), // 10
+			byte(vm.DUP1),
+			byte(vm.ISZERO), byte(vm.PUSH2), 0x00, 0x19, byte(vm.JUMPI), // ISZERO_PUSH2_JUMPI
+			byte(vm.PUSH1), 0x00,
+			byte(vm.MSTORE),
+			byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0x00,
+			byte(vm.RETURN),
+			byte(vm.JUMPDEST), // 25
+			byte(vm.STOP),
+		},
+		"revert": {byte(vm.PUSH1), 0x00, byte(vm.DUP1), byte(vm.REVERT)},
+		"end":    {byte(vm.PUSH1), 0x01, byte(vm.PUSH1), 0x02, byte(vm.ADD)},
+		"jump":   {byte(vm.PUSH1), 0x05, byte(vm.JUMP)},
+		"empty":  {},
+	}
+	for name, code := range codes {
+		want := &profileRecorder{}
+		runtime.Execute(code, nil, &runtime.Config{EVMConfig: vm.Config{Profilers: []vm.Profiler{want}}})
+		if len(code) > 0 && len(want.events) == 0 {
+			t.Fatalf("%s: no events reported by geth", name)
+		}
+
+		for _, interpreter := range []string{"lfvm", "lfvm-si"} {
+			have := &profileRecorder{}
+			runtime.Execute(code, nil, &runtime.Config{EVMConfig: vm.Config{Profilers: []vm.Profiler{have}, InterpreterImpl: interpreter}})
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("%s: %s reported wrong events:\nhave %d frames, %q\nwant %d frames, %q", name, interpreter, have.frames, have.events, want.frames, want.events)
+			}
+			if have.exits != have.frames {
+				t.Errorf("%s: %s exited %d of %d frames", name, interpreter, have.exits, have.frames)
+			}
+		}
+	}
+}
+
+// slowProfiler sleeps for every instruction and records the duration of
+// CALL instructions.
+type slowProfiler struct {
+	calls []time.Duration
+}
+
+func (p *slowProfiler) Enter(contract *vm.Contract) vm.FrameProfile {
+	return p
+}
+
+func (p *slowProfiler) BasicBlock(pc uint64) {}
+
+func (p *slowProfiler) Instruction(pc uint64, op vm.OpCode, gas uint64, duration time.Duration) {
+	if op == vm.CALL {
+		p.calls = append(p.calls, duration)
+	}
+	time.Sleep(5 * time.Millisecond)
+}
+
+func (p *slowProfiler) Exit() {}
+
+func TestProfiledDurationsExcludeNestedCalls(t *testing.T) {
+	callee := common.BytesToAddress([]byte("callee"))
+	code := []byte{
+		byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00,
+		byte(vm.PUSH20),
+	}
+	code = append(code, callee.Bytes()...)
+	code = append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.STOP))
+
+	for _, interpreter := range []string{"geth", "lfvm"} {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil, nil)
+		statedb.SetCode(callee, []byte{byte(vm.PUSH1), 0x01, byte(vm.PUSH1), 0x02, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)})
+
+		profiler := &slowProfiler{}
+		recorder := &profileRecorder{}
+		_, _, err := runtime.Execute(code, nil, &runtime.Config{State: statedb, EVMConfig: vm.Config{Profilers: []vm.Profiler{recorder, profiler}, InterpreterImpl: interpreter}})
+		if err != nil {
+			t.Fatalf("%s: execution failed: %v", interpreter, err)
+		}
+		if recorder.frames != 2 || recorder.exits != 2 {
+			t.Errorf("%s: wrong nesting of frames: %d entered, %d exited", interpreter, recorder.frames, recorder.exits)
+		}
+		// the callee sleeps for 25ms in its 5 instructions
+		if len(profiler.calls) != 1 || profiler.calls[0] >= 25*time.Millisecond {
+			t.Errorf("%s: wrong durations of calls: %v", interpreter, profiler.calls)
+		}
+	}
+}
+
+// panickingProfiler panics on the first instruction of a nested call.
+type panickingProfiler struct {
+	profileRecorder
+}
+
+func (p *panickingProfiler) Enter(contract *vm.Contract) vm.FrameProfile {
+	p.frames++
+	if p.frames > 1 {
+		return &panickingFrame{&p.profileRecorder}
+	}
+	return &p.profileRecorder
+}
+
+type panickingFrame struct {
+	*profileRecorder
+}
+
+func (f *panickingFrame) Instruction(pc uint64, op vm.OpCode, gas uint64, duration time.Duration) {
+	panic("profiler failure")
+}
+
+func TestProfilingStopsOnPanic(t *testing.T) {
+	callee := common.BytesToAddress([]byte("callee"))
+	code := []byte{
+		byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00,
+		byte(vm.PUSH20),
+	}
+	code = append(code, callee.Bytes()...)
+	code = append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.STOP))
+
+	for _, interpreter := range []string{"geth", "lfvm"} {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil, nil)
+		statedb.SetCode(callee, []byte{byte(vm.PUSH1), 0x01, byte(vm.POP), byte(vm.STOP)})
+
+		profiler := &panickingProfiler{}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: profiler did not panic", interpreter)
+				}
+			}()
+			runtime.Execute(code, nil, &runtime.Config{State: statedb, EVMConfig: vm.Config{Profilers: []vm.Profiler{profiler}, InterpreterImpl: interpreter}})
+		}()
+		if profiler.frames != 2 || profiler.exits != 2 {
+			t.Errorf("%s: wrong nesting of frames: %d entered, %d exited", interpreter, profiler.frames, profiler.exits)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package lfvm
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+)
+
+// InstructionStatistics are the instruction statistics collected by the
+// lfvm-stats interpreters in a machine-readable form.
+type InstructionStatistics struct {
+	Steps     uint64                `json:"steps"`
+	Sequences []InstructionSequence `json:"sequences"` // by decreasing count
+}
+
+// InstructionSequence is a sequence of one to four instructions executed
+// consecutively and the number of times it was executed.
+type InstructionSequence struct {
+	Instructions []OpCode `json:"instructions"`
+	Count        uint64   `json:"count"`
+}
+
+// ReadInstructionStatistics reads statistics in the JSON form written by
+// Write.
+func ReadInstructionStatistics(r io.Reader) (*InstructionStatistics, error) {
+	res := &InstructionStatistics{}
+	if err := json.NewDecoder(r).Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Write writes the statistics as JSON.
+func (s *InstructionStatistics) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// CollectedInstructionStatistics returns the statistics collected by the
+// lfvm-stats interpreters so far.
+func CollectedInstructionStatistics() *InstructionStatistics {
+	global_stats_mu.Lock()
+	defer global_stats_mu.Unlock()
+	return global_statistics.export()
+}
+
+// ResetInstructionStatistics discards the statistics collected so far.
+func ResetInstructionStatistics() {
+	global_stats_mu.Lock()
+	defer global_stats_mu.Unlock()
+	global_statistics = newStatistics()
+}
+
+func (s *statistics) export() *InstructionStatistics {
+	res := &InstructionStatistics{Steps: s.count}
+	for length, counts := range []map[uint64]uint64{s.single_count, s.pair_count, s.triple_count, s.quad_count} {
+		for key, count := range counts {
+			ops := make([]OpCode, length+1)
+			for i := range ops {
+				ops[i] = OpCode(key >> (16 * (length - i)) & 0xffff)
+			}
+			res.Sequences = append(res.Sequences, InstructionSequence{ops, count})
+		}
+	}
+	sort.Slice(res.Sequences, func(i, j int) bool {
+		a, b := res.Sequences[i], res.Sequences[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return getSequenceName(a.Instructions) < getSequenceName(b.Instructions)
+	})
+	return res
+}
+
+// getSequenceName returns the name of a sequence of instructions in the
+// form of super instructions, e.g. PUSH1_PUSH1_ADD.
+func getSequenceName(ops []OpCode) string {
+	names := make([]string, len(ops))
+	for i, op := range ops {
+		names[i] = op.String()
+	}
+	return strings.Join(names, "_")
+}
+
+// RankSuperInstructions ranks the instruction sequences of stats as
+// candidates for generated super instructions and returns at most limit of
+// them. Candidates are ranked by the number of instruction dispatches they
+// would save, their count times their length less one. Sequences that can
+// not be generated, e.g. because they contain a jump before their end, and
+// those of hand-picked super instructions are skipped. Hand-picked super
+// instructions in the statistics are expanded to their instructions.
+func RankSuperInstructions(stats *InstructionStatistics, limit int) []SuperInstruction {
+	hand_picked := map[string]bool{}
+	for _, parts := range super_instructions {
+		hand_picked[getSequenceName(parts)] = true
+	}
+
+	type candidate struct {
+		si    SuperInstruction
+		score uint64
+	}
+	candidates := map[string]*candidate{}
+	for _, seq := range stats.Sequences {
+		var ops []OpCode
+		for _, op := range seq.Instructions {
+			if parts, found := super_instructions[op]; found {
+				ops = append(ops, parts...)
+			} else {
+				ops = append(ops, op)
+			}
+		}
+		name := getSequenceName(ops)
+		if len(ops) < 2 || hand_picked[name] {
+			continue
+		}
+		si := make(SuperInstruction, 0, len(ops))
+		for _, op := range ops {
+			if evm_op, found := op_2_evm_op[op]; found {
+				si = append(si, evm_op)
+			}
+		}
+		if len(si) != len(ops) {
+			continue
+		}
+		if _, err := newSuperInstruction(si); err != nil {
+			continue
+		}
+		if candidates[name] == nil {
+			candidates[name] = &candidate{si: si}
+		}
+		candidates[name].score += seq.Count * uint64(len(ops)-1)
+	}
+
+	list := make([]*candidate, 0, len(candidates))
+	for _, c := range candidates {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].score != list[j].score {
+			return list[i].score > list[j].score
+		}
+		return list[i].si.String() < list[j].si.String()
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	res := make([]SuperInstruction, len(list))
+	for i, c := range list {
+		res[i] = c.si
+	}
+	return res
+}
@@ -0,0 +1,78 @@
+package lfvm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+func TestInstructionStatisticsExport(t *testing.T) {
+	collector := stats_collector{stats: newStatistics()}
+	for _, op := range []OpCode{PUSH1, PUSH1, ADD, PUSH1, PUSH1} {
+		collector.NextOp(op)
+	}
+	stats := collector.stats.export()
+	if stats.Steps != 5 {
+		t.Fatalf("wrong number of steps: %d", stats.Steps)
+	}
+	want := InstructionSequence{[]OpCode{PUSH1, PUSH1}, 2}
+	if !reflect.DeepEqual(stats.Sequences[1], want) {
+		t.Fatalf("wrong second sequence: have %v, want %v", stats.Sequences[1], want)
+	}
+	if n := len(stats.Sequences); n != 2+3+3+2 {
+		t.Fatalf("wrong number of sequences: %d", n)
+	}
+
+	var buffer bytes.Buffer
+	if err := stats.Write(&buffer); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if !bytes.Contains(buffer.Bytes(), []byte(`"PUSH1"`)) {
+		t.Fatalf("instructions not written by name: %s", buffer.Bytes())
+	}
+	res, err := ReadInstructionStatistics(&buffer)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !reflect.DeepEqual(res, stats) {
+		t.Fatalf("wrong statistics: have %v, want %v", res, stats)
+	}
+}
+
+func TestRankSuperInstructions(t *testing.T) {
+	stats := &InstructionStatistics{
+		Steps: 1000,
+		Sequences: []InstructionSequence{
+			{[]OpCode{SWAP1, POP}, 100},              // hand-picked
+			{[]OpCode{JUMP, PUSH1}, 50},              // jump before the end
+			{[]OpCode{JUMP_TO, PUSH1}, 50},           // not an EVM instruction
+			{[]OpCode{DUP1, ISZERO}, 30},             // 30
+			{[]OpCode{PUSH1, PUSH1, ADD}, 10},        // 20
+			{[]OpCode{PUSH1_PUSH1, ADD}, 5},          // 10 more
+			{[]OpCode{ADD}, 500},                     // single instruction
+			{[]OpCode{CALLER, PUSH1, AND, JUMPI}, 1}, // 3
+		},
+	}
+	want := []SuperInstruction{
+		{vm.DUP1, vm.ISZERO},
+		{vm.PUSH1, vm.PUSH1, vm.ADD},
+		{vm.CALLER, vm.PUSH1, vm.AND, vm.JUMPI},
+	}
+	if have := RankSuperInstructions(stats, 10); !reflect.DeepEqual(have, want) {
+		t.Errorf("wrong ranking: have %v, want %v", have, want)
+	}
+	if have := RankSuperInstructions(stats, 1); !reflect.DeepEqual(have, want[:1]) {
+		t.Errorf("wrong limited ranking: have %v, want %v", have, want[:1])
+	}
+}
+
+func TestOpCodeNamesAreUnique(t *testing.T) {
+	for op := OpCode(0); op < NUM_OPCODES; op++ {
+		var res OpCode
+		if err := res.UnmarshalText([]byte(op.String())); err != nil || res != op {
+			t.Errorf("%v can not be read from its name: %v, %v", op, res, err)
+		}
+	}
+}
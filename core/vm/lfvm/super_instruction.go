@@ -0,0 +1,503 @@
+package lfvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
+)
+
+// Besides the hand-picked super instructions of toInstructions, super
+// instructions can be generated from instruction statistics, see
+// RankSuperInstructions. A generated super instruction is converted to a
+// SUPER instruction, whose argument selects the sequence of instructions to
+// execute, followed by DATA instructions holding the data of its PUSH
+// instructions. Generated super instructions are verified against the EVM
+// before they are enabled, and are only used by the interpreters with super
+// instructions.
+
+// SuperInstruction is a sequence of EVM instructions executed by a single
+// instruction of the long-form EVM. Its text form are the names of the
+// instructions joined by underscores, e.g. PUSH1_PUSH1_ADD.
+type SuperInstruction []vm.OpCode
+
+func (s SuperInstruction) String() string {
+	names := make([]string, len(s))
+	for i, op := range s {
+		names[i] = op.String()
+	}
+	return strings.Join(names, "_")
+}
+
+func (s SuperInstruction) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *SuperInstruction) UnmarshalText(text []byte) error {
+	names := strings.Split(string(text), "_")
+	res := make(SuperInstruction, len(names))
+	for i, name := range names {
+		op := vm.StringToOp(name)
+		if op.String() != name {
+			return fmt.Errorf("unknown instruction %q in super instruction %q", name, text)
+		}
+		res[i] = op
+	}
+	*s = res
+	return nil
+}
+
+// ReadSuperInstructions reads a JSON list of super instructions, e.g.
+// ["PUSH1_PUSH1_ADD", "DUP1_ISZERO"].
+func ReadSuperInstructions(r io.Reader) ([]SuperInstruction, error) {
+	var res []SuperInstruction
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// WriteSuperInstructions writes sis as a JSON list in the form read by
+// ReadSuperInstructions.
+func WriteSuperInstructions(w io.Writer, sis []SuperInstruction) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sis)
+}
+
+// The instructions generated super instructions can be composed of, besides
+// PUSH instructions. Instructions depending on their position in the code or
+// the remaining gas, accessing the state or calling other contracts are not
+// supported.
+var super_instruction_parts = map[OpCode]func(*context){
+	POP: opPop,
+
+	ADD:        opAdd,
+	SUB:        opSub,
+	MUL:        opMul,
+	DIV:        opDiv,
+	SDIV:       opSDiv,
+	MOD:        opMod,
+	SMOD:       opSMod,
+	ADDMOD:     opAddMod,
+	MULMOD:     opMulMod,
+	EXP:        opExp,
+	SIGNEXTEND: opSignExtend,
+	SHA3:       opSha3,
+
+	LT:     opLt,
+	GT:     opGt,
+	SLT:    opSlt,
+	SGT:    opSgt,
+	EQ:     opEq,
+	ISZERO: opIszero,
+
+	AND:  opAnd,
+	OR:   opOr,
+	XOR:  opXor,
+	NOT:  opNot,
+	BYTE: opByte,
+	SHL:  opShl,
+	SHR:  opShr,
+	SAR:  opSar,
+
+	MLOAD:   opMload,
+	MSTORE:  opMstore,
+	MSTORE8: opMstore8,
+	MSIZE:   opMsize,
+
+	ADDRESS:      opAddress,
+	ORIGIN:       opOrigin,
+	CALLER:       opCaller,
+	CALLVALUE:    opCallvalue,
+	CALLDATALOAD: opCallDataload,
+	CALLDATASIZE: opCallDatasize,
+	CODESIZE:     opCodeSize,
+}
+
+// The instructions that may only end a generated super instruction.
+var final_super_instruction_parts = map[OpCode]func(*context){
+	JUMP:   opJump,
+	JUMPI:  opJumpi,
+	STOP:   opStop,
+	RETURN: opReturn,
+	REVERT: opRevert,
+}
+
+func init() {
+	for i := 0; i < 16; i++ {
+		n := i + 1
+		super_instruction_parts[DUP1+OpCode(i)] = func(c *context) { opDup(c, n) }
+		super_instruction_parts[SWAP1+OpCode(i)] = func(c *context) { opSwap(c, n) }
+	}
+	registered_super_instructions.Store([]*super_instruction{})
+	enabled_super_instructions.Store([]*super_instruction{})
+	verified_super_instruction.Store((*super_instruction)(nil))
+}
+
+type super_instruction_part struct {
+	op   OpCode
+	push int // number of bytes pushed by a PUSH instruction
+	exec func(*context)
+}
+
+// super_instruction is a generated super instruction prepared for conversion
+// and execution.
+type super_instruction struct {
+	evm_ops SuperInstruction
+	ops     []OpCode
+	parts   []super_instruction_part
+	index   uint16 // argument of the SUPER instructions
+	data    int32  // number of DATA instructions following the SUPER instruction
+}
+
+func newSuperInstruction(evm_ops SuperInstruction) (*super_instruction, error) {
+	if len(evm_ops) < 2 {
+		return nil, fmt.Errorf("super instruction %v has less than two instructions", evm_ops)
+	}
+	res := &super_instruction{evm_ops: append(SuperInstruction{}, evm_ops...)}
+	for i, evm_op := range evm_ops {
+		var part super_instruction_part
+		if vm.PUSH1 <= evm_op && evm_op <= vm.PUSH32 {
+			n := int(evm_op-vm.PUSH1) + 1
+			part = super_instruction_part{op: PUSH1 + OpCode(n-1), push: n}
+			res.data += int32(n/2 + n%2)
+		} else {
+			op, found := op_2_op[evm_op]
+			if !found {
+				return nil, fmt.Errorf("%v is not supported in super instruction %v", evm_op, evm_ops)
+			}
+			exec := super_instruction_parts[op]
+			if i == len(evm_ops)-1 && exec == nil {
+				exec = final_super_instruction_parts[op]
+			}
+			if exec == nil {
+				return nil, fmt.Errorf("%v is not supported in super instruction %v", evm_op, evm_ops)
+			}
+			part = super_instruction_part{op: op, exec: exec}
+		}
+		res.ops = append(res.ops, part.op)
+		res.parts = append(res.parts, part)
+	}
+	return res, nil
+}
+
+// convert converts the instructions at pos in code if they match the super
+// instruction. Like toInstructions, it returns the number of bytes of code
+// converted in addition to the one at pos.
+func (s *super_instruction) convert(pos int, code []byte) ([]Instruction, int, bool) {
+	end := pos
+	for _, op := range s.evm_ops {
+		if end >= len(code) || vm.OpCode(code[end]) != op {
+			return nil, 0, false
+		}
+		end++
+		if vm.PUSH1 <= op && op <= vm.PUSH32 {
+			end += int(op-vm.PUSH1) + 1
+		}
+	}
+	if end > len(code) {
+		return nil, 0, false
+	}
+
+	// Pack the data of each PUSH instruction in pairs into DATA instructions.
+	res := make([]Instruction, 1, 1+s.data)
+	res[0] = Instruction{opcode: SUPER, arg: s.index}
+	data := pos
+	for _, part := range s.parts {
+		data++
+		for i := 0; i < part.push; i += 2 {
+			arg := uint16(code[data+i]) << 8
+			if i+1 < part.push {
+				arg |= uint16(code[data+i+1])
+			}
+			res = append(res, Instruction{opcode: DATA, arg: arg})
+		}
+		data += part.push
+	}
+	return res, end - pos - 1, true
+}
+
+// opSuper executes the instructions of a generated super instruction. The
+// static gas of each instruction is charged before it is executed, as the
+// EVM does.
+func opSuper(c *context) {
+	si := getSuperInstruction(c.code[c.pc].arg)
+	end := c.pc + si.data
+	for i, part := range si.parts {
+		price := c.static_gas[part.op]
+		if price == UNDEFINED_GAS_PRICE {
+			opInvalid(c)
+			return
+		}
+		if !c.UseGas(price) {
+			return
+		}
+		if part.push > 0 {
+			// opPush continues at the last DATA instruction of the PUSH
+			c.pc++
+			opPush(c, part.push)
+		} else {
+			if i == len(si.parts)-1 {
+				c.pc = end
+			}
+			part.exec(c)
+		}
+		if c.status != RUNNING {
+			return
+		}
+	}
+}
+
+// getParts returns the instructions of the EVM instructions executed by the
+// given instruction.
+func getParts(instruction Instruction) []OpCode {
+	if instruction.opcode == SUPER {
+		return getSuperInstruction(instruction.arg).ops
+	}
+	if parts, found := super_instructions[instruction.opcode]; found {
+		return parts
+	}
+	return []OpCode{instruction.opcode}
+}
+
+var (
+	super_instructions_lock sync.Mutex
+
+	// All generated super instructions registered so far, indexed by the
+	// argument of SUPER instructions. Super instructions are never removed,
+	// since converted code may refer to them.
+	registered_super_instructions atomic.Value // []*super_instruction
+
+	// The generated super instructions used by the converter, longest first.
+	enabled_super_instructions atomic.Value // []*super_instruction
+
+	// The super instruction being verified, with the index following the
+	// registered ones. It is only registered if it passes the verification.
+	verified_super_instruction atomic.Value // *super_instruction
+)
+
+func getSuperInstruction(index uint16) *super_instruction {
+	registered := registered_super_instructions.Load().([]*super_instruction)
+	if int(index) < len(registered) {
+		return registered[index]
+	}
+	return verified_super_instruction.Load().(*super_instruction)
+}
+
+func enabledSuperInstructions() []*super_instruction {
+	return enabled_super_instructions.Load().([]*super_instruction)
+}
+
+func registerSuperInstruction(evm_ops SuperInstruction) (*super_instruction, error) {
+	super_instructions_lock.Lock()
+	defer super_instructions_lock.Unlock()
+
+	si, err := getOrCreateSuperInstruction(evm_ops)
+	if err != nil {
+		return nil, err
+	}
+	registered := registered_super_instructions.Load().([]*super_instruction)
+	if int(si.index) == len(registered) {
+		registered_super_instructions.Store(append(registered[:len(registered):len(registered)], si))
+	}
+	return si, nil
+}
+
+// EnableSuperInstructions verifies the given generated super instructions
+// and enables them for the interpreters with super instructions, replacing
+// the ones enabled before. If any of them fails the verification, none is
+// enabled. Converted code is removed from the cache.
+func EnableSuperInstructions(sis []SuperInstruction) error {
+	// only verified super instructions are registered
+	for _, evm_ops := range sis {
+		if err := VerifySuperInstruction(evm_ops); err != nil {
+			return err
+		}
+	}
+	enabled := make([]*super_instruction, 0, len(sis))
+	for _, evm_ops := range sis {
+		si, err := registerSuperInstruction(evm_ops)
+		if err != nil {
+			return err
+		}
+		enabled = append(enabled, si)
+	}
+	sort.SliceStable(enabled, func(i, j int) bool { return len(enabled[i].evm_ops) > len(enabled[j].evm_ops) })
+	enabled_super_instructions.Store(enabled)
+	ClearConversionCache()
+	return nil
+}
+
+// EnabledSuperInstructions returns the enabled generated super instructions.
+func EnabledSuperInstructions() []SuperInstruction {
+	enabled := enabledSuperInstructions()
+	res := make([]SuperInstruction, len(enabled))
+	for i, si := range enabled {
+		res[i] = si.evm_ops
+	}
+	return res
+}
+
+// The number of values on the stack when a super instruction is verified,
+// enough for DUP16 and SWAP16.
+const verification_stack_size = 24
+
+// The first mainnet blocks of the hard-forks super instructions are verified
+// with.
+var verification_blocks = []uint64{1, 1150000, 2463000, 2675000, 4370000, 7280000, 9069000, 12244000, 12965000}
+
+// The values on the stack and pushed by a verified super instruction, given
+// their position and the position of a jump destination after the super
+// instruction.
+var verification_values = []func(i int, dest uint64) *uint256.Int{
+	func(i int, dest uint64) *uint256.Int { return uint256.NewInt(0) },
+	func(i int, dest uint64) *uint256.Int { return uint256.NewInt(uint64(i + 1)) },
+	func(i int, dest uint64) *uint256.Int { return uint256.NewInt(dest) },
+	func(i int, dest uint64) *uint256.Int {
+		return new(uint256.Int).Sub(new(uint256.Int).SetAllOne(), uint256.NewInt(uint64(i)))
+	},
+	func(i int, dest uint64) *uint256.Int {
+		if i%2 == 0 {
+			return uint256.NewInt(dest)
+		}
+		return new(uint256.Int).Lsh(uint256.NewInt(1), uint(255-i))
+	},
+}
+
+// The shadow EVM state is shared by all shadow runs.
+var verification_lock sync.Mutex
+
+// VerifySuperInstruction checks that a generated super instruction behaves
+// like its EVM instructions. It is executed with a range of stack values and
+// push data in every hard-fork, and the state of the interpreter is compared
+// with the state of a shadow EVM after every step.
+func VerifySuperInstruction(evm_ops SuperInstruction) error {
+	// no super instruction is registered during the verification, so the
+	// index of an unregistered one stays unused
+	super_instructions_lock.Lock()
+	defer super_instructions_lock.Unlock()
+
+	verification_lock.Lock()
+	defer verification_lock.Unlock()
+
+	si, err := getOrCreateSuperInstruction(evm_ops)
+	if err != nil {
+		return err
+	}
+	verified_super_instruction.Store(si)
+	defer verified_super_instruction.Store((*super_instruction)(nil))
+
+	for _, value := range verification_values {
+		code := getVerificationCode(evm_ops, value)
+		converted, _, err := convertWithSuperInstructions(code, false, []*super_instruction{si})
+		if err != nil {
+			return err
+		}
+		used := false
+		for _, instruction := range converted {
+			used = used || instruction == Instruction{opcode: SUPER, arg: si.index}
+		}
+		if !used {
+			return fmt.Errorf("super instruction %v not converted", evm_ops)
+		}
+		for _, block := range verification_blocks {
+			if err := runWithShadowEvm(code, converted, block); err != nil {
+				return fmt.Errorf("super instruction %v diverges from the EVM in block %d: %v", evm_ops, block, err)
+			}
+		}
+	}
+	return nil
+}
+
+// getOrCreateSuperInstruction returns the registered super instruction of
+// evm_ops or a new, unregistered one with the index following the registered
+// ones. The caller must hold super_instructions_lock.
+func getOrCreateSuperInstruction(evm_ops SuperInstruction) (*super_instruction, error) {
+	registered := registered_super_instructions.Load().([]*super_instruction)
+	for _, si := range registered {
+		if si.evm_ops.String() == evm_ops.String() {
+			return si, nil
+		}
+	}
+	si, err := newSuperInstruction(evm_ops)
+	if err != nil {
+		return nil, err
+	}
+	if len(registered) > math.MaxUint16 {
+		return nil, fmt.Errorf("too many super instructions")
+	}
+	si.index = uint16(len(registered))
+	return si, nil
+}
+
+// getVerificationCode returns code pushing the values for the stack, then
+// executing the instructions of the super instruction and stopping. Jumps
+// are valid if they target the jump destination at the end of the code.
+func getVerificationCode(evm_ops SuperInstruction, value func(i int, dest uint64) *uint256.Int) []byte {
+	dest := verification_stack_size * 33
+	for _, op := range evm_ops {
+		dest++
+		if vm.PUSH1 <= op && op <= vm.PUSH32 {
+			dest += int(op-vm.PUSH1) + 1
+		}
+	}
+	dest++ // the STOP after the super instruction
+
+	code := make([]byte, 0, dest+2)
+	for i := 0; i < verification_stack_size; i++ {
+		data := value(i, uint64(dest)).Bytes32()
+		code = append(code, byte(vm.PUSH32))
+		code = append(code, data[:]...)
+	}
+	for i, op := range evm_ops {
+		code = append(code, byte(op))
+		if vm.PUSH1 <= op && op <= vm.PUSH32 {
+			data := value(verification_stack_size+i, uint64(dest)).Bytes32()
+			code = append(code, data[32-(int(op-vm.PUSH1)+1):]...)
+		}
+	}
+	return append(code, byte(vm.STOP), byte(vm.JUMPDEST), byte(vm.STOP))
+}
+
+// runWithShadowEvm runs converted code with a shadow EVM in the given
+// mainnet block and returns an error if their states diverge.
+func runWithShadowEvm(code []byte, converted Code, block uint64) (err error) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil, nil)
+	cfg := &runtime.Config{
+		ChainConfig: params.MainnetChainConfig,
+		BlockNumber: new(big.Int).SetUint64(block),
+		Time:        new(big.Int),
+		Difficulty:  new(big.Int),
+		GasLimit:    1000000,
+		BaseFee:     new(big.Int),
+		State:       statedb,
+	}
+	address := common.BytesToAddress([]byte("super"))
+	contract := vm.NewContract(vm.AccountRef(cfg.Origin), vm.AccountRef(address), new(big.Int), cfg.GasLimit)
+	contract.SetCallCode(&address, crypto.Keccak256Hash(code), code)
+
+	// divergences are reported by panics
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	runCode(runtime.NewEnv(cfg), vm.Config{}, contract, converted, nil, false, statedb, true, ioutil.Discard, false)
+	return nil
+}
@@ -0,0 +1,210 @@
+package lfvm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestHandPickedSuperInstructionsMatchEvm(t *testing.T) {
+	for op, parts := range super_instructions {
+		si := make(SuperInstruction, len(parts))
+		for i, part := range parts {
+			si[i] = op_2_evm_op[part]
+		}
+		for _, value := range verification_values {
+			code := getVerificationCode(si, value)
+			converted, err := convert(code, true)
+			if err != nil {
+				t.Fatalf("failed to convert %v: %v", si, err)
+			}
+			for _, block := range verification_blocks {
+				if err := runWithShadowEvm(code, converted, block); err != nil {
+					t.Errorf("%v diverges from the EVM in block %d: %v", op, block, err)
+				}
+			}
+		}
+	}
+}
+
+func TestGeneratedSuperInstructionsMatchEvm(t *testing.T) {
+	sis := []SuperInstruction{
+		{vm.PUSH1, vm.PUSH1, vm.ADD},
+		{vm.DUP1, vm.ISZERO, vm.PUSH2, vm.JUMPI},
+		{vm.SWAP3, vm.SWAP1, vm.POP, vm.JUMP},
+		{vm.PUSH32, vm.DUP2, vm.MSTORE},
+		{vm.DUP16, vm.SWAP16, vm.SHL},
+		{vm.PUSH3, vm.PUSH1, vm.SHA3, vm.CALLDATASIZE, vm.RETURN},
+		{vm.CALLDATALOAD, vm.PUSH1, vm.SHR, vm.STOP},
+	}
+	for _, si := range sis {
+		if err := VerifySuperInstruction(si); err != nil {
+			t.Errorf("verification of %v failed: %v", si, err)
+		}
+	}
+
+	unsupported := []SuperInstruction{
+		{vm.POP},
+		{vm.JUMP, vm.POP},
+		{vm.PUSH1, vm.SSTORE},
+		{vm.PC, vm.ADD},
+		{vm.GAS, vm.CALL},
+		{vm.JUMPDEST, vm.POP},
+	}
+	for _, si := range unsupported {
+		if err := VerifySuperInstruction(si); err == nil {
+			t.Errorf("unsupported super instruction %v verified", si)
+		}
+	}
+}
+
+func TestEnabledSuperInstructionsAreConverted(t *testing.T) {
+	defer EnableSuperInstructions(nil)
+
+	si := SuperInstruction{vm.PUSH1, vm.PUSH2, vm.ADD}
+	if err := EnableSuperInstructions([]SuperInstruction{si}); err != nil {
+		t.Fatalf("failed to enable super instructions: %v", err)
+	}
+	if enabled := EnabledSuperInstructions(); !reflect.DeepEqual(enabled, []SuperInstruction{si}) {
+		t.Fatalf("wrong super instructions enabled: %v", enabled)
+	}
+
+	code := []byte{
+		byte(vm.PUSH1), 0x01, byte(vm.PUSH2), 0x02, 0x03, byte(vm.ADD),
+		byte(vm.PUSH1), 0x00, byte(vm.MSTORE),
+		byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0x00, byte(vm.RETURN),
+	}
+	converted, err := Convert(code, crypto.Keccak256Hash(code), true)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if converted[0].opcode != SUPER || converted[1] != (Instruction{DATA, 0x0100}) || converted[2] != (Instruction{DATA, 0x0203}) {
+		t.Fatalf("super instruction not converted:\n%v", converted)
+	}
+
+	want, _, _ := runtime.Execute(code, nil, &runtime.Config{})
+	have, _, err := runtime.Execute(code, nil, &runtime.Config{EVMConfig: vm.Config{InterpreterImpl: "lfvm-si"}})
+	if err != nil || !bytes.Equal(have, want) {
+		t.Fatalf("wrong result: have %x, %v, want %x", have, err, want)
+	}
+
+	// disabled super instructions are not converted any more
+	if err := EnableSuperInstructions(nil); err != nil {
+		t.Fatalf("failed to disable super instructions: %v", err)
+	}
+	if converted, _ := Convert(code, crypto.Keccak256Hash(code), true); converted[0].opcode == SUPER {
+		t.Fatalf("disabled super instruction converted")
+	}
+}
+
+func TestEnableSuperInstructionsRejectsUnsupported(t *testing.T) {
+	defer EnableSuperInstructions(nil)
+
+	err := EnableSuperInstructions([]SuperInstruction{{vm.PUSH1, vm.ADD}, {vm.PUSH1, vm.SLOAD}})
+	if err == nil {
+		t.Fatalf("unsupported super instruction enabled")
+	}
+	if enabled := EnabledSuperInstructions(); len(enabled) != 0 {
+		t.Fatalf("super instructions enabled despite error: %v", enabled)
+	}
+}
+
+func TestRejectedSuperInstructionsAreNotRegistered(t *testing.T) {
+	defer EnableSuperInstructions(nil)
+
+	registered := len(registered_super_instructions.Load().([]*super_instruction))
+	if err := VerifySuperInstruction(SuperInstruction{vm.PUSH2, vm.PUSH3, vm.XOR}); err != nil {
+		t.Fatalf("verification failed: %v", err)
+	}
+	err := EnableSuperInstructions([]SuperInstruction{{vm.PUSH3, vm.PUSH2, vm.XOR}, {vm.PUSH1, vm.SLOAD}})
+	if err == nil {
+		t.Fatalf("unsupported super instruction enabled")
+	}
+	if have := len(registered_super_instructions.Load().([]*super_instruction)); have != registered {
+		t.Fatalf("super instructions registered without being enabled: have %d, want %d", have, registered)
+	}
+
+	if err := EnableSuperInstructions([]SuperInstruction{{vm.PUSH3, vm.PUSH2, vm.XOR}}); err != nil {
+		t.Fatalf("failed to enable super instructions: %v", err)
+	}
+	if have := len(registered_super_instructions.Load().([]*super_instruction)); have != registered+1 {
+		t.Fatalf("enabled super instruction not registered: have %d, want %d", have, registered+1)
+	}
+}
+
+func TestSuperInstructionsJSON(t *testing.T) {
+	sis := []SuperInstruction{{vm.PUSH1, vm.PUSH1, vm.ADD}, {vm.DUP1, vm.ISZERO}}
+	var buffer bytes.Buffer
+	if err := WriteSuperInstructions(&buffer, sis); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if !bytes.Contains(buffer.Bytes(), []byte(`"PUSH1_PUSH1_ADD"`)) {
+		t.Fatalf("wrong JSON: %s", buffer.Bytes())
+	}
+	res, err := ReadSuperInstructions(&buffer)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !reflect.DeepEqual(res, sis) {
+		t.Fatalf("wrong super instructions: have %v, want %v", res, sis)
+	}
+
+	if _, err := ReadSuperInstructions(bytes.NewBufferString(`["PUSH1_FOO"]`)); err == nil {
+		t.Fatalf("unknown instruction accepted")
+	}
+}
+
+func TestShadowEvmFollowsJumps(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH2), 0x00, 0x04, byte(vm.JUMP), // PUSH2_JUMP
+		byte(vm.JUMPDEST), // 4
+		byte(vm.PUSH1), 0x01, byte(vm.PUSH2), 0x00, 0x0c, byte(vm.JUMPI),
+		byte(vm.INVALID),
+		byte(vm.JUMPDEST), // 12
+		byte(vm.PUSH1), 0x13, byte(vm.PUSH1), 0x00, byte(vm.SWAP1), byte(vm.JUMP),
+		byte(vm.JUMPDEST), // 19
+		byte(vm.STOP),
+	}
+	for _, interpreter := range []string{"lfvm-dbg", "lfvm-si-dbg"} {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s diverged from the shadow EVM: %v", interpreter, r)
+				}
+			}()
+			if _, _, err := runtime.Execute(code, nil, &runtime.Config{EVMConfig: vm.Config{InterpreterImpl: interpreter}}); err != nil {
+				t.Errorf("%s failed: %v", interpreter, err)
+			}
+		}()
+	}
+}
+
+func TestShadowEvmComparesWholeStack(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH1), 0x01, byte(vm.PUSH1), 0x01, byte(vm.PUSH1), 0x02, byte(vm.PUSH1), 0x03,
+		byte(vm.SWAP2),
+		byte(vm.STOP),
+	}
+	converted, err := convert(code, false)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if err := runWithShadowEvm(code, converted, 0); err != nil {
+		t.Fatalf("converted code diverges from the EVM: %v", err)
+	}
+
+	// SWAP3 has the same gas and top of the stack, only a deeper slot differs
+	scrambled := append(Code{}, converted...)
+	for i := range scrambled {
+		if scrambled[i].opcode == SWAP2 {
+			scrambled[i].opcode = SWAP3
+		}
+	}
+	if err := runWithShadowEvm(code, scrambled, 0); err == nil {
+		t.Errorf("divergence below the top of the stack not detected")
+	}
+}
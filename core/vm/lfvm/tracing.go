@@ -0,0 +1,170 @@
+package lfvm
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// Tracers observe EVM instructions. Traced code is therefore converted with a
+// map to EVM program counters. Traced code with super instructions is
+// converted without them as well, to run the parts of a super instruction one
+// by one for the tracer.
+type traced_code struct {
+	code   Code
+	pc_map []int32
+}
+
+var traced_cache, _ = lru.New(256)
+
+func convertForTracing(code []byte, code_hash common.Hash, with_super_instructions bool) (Code, []int32, error) {
+	if code_hash == (common.Hash{}) {
+		code_hash = crypto.Keccak256Hash(code)
+	}
+	key := cache_key{code_hash, with_super_instructions}
+	if res, exists := traced_cache.Get(key); exists {
+		traced := res.(traced_code)
+		return traced.code, traced.pc_map, nil
+	}
+	res, pc_map, err := convertWithPcMap(code, with_super_instructions)
+	if err != nil {
+		return nil, nil, err
+	}
+	traced_cache.Add(key, traced_code{res, pc_map})
+	return res, pc_map, nil
+}
+
+// stepError returns the error a step terminated the execution with, or nil.
+func stepError(c *context) error {
+	switch c.status {
+	case REVERTED:
+		return vm.ErrExecutionReverted
+	case OUT_OF_GAS:
+		return vm.ErrOutOfGas
+	case INVALID_INSTRUCTION:
+		return vm.ErrInvalidCode
+	case ERROR:
+		if c.err != nil {
+			return c.err
+		}
+		return fmt.Errorf("unspecified error in interpreter")
+	}
+	return nil
+}
+
+// runWithTracer runs the interpreter and reports every EVM instruction,
+// including the JUMPDEST executed as part of a jump, to the tracer of the VM
+// config. The gas cost reported to CaptureState is the static gas of the
+// instruction and the memory is reported before it is expanded by the
+// instruction; dynamic gas is reflected by the gas of the next step.
+func runWithTracer(c *context, tracer vm.Tracer) {
+	// like the EVM, do not trace contracts without code
+	if len(c.contract.Code) == 0 {
+		run(c)
+		return
+	}
+	for c.status == RUNNING {
+		skipJumpTo(c)
+		if int(c.pc) < len(c.code) && len(getParts(c.code[c.pc])) > 1 {
+			traceSuperInstruction(c, tracer)
+		} else {
+			traceStep(c, tracer)
+		}
+	}
+}
+
+// skipJumpTo executes the JUMP_TO instructions at c.pc, which are not EVM
+// instructions.
+func skipJumpTo(c *context) {
+	for int(c.pc) < len(c.code) && c.code[c.pc].opcode == JUMP_TO {
+		step(c)
+	}
+}
+
+// traceStep executes the instruction at c.pc, which is a single EVM
+// instruction, and reports it to the tracer. It returns whether the
+// instruction failed.
+func traceStep(c *context, tracer vm.Tracer) bool {
+	// the EVM stops at the end of the code
+	pc, op, cost := uint64(len(c.contract.Code)), vm.STOP, uint64(0)
+	if int(c.pc) < len(c.code) {
+		pc = uint64(c.pc_map[c.pc])
+		op = vm.OpCode(c.contract.Code[pc])
+		if cost = getGasPrice(c); cost == UNDEFINED_GAS_PRICE {
+			cost = 0
+		}
+	}
+	gas := c.contract.Gas
+	tracer.CaptureState(c.evm, pc, op, gas, cost, tracingScope(c), c.return_data, c.evm.Depth, nil)
+
+	next := c.pc + 1
+	step(c)
+
+	if err := stepError(c); err != nil {
+		tracer.CaptureFault(c.evm, pc, op, gas, cost, tracingScope(c), c.evm.Depth, err)
+		return true
+	}
+	// a jump executes the JUMPDEST at its destination in the same step
+	if (op == vm.JUMP || op == vm.JUMPI) && c.pc != next {
+		dest := c.pc - 1
+		tracer.CaptureState(c.evm, uint64(c.pc_map[dest]), vm.JUMPDEST, c.contract.Gas+1, 1, tracingScope(c), c.return_data, c.evm.Depth, nil)
+	}
+	return false
+}
+
+// traceSuperInstruction executes the super instruction at c.pc and reports
+// each of its EVM instructions to the tracer. The intermediate states only
+// exist if the parts are executed one by one, so they are traced on a copy of
+// the context running the code converted without super instructions before c
+// executes the super instruction.
+func traceSuperInstruction(c *context, tracer vm.Tracer) {
+	code, pc_map, err := convertForTracing(c.contract.Code, c.contract.CodeHash, false)
+	if err != nil {
+		// the code was converted with super instructions, so this is a bug
+		panic(fmt.Sprintf("failed to convert traced code: %v", err))
+	}
+	parts := copyContext(c)
+	defer ReturnStack(parts.stack)
+	parts.code, parts.pc_map = code, pc_map
+	evm_pc := c.pc_map[c.pc]
+	parts.pc = int32(sort.Search(len(pc_map), func(i int) bool { return pc_map[i] >= evm_pc }))
+
+	faulted := false
+	for i := len(getParts(c.code[c.pc])); i > 0 && !faulted && parts.status == RUNNING; i-- {
+		skipJumpTo(parts)
+		faulted = traceStep(parts, tracer)
+	}
+
+	pc, op, gas := uint64(evm_pc), vm.OpCode(c.contract.Code[evm_pc]), c.contract.Gas
+	step(c)
+	if err := stepError(c); err != nil && !faulted {
+		tracer.CaptureFault(c.evm, pc, op, gas, 0, tracingScope(c), c.evm.Depth, err)
+	}
+}
+
+// copyContext returns a copy of c with its own stack, memory and contract gas.
+func copyContext(c *context) *context {
+	res := *c
+	res.stack = NewStack()
+	res.stack.data = c.stack.data
+	res.stack.stack_ptr = c.stack.stack_ptr
+	res.memory = &Memory{
+		store:             append([]byte(nil), c.memory.store...),
+		total_memory_cost: c.memory.total_memory_cost,
+	}
+	contract := *c.contract
+	res.contract = &contract
+	return &res
+}
+
+func tracingScope(c *context) *vm.ScopeContext {
+	return &vm.ScopeContext{
+		Memory:   vm.NewMemoryOf(c.memory.Data()),
+		Stack:    vm.NewStackOf(c.stack.Data()),
+		Contract: c.contract,
+	}
+}
@@ -0,0 +1,124 @@
+package lfvm
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+)
+
+// stepRecorder records the steps and faults reported to a tracer.
+type stepRecorder struct {
+	steps  []string
+	faults []string
+	starts int
+	ends   int
+}
+
+func (r *stepRecorder) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	r.starts++
+}
+
+func (r *stepRecorder) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	r.steps = append(r.steps, fmt.Sprintf("%d %v gas=%d depth=%d stack=%v", pc, op, gas, depth, scope.Stack.Data()))
+}
+
+func (r *stepRecorder) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+
+func (r *stepRecorder) CaptureExit(output []byte, gasUsed uint64, err error) {}
+
+func (r *stepRecorder) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+	r.faults = append(r.faults, fmt.Sprintf("%d %v %v", pc, op, err))
+}
+
+func (r *stepRecorder) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) {
+	r.ends++
+}
+
+func TestTracerReportsEvmProgramCounters(t *testing.T) {
+	codes := map[string][]byte{
+		"jumps": {
+			byte(vm.PUSH1), 0x02, byte(vm.PUSH1), 0x03, // PUSH1_PUSH1 with super instructions
+			byte(vm.ADD),
+			byte(vm.PUSH2), 0x00, 0x0a, byte(vm.JUMP), // PUSH2_JUMP
+			byte(vm.INVALID),
+			byte(vm.JUMPDEST), // 10
+			byte(vm.DUP1),
+			byte(vm.ISZERO), byte(vm.PUSH2), 0x00, 0x19, byte(vm.JUMPI), // ISZERO_PUSH2_JUMPI
+			byte(vm.PUSH1), 0x00,
+			byte(vm.MSTORE),
+			byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0x00,
+			byte(vm.RETURN),
+			byte(vm.JUMPDEST), // 25
+			byte(vm.STOP),
+		},
+		"revert": {byte(vm.PUSH1), 0x00, byte(vm.DUP1), byte(vm.REVERT)},
+		"end":    {byte(vm.PUSH1), 0x01, byte(vm.PUSH1), 0x02, byte(vm.ADD)},
+		"jump":   {byte(vm.PUSH1), 0x05, byte(vm.JUMP)},
+	}
+	for name, code := range codes {
+		want := &stepRecorder{}
+		runtime.Execute(code, nil, &runtime.Config{EVMConfig: vm.Config{Debug: true, Tracer: want}})
+		if len(want.steps) == 0 {
+			t.Fatalf("%s: no steps traced by geth", name)
+		}
+
+		for _, interpreter := range []string{"lfvm", "lfvm-si"} {
+			have := &stepRecorder{}
+			runtime.Execute(code, nil, &runtime.Config{EVMConfig: vm.Config{Debug: true, Tracer: have, InterpreterImpl: interpreter}})
+			if !reflect.DeepEqual(have.steps, want.steps) {
+				t.Errorf("%s: %s traced wrong steps:\nhave %q\nwant %q", name, interpreter, have.steps, want.steps)
+			}
+			if !reflect.DeepEqual(have.faults, want.faults) {
+				t.Errorf("%s: %s traced wrong faults:\nhave %q\nwant %q", name, interpreter, have.faults, want.faults)
+			}
+			if have.starts != 1 || have.ends != 1 {
+				t.Errorf("%s: %s traced %d starts and %d ends", name, interpreter, have.starts, have.ends)
+			}
+		}
+	}
+}
+
+func TestTracerReportsPartsOfSuperInstructions(t *testing.T) {
+	defer EnableSuperInstructions(nil)
+	if err := EnableSuperInstructions([]SuperInstruction{{vm.PUSH1, vm.PUSH1, vm.MSTORE}}); err != nil {
+		t.Fatalf("failed to enable super instructions: %v", err)
+	}
+
+	code := []byte{
+		byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0x00, byte(vm.MSTORE), // generated super instruction
+		byte(vm.PUSH1), 0x02, byte(vm.PUSH1), 0x03, byte(vm.ADD), // PUSH1_PUSH1_ADD
+		byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0x00, byte(vm.RETURN),
+	}
+	converted, _, err := convertForTracing(code, common.Hash{}, true)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if len(getParts(converted[0])) != 3 || converted[0].opcode != SUPER {
+		t.Fatalf("traced code not converted with super instructions:\n%v", converted)
+	}
+
+	// running out of gas in each part of the super instructions, faults are
+	// compared with lfvm as geth reports them with CaptureState
+	for gas := uint64(0); gas <= 30; gas++ {
+		want := &stepRecorder{}
+		runtime.Execute(code, nil, &runtime.Config{GasLimit: gas, EVMConfig: vm.Config{Debug: true, Tracer: want}})
+		plain := &stepRecorder{}
+		runtime.Execute(code, nil, &runtime.Config{GasLimit: gas, EVMConfig: vm.Config{Debug: true, Tracer: plain, InterpreterImpl: "lfvm"}})
+
+		have := &stepRecorder{}
+		runtime.Execute(code, nil, &runtime.Config{GasLimit: gas, EVMConfig: vm.Config{Debug: true, Tracer: have, InterpreterImpl: "lfvm-si"}})
+		if !reflect.DeepEqual(have.steps, want.steps) {
+			t.Errorf("gas %d: traced wrong steps:\nhave %q\nwant %q", gas, have.steps, want.steps)
+		}
+		if !reflect.DeepEqual(have.faults, plain.faults) {
+			t.Errorf("gas %d: traced wrong faults:\nhave %q\nwant %q", gas, have.faults, plain.faults)
+		}
+	}
+}
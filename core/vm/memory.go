@@ -33,6 +33,12 @@ func NewMemory() *Memory {
 	return &Memory{}
 }
 
+// NewMemoryOf returns a memory model backed by store. It lets other
+// interpreter implementations present their memory to a Tracer.
+func NewMemoryOf(store []byte) *Memory {
+	return &Memory{store: store}
+}
+
 // Set sets offset + size to value
 func (m *Memory) Set(offset, size uint64, value []byte) {
 	// It's possible the offset is greater than 0 and size equals 0. This is because
@@ -17,40 +17,67 @@
 package vm
 
 import (
-	"context"
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
-	"log"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 // Micro-Profiling data record for a single smart contract invocation
 type MicroProfileData struct {
+	Function             ContractFunction         // function of the contract invoked
 	OpCodeFrequency      map[OpCode]uint64        // opcode frequency stats
 	OpCodeDuration       map[OpCode]time.Duration // opcode durations stats
+	OpCodeGas            map[OpCode]uint64        // opcode gas stats
 	InstructionFrequency map[uint64]uint64        // instruction frequency stats
 	StepLength           int                      // number of executed instructions
 }
 
-// Micro-profiling statistic
-type MicroProfileStatistic struct {
-	opCodeFrequency      map[OpCode]uint64 // opcode frequency statistics
-	opCodeDuration       map[OpCode]uint64 // accumulated duration of opcodes
-	instructionFrequency map[uint64]uint64 // instruction frequency statistics
-	stepLengthFrequency  map[int]uint64    // smart contract length frequency
+// ContractFunction identifies the function of a contract entered by an
+// invocation: the address and hash of the executed code and the 4-byte
+// selector of the call in hex, which is empty for creations and calls with
+// less than 4 bytes of input.
+type ContractFunction struct {
+	Contract common.Address
+	CodeHash common.Hash
+	Selector string
 }
 
-// Micro profiling flag controlled by cli
-var MicroProfiling bool
+// Profile of the invocations of a contract function
+type FunctionProfile struct {
+	Calls        uint64        // number of invocations
+	Instructions uint64        // number of executed instructions
+	Gas          uint64        // gas used, excluding nested calls
+	Duration     time.Duration // duration, excluding nested calls
+}
 
-// Buffer size for micro-profiling channel
-var MicroProfilingBufferSize int
+// Profile of an opcode in the invocations of a contract function
+type FunctionOpCodeProfile struct {
+	Frequency uint64        // number of executions
+	Gas       uint64        // gas used, excluding nested calls
+	Duration  time.Duration // duration, excluding nested calls
+}
 
-// Name of micro-profiling SQLITE3 database
-var MicroProfilingDB string
+// Key of the opcode statistics of a contract function
+type functionOpCodeKey struct {
+	function ContractFunction
+	opCode   OpCode
+}
 
-// Micro-Profiling channel
-var mpChannel chan *MicroProfileData = make(chan *MicroProfileData, MicroProfilingBufferSize)
+// Micro-profiling statistic
+type MicroProfileStatistic struct {
+	opCodeFrequency      map[OpCode]uint64                           // opcode frequency statistics
+	opCodeDuration       map[OpCode]uint64                           // accumulated duration of opcodes
+	instructionFrequency map[uint64]uint64                           // instruction frequency statistics
+	stepLengthFrequency  map[int]uint64                              // smart contract length frequency
+	functions            map[ContractFunction]FunctionProfile        // contract function statistics
+	functionOpCodes      map[functionOpCodeKey]FunctionOpCodeProfile // opcode statistics of contract functions
+}
 
 // Create new micro-profiling statistic
 func NewMicroProfileStatistic() *MicroProfileStatistic {
@@ -59,50 +86,185 @@ func NewMicroProfileStatistic() *MicroProfileStatistic {
 	p.opCodeDuration = make(map[OpCode]uint64)
 	p.instructionFrequency = make(map[uint64]uint64)
 	p.stepLengthFrequency = make(map[int]uint64)
+	p.functions = make(map[ContractFunction]FunctionProfile)
+	p.functionOpCodes = make(map[functionOpCodeKey]FunctionOpCodeProfile)
 	return p
 }
 
-// The data collector checks for a stopping signal and processes
-// the workers' records via a channel. A data collector is a background task.
-func MicroProfilingCollector(ctx context.Context, done chan struct{}, mps *MicroProfileStatistic) {
-	defer close(done)
-	for {
-		select {
+// ProfileCollectorConfig configures the collectors of profiling data records.
+type ProfileCollectorConfig struct {
+	Shards     int // number of goroutines aggregating records, at least one
+	BufferSize int // capacity of the channel of every shard
+}
 
-		// receive a new data record from a worker?
-		case mpd := <- mpChannel:
-			// process the data record and update the statistic
+// ErrProfileCollectorNotRunning is returned for records processed by a
+// collector that is not started or already stopped.
+var ErrProfileCollectorNotRunning = errors.New("profile collector not running")
+
+// MicroProfileCollector is the profiler of the micro-profiling. It sends a
+// micro-profiling data record for every execution of contract code to one
+// of its shards, each aggregating the records it receives in a background
+// goroutine. A collector is started before and stopped after profiling.
+type MicroProfileCollector struct {
+	config   ProfileCollectorConfig
+	channels []chan *MicroProfileData
+	shards   []*MicroProfileStatistic
+	next     uint32 // shard of the next record
+	wg       sync.WaitGroup
+	lock     sync.RWMutex // held for writing while starting and stopping
+	running  bool
+}
 
-			// update op-code frequency
-			for opCode, freq := range mpd.OpCodeFrequency {
-				mps.opCodeFrequency[opCode] += freq
-			}
+// NewMicroProfileCollector creates a collector with the given configuration.
+func NewMicroProfileCollector(config ProfileCollectorConfig) *MicroProfileCollector {
+	if config.Shards < 1 {
+		config.Shards = 1
+	}
+	return &MicroProfileCollector{config: config}
+}
 
-			// update op-code duration
-			for opCode, duration := range mpd.OpCodeDuration {
-				mps.opCodeDuration[opCode] += uint64(duration)
+// Start starts the shards aggregating the data records. A running collector
+// is not restarted.
+func (c *MicroProfileCollector) Start() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.running {
+		return
+	}
+	c.running = true
+	c.channels = make([]chan *MicroProfileData, c.config.Shards)
+	c.shards = make([]*MicroProfileStatistic, c.config.Shards)
+	for i := range c.channels {
+		channel, mps := make(chan *MicroProfileData, c.config.BufferSize), NewMicroProfileStatistic()
+		c.channels[i], c.shards[i] = channel, mps
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for mpd := range channel {
+				mps.add(mpd)
 			}
+		}()
+	}
+}
 
-			// update instruction frequency
-			for instructions, freq := range mpd.InstructionFrequency {
-				mps.instructionFrequency[instructions] += freq
-			}
+// Stop waits for the records processed so far to be aggregated and returns
+// the statistic of all of them. Records processed after Stop are rejected.
+func (c *MicroProfileCollector) Stop() *MicroProfileStatistic {
+	c.lock.Lock()
+	if c.running {
+		c.running = false
+		for _, channel := range c.channels {
+			close(channel)
+		}
+	}
+	c.lock.Unlock()
+	c.wg.Wait()
+	res := NewMicroProfileStatistic()
+	for _, mps := range c.shards {
+		res.Merge(mps)
+	}
+	return res
+}
 
-			// step length frequency
-			mps.stepLengthFrequency[mpd.StepLength]++
+// Process puts a micro-profiling data record into the processing queue of
+// a shard. It fails if the collector is not running.
+func (c *MicroProfileCollector) Process(mpd *MicroProfileData) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if !c.running {
+		return ErrProfileCollectorNotRunning
+	}
+	shard := atomic.AddUint32(&c.next, 1) % uint32(len(c.channels))
+	c.channels[shard] <- mpd
+	return nil
+}
 
-		// receive stop signal?
-		case <-ctx.Done():
-			if len(mpChannel) == 0 {
-				return
-			}
-		}
+func (c *MicroProfileCollector) Enter(contract *Contract) FrameProfile {
+	function := ContractFunction{
+		Contract: profiledCodeAddress(contract),
+		CodeHash: contract.CodeHash,
+	}
+	// the hash of init code is not always known
+	if function.CodeHash == (common.Hash{}) {
+		function.CodeHash = crypto.Keccak256Hash(contract.Code)
+	}
+	if len(contract.Input) >= 4 {
+		function.Selector = hexutil.Encode(contract.Input[:4])
 	}
+	return &microProfileFrame{
+		collector: c,
+		data: MicroProfileData{
+			Function:        function,
+			OpCodeFrequency: map[OpCode]uint64{},
+			OpCodeDuration:  map[OpCode]time.Duration{},
+			OpCodeGas:       map[OpCode]uint64{},
+		},
+		pcCounterFrequency: map[uint64]uint64{},
+	}
+}
+
+type microProfileFrame struct {
+	collector          *MicroProfileCollector
+	data               MicroProfileData
+	pcCounterFrequency map[uint64]uint64 // pc-counter frequency stats
 }
 
-// put micro profiling data into the processing queue
-func ProcessMicroProfileData(mpd *MicroProfileData) {
-	mpChannel <- mpd
+func (f *microProfileFrame) BasicBlock(pc uint64) {}
+
+func (f *microProfileFrame) Instruction(pc uint64, op OpCode, gas uint64, duration time.Duration) {
+	f.data.OpCodeFrequency[op]++
+	f.data.OpCodeDuration[op] += duration
+	f.data.OpCodeGas[op] += gas
+	f.pcCounterFrequency[pc]++
+	f.data.StepLength++
+}
+
+func (f *microProfileFrame) Exit() {
+	// compute frequency statistics for instructions
+	f.data.InstructionFrequency = map[uint64]uint64{}
+	for _, ctr := range f.pcCounterFrequency {
+		f.data.InstructionFrequency[ctr]++
+	}
+	// records of frames exiting while the collector is not running are dropped
+	f.collector.Process(&f.data)
+}
+
+// add a data record to the statistic
+func (mps *MicroProfileStatistic) add(mpd *MicroProfileData) {
+	// update op-code frequency
+	for opCode, freq := range mpd.OpCodeFrequency {
+		mps.opCodeFrequency[opCode] += freq
+	}
+
+	// update op-code duration
+	for opCode, duration := range mpd.OpCodeDuration {
+		mps.opCodeDuration[opCode] += uint64(duration)
+	}
+
+	// update instruction frequency
+	for instructions, freq := range mpd.InstructionFrequency {
+		mps.instructionFrequency[instructions] += freq
+	}
+
+	// step length frequency
+	mps.stepLengthFrequency[mpd.StepLength]++
+
+	// update statistics of the contract function
+	function := mps.functions[mpd.Function]
+	function.Calls++
+	function.Instructions += uint64(mpd.StepLength)
+	for opCode, freq := range mpd.OpCodeFrequency {
+		key := functionOpCodeKey{mpd.Function, opCode}
+		profile := mps.functionOpCodes[key]
+		profile.Frequency += freq
+		profile.Gas += mpd.OpCodeGas[opCode]
+		profile.Duration += mpd.OpCodeDuration[opCode]
+		mps.functionOpCodes[key] = profile
+
+		function.Gas += mpd.OpCodeGas[opCode]
+		function.Duration += mpd.OpCodeDuration[opCode]
+	}
+	mps.functions[mpd.Function] = function
 }
 
 // Merge two micro-profiling statistics
@@ -126,138 +288,160 @@ func (mps *MicroProfileStatistic) Merge(src *MicroProfileStatistic) {
 	for length, freq := range src.stepLengthFrequency {
 		mps.stepLengthFrequency[length] += freq
 	}
-}
 
-// dump opcode frequency stats into a SQLITE3 database
-func (mps *MicroProfileStatistic) dumpOpCodeFrequency(db *sql.DB) {
-	// drop old frequency table and create new one
-	_, err := db.Exec("DROP TABLE IF EXISTS OpCodeFrequency;CREATE TABLE OpCodeFrequency ( opcode TEXT NOT NULL, frequency INTEGER NOT NULL, PRIMARY KEY (opcode));")
-	if err != nil {
-		log.Fatalln(err.Error())
+	// contract function statistics
+	for key, src := range src.functions {
+		function := mps.functions[key]
+		function.Calls += src.Calls
+		function.Instructions += src.Instructions
+		function.Gas += src.Gas
+		function.Duration += src.Duration
+		mps.functions[key] = function
 	}
-
-	// prepare an insert statement for faster inserts and insert frequencies
-	statement, err := db.Prepare("INSERT INTO OpCodeFrequency(opcode, frequency) VALUES (?, ?)")
-	if err != nil {
-		log.Fatalln(err.Error())
+	for key, src := range src.functionOpCodes {
+		profile := mps.functionOpCodes[key]
+		profile.Frequency += src.Frequency
+		profile.Gas += src.Gas
+		profile.Duration += src.Duration
+		mps.functionOpCodes[key] = profile
 	}
-	for opCode, freq := range mps.opCodeFrequency {
-		_, err = statement.Exec(opCodeToString[opCode], freq)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
+}
 
-	}
+// Functions returns the profiles of the contract functions invoked.
+func (mps *MicroProfileStatistic) Functions() map[ContractFunction]FunctionProfile {
+	return mps.functions
 }
 
-// dump opcode duration statistic
-func (mps *MicroProfileStatistic) dumpOpCodeDuration(db *sql.DB) {
-	// drop old frequency table and create new one
-	_, err := db.Exec("DROP TABLE IF EXISTS OpCodeDuration;CREATE TABLE OpCodeDuration ( opcode TEXT NOT NULL, duration NUMERIC NOT NULL, PRIMARY KEY (opcode));")
-	if err != nil {
-		log.Fatalln(err.Error())
+// FunctionOpCodes returns the profiles of the opcodes executed by a contract
+// function.
+func (mps *MicroProfileStatistic) FunctionOpCodes(function ContractFunction) map[OpCode]FunctionOpCodeProfile {
+	res := map[OpCode]FunctionOpCodeProfile{}
+	for key, profile := range mps.functionOpCodes {
+		if key.function == function {
+			res[key.opCode] = profile
+		}
 	}
+	return res
+}
 
-	// prepare an insert statement for faster inserts and insert frequencies
-	statement, err := db.Prepare("INSERT INTO OpCodeDuration(opcode, duration) VALUES (?, ?)")
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-	for opCode, duration := range mps.opCodeDuration {
-		_, err = statement.Exec(opCodeToString[opCode], duration)
-		if err != nil {
-			log.Fatalln(err.Error())
+// dump opcode frequency stats into a SQLITE3 database
+func (mps *MicroProfileStatistic) dumpOpCodeFrequency(db *sql.DB, run *ProfilingRun) error {
+	return dumpProfileTable(db, run, "OpCodeFrequency", "opcode TEXT NOT NULL, frequency INTEGER NOT NULL", "opcode", func(insert func(...interface{}) error) error {
+		for opCode, freq := range mps.opCodeFrequency {
+			if err := insert(opCodeToString[opCode], freq); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
 
-	}
+// dump opcode duration statistic
+func (mps *MicroProfileStatistic) dumpOpCodeDuration(db *sql.DB, run *ProfilingRun) error {
+	return dumpProfileTable(db, run, "OpCodeDuration", "opcode TEXT NOT NULL, duration NUMERIC NOT NULL", "opcode", func(insert func(...interface{}) error) error {
+		for opCode, duration := range mps.opCodeDuration {
+			if err := insert(opCodeToString[opCode], duration); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // dump instruction frequency statistic
-func (mps *MicroProfileStatistic) dumpInstructionFrequency(db *sql.DB) {
-	// drop old frequency table and create new one
-	_, err := db.Exec("DROP TABLE IF EXISTS InstructionFrequency;CREATE TABLE InstructionFrequency ( instructions INTEGER NOT NULL, frequency INTEGER NOT NULL, PRIMARY KEY (instructions));")
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	// prepare an insert statement for faster inserts and insert frequencies
-	statement, err := db.Prepare("INSERT INTO InstructionFrequency(instructions, frequency) VALUES (?, ?)")
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-	for instructions, freq := range mps.instructionFrequency {
-		_, err = statement.Exec(instructions, freq)
-		if err != nil {
-			log.Fatalln(err.Error())
+func (mps *MicroProfileStatistic) dumpInstructionFrequency(db *sql.DB, run *ProfilingRun) error {
+	return dumpProfileTable(db, run, "InstructionFrequency", "instructions INTEGER NOT NULL, frequency INTEGER NOT NULL", "instructions", func(insert func(...interface{}) error) error {
+		for instructions, freq := range mps.instructionFrequency {
+			if err := insert(instructions, freq); err != nil {
+				return err
+			}
 		}
-
-	}
+		return nil
+	})
 }
 
 // dump step-length frequency statistic
-func (mps *MicroProfileStatistic) dumpStepLengthFrequency(db *sql.DB) {
-	// drop old frequency table and create new one
-	_, err := db.Exec("DROP TABLE IF EXISTS StepLengthFrequency;CREATE TABLE StepLengthFrequency ( steplength INTEGER NOT NULL, frequency INTEGER NOT NULL, PRIMARY KEY (steplength));")
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	// prepare an insert statement for faster inserts and insert frequencies
-	statement, err := db.Prepare("INSERT INTO StepLengthFrequency(steplength, frequency) VALUES (?, ?)")
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-	for length, freq := range mps.stepLengthFrequency {
-		_, err = statement.Exec(length, freq)
-		if err != nil {
-			log.Fatalln(err.Error())
+func (mps *MicroProfileStatistic) dumpStepLengthFrequency(db *sql.DB, run *ProfilingRun) error {
+	return dumpProfileTable(db, run, "StepLengthFrequency", "steplength INTEGER NOT NULL, frequency INTEGER NOT NULL", "steplength", func(insert func(...interface{}) error) error {
+		for length, freq := range mps.stepLengthFrequency {
+			if err := insert(length, freq); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
 
+// dump the statistics of contracts, summed over their functions
+func (mps *MicroProfileStatistic) dumpContractProfile(db *sql.DB, run *ProfilingRun) error {
+	type contract struct {
+		address  common.Address
+		codeHash common.Hash
+	}
+	contracts := map[contract]FunctionProfile{}
+	for key, function := range mps.functions {
+		c := contract{key.Contract, key.CodeHash}
+		profile := contracts[c]
+		profile.Calls += function.Calls
+		profile.Instructions += function.Instructions
+		profile.Gas += function.Gas
+		profile.Duration += function.Duration
+		contracts[c] = profile
 	}
+	return dumpProfileTable(db, run, "ContractProfile", "contract TEXT NOT NULL, codehash TEXT NOT NULL, calls INTEGER NOT NULL, instructions INTEGER NOT NULL, gas INTEGER NOT NULL, duration NUMERIC NOT NULL", "contract, codehash", func(insert func(...interface{}) error) error {
+		for c, profile := range contracts {
+			if err := insert(c.address.Hex(), c.codeHash.Hex(), profile.Calls, profile.Instructions, profile.Gas, uint64(profile.Duration)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
+// dump the statistics of contract functions
+func (mps *MicroProfileStatistic) dumpFunctionProfile(db *sql.DB, run *ProfilingRun) error {
+	return dumpProfileTable(db, run, "FunctionProfile", "contract TEXT NOT NULL, codehash TEXT NOT NULL, selector TEXT NOT NULL, calls INTEGER NOT NULL, instructions INTEGER NOT NULL, gas INTEGER NOT NULL, duration NUMERIC NOT NULL", "contract, codehash, selector", func(insert func(...interface{}) error) error {
+		for key, profile := range mps.functions {
+			if err := insert(key.Contract.Hex(), key.CodeHash.Hex(), key.Selector, profile.Calls, profile.Instructions, profile.Gas, uint64(profile.Duration)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-// dump micro-profiling statistic into a sqlite3 database
-func (mps *MicroProfileStatistic) Dump(version string) {
+// dump the opcode statistics of contract functions
+func (mps *MicroProfileStatistic) dumpFunctionOpCodeProfile(db *sql.DB, run *ProfilingRun) error {
+	return dumpProfileTable(db, run, "FunctionOpCodeProfile", "contract TEXT NOT NULL, codehash TEXT NOT NULL, selector TEXT NOT NULL, opcode TEXT NOT NULL, frequency INTEGER NOT NULL, gas INTEGER NOT NULL, duration NUMERIC NOT NULL", "contract, codehash, selector, opcode", func(insert func(...interface{}) error) error {
+		for key, profile := range mps.functionOpCodes {
+			if err := insert(key.function.Contract.Hex(), key.function.CodeHash.Hex(), key.function.Selector, opCodeToString[key.opCode], profile.Frequency, profile.Gas, uint64(profile.Duration)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	// open sqlite3 database
-	// TODO: have parameters for sqlite3 database name
-	db, err := sql.Open("sqlite3", MicroProfilingDB) // Open the created SQLite File
+// dump micro-profiling statistic of a run into a sqlite3 database
+func (mps *MicroProfileStatistic) Dump(name string, run ProfilingRun) error {
+	db, err := openProfilingDB(name, &run)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
 	defer db.Close()
 
-	// switch synchronous mode off, enable memory journaling,
-	_, err = db.Exec("PRAGMA synchronous = OFF;PRAGMA journal_mode = MEMORY;")
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	_, err = db.Exec("PRAGMA synchronous = OFF;PRAGMA journal_mode = MEMORY;")
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS Information ( version TEXT );")
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	_, err = db.Exec("INSERT INTO Information (version) VALUES (\"" + version + "\")")
-	if err != nil {
-		log.Fatalln(err.Error())
+	for _, dump := range []func(*sql.DB, *ProfilingRun) error{
+		mps.dumpOpCodeFrequency,
+		mps.dumpOpCodeDuration,
+		mps.dumpInstructionFrequency,
+		mps.dumpStepLengthFrequency,
+		mps.dumpContractProfile,
+		mps.dumpFunctionProfile,
+		mps.dumpFunctionOpCodeProfile,
+	} {
+		if err := dump(db, &run); err != nil {
+			return err
+		}
 	}
-
-	// dump op-code frequencies
-	mps.dumpOpCodeFrequency(db)
-
-	// dump op-code durations
-	mps.dumpOpCodeDuration(db)
-
-	// dump instruction frequency
-	mps.dumpInstructionFrequency(db)
-
-	// dump step-length frequency
-	mps.dumpStepLengthFrequency(db)
+	return db.Close()
 }
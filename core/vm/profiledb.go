@@ -0,0 +1,129 @@
+// Copyright 2022 The go-fantom Authors
+// This file is part of the go-fantom library.
+//
+// The go-fantom library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Maximal number of records per SQLITE3 transaction for writing
+const ProfilingMaxNumRecords = 1000
+
+// ProfilingRun describes the run profiles were collected in. The run is
+// attached to every row dumped, so that a database can hold the profiles of
+// several runs; dumping the profiles of a run again replaces its rows.
+type ProfilingRun struct {
+	Version     string // version of the profiling tool
+	FirstBlock  uint64 // first block of the replayed range
+	LastBlock   uint64 // last block of the replayed range
+	Interpreter string // name of the interpreter
+	Fork        string // hard-fork of the replayed range
+}
+
+// columns of the run in every table
+const (
+	runColumns = "first_block INTEGER NOT NULL, last_block INTEGER NOT NULL, interpreter TEXT NOT NULL, fork TEXT NOT NULL"
+	runKey     = "first_block, last_block, interpreter, fork"
+	runFilter  = "first_block = ? AND last_block = ? AND interpreter = ? AND fork = ?"
+)
+
+func (r *ProfilingRun) values() []interface{} {
+	return []interface{}{r.FirstBlock, r.LastBlock, r.Interpreter, r.Fork}
+}
+
+// openProfilingDB opens a SQLITE3 database of profiles and records run in its
+// Information table.
+func openProfilingDB(name string, run *ProfilingRun) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", name)
+	if err != nil {
+		return nil, err
+	}
+	// pragmas apply to a connection
+	db.SetMaxOpenConns(1)
+
+	// switch synchronous mode off, enable memory journaling
+	if _, err := db.Exec("PRAGMA synchronous = OFF; PRAGMA journal_mode = MEMORY;"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS Information (version TEXT NOT NULL, " + runColumns + ", PRIMARY KEY (" + runKey + "));"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("INSERT OR REPLACE INTO Information (version, "+runKey+") VALUES (?, ?, ?, ?, ?)", append([]interface{}{run.Version}, run.values()...)...); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// dumpProfileTable replaces the rows of run in table by the rows written by
+// dump. The table is created with the given columns and key, in addition to
+// those of the run, if it does not exist.
+func dumpProfileTable(db *sql.DB, run *ProfilingRun, table, columns, key string, dump func(insert func(values ...interface{}) error) error) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + table + " (" + runColumns + ", " + columns + ", PRIMARY KEY (" + runKey + ", " + key + "));"); err != nil {
+		return fmt.Errorf("failed to create table %s: %v", table, err)
+	}
+	if _, err := db.Exec("DELETE FROM "+table+" WHERE "+runFilter, run.values()...); err != nil {
+		return fmt.Errorf("failed to delete rows of the run from %s: %v", table, err)
+	}
+
+	var names []string
+	for _, column := range strings.Split(columns, ",") {
+		names = append(names, strings.Fields(column)[0])
+	}
+	insertSQL := "INSERT INTO " + table + " (" + runKey + ", " + strings.Join(names, ", ") + ") VALUES (?, ?, ?, ?" + strings.Repeat(", ?", len(names)) + ")"
+	statement, err := db.Prepare(insertSQL)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert into %s: %v", table, err)
+	}
+	defer statement.Close()
+
+	// commit the rows in transactions of ProfilingMaxNumRecords records
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var (
+		stmt    = tx.Stmt(statement)
+		records = 0
+	)
+	insert := func(values ...interface{}) error {
+		if records == ProfilingMaxNumRecords {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			next, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			tx, stmt, records = next, next.Stmt(statement), 0
+		}
+		records++
+		_, err := stmt.Exec(append(run.values(), values...)...)
+		return err
+	}
+	if err := dump(insert); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to insert into %s: %v", table, err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 The go-fantom Authors
+// This file is part of the go-fantom library.
+//
+// The go-fantom library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestCollectorsAggregateShards(t *testing.T) {
+	config := ProfileCollectorConfig{Shards: 3, BufferSize: 2}
+	micro, blocks := NewMicroProfileCollector(config), NewBasicBlockProfileCollector(config)
+	micro.Start()
+	blocks.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runProfiledCall(t, micro, blocks)
+		}()
+	}
+	wg.Wait()
+	mps, bbps := micro.Stop(), blocks.Stop()
+
+	if have := mps.opCodeFrequency[PUSH1]; have != 4*8 {
+		t.Errorf("wrong frequency of PUSH1: have %d, want %d", have, 4*8)
+	}
+	if have := mps.stepLengthFrequency[5]; have != 4 {
+		t.Errorf("wrong frequency of the callee's step length: have %d, want 4", have)
+	}
+	caller := ContractFunction{Contract: profiledCaller, CodeHash: crypto.Keccak256Hash(profiledCallerCode()), Selector: "0xa9059cbb"}
+	if have := mps.Functions()[caller]; have.Calls != 4 || have.Instructions != 4*13 {
+		t.Errorf("wrong profile of the caller: %+v", have)
+	}
+	callee := ContractFunction{Contract: profiledCallee, CodeHash: crypto.Keccak256Hash(profiledCalleeCode)}
+	if have := mps.Functions()[callee]; have.Calls != 4 || have.Instructions != 4*5 || have.Gas != 4*11 {
+		t.Errorf("wrong profile of the callee: %+v", have)
+	}
+	if have := mps.FunctionOpCodes(callee)[PUSH1]; have.Frequency != 4*2 || have.Gas != 4*6 {
+		t.Errorf("wrong profile of PUSH1 in the callee: %+v", have)
+	}
+	// the gas of the callee is not counted for the CALL of the caller again
+	if have, want := mps.Functions()[caller].Gas+mps.Functions()[callee].Gas, 4*runProfiledCall(t); have != want {
+		t.Errorf("wrong gas of all functions: have %d, want %d", have, want)
+	}
+
+	key := BasicBlockKey{Contract: profiledCaller.String(), Address: 38, Instructions: "5b00"}
+	if have := bbps.basicBlockFrequency[key]; have != 4 || len(bbps.basicBlockFrequency) != 1 {
+		t.Errorf("wrong basic blocks: %v", bbps.basicBlockFrequency)
+	}
+}
+
+func TestCollectorsRejectRecordsOutsideOfRun(t *testing.T) {
+	micro, blocks := NewMicroProfileCollector(ProfileCollectorConfig{}), NewBasicBlockProfileCollector(ProfileCollectorConfig{})
+
+	// neither before Start nor after Stop the records are aggregated
+	runProfiledCall(t, micro, blocks)
+	micro.Start()
+	blocks.Start()
+	mps, bbps := micro.Stop(), blocks.Stop()
+	runProfiledCall(t, micro, blocks)
+	if len(mps.opCodeFrequency) != 0 || len(bbps.basicBlockFrequency) != 0 {
+		t.Errorf("records outside of the run aggregated")
+	}
+	if err := micro.Process(&MicroProfileData{}); err != ErrProfileCollectorNotRunning {
+		t.Errorf("wrong error of a stopped micro-profiling collector: %v", err)
+	}
+	if err := blocks.Process(&BasicBlockProfileData{}); err != ErrProfileCollectorNotRunning {
+		t.Errorf("wrong error of a stopped basic-block collector: %v", err)
+	}
+	// stopping again is harmless
+	micro.Stop()
+	blocks.Stop()
+}
+
+func TestDumpReplacesRowsOfRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "profile.db")
+
+	micro, blocks := NewMicroProfileCollector(ProfileCollectorConfig{}), NewBasicBlockProfileCollector(ProfileCollectorConfig{})
+	micro.Start()
+	blocks.Start()
+	runProfiledCall(t, micro, blocks)
+	mps, bbps := micro.Stop(), blocks.Stop()
+
+	// the version is bound, not part of the statement
+	runs := []ProfilingRun{
+		{Version: `1.0 "quoted"`, FirstBlock: 1, LastBlock: 2, Interpreter: "geth", Fork: "London"},
+		{Version: `1.0 "quoted"`, FirstBlock: 1, LastBlock: 2, Interpreter: "lfvm", Fork: "London"},
+		{Version: `1.0 "quoted"`, FirstBlock: 1, LastBlock: 2, Interpreter: "lfvm", Fork: "London"},
+	}
+	for _, run := range runs {
+		if err := mps.Dump(name, run); err != nil {
+			t.Fatalf("failed to dump micro-profiling statistic: %v", err)
+		}
+		if err := bbps.Dump(name, run); err != nil {
+			t.Fatalf("failed to dump basic-block statistic: %v", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for query, want := range map[string]uint64{
+		"SELECT COUNT(*) FROM Information WHERE version = '1.0 \"quoted\"'":                                   2,
+		"SELECT frequency FROM OpCodeFrequency WHERE opcode = 'PUSH1' AND interpreter = 'lfvm'":               8,
+		"SELECT COUNT(*) FROM OpCodeFrequency WHERE opcode = 'PUSH1' AND first_block = 1 AND fork = 'London'": 2,
+		"SELECT COUNT(*) FROM OpCodeDuration WHERE opcode = 'CALL'":                                           2,
+		"SELECT SUM(frequency) FROM StepLengthFrequency WHERE interpreter = 'geth'":                           2,
+		"SELECT COUNT(*) FROM InstructionFrequency WHERE interpreter = 'geth'":                                1,
+		"SELECT frequency FROM BasicBlockFrequency WHERE address = 38 AND interpreter = 'lfvm'":               1,
+		"SELECT calls FROM FunctionProfile WHERE selector = '0xa9059cbb' AND interpreter = 'lfvm'":            1,
+		"SELECT gas FROM FunctionProfile WHERE selector = '' AND interpreter = 'geth'":                        11,
+		"SELECT COUNT(*) FROM FunctionOpCodeProfile WHERE opcode = 'PUSH1' AND interpreter = 'geth'":          2,
+		"SELECT SUM(calls) FROM ContractProfile WHERE interpreter = 'geth'":                                   2,
+	} {
+		var have uint64
+		if err := db.QueryRow(query).Scan(&have); err != nil {
+			t.Errorf("%s failed: %v", query, err)
+		} else if have != want {
+			t.Errorf("%s: have %d, want %d", query, have, want)
+		}
+	}
+
+	// errors are returned
+	if err := mps.Dump(filepath.Join(dir, "missing", "profile.db"), runs[0]); err == nil {
+		t.Errorf("dump to a missing directory succeeded")
+	}
+}
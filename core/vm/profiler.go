@@ -0,0 +1,272 @@
+// Copyright 2022 The go-fantom Authors
+// This file is part of the go-fantom library.
+//
+// The go-fantom library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Profiler collects a profile of the code executed by the interpreters. The
+// profilers are selected by Config.Profilers and are shared by all interpreters
+// using the configuration, so they must be safe for concurrent use.
+type Profiler interface {
+	// Enter is called when an interpreter starts to execute the code of a
+	// contract with contract.Input as input. The returned profile receives
+	// the events of this execution.
+	Enter(contract *Contract) FrameProfile
+}
+
+// FrameProfile receives the events of a single execution of contract code.
+// It is only used by the goroutine running the execution.
+type FrameProfile interface {
+	// BasicBlock is called when the basic block starting with the JUMPDEST
+	// at pc was entered, before the JUMPDEST is reported to Instruction.
+	BasicBlock(pc uint64)
+	// Instruction is called after op at pc was executed with the gas it
+	// used and its duration, both excluding the code executed by nested
+	// calls. Instructions failing with an error are not reported.
+	Instruction(pc uint64, op OpCode, gas uint64, duration time.Duration)
+	// Exit is called when the execution of the code ends.
+	Exit()
+}
+
+// profiledCodeAddress returns the address of the code executed by contract,
+// which differs from the address of contract for DELEGATECALL and CALLCODE.
+func profiledCodeAddress(contract *Contract) common.Address {
+	if contract.CodeAddr != nil {
+		return *contract.CodeAddr
+	}
+	return contract.Address()
+}
+
+// Profiling reports the execution of code by an interpreter to the profilers
+// of its configuration. It is started by StartProfiling for every execution of
+// code and stopped when the execution ends; in between, the interpreter
+// reports every instruction to BeginInstruction and, if it succeeded, to
+// EndInstruction.
+type Profiling struct {
+	evm       *EVM
+	parent    *Profiling
+	frames    []FrameProfile
+	start     time.Time
+	nested    time.Duration // duration of nested executions
+	used      uint64        // gas used by reported instructions, including nested executions
+	nestedGas uint64        // gas used by nested executions
+
+	// instruction being executed
+	pc           uint64
+	op           OpCode
+	gas          uint64
+	begin        time.Time
+	nestedOld    time.Duration
+	nestedGasOld uint64
+}
+
+// StartProfiling starts the profiling of the execution of contract's code,
+// or returns nil if there are no profilers.
+func StartProfiling(evm *EVM, profilers []Profiler, contract *Contract) *Profiling {
+	if len(profilers) == 0 {
+		return nil
+	}
+	p := &Profiling{
+		evm:    evm,
+		parent: evm.profiling,
+		frames: make([]FrameProfile, len(profilers)),
+	}
+	for i, profiler := range profilers {
+		p.frames[i] = profiler.Enter(contract)
+	}
+	evm.profiling = p
+	p.start = time.Now()
+	return p
+}
+
+// BeginInstruction is called before op at pc is executed with the given gas.
+func (p *Profiling) BeginInstruction(pc uint64, op OpCode, gas uint64) {
+	p.pc, p.op, p.gas = pc, op, gas
+	p.nestedOld, p.nestedGasOld = p.nested, p.nestedGas
+	p.begin = time.Now()
+}
+
+// EndInstruction is called after the instruction of the last BeginInstruction
+// was executed successfully, leaving the given gas.
+func (p *Profiling) EndInstruction(gas uint64) {
+	duration := time.Since(p.begin) - (p.nested - p.nestedOld)
+	used := p.gas - gas
+	p.used += used
+	// the gas of a call that is not used by the nested execution, e.g. the
+	// gas of failed instructions, remains with the call
+	if nested := p.nestedGas - p.nestedGasOld; nested <= used {
+		used -= nested
+	}
+	for _, frame := range p.frames {
+		if p.op == JUMPDEST {
+			frame.BasicBlock(p.pc)
+		}
+		frame.Instruction(p.pc, p.op, used, duration)
+	}
+}
+
+// Stop ends the profiling of the execution.
+func (p *Profiling) Stop() {
+	if p.parent != nil {
+		p.parent.nested += time.Since(p.start)
+		p.parent.nestedGas += p.used
+	}
+	p.evm.profiling = p.parent
+	for _, frame := range p.frames {
+		frame.Exit()
+	}
+}
+
+// NGramProfiler counts the sequences of up to N instructions executed
+// consecutively in the code of a contract.
+type NGramProfiler struct {
+	n      int
+	mu     sync.Mutex
+	counts map[ngram]uint64
+}
+
+// MaxNGramLength is the maximum length of sequences counted by NGramProfiler.
+const MaxNGramLength = 8
+
+// ngram is a sequence of up to MaxNGramLength instructions, one per byte
+// of ops with the last instruction in the lowest byte.
+type ngram struct {
+	ops uint64
+	len int
+}
+
+func (g ngram) String() string {
+	names := make([]string, g.len)
+	for i := range names {
+		names[i] = OpCode(g.ops >> (8 * (g.len - 1 - i))).String()
+	}
+	return strings.Join(names, "_")
+}
+
+// NewNGramProfiler creates a profiler of sequences of 1 to n instructions,
+// at most MaxNGramLength.
+func NewNGramProfiler(n int) *NGramProfiler {
+	if n > MaxNGramLength {
+		n = MaxNGramLength
+	}
+	return &NGramProfiler{n: n, counts: map[ngram]uint64{}}
+}
+
+// Counts returns the number of times every sequence was executed so far, by
+// sequences of instruction names joined by underscores, e.g. PUSH1_PUSH1_ADD.
+func (p *NGramProfiler) Counts() map[string]uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make(map[string]uint64, len(p.counts))
+	for g, count := range p.counts {
+		res[g.String()] = count
+	}
+	return res
+}
+
+func (p *NGramProfiler) Enter(contract *Contract) FrameProfile {
+	return &ngramFrame{profiler: p, counts: map[ngram]uint64{}}
+}
+
+type ngramFrame struct {
+	profiler *NGramProfiler
+	window   ngram // the last n instructions
+	counts   map[ngram]uint64
+}
+
+func (f *ngramFrame) BasicBlock(pc uint64) {}
+
+func (f *ngramFrame) Instruction(pc uint64, op OpCode, gas uint64, duration time.Duration) {
+	f.window.ops = f.window.ops<<8 | uint64(op)
+	if f.window.len < f.profiler.n {
+		f.window.len++
+	}
+	for n := 1; n <= f.window.len; n++ {
+		f.counts[ngram{f.window.ops & (1<<(8*n) - 1), n}]++
+	}
+}
+
+func (f *ngramFrame) Exit() {
+	f.profiler.mu.Lock()
+	defer f.profiler.mu.Unlock()
+	for g, count := range f.counts {
+		f.profiler.counts[g] += count
+	}
+}
+
+// OpCodeGas is the gas used by the executions of an instruction.
+type OpCodeGas struct {
+	Count uint64 // number of executions
+	Gas   uint64 // total gas used
+}
+
+// GasProfiler accumulates the gas used per instruction. The gas of calls and
+// creations excludes the gas used by the nested frame.
+type GasProfiler struct {
+	mu  sync.Mutex
+	gas map[OpCode]OpCodeGas
+}
+
+func NewGasProfiler() *GasProfiler {
+	return &GasProfiler{gas: map[OpCode]OpCodeGas{}}
+}
+
+// Gas returns the gas used per instruction so far.
+func (p *GasProfiler) Gas() map[OpCode]OpCodeGas {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make(map[OpCode]OpCodeGas, len(p.gas))
+	for op, gas := range p.gas {
+		res[op] = gas
+	}
+	return res
+}
+
+func (p *GasProfiler) Enter(contract *Contract) FrameProfile {
+	return &gasFrame{profiler: p, gas: map[OpCode]OpCodeGas{}}
+}
+
+type gasFrame struct {
+	profiler *GasProfiler
+	gas      map[OpCode]OpCodeGas
+}
+
+func (f *gasFrame) BasicBlock(pc uint64) {}
+
+func (f *gasFrame) Instruction(pc uint64, op OpCode, gas uint64, duration time.Duration) {
+	res := f.gas[op]
+	res.Count++
+	res.Gas += gas
+	f.gas[op] = res
+}
+
+func (f *gasFrame) Exit() {
+	f.profiler.mu.Lock()
+	defer f.profiler.mu.Unlock()
+	for op, gas := range f.gas {
+		res := f.profiler.gas[op]
+		res.Count += gas.Count
+		res.Gas += gas.Gas
+		f.profiler.gas[op] = res
+	}
+}
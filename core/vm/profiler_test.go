@@ -0,0 +1,143 @@
+// Copyright 2022 The go-fantom Authors
+// This file is part of the go-fantom library.
+//
+// The go-fantom library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// profileRecorder records the events of every execution of code.
+type profileRecorder struct {
+	frames []*recordedFrame
+}
+
+type recordedFrame struct {
+	address common.Address
+	events  []string
+	exited  bool
+}
+
+func (r *profileRecorder) Enter(contract *Contract) FrameProfile {
+	frame := &recordedFrame{address: contract.Address()}
+	r.frames = append(r.frames, frame)
+	return frame
+}
+
+func (f *recordedFrame) BasicBlock(pc uint64) {
+	f.events = append(f.events, fmt.Sprintf("block %d", pc))
+}
+
+func (f *recordedFrame) Instruction(pc uint64, op OpCode, gas uint64, duration time.Duration) {
+	f.events = append(f.events, fmt.Sprintf("%d %v gas=%d", pc, op, gas))
+}
+
+func (f *recordedFrame) Exit() {
+	f.exited = true
+}
+
+var (
+	profiledCaller = common.BytesToAddress([]byte("caller"))
+	profiledCallee = common.BytesToAddress([]byte("callee"))
+	// input of the call of the caller, the callee is called without input
+	profiledInput = []byte{0xa9, 0x05, 0x9c, 0xbb}
+
+	profiledCalleeCode = []byte{byte(PUSH1), 0x01, byte(PUSH1), 0x02, byte(ADD), byte(POP), byte(STOP)}
+)
+
+// profiledCallerCode returns the code of the caller, calling the callee.
+func profiledCallerCode() []byte {
+	code := []byte{
+		byte(PUSH1), 0x00, byte(PUSH1), 0x00, byte(PUSH1), 0x00, byte(PUSH1), 0x00, byte(PUSH1), 0x00,
+		byte(PUSH20),
+	}
+	code = append(code, profiledCallee.Bytes()...)
+	return append(code,
+		byte(GAS), byte(CALL), byte(POP), // 31
+		byte(PUSH1), 0x26, byte(JUMP), // 34
+		byte(INVALID),
+		byte(JUMPDEST), // 38
+		byte(STOP),
+	)
+}
+
+// runProfiledCall executes code calling another contract with profilers and
+// returns the gas used.
+func runProfiledCall(t *testing.T, profilers ...Profiler) uint64 {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil, nil)
+	statedb.SetCode(profiledCaller, profiledCallerCode())
+	statedb.SetCode(profiledCallee, profiledCalleeCode)
+
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: new(big.Int),
+	}
+	vmenv := NewEVM(vmctx, TxContext{}, statedb, params.TestChainConfig, Config{Profilers: profilers})
+	_, gas, err := vmenv.Call(AccountRef(common.Address{}), profiledCaller, profiledInput, 100000, new(big.Int))
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	return 100000 - gas
+}
+
+func TestProfilersReceiveInstructionsOfFrames(t *testing.T) {
+	var (
+		recorder = &profileRecorder{}
+		gas      = NewGasProfiler()
+		ngrams   = NewNGramProfiler(2)
+	)
+	runProfiledCall(t, recorder, gas, ngrams)
+
+	if len(recorder.frames) != 2 || recorder.frames[0].address != profiledCaller || recorder.frames[1].address != profiledCallee {
+		t.Fatalf("wrong frames entered: %v", recorder.frames)
+	}
+	for _, frame := range recorder.frames {
+		if !frame.exited {
+			t.Errorf("frame of %v not exited", frame.address)
+		}
+	}
+	want := []string{"0 PUSH1 gas=3", "2 PUSH1 gas=3", "4 ADD gas=3", "5 POP gas=2", "6 STOP gas=0"}
+	if have := recorder.frames[1].events; !reflect.DeepEqual(have, want) {
+		t.Errorf("wrong events of the callee:\nhave %q\nwant %q", have, want)
+	}
+	if have := recorder.frames[0].events; len(have) != 14 || have[11] != "block 38" {
+		t.Errorf("wrong events of the caller: %q", have)
+	}
+
+	if have, want := gas.Gas()[PUSH1], (OpCodeGas{Count: 8, Gas: 24}); have != want {
+		t.Errorf("wrong gas of PUSH1: have %v, want %v", have, want)
+	}
+	if have, want := gas.Gas()[JUMPDEST], (OpCodeGas{Count: 1, Gas: 1}); have != want {
+		t.Errorf("wrong gas of JUMPDEST: have %v, want %v", have, want)
+	}
+
+	counts := ngrams.Counts()
+	for ngram, want := range map[string]uint64{"PUSH1": 8, "PUSH1_PUSH1": 5, "GAS_CALL": 1, "JUMP_JUMPDEST": 1, "STOP_POP": 0} {
+		if have := counts[ngram]; have != want {
+			t.Errorf("wrong count of %s: have %d, want %d", ngram, have, want)
+		}
+	}
+}
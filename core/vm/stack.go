@@ -40,6 +40,12 @@ func newstack() *Stack {
 	return stackPool.Get().(*Stack)
 }
 
+// NewStackOf returns a stack holding data, the top item last. It lets other
+// interpreter implementations present their stack to a Tracer.
+func NewStackOf(data []uint256.Int) *Stack {
+	return &Stack{data: data}
+}
+
 func returnStack(s *Stack) {
 	s.data = s.data[:0]
 	stackPool.Put(s)
@@ -488,7 +488,7 @@ func testGetNodeData(t *testing.T, protocol uint) {
 	}
 	accounts := []common.Address{testAddr, acc1Addr, acc2Addr}
 	for i := uint64(0); i <= backend.chain.CurrentBlock().NumberU64(); i++ {
-		trie, _ := state.New(backend.chain.GetBlockByNumber(i).Root(), state.NewDatabase(statedb), nil)
+		trie, _ := state.New(backend.chain.GetBlockByNumber(i).Root(), state.NewDatabase(statedb), nil, nil)
 
 		for j, acc := range accounts {
 			state, _ := backend.chain.State()
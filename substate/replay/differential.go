@@ -0,0 +1,286 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/substate"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+const (
+	// ExecutionSection labels differences of the execution result that is
+	// not part of a substate.
+	ExecutionSection = "execution"
+
+	DiffReturnData substate.DiffKind = "returnData"
+	DiffError      substate.DiffKind = "error" // error of the VM or of applying the message
+)
+
+var (
+	ReferenceInterpreterFlag = cli.StringFlag{
+		Name:  "reference-vm",
+		Usage: "Interpreter whose outcome is taken as correct in a differential replay",
+		Value: "geth",
+	}
+	CandidateInterpreterFlag = cli.StringFlag{
+		Name:  "candidate-vm",
+		Usage: "Interpreter checked against the reference interpreter in a differential replay",
+		Value: "lfvm",
+	}
+	DivergenceReportFlag = cli.StringFlag{
+		Name:  "divergence-report",
+		Usage: "File the divergent transactions of a differential replay are written to as JSON lines",
+		Value: "divergences.jsonl",
+	}
+)
+
+// DifferentialCommand replays substates under two interpreters and reports
+// the transactions with different outcomes.
+var DifferentialCommand = cli.Command{
+	Action:    differentialAction,
+	Name:      "replay-diff",
+	Usage:     "executes transactions under two interpreters and reports divergent transactions",
+	ArgsUsage: "<blockNumFirst> <blockNumLast>",
+	Flags: []cli.Flag{
+		substate.WorkersFlag,
+		substate.SkipTransferTxsFlag,
+		substate.SkipCallTxsFlag,
+		substate.SkipCreateTxsFlag,
+		substate.FilterFlag,
+		substate.SchedulingFlag,
+		substate.OrderedOutputFlag,
+		ReferenceInterpreterFlag,
+		CandidateInterpreterFlag,
+		DivergenceReportFlag,
+		SuperInstructionsFlag,
+		substate.CheckpointFlag,
+		substate.ResumeFlag,
+		substate.SubstateDirFlag,
+		substate.SubstateCacheFlag,
+		substate.SubstateHandlesFlag,
+	},
+	Description: `
+The replay-diff command requires two arguments:
+<blockNumFirst> <blockNumLast>
+
+<blockNumFirst> and <blockNumLast> are the first and
+last block of the inclusive range of blocks to replay transactions.
+
+Unlike lfvm-dbg, divergent transactions do not stop the replay. They are
+written to --divergence-report with the differences of the output alloc,
+return data, gas and logs. Super instructions generated by
+lfvm-super-instructions are enabled with --super-instructions.`,
+}
+
+// Divergence is a transaction whose outcome under the candidate interpreter
+// differs from the outcome under the reference interpreter. Expected values
+// of Diff are those of the reference interpreter.
+type Divergence struct {
+	Block     uint64                `json:"block"`
+	Tx        int                   `json:"tx"`
+	Reference string                `json:"reference"`
+	Candidate string                `json:"candidate"`
+	Diff      substate.SubstateDiff `json:"diff"`
+}
+
+// Compare replays substate s with the reference and the candidate config and
+// returns the differences of the output alloc, the result, the return data
+// and errors of the candidate. A panic of an interpreter is an error of its
+// replay. It returns an error if the substate cannot be replayed with either
+// config in the same way, e.g. because of a block hash missing in the
+// substate.
+func Compare(s *substate.Substate, reference, candidate *Config) (substate.SubstateDiff, error) {
+	refResult, refErr := replayRecovered(s, reference)
+	canResult, canErr := replayRecovered(s, candidate)
+	switch {
+	case refErr != nil && canErr != nil && refErr.Error() == canErr.Error():
+		return nil, refErr
+	case refErr != nil || canErr != nil:
+		return substate.SubstateDiff{{
+			Section:  ExecutionSection,
+			Kind:     DiffError,
+			Expected: formatError(refErr),
+			Actual:   formatError(canErr),
+		}}, nil
+	}
+
+	expected := &substate.Substate{OutputAlloc: refResult.OutputAlloc, Result: refResult.SubstateResult()}
+	actual := &substate.Substate{OutputAlloc: canResult.OutputAlloc, Result: canResult.SubstateResult()}
+	diff := expected.Diff(actual)
+
+	refExec, canExec := refResult.Execution, canResult.Execution
+	if ref, can := hexutil.Encode(refExec.ReturnData), hexutil.Encode(canExec.ReturnData); ref != can {
+		diff = append(diff, substate.Difference{Section: ExecutionSection, Kind: DiffReturnData, Expected: ref, Actual: can})
+	}
+	if ref, can := formatError(refExec.Err), formatError(canExec.Err); ref != can {
+		diff = append(diff, substate.Difference{Section: ExecutionSection, Kind: DiffError, Expected: ref, Actual: can})
+	}
+	return diff, nil
+}
+
+// replayRecovered replays s like Replay, but returns a panic of the
+// interpreter as an error, so that a single transaction does not abort a
+// differential replay.
+func replayRecovered(s *substate.Substate, config *Config) (result *Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return Replay(s, config)
+}
+
+func formatError(err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	return strconv.Quote(err.Error())
+}
+
+// DifferentialStats counts the transactions of a differential replay.
+type DifferentialStats struct {
+	Transactions uint64 // number of compared transactions
+	Divergences  uint64 // number of transactions with different outcomes
+	Failures     uint64 // number of transactions neither interpreter could replay
+}
+
+// DifferentialReplayer compares substates under two interpreters and writes
+// every divergence to a report. It keeps going after a divergence, so that
+// a block range is checked completely. Task is safe for concurrent use and
+// can be used as the TaskFunc of a SubstateTaskPool.
+type DifferentialReplayer struct {
+	Reference *Config
+	Candidate *Config
+
+	lock   sync.Mutex
+	report *json.Encoder // nil if divergences are only counted
+	stats  DifferentialStats
+}
+
+// NewDifferentialReplayer creates a DifferentialReplayer that writes
+// divergences to report as JSON lines. report may be nil.
+func NewDifferentialReplayer(reference, candidate *Config, report io.Writer) *DifferentialReplayer {
+	d := &DifferentialReplayer{
+		Reference: reference,
+		Candidate: candidate,
+	}
+	if report != nil {
+		d.report = json.NewEncoder(report)
+	}
+	return d
+}
+
+// Task compares the substate of transaction tx in block. If taskPool has an
+// OutputFunc, divergences are emitted with taskPool.Output instead of being
+// written to the report. Task only returns an error if the divergence cannot
+// be written.
+func (d *DifferentialReplayer) Task(block uint64, tx int, s *substate.Substate, taskPool *substate.SubstateTaskPool) error {
+	diff, err := Compare(s, d.Reference, d.Candidate)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.stats.Transactions++
+	if err != nil {
+		d.stats.Failures++
+		return nil
+	}
+	if diff.Empty() {
+		return nil
+	}
+	d.stats.Divergences++
+	divergence := &Divergence{
+		Block:     block,
+		Tx:        tx,
+		Reference: interpreterName(d.Reference),
+		Candidate: interpreterName(d.Candidate),
+		Diff:      diff,
+	}
+	if taskPool != nil && taskPool.OutputFunc != nil {
+		return taskPool.Output(block, tx, divergence)
+	}
+	if d.report == nil {
+		return nil
+	}
+	return d.report.Encode(divergence)
+}
+
+// Stats returns the counts of the transactions compared so far.
+func (d *DifferentialReplayer) Stats() DifferentialStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.stats
+}
+
+func interpreterName(cfg *Config) string {
+	name := "geth"
+	if cfg != nil && cfg.Interpreter != "" {
+		name = cfg.Interpreter
+	} else if cfg != nil && cfg.VMConfig.InterpreterImpl != "" {
+		name = cfg.VMConfig.InterpreterImpl
+	}
+	return name
+}
+
+func differentialAction(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("substate-cli replay-diff command requires exactly 2 arguments")
+	}
+	first, ferr := strconv.ParseUint(ctx.Args().Get(0), 10, 64)
+	last, lerr := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	if ferr != nil || lerr != nil {
+		return fmt.Errorf("substate-cli replay-diff: error in parsing parameters: block number not an integer")
+	}
+	if first > last {
+		return fmt.Errorf("substate-cli replay-diff: error: first block has larger number than last block")
+	}
+
+	for _, flag := range []cli.StringFlag{ReferenceInterpreterFlag, CandidateInterpreterFlag} {
+		if name := ctx.String(flag.Name); !vm.HasInterpreterFactory(name) {
+			return fmt.Errorf("substate-cli replay-diff: unknown interpreter %q", name)
+		}
+	}
+
+	if err := EnableSuperInstructions(ctx); err != nil {
+		return fmt.Errorf("substate-cli replay-diff: %v", err)
+	}
+
+	report, err := os.Create(ctx.String(DivergenceReportFlag.Name))
+	if err != nil {
+		return err
+	}
+	defer report.Close()
+
+	substate.SetSubstateFlags(ctx)
+	substate.OpenSubstateDBReadOnly()
+	defer substate.CloseSubstateDB()
+
+	d := NewDifferentialReplayer(
+		&Config{Interpreter: ctx.String(ReferenceInterpreterFlag.Name)},
+		&Config{Interpreter: ctx.String(CandidateInterpreterFlag.Name)},
+		report,
+	)
+	taskPool := substate.NewSubstateTaskPool("substate-cli replay-diff", d.Task, first, last, ctx)
+	if taskPool.OrderedOutput {
+		enc := json.NewEncoder(report)
+		taskPool.OutputFunc = func(block uint64, tx int, output interface{}) error {
+			return enc.Encode(output)
+		}
+	}
+	err = taskPool.Execute()
+
+	stats := d.Stats()
+	fmt.Printf("substate-cli replay-diff: %v transactions, %v divergences, %v failures\n", stats.Transactions, stats.Divergences, stats.Failures)
+	if err != nil {
+		return err
+	}
+	return report.Close()
+}
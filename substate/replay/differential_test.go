@@ -0,0 +1,128 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+func TestDifferentialReplayer(t *testing.T) {
+	db := substate.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+
+	db.PutSubstate(1, 0, newTestSubstate(100, nil, 21000))
+	db.PutSubstate(1, 1, newTestSubstate(100, nil, 21000))
+	// the candidate uses more gas for code
+	db.PutSubstate(2, 0, newTestSubstate(0, []byte{0x60, 0x01, 0x00}, 100000)) // PUSH1 1; STOP
+	// the hash of the previous block is not recorded
+	db.PutSubstate(3, 0, newTestSubstate(0, []byte{0x63, 0x00, 0xc6, 0x5d, 0x3f, 0x40, 0x00}, 100000)) // PUSH4 12999999; BLOCKHASH; STOP
+
+	var report bytes.Buffer
+	d := NewDifferentialReplayer(&Config{Interpreter: "geth"}, &Config{Interpreter: "test-divergent"}, &report)
+	pool := &substate.SubstateTaskPool{
+		Name:     "replay-diff",
+		TaskFunc: d.Task,
+		First:    0,
+		Last:     10,
+		Workers:  2,
+		DB:       db,
+	}
+	if err := pool.Execute(); err != nil {
+		t.Fatalf("differential replay failed: %v", err)
+	}
+
+	if stats := d.Stats(); stats != (DifferentialStats{Transactions: 4, Divergences: 1, Failures: 1}) {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+	var divergence Divergence
+	if err := json.Unmarshal(report.Bytes(), &divergence); err != nil {
+		t.Fatalf("failed to decode report: %v\n%s", err, report.String())
+	}
+	if divergence.Block != 2 || divergence.Tx != 0 || divergence.Reference != "geth" || divergence.Candidate != "test-divergent" {
+		t.Fatalf("wrong divergence: %+v", divergence)
+	}
+	var gasDiff bool
+	for _, d := range divergence.Diff {
+		if d.Section == substate.ResultSection && d.Kind == substate.DiffGasUsed {
+			gasDiff = true
+		}
+	}
+	if !gasDiff {
+		t.Fatalf("gas difference not reported:\n%s", divergence.Diff)
+	}
+}
+
+// divergentInterpreter runs the EVM interpreter, but uses an extra unit of
+// gas for every contract with code.
+type divergentInterpreter struct {
+	vm.EVMInterpreter
+}
+
+func (i divergentInterpreter) Run(contract *vm.Contract, input []byte, readOnly bool) ([]byte, error) {
+	ret, err := i.EVMInterpreter.Run(contract, input, readOnly)
+	contract.UseGas(1)
+	return ret, err
+}
+
+// panickingInterpreter panics on every contract with code.
+type panickingInterpreter struct{}
+
+func (panickingInterpreter) Run(contract *vm.Contract, input []byte, readOnly bool) ([]byte, error) {
+	panic("interpreter failed")
+}
+
+func init() {
+	vm.RegisterInterpreterFactory("test-divergent", func(evm *vm.EVM, cfg vm.Config) vm.EVMInterpreter {
+		return divergentInterpreter{vm.NewEVMInterpreter(evm, cfg)}
+	})
+	vm.RegisterInterpreterFactory("test-panicking", func(evm *vm.EVM, cfg vm.Config) vm.EVMInterpreter {
+		return panickingInterpreter{}
+	})
+}
+
+func TestDifferentialReplayerRecoversPanics(t *testing.T) {
+	db := substate.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+
+	db.PutSubstate(1, 0, newTestSubstate(0, []byte{0x00}, 100000)) // STOP
+	db.PutSubstate(2, 0, newTestSubstate(0, []byte{0x00}, 100000))
+
+	for _, test := range []struct {
+		reference string
+		want      DifferentialStats
+	}{
+		{"geth", DifferentialStats{Transactions: 2, Divergences: 2}},
+		{"test-panicking", DifferentialStats{Transactions: 2, Failures: 2}},
+	} {
+		var report bytes.Buffer
+		d := NewDifferentialReplayer(&Config{Interpreter: test.reference}, &Config{Interpreter: "test-panicking"}, &report)
+		pool := &substate.SubstateTaskPool{
+			Name:     "replay-diff",
+			TaskFunc: d.Task,
+			First:    0,
+			Last:     10,
+			Workers:  2,
+			DB:       db,
+		}
+		if err := pool.Execute(); err != nil {
+			t.Fatalf("%s: differential replay failed: %v", test.reference, err)
+		}
+		if stats := d.Stats(); stats != test.want {
+			t.Errorf("%s: wrong stats: have %+v, want %+v", test.reference, stats, test.want)
+		}
+		if test.want.Divergences == 0 {
+			continue
+		}
+		var divergence Divergence
+		if err := json.NewDecoder(&report).Decode(&divergence); err != nil {
+			t.Fatalf("failed to decode report: %v", err)
+		}
+		if len(divergence.Diff) != 1 || divergence.Diff[0].Kind != DiffError || divergence.Diff[0].Actual != `"panic: interpreter failed"` {
+			t.Errorf("wrong divergence of a panic: %s", divergence.Diff)
+		}
+	}
+}
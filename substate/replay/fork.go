@@ -0,0 +1,279 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/substate"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var HardForkFlag = cli.Uint64Flag{
+	Name: "hard-fork",
+	Usage: `Hard-fork block number, won't change block number in Env for NUMBER instruction
+	1: Frontier
+	1150000: Homestead
+	2463000: Tangerine Whistle
+	2675000: Spurious Dragon
+	4370000: Byzantium
+	7280000: Constantinople + Petersburg
+	9069000: Istanbul
+	12244000: Berlin
+	12965000: London`,
+	Value: 12965000,
+}
+
+// ForkCommand replays substates under the rules of a single hard-fork and
+// summarizes how the outcomes differ from the recorded ones.
+var ForkCommand = cli.Command{
+	Action:    forkAction,
+	Name:      "replay-fork",
+	Usage:     "executes and check output of transactions in the given block range with the given hard-fork",
+	ArgsUsage: "<blockNumFirst> <blockNumLast>",
+	Flags: []cli.Flag{
+		substate.WorkersFlag,
+		substate.SkipTransferTxsFlag,
+		substate.SkipCallTxsFlag,
+		substate.SkipCreateTxsFlag,
+		HardForkFlag,
+		substate.FilterFlag,
+		substate.SchedulingFlag,
+		substate.CheckpointFlag,
+		substate.ResumeFlag,
+		substate.SubstateDirFlag,
+		substate.SubstateCacheFlag,
+		substate.SubstateHandlesFlag,
+	},
+	Description: `
+The replay-fork command requires two arguments:
+<blockNumFirst> <blockNumLast>
+
+<blockNumFirst> and <blockNumLast> are the first and
+last block of the inclusive range of blocks to replay transactions.
+
+--hard-fork parameter is recommended for this command.`,
+}
+
+// ForkChainConfig returns a copy of the mainnet chain config that applies
+// the rules of the hard-fork active at block number on mainnet to every
+// block. Later hard-forks are disabled.
+func ForkChainConfig(number uint64) *params.ChainConfig {
+	var (
+		config = *params.MainnetChainConfig
+		num    = new(big.Int).SetUint64(number)
+	)
+	fork := func(block *big.Int) *big.Int {
+		if block == nil || block.Cmp(num) > 0 {
+			return nil
+		}
+		return new(big.Int)
+	}
+	config.HomesteadBlock = fork(config.HomesteadBlock)
+	config.DAOForkBlock = nil // irregular state change, not part of transactions
+	config.DAOForkSupport = false
+	config.EIP150Block = fork(config.EIP150Block)
+	config.EIP155Block = fork(config.EIP155Block)
+	config.EIP158Block = fork(config.EIP158Block)
+	config.ByzantiumBlock = fork(config.ByzantiumBlock)
+	config.ConstantinopleBlock = fork(config.ConstantinopleBlock)
+	config.PetersburgBlock = fork(config.PetersburgBlock)
+	config.IstanbulBlock = fork(config.IstanbulBlock)
+	config.MuirGlacierBlock = fork(config.MuirGlacierBlock)
+	config.BerlinBlock = fork(config.BerlinBlock)
+	config.LondonBlock = fork(config.LondonBlock)
+	config.CatalystBlock = fork(config.CatalystBlock)
+	return &config
+}
+
+// ForkOutcome classifies the outcome of a transaction replayed under the
+// rules of another hard-fork.
+type ForkOutcome int
+
+const (
+	ForkIdentical       ForkOutcome = iota // same output alloc and result
+	ForkDifferentGas                       // same effects, but different gas and fees
+	ForkDifferentResult                    // different status, logs or state changes
+	ForkNowFailing                         // successful transaction fails or cannot be applied
+
+	numForkOutcomes = iota
+)
+
+var forkOutcomeNames = [numForkOutcomes]string{
+	ForkIdentical:       "identical",
+	ForkDifferentGas:    "different gas",
+	ForkDifferentResult: "different result",
+	ForkNowFailing:      "now failing",
+}
+
+func (o ForkOutcome) String() string {
+	if o < 0 || int(o) >= numForkOutcomes {
+		return fmt.Sprintf("ForkOutcome(%d)", int(o))
+	}
+	return forkOutcomeNames[o]
+}
+
+// ClassifyFork classifies the outcome of replaying s, the result and error
+// returned by Replay. A transaction that cannot be applied any more, e.g.
+// because of a higher intrinsic gas, is now failing. Differences that only
+// concern the gas used and the balances of the sender and the coinbase are
+// differences of gas.
+func ClassifyFork(s *substate.Substate, result *Result, err error) ForkOutcome {
+	if err != nil {
+		return ForkNowFailing
+	}
+	if result.OK() {
+		return ForkIdentical
+	}
+	if s.Result.Status == types.ReceiptStatusSuccessful && result.Receipt.Status == types.ReceiptStatusFailed {
+		return ForkNowFailing
+	}
+	for _, d := range result.Diff {
+		switch d.Kind {
+		case substate.DiffGasUsed:
+			continue
+		case substate.DiffBalance, substate.DiffAccount:
+			if d.Address != nil && (*d.Address == s.Message.From || *d.Address == s.Env.Coinbase) {
+				continue
+			}
+		}
+		return ForkDifferentResult
+	}
+	return ForkDifferentGas
+}
+
+// ReplayFork replays s with config and classifies the outcome. It returns an
+// error if the substate cannot be replayed independent of the hard-fork,
+// e.g. because of a block hash missing in the substate.
+func ReplayFork(s *substate.Substate, config *Config) (ForkOutcome, *Result, error) {
+	if name := interpreterName(config); !vm.HasInterpreterFactory(name) {
+		return 0, nil, fmt.Errorf("unknown interpreter %q", name)
+	}
+	result, err := Replay(s, config)
+	if errors.Is(err, ErrBlockHashNotRecorded) {
+		return 0, nil, err
+	}
+	return ClassifyFork(s, result, err), result, nil
+}
+
+// ForkStats counts the outcomes of transactions replayed under the rules of
+// a hard-fork.
+type ForkStats struct {
+	Outcomes [numForkOutcomes]uint64
+	Failures uint64 // number of transactions that could not be replayed
+}
+
+// Transactions returns the number of classified transactions.
+func (s *ForkStats) Transactions() uint64 {
+	var n uint64
+	for _, count := range s.Outcomes {
+		n += count
+	}
+	return n
+}
+
+// WriteTable writes the number and share of transactions of every outcome
+// as a table.
+func (s *ForkStats) WriteTable(w io.Writer) error {
+	total := s.Transactions()
+	share := func(n uint64) string {
+		if total == 0 {
+			return "-"
+		}
+		return strconv.FormatFloat(100*float64(n)/float64(total), 'f', 2, 64) + "%"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "outcome\ttransactions\tshare\t\n")
+	for o, n := range s.Outcomes {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t\n", ForkOutcome(o), n, share(n))
+	}
+	fmt.Fprintf(tw, "total\t%d\t%s\t\n", total, share(total))
+	if s.Failures > 0 {
+		fmt.Fprintf(tw, "not replayable\t%d\t\t\n", s.Failures)
+	}
+	return tw.Flush()
+}
+
+// ForkReplayer replays substates under the rules of a hard-fork and counts
+// the outcomes. Task is safe for concurrent use and can be used as the
+// TaskFunc of a SubstateTaskPool.
+type ForkReplayer struct {
+	Config *Config
+
+	lock  sync.Mutex
+	stats ForkStats
+}
+
+// NewForkReplayer creates a ForkReplayer replaying with the rules of the
+// hard-fork active at block number on mainnet.
+func NewForkReplayer(number uint64, interpreter string) *ForkReplayer {
+	return &ForkReplayer{
+		Config: &Config{
+			ChainConfig: ForkChainConfig(number),
+			Interpreter: interpreter,
+		},
+	}
+}
+
+// Task replays the substate of transaction tx in block and counts its
+// outcome. Transactions that cannot be replayed are counted as failures.
+func (f *ForkReplayer) Task(block uint64, tx int, s *substate.Substate, taskPool *substate.SubstateTaskPool) error {
+	outcome, _, err := ReplayFork(s, f.Config)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err != nil {
+		f.stats.Failures++
+		return nil
+	}
+	f.stats.Outcomes[outcome]++
+	return nil
+}
+
+// Stats returns the counts of the transactions replayed so far.
+func (f *ForkReplayer) Stats() ForkStats {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.stats
+}
+
+func forkAction(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("substate-cli replay-fork command requires exactly 2 arguments")
+	}
+	first, ferr := strconv.ParseUint(ctx.Args().Get(0), 10, 64)
+	last, lerr := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	if ferr != nil || lerr != nil {
+		return fmt.Errorf("substate-cli replay-fork: error in parsing parameters: block number not an integer")
+	}
+	if first > last {
+		return fmt.Errorf("substate-cli replay-fork: error: first block has larger number than last block")
+	}
+
+	substate.SetSubstateFlags(ctx)
+	substate.OpenSubstateDBReadOnly()
+	defer substate.CloseSubstateDB()
+
+	hardFork := ctx.Uint64(HardForkFlag.Name)
+	f := NewForkReplayer(hardFork, "")
+	taskPool := substate.NewSubstateTaskPool("substate-cli replay-fork", f.Task, first, last, ctx)
+	err := taskPool.Execute()
+
+	fmt.Printf("substate-cli replay-fork: hard-fork %v\n", hardFork)
+	stats := f.Stats()
+	if werr := stats.WriteTable(os.Stdout); err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package replay
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+func TestForkChainConfig(t *testing.T) {
+	number := big.NewInt(13000000)
+	if config := ForkChainConfig(12965000); !config.IsLondon(number) {
+		t.Fatalf("London not active")
+	}
+	config := ForkChainConfig(9069000)
+	if !config.IsIstanbul(big.NewInt(0)) || config.IsBerlin(number) || config.IsLondon(number) {
+		t.Fatalf("wrong rules of Istanbul config: %v", config)
+	}
+	if config := ForkChainConfig(1); config.IsHomestead(number) || config.IsEIP150(number) {
+		t.Fatalf("wrong rules of Frontier config: %v", config)
+	}
+
+	// NUMBER is not changed by the fork override
+	code := []byte{0x43, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3} // NUMBER; PUSH1 0; MSTORE; PUSH1 32; PUSH1 0; RETURN
+	result, err := Replay(newTestSubstate(0, code, 100000), &Config{ChainConfig: ForkChainConfig(1)})
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if ret := result.Execution.ReturnData; common.BytesToHash(ret) != common.BigToHash(big.NewInt(13000000)) {
+		t.Fatalf("wrong block number: %x", ret)
+	}
+}
+
+// newRecordedSubstate returns the substate of a transaction calling code, as
+// recorded under London.
+func newRecordedSubstate(t *testing.T, code []byte) *substate.Substate {
+	s := newTestSubstate(0, code, 100000)
+	result, err := Replay(s, nil)
+	if err != nil {
+		t.Fatalf("failed to record substate: %v", err)
+	}
+	s.OutputAlloc = result.OutputAlloc
+	s.Result = result.SubstateResult()
+	return s
+}
+
+func TestReplayFork(t *testing.T) {
+	var (
+		sload  = []byte{0x60, 0x00, 0x54, 0x50, 0x00}                   // PUSH1 0; SLOAD; POP; STOP
+		store  = []byte{0x60, 0x00, 0x54, 0x50, 0x5a, 0x60, 0x00, 0x55} // PUSH1 0; SLOAD; POP; GAS; PUSH1 0; SSTORE
+		chain  = []byte{0x46, 0x60, 0x00, 0x55}                         // CHAINID; PUSH1 0; SSTORE
+		london = uint64(12965000)
+	)
+	tests := []struct {
+		substate *substate.Substate
+		fork     uint64
+		outcome  ForkOutcome
+	}{
+		{newTestSubstate(100, nil, 21000), london, ForkIdentical},
+		{newRecordedSubstate(t, sload), london, ForkIdentical},
+		// without EIP-1559 the coinbase receives the whole fee
+		{newTestSubstate(100, nil, 21000), 12244000, ForkDifferentGas},
+		// SLOAD costs 800 gas in Istanbul instead of 2100 for a cold slot
+		{newRecordedSubstate(t, sload), 9069000, ForkDifferentGas},
+		{newRecordedSubstate(t, store), 9069000, ForkDifferentResult},
+		// CHAINID is introduced by Istanbul
+		{newRecordedSubstate(t, chain), 7280000, ForkNowFailing},
+	}
+	for i, test := range tests {
+		outcome, _, err := ReplayFork(test.substate, &Config{ChainConfig: ForkChainConfig(test.fork)})
+		if err != nil {
+			t.Fatalf("test %d: failed to replay: %v", i, err)
+		}
+		if outcome != test.outcome {
+			t.Errorf("test %d: wrong outcome: have %v, want %v", i, outcome, test.outcome)
+		}
+	}
+
+	if _, _, err := ReplayFork(newTestSubstate(100, nil, 21000), &Config{Interpreter: "no-such-vm"}); err == nil {
+		t.Fatalf("replayed with unknown interpreter")
+	}
+}
+
+func TestForkReplayer(t *testing.T) {
+	db := substate.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+
+	db.PutSubstate(1, 0, newTestSubstate(100, nil, 21000))
+	db.PutSubstate(1, 1, newRecordedSubstate(t, []byte{0x60, 0x01, 0x60, 0x00, 0x55})) // PUSH1 1; PUSH1 0; SSTORE
+	db.PutSubstate(2, 0, newRecordedSubstate(t, []byte{0x47, 0x60, 0x00, 0x55}))       // SELFBALANCE; PUSH1 0; SSTORE
+	// the hash of the previous block is not recorded
+	db.PutSubstate(3, 0, newTestSubstate(0, []byte{0x63, 0x00, 0xc6, 0x5d, 0x3f, 0x40, 0x00}, 100000)) // PUSH4 12999999; BLOCKHASH; STOP
+
+	f := NewForkReplayer(4370000, "")
+	pool := &substate.SubstateTaskPool{
+		Name:     "replay-fork",
+		TaskFunc: f.Task,
+		First:    0,
+		Last:     10,
+		Workers:  2,
+		DB:       db,
+	}
+	if err := pool.Execute(); err != nil {
+		t.Fatalf("fork replay failed: %v", err)
+	}
+
+	stats := f.Stats()
+	want := ForkStats{Failures: 1}
+	want.Outcomes[ForkDifferentGas] = 2
+	want.Outcomes[ForkNowFailing] = 1
+	if stats != want {
+		t.Fatalf("wrong stats: have %+v, want %+v", stats, want)
+	}
+
+	var table bytes.Buffer
+	if err := stats.WriteTable(&table); err != nil {
+		t.Fatalf("failed to write table: %v", err)
+	}
+	text := strings.Join(strings.Fields(table.String()), " ")
+	for _, row := range []string{"different gas 2 66.67%", "now failing 1 33.33%", "total 3 100.00%", "not replayable 1"} {
+		if !strings.Contains(text, row) {
+			t.Errorf("row %q missing in table:\n%s", row, table.String())
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package replay
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/substate"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	InterpreterFlag = cli.StringFlag{
+		Name:  "interpreter",
+		Usage: "Interpreter executing the replayed transactions",
+		Value: "geth",
+	}
+	MicroProfilingDBFlag = cli.StringFlag{
+		Name:  "micro-profiling-db",
+		Usage: "SQLite3 database the micro-profiling statistics are written to; disabled if empty",
+	}
+	BasicBlockProfilingDBFlag = cli.StringFlag{
+		Name:  "basic-block-profiling-db",
+		Usage: "SQLite3 database the basic-block statistics are written to; disabled if empty",
+	}
+	ProfilingShardsFlag = cli.IntFlag{
+		Name:  "profiling-shards",
+		Usage: "Number of goroutines aggregating the profiling records of each collector (default: number of workers)",
+	}
+	ProfilingBufferSizeFlag = cli.IntFlag{
+		Name:  "profiling-buffer-size",
+		Usage: "Number of profiling records buffered for each goroutine aggregating them",
+		Value: 10000,
+	}
+)
+
+// ProfileCommand replays substates with the micro-profiling and basic-block
+// profiling collectors and writes their statistics to SQLite3 databases.
+var ProfileCommand = cli.Command{
+	Action:    profileAction,
+	Name:      "replay-profile",
+	Usage:     "profiles the execution of transactions in the given block range",
+	ArgsUsage: "<blockNumFirst> <blockNumLast>",
+	Flags: []cli.Flag{
+		substate.WorkersFlag,
+		substate.SkipTransferTxsFlag,
+		substate.SkipCallTxsFlag,
+		substate.SkipCreateTxsFlag,
+		substate.FilterFlag,
+		substate.SchedulingFlag,
+		InterpreterFlag,
+		MicroProfilingDBFlag,
+		BasicBlockProfilingDBFlag,
+		ProfilingShardsFlag,
+		ProfilingBufferSizeFlag,
+		substate.SubstateDirFlag,
+		substate.SubstateCacheFlag,
+		substate.SubstateHandlesFlag,
+	},
+	Description: `
+The replay-profile command requires two arguments:
+<blockNumFirst> <blockNumLast>
+
+<blockNumFirst> and <blockNumLast> are the first and
+last block of the inclusive range of blocks to replay transactions.
+
+The statistics are written to --micro-profiling-db and
+--basic-block-profiling-db, tagged with the block range, the
+interpreter and the hard-fork; the rows of earlier runs with other
+tags are kept. The statistics of a failed or interrupted run are not
+written.`,
+}
+
+// ProfilingConfig selects the profiles collected by a ProfileReplayer.
+type ProfilingConfig struct {
+	MicroProfilingDB      string // micro-profiling is disabled if empty
+	BasicBlockProfilingDB string // basic-block profiling is disabled if empty
+	Collector             vm.ProfileCollectorConfig
+}
+
+// ProfileReplayer replays substates with the profiling collectors of its
+// configuration. The collectors run from Start to Stop.
+type ProfileReplayer struct {
+	Config *Config
+
+	profiling ProfilingConfig
+	micro     *vm.MicroProfileCollector
+	blocks    *vm.BasicBlockProfileCollector
+}
+
+// NewProfileReplayer creates a ProfileReplayer replaying with interpreter.
+func NewProfileReplayer(interpreter string, profiling ProfilingConfig) *ProfileReplayer {
+	p := &ProfileReplayer{
+		Config:    &Config{Interpreter: interpreter},
+		profiling: profiling,
+	}
+	if profiling.MicroProfilingDB != "" {
+		p.micro = vm.NewMicroProfileCollector(profiling.Collector)
+		p.Config.VMConfig.Profilers = append(p.Config.VMConfig.Profilers, p.micro)
+	}
+	if profiling.BasicBlockProfilingDB != "" {
+		p.blocks = vm.NewBasicBlockProfileCollector(profiling.Collector)
+		p.Config.VMConfig.Profilers = append(p.Config.VMConfig.Profilers, p.blocks)
+	}
+	return p
+}
+
+// Start starts the collectors.
+func (p *ProfileReplayer) Start() {
+	if p.micro != nil {
+		p.micro.Start()
+	}
+	if p.blocks != nil {
+		p.blocks.Start()
+	}
+}
+
+// Task replays the substate of transaction tx in block. Only the executed
+// instructions matter, not the outcome.
+func (p *ProfileReplayer) Task(block uint64, tx int, s *substate.Substate, taskPool *substate.SubstateTaskPool) error {
+	Replay(s, p.Config)
+	return nil
+}
+
+// Stop stops the collectors and writes their statistics of run to the
+// databases of the configuration.
+func (p *ProfileReplayer) Stop(run vm.ProfilingRun) error {
+	if p.micro != nil {
+		if err := p.micro.Stop().Dump(p.profiling.MicroProfilingDB, run); err != nil {
+			return fmt.Errorf("failed to write micro-profiling statistics: %v", err)
+		}
+	}
+	if p.blocks != nil {
+		if err := p.blocks.Stop().Dump(p.profiling.BasicBlockProfilingDB, run); err != nil {
+			return fmt.Errorf("failed to write basic-block statistics: %v", err)
+		}
+	}
+	return nil
+}
+
+// Discard stops the collectors without writing their statistics, e.g. of a
+// run that did not complete its block range.
+func (p *ProfileReplayer) Discard() {
+	if p.micro != nil {
+		p.micro.Stop()
+	}
+	if p.blocks != nil {
+		p.blocks.Stop()
+	}
+}
+
+// ForkName returns the name of the mainnet hard-fork active at block number.
+func ForkName(number uint64) string {
+	var (
+		config = params.MainnetChainConfig
+		num    = new(big.Int).SetUint64(number)
+	)
+	switch {
+	case config.IsLondon(num):
+		return "London"
+	case config.IsBerlin(num):
+		return "Berlin"
+	case config.IsIstanbul(num):
+		return "Istanbul"
+	case config.IsPetersburg(num):
+		return "Petersburg"
+	case config.IsByzantium(num):
+		return "Byzantium"
+	case config.IsEIP158(num):
+		return "Spurious Dragon"
+	case config.IsEIP150(num):
+		return "Tangerine Whistle"
+	case config.IsHomestead(num):
+		return "Homestead"
+	}
+	return "Frontier"
+}
+
+// NewProfilingRun returns the description of a profiling run of interpreter
+// over the blocks from first to last. A range spanning hard-forks is
+// described by its first and last hard-fork, e.g. Berlin-London.
+func NewProfilingRun(first, last uint64, interpreter string) vm.ProfilingRun {
+	fork := ForkName(first)
+	if lastFork := ForkName(last); lastFork != fork {
+		fork += "-" + lastFork
+	}
+	return vm.ProfilingRun{
+		Version:     params.VersionWithMeta(),
+		FirstBlock:  first,
+		LastBlock:   last,
+		Interpreter: interpreter,
+		Fork:        fork,
+	}
+}
+
+func profileAction(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("substate-cli replay-profile command requires exactly 2 arguments")
+	}
+	first, ferr := strconv.ParseUint(ctx.Args().Get(0), 10, 64)
+	last, lerr := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	if ferr != nil || lerr != nil {
+		return fmt.Errorf("substate-cli replay-profile: error in parsing parameters: block number not an integer")
+	}
+	if first > last {
+		return fmt.Errorf("substate-cli replay-profile: error: first block has larger number than last block")
+	}
+	interpreter := ctx.String(InterpreterFlag.Name)
+	if !vm.HasInterpreterFactory(interpreter) {
+		return fmt.Errorf("substate-cli replay-profile: unknown interpreter %q", interpreter)
+	}
+	shards := ctx.Int(ProfilingShardsFlag.Name)
+	if shards <= 0 {
+		shards = ctx.Int(substate.WorkersFlag.Name)
+	}
+
+	substate.SetSubstateFlags(ctx)
+	substate.OpenSubstateDBReadOnly()
+	defer substate.CloseSubstateDB()
+
+	p := NewProfileReplayer(interpreter, ProfilingConfig{
+		MicroProfilingDB:      ctx.String(MicroProfilingDBFlag.Name),
+		BasicBlockProfilingDB: ctx.String(BasicBlockProfilingDBFlag.Name),
+		Collector: vm.ProfileCollectorConfig{
+			Shards:     shards,
+			BufferSize: ctx.Int(ProfilingBufferSizeFlag.Name),
+		},
+	})
+	p.Start()
+	taskPool := substate.NewSubstateTaskPool("substate-cli replay-profile", p.Task, first, last, ctx)
+	// the statistics of an aborted run would replace those of a complete run
+	// of the block range
+	if err := taskPool.Execute(); err != nil {
+		p.Discard()
+		return fmt.Errorf("%v; statistics of the incomplete run are not written", err)
+	}
+	return p.Stop(NewProfilingRun(first, last, interpreter))
+}
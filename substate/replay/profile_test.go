@@ -0,0 +1,109 @@
+package replay
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+func TestProfileReplayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := substate.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	db.PutSubstate(1, 0, newTestSubstate(0, []byte{0x60, 0x2a, 0x60, 0x00, 0x52, 0x00}, 100000)) // PUSH1 42; PUSH1 0; MSTORE; STOP
+	db.PutSubstate(2, 0, newTestSubstate(0, []byte{0x60, 0x03, 0x56, 0x5b, 0x00}, 100000))       // PUSH1 3; JUMP; JUMPDEST; STOP
+
+	for _, interpreter := range []string{"geth", "lfvm"} {
+		profiling := ProfilingConfig{
+			MicroProfilingDB:      filepath.Join(dir, "micro.db"),
+			BasicBlockProfilingDB: filepath.Join(dir, "blocks.db"),
+			Collector:             vm.ProfileCollectorConfig{Shards: 2, BufferSize: 4},
+		}
+		p := NewProfileReplayer(interpreter, profiling)
+		p.Start()
+		pool := &substate.SubstateTaskPool{
+			Name:     "replay-profile",
+			TaskFunc: p.Task,
+			First:    0,
+			Last:     10,
+			Workers:  2,
+			DB:       db,
+		}
+		if err := pool.Execute(); err != nil {
+			t.Fatalf("%s: profiled replay failed: %v", interpreter, err)
+		}
+		if err := p.Stop(NewProfilingRun(1, 2, interpreter)); err != nil {
+			t.Fatalf("%s: failed to write profiles: %v", interpreter, err)
+		}
+	}
+
+	for name, queries := range map[string]map[string]uint64{
+		"micro.db": {
+			"SELECT frequency FROM OpCodeFrequency WHERE opcode = 'PUSH1' AND interpreter = 'lfvm' AND fork = 'Frontier'": 3,
+			"SELECT COUNT(*) FROM OpCodeFrequency WHERE opcode = 'STOP'":                                                  2,
+			"SELECT COUNT(*) FROM FunctionProfile WHERE selector = '' AND interpreter = 'lfvm'":                           2,
+		},
+		"blocks.db": {
+			"SELECT frequency FROM BasicBlockFrequency WHERE address = 3 AND interpreter = 'geth'": 1,
+		},
+	} {
+		sqlDB, err := sql.Open("sqlite3", filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for query, want := range queries {
+			var have uint64
+			if err := sqlDB.QueryRow(query).Scan(&have); err != nil {
+				t.Errorf("%s: %s failed: %v", name, query, err)
+			} else if have != want {
+				t.Errorf("%s: %s: have %d, want %d", name, query, have, want)
+			}
+		}
+		sqlDB.Close()
+	}
+}
+
+func TestProfileReplayerDiscard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	profiling := ProfilingConfig{
+		MicroProfilingDB:      filepath.Join(dir, "micro.db"),
+		BasicBlockProfilingDB: filepath.Join(dir, "blocks.db"),
+	}
+	p := NewProfileReplayer("geth", profiling)
+	p.Start()
+	p.Task(1, 0, newTestSubstate(0, []byte{0x60, 0x03, 0x56, 0x5b, 0x00}, 100000), nil)
+	p.Discard()
+	for _, name := range []string{profiling.MicroProfilingDB, profiling.BasicBlockProfilingDB} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("discarded statistics written to %s", name)
+		}
+	}
+}
+
+func TestNewProfilingRun(t *testing.T) {
+	if run := NewProfilingRun(12244000, 12244010, "lfvm"); run.Fork != "Berlin" || run.Interpreter != "lfvm" {
+		t.Errorf("wrong run: %+v", run)
+	}
+	if run := NewProfilingRun(12300000, 13000000, "geth"); run.Fork != "Berlin-London" {
+		t.Errorf("wrong fork of a range spanning hard-forks: %q", run.Fork)
+	}
+	if fork := ForkName(0); fork != "Frontier" {
+		t.Errorf("wrong fork of the genesis block: %q", fork)
+	}
+}
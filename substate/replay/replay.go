@@ -0,0 +1,208 @@
+// Package replay executes transaction substates and compares the outcome with
+// the recorded substate.
+//
+// It is a separate package because the state implementation in core/state
+// records substates and therefore depends on package substate.
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	_ "github.com/ethereum/go-ethereum/core/vm/lfvm" // register lfvm interpreters
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+// ErrBlockHashNotRecorded is returned by Replay if the transaction reads the
+// hash of a block that is not recorded in the substate.
+var ErrBlockHashNotRecorded = errors.New("block hash not recorded")
+
+var (
+	// replayBlockHash and replayTxHash identify the replayed transaction in
+	// its logs and receipt.
+	replayBlockHash = common.Hash{0x01}
+	replayTxHash    = common.Hash{0x02}
+)
+
+// StateDB is the state a substate is replayed on. GetSubstatePostAlloc
+// returns the accounts modified by the replayed transaction after Finalise.
+type StateDB interface {
+	vm.StateDB
+
+	Prepare(thash common.Hash, ti int)
+	Finalise(deleteEmptyObjects bool)
+	IntermediateRoot(deleteEmptyObjects bool) common.Hash
+	GetLogs(hash common.Hash, blockHash common.Hash) []*types.Log
+	GetSubstatePostAlloc() substate.SubstateAlloc
+}
+
+// StateFactory creates a StateDB holding the accounts of alloc.
+type StateFactory func(alloc substate.SubstateAlloc) (StateDB, error)
+
+// NewMemoryStateDB is the default StateFactory. It creates an in-memory
+// state.StateDB that records the substate of the replayed transaction.
+func NewMemoryStateDB(alloc substate.SubstateAlloc) (StateDB, error) {
+	db := state.NewDatabase(rawdb.NewMemoryDatabase())
+	statedb, err := state.New(common.Hash{}, db, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	for addr, account := range alloc {
+		if account == nil {
+			continue // account did not exist before the transaction
+		}
+		statedb.SetNonce(addr, account.Nonce)
+		statedb.SetBalance(addr, account.Balance)
+		statedb.SetCode(addr, account.Code)
+		for key, value := range account.Storage {
+			statedb.SetState(addr, key, value)
+		}
+	}
+	// reopen the committed state, so that the accounts of alloc are not
+	// recorded as modified by the transaction
+	root, err := statedb.Commit(false)
+	if err != nil {
+		return nil, err
+	}
+	return state.New(root, db, nil, state.NewAllocRecorder())
+}
+
+// Config holds the options to replay a substate.
+type Config struct {
+	ChainConfig *params.ChainConfig // mainnet if nil
+	Interpreter string              // name of a registered interpreter, e.g. geth, lfvm or lfvm-si; overrides VMConfig.InterpreterImpl if set
+	VMConfig    vm.Config
+	NewStateDB  StateFactory // NewMemoryStateDB if nil
+}
+
+// Result is the outcome of a replayed substate.
+type Result struct {
+	OutputAlloc substate.SubstateAlloc
+	Receipt     *types.Receipt
+	Execution   *core.ExecutionResult // gas, VM error and return data
+
+	// Diff lists the differences of the output alloc and the result from
+	// the recorded substate.
+	Diff substate.SubstateDiff
+}
+
+// OK reports whether the replay reproduced the recorded substate.
+func (r *Result) OK() bool {
+	return r.Diff.Empty()
+}
+
+// SubstateResult returns the receipt in the form recorded in substates.
+func (r *Result) SubstateResult() *substate.SubstateResult {
+	return substate.NewSubstateResult(r.Receipt)
+}
+
+// Replay executes the transaction of substate s on its input alloc and
+// compares the output alloc and the result with the recorded ones. It returns
+// an error if the transaction cannot be applied, e.g. because of an invalid
+// nonce, or if it reads a block hash that was not recorded; a transaction
+// that produces a different outcome is reported in Result.Diff.
+func Replay(s *substate.Substate, config *Config) (*Result, error) {
+	cfg := Config{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.ChainConfig == nil {
+		cfg.ChainConfig = params.MainnetChainConfig
+	}
+	if cfg.Interpreter != "" {
+		cfg.VMConfig.InterpreterImpl = cfg.Interpreter
+	}
+	if !vm.HasInterpreterFactory(cfg.VMConfig.InterpreterImpl) {
+		return nil, fmt.Errorf("unknown interpreter %q", cfg.VMConfig.InterpreterImpl)
+	}
+	if cfg.NewStateDB == nil {
+		cfg.NewStateDB = NewMemoryStateDB
+	}
+
+	statedb, err := cfg.NewStateDB(s.InputAlloc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create state: %v", err)
+	}
+
+	env := s.Env
+	var hashErr error
+	getHash := func(num uint64) common.Hash {
+		hash, found := env.BlockHashes[num]
+		if !found && hashErr == nil {
+			hashErr = fmt.Errorf("%w: block %d", ErrBlockHashNotRecorded, num)
+		}
+		return hash
+	}
+	blockCtx := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GetHash:     getHash,
+		Coinbase:    env.Coinbase,
+		GasLimit:    env.GasLimit,
+		BlockNumber: new(big.Int).SetUint64(env.Number),
+		Time:        new(big.Int).SetUint64(env.Timestamp),
+		Difficulty:  env.Difficulty,
+	}
+	if env.BaseFee != nil {
+		blockCtx.BaseFee = new(big.Int).Set(env.BaseFee)
+	} else if cfg.ChainConfig.IsLondon(blockCtx.BlockNumber) {
+		// transaction recorded before London replayed with a fork override
+		blockCtx.BaseFee = new(big.Int)
+	}
+
+	msg := s.Message.AsMessage()
+	statedb.Prepare(replayTxHash, 0)
+	evm := vm.NewEVM(blockCtx, core.NewEVMTxContext(msg), statedb, cfg.ChainConfig, cfg.VMConfig)
+	gaspool := new(core.GasPool).AddGas(env.GasLimit)
+	snapshot := statedb.Snapshot()
+	execution, err := core.ApplyMessage(evm, msg, gaspool)
+	if err != nil {
+		statedb.RevertToSnapshot(snapshot)
+		return nil, err
+	}
+	if hashErr != nil {
+		return nil, hashErr
+	}
+	if cfg.ChainConfig.IsByzantium(blockCtx.BlockNumber) {
+		statedb.Finalise(true)
+	} else {
+		statedb.IntermediateRoot(cfg.ChainConfig.IsEIP158(blockCtx.BlockNumber))
+	}
+
+	receipt := &types.Receipt{
+		CumulativeGasUsed: execution.UsedGas,
+		TxHash:            replayTxHash,
+		GasUsed:           execution.UsedGas,
+		Logs:              statedb.GetLogs(replayTxHash, replayBlockHash),
+		BlockHash:         replayBlockHash,
+		BlockNumber:       new(big.Int).SetUint64(env.Number),
+	}
+	if execution.Failed() {
+		receipt.Status = types.ReceiptStatusFailed
+	} else {
+		receipt.Status = types.ReceiptStatusSuccessful
+	}
+	if msg.To() == nil {
+		receipt.ContractAddress = crypto.CreateAddress(msg.From(), msg.Nonce())
+	}
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+
+	result := &Result{
+		OutputAlloc: statedb.GetSubstatePostAlloc(),
+		Receipt:     receipt,
+		Execution:   execution,
+	}
+	expected := &substate.Substate{OutputAlloc: s.OutputAlloc, Result: s.Result}
+	actual := &substate.Substate{OutputAlloc: result.OutputAlloc, Result: result.SubstateResult()}
+	result.Diff = expected.Diff(actual)
+	return result, nil
+}
@@ -0,0 +1,126 @@
+package replay
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+var (
+	testSender   = common.HexToAddress("0x1000000000000000000000000000000000000001")
+	testTo       = common.HexToAddress("0x2000000000000000000000000000000000000002")
+	testCoinbase = common.HexToAddress("0x3000000000000000000000000000000000000003")
+)
+
+// newTestSubstate returns the substate of a London transaction from
+// testSender to testTo with the given code. The output alloc is recorded
+// for a transfer of value without code.
+func newTestSubstate(value int64, code []byte, gas uint64) *substate.Substate {
+	var (
+		balance = big.NewInt(1000000000)
+		baseFee = big.NewInt(10)
+		tip     = big.NewInt(2)
+	)
+	fee := new(big.Int).Mul(new(big.Int).Add(baseFee, tip), big.NewInt(21000))
+	senderBalance := new(big.Int).Sub(balance, fee)
+	senderBalance.Sub(senderBalance, big.NewInt(value))
+
+	inputAlloc := substate.SubstateAlloc{
+		testSender: substate.NewSubstateAccount(0, balance, nil),
+		testTo:     substate.NewSubstateAccount(0, big.NewInt(0), code),
+	}
+	outputAlloc := substate.SubstateAlloc{
+		testSender:   substate.NewSubstateAccount(1, senderBalance, nil),
+		testTo:       substate.NewSubstateAccount(0, big.NewInt(value), code),
+		testCoinbase: substate.NewSubstateAccount(0, new(big.Int).Mul(tip, big.NewInt(21000)), nil),
+	}
+	env := &substate.SubstateEnv{
+		Coinbase:    testCoinbase,
+		Difficulty:  big.NewInt(1),
+		GasLimit:    30000000,
+		Number:      13000000,
+		Timestamp:   1628166822,
+		BlockHashes: map[uint64]common.Hash{},
+		BaseFee:     baseFee,
+	}
+	to := testTo
+	msg := &substate.SubstateMessage{
+		CheckNonce: true,
+		GasPrice:   new(big.Int).Add(baseFee, tip),
+		Gas:        gas,
+		From:       testSender,
+		To:         &to,
+		Value:      big.NewInt(value),
+		GasFeeCap:  big.NewInt(100),
+		GasTipCap:  tip,
+	}
+	result := &substate.SubstateResult{Status: 1, GasUsed: 21000}
+	return substate.NewSubstate(inputAlloc, outputAlloc, env, msg, result)
+}
+
+func TestReplayTransfer(t *testing.T) {
+	for _, interpreter := range []string{"", "geth", "lfvm", "lfvm-si"} {
+		s := newTestSubstate(12345, nil, 21000)
+		result, err := Replay(s, &Config{Interpreter: interpreter})
+		if err != nil {
+			t.Fatalf("%s: failed to replay: %v", interpreter, err)
+		}
+		if !result.OK() {
+			t.Fatalf("%s: replay differs from recorded substate:\n%s", interpreter, result.Diff)
+		}
+		if result.Receipt.GasUsed != 21000 || result.Receipt.Status != 1 {
+			t.Fatalf("%s: wrong receipt: %+v", interpreter, result.Receipt)
+		}
+	}
+
+	s := newTestSubstate(12345, nil, 21000)
+	s.Result.GasUsed = 21001
+	s.OutputAlloc[testTo].Balance = big.NewInt(1)
+	result, err := Replay(s, nil)
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if len(result.Diff) != 2 || result.Diff[0].Kind != substate.DiffBalance || result.Diff[1].Kind != substate.DiffGasUsed {
+		t.Fatalf("wrong diff of tampered substate:\n%s", result.Diff)
+	}
+
+	if _, err := Replay(s, &Config{Interpreter: "no-such-vm"}); err == nil {
+		t.Fatalf("replayed with unknown interpreter")
+	}
+	s.Message.Nonce = 1
+	if _, err := Replay(s, nil); err == nil {
+		t.Fatalf("replayed transaction with invalid nonce")
+	}
+}
+
+func TestReplayInterpretersAgree(t *testing.T) {
+	code := []byte{0x60, 0x2a, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3} // PUSH1 42; PUSH1 0; MSTORE; PUSH1 32; PUSH1 0; RETURN
+
+	// record the outcome of geth as expected substate
+	s := newTestSubstate(0, code, 100000)
+	expected, err := Replay(s, &Config{Interpreter: "geth"})
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if ret := expected.Execution.ReturnData; common.BytesToHash(ret) != common.BigToHash(big.NewInt(42)) {
+		t.Fatalf("wrong return data: %x", ret)
+	}
+	s.OutputAlloc = expected.OutputAlloc
+	s.Result = expected.SubstateResult()
+
+	for _, interpreter := range []string{"lfvm", "lfvm-si"} {
+		result, err := Replay(s, &Config{Interpreter: interpreter})
+		if err != nil {
+			t.Fatalf("%s: failed to replay: %v", interpreter, err)
+		}
+		if !result.OK() {
+			t.Fatalf("%s: replay differs from geth:\n%s", interpreter, result.Diff)
+		}
+		if !bytes.Equal(result.Execution.ReturnData, expected.Execution.ReturnData) {
+			t.Fatalf("%s: wrong return data: %x", interpreter, result.Execution.ReturnData)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/core/vm/lfvm"
+	"github.com/ethereum/go-ethereum/substate"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	InstructionStatisticsFlag = cli.StringFlag{
+		Name:  "instruction-stats",
+		Usage: "File the lfvm instruction statistics are written to as JSON",
+		Value: "instruction-stats.json",
+	}
+	SuperInstructionsFlag = cli.StringFlag{
+		Name:  "super-instructions",
+		Usage: "JSON file of generated lfvm super instructions, used by the lfvm interpreters with super instructions",
+	}
+	SuperInstructionsLimitFlag = cli.IntFlag{
+		Name:  "super-instructions-limit",
+		Usage: "Maximum number of generated super instructions",
+		Value: 20,
+	}
+)
+
+// SuperInstructionsCommand replays substates with lfvm-stats and generates
+// super instructions from the most frequent instruction sequences.
+var SuperInstructionsCommand = cli.Command{
+	Action:    superInstructionsAction,
+	Name:      "lfvm-super-instructions",
+	Usage:     "generates lfvm super instructions from the instruction statistics of transactions in the given block range",
+	ArgsUsage: "<blockNumFirst> <blockNumLast>",
+	Flags: []cli.Flag{
+		substate.WorkersFlag,
+		substate.SkipTransferTxsFlag,
+		substate.SkipCallTxsFlag,
+		substate.SkipCreateTxsFlag,
+		substate.FilterFlag,
+		substate.SchedulingFlag,
+		InstructionStatisticsFlag,
+		SuperInstructionsFlag,
+		SuperInstructionsLimitFlag,
+		substate.SubstateDirFlag,
+		substate.SubstateCacheFlag,
+		substate.SubstateHandlesFlag,
+	},
+	Description: `
+The lfvm-super-instructions command requires two arguments:
+<blockNumFirst> <blockNumLast>
+
+<blockNumFirst> and <blockNumLast> are the first and
+last block of the inclusive range of blocks to replay transactions.
+
+The instruction statistics are written to --instruction-stats. Up to
+--super-instructions-limit of the most frequent instruction sequences that
+pass the verification against the EVM are written to --super-instructions
+(default: super-instructions.json), which can be passed to replay-diff.`,
+}
+
+// SelectSuperInstructions returns up to limit of the super instructions
+// ranked by lfvm.RankSuperInstructions that pass lfvm.VerifySuperInstruction.
+// Failed verifications are returned as well.
+func SelectSuperInstructions(stats *lfvm.InstructionStatistics, limit int) ([]lfvm.SuperInstruction, []error) {
+	var (
+		res  []lfvm.SuperInstruction
+		errs []error
+	)
+	for _, si := range lfvm.RankSuperInstructions(stats, math.MaxInt32) {
+		if len(res) >= limit {
+			break
+		}
+		if err := lfvm.VerifySuperInstruction(si); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		res = append(res, si)
+	}
+	return res, errs
+}
+
+// EnableSuperInstructions enables the super instructions of the file given by
+// --super-instructions, if any.
+func EnableSuperInstructions(ctx *cli.Context) error {
+	name := ctx.String(SuperInstructionsFlag.Name)
+	if name == "" {
+		return nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sis, err := lfvm.ReadSuperInstructions(file)
+	if err != nil {
+		return fmt.Errorf("failed to read super instructions from %v: %v", name, err)
+	}
+	return lfvm.EnableSuperInstructions(sis)
+}
+
+func superInstructionsAction(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("substate-cli lfvm-super-instructions command requires exactly 2 arguments")
+	}
+	first, ferr := strconv.ParseUint(ctx.Args().Get(0), 10, 64)
+	last, lerr := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	if ferr != nil || lerr != nil {
+		return fmt.Errorf("substate-cli lfvm-super-instructions: error in parsing parameters: block number not an integer")
+	}
+	if first > last {
+		return fmt.Errorf("substate-cli lfvm-super-instructions: error: first block has larger number than last block")
+	}
+
+	substate.SetSubstateFlags(ctx)
+	substate.OpenSubstateDBReadOnly()
+	defer substate.CloseSubstateDB()
+
+	// only the instructions executed matter, not the outcome
+	lfvm.ResetInstructionStatistics()
+	config := &Config{Interpreter: "lfvm-stats"}
+	task := func(block uint64, tx int, s *substate.Substate, taskPool *substate.SubstateTaskPool) error {
+		Replay(s, config)
+		return nil
+	}
+	taskPool := substate.NewSubstateTaskPool("substate-cli lfvm-super-instructions", task, first, last, ctx)
+	if err := taskPool.Execute(); err != nil {
+		return err
+	}
+
+	stats := lfvm.CollectedInstructionStatistics()
+	if err := writeFile(ctx.String(InstructionStatisticsFlag.Name), stats.Write); err != nil {
+		return err
+	}
+
+	sis, errs := SelectSuperInstructions(stats, ctx.Int(SuperInstructionsLimitFlag.Name))
+	for _, err := range errs {
+		fmt.Printf("substate-cli lfvm-super-instructions: %v\n", err)
+	}
+	name := ctx.String(SuperInstructionsFlag.Name)
+	if name == "" {
+		name = "super-instructions.json"
+	}
+	err := writeFile(name, func(w io.Writer) error { return lfvm.WriteSuperInstructions(w, sis) })
+	fmt.Printf("substate-cli lfvm-super-instructions: %v steps, %v super instructions\n", stats.Steps, len(sis))
+	return err
+}
+
+func writeFile(name string, write func(w io.Writer) error) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
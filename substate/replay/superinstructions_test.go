@@ -0,0 +1,47 @@
+package replay
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/vm/lfvm"
+)
+
+func TestSelectSuperInstructions(t *testing.T) {
+	defer lfvm.ResetInstructionStatistics()
+	defer lfvm.EnableSuperInstructions(nil)
+
+	// counts down from 5 in a loop
+	code := []byte{
+		0x60, 0x05, // PUSH1 5
+		0x5b,       // JUMPDEST
+		0x60, 0x01, // PUSH1 1
+		0x90,       // SWAP1
+		0x03,       // SUB
+		0x80,       // DUP1
+		0x60, 0x02, // PUSH1 2
+		0x57, // JUMPI
+		0x00, // STOP
+	}
+	s := newTestSubstate(0, code, 100000)
+
+	lfvm.ResetInstructionStatistics()
+	if _, err := Replay(s, &Config{Interpreter: "lfvm-stats"}); err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	stats := lfvm.CollectedInstructionStatistics()
+	if stats.Steps == 0 {
+		t.Fatalf("no instruction statistics collected")
+	}
+
+	sis, errs := SelectSuperInstructions(stats, 3)
+	if len(sis) != 3 || len(errs) != 0 {
+		t.Fatalf("wrong super instructions selected: %v, %v", sis, errs)
+	}
+	if err := lfvm.EnableSuperInstructions(sis); err != nil {
+		t.Fatalf("failed to enable super instructions: %v", err)
+	}
+	diff, err := Compare(s, &Config{Interpreter: "geth"}, &Config{Interpreter: "lfvm-si"})
+	if err != nil || !diff.Empty() {
+		t.Fatalf("generated super instructions diverge: %v, %v", diff, err)
+	}
+}
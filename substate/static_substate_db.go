@@ -1,6 +1,7 @@
 package substate
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -11,29 +12,43 @@ import (
 var (
 	SubstateDirFlag = cli.StringFlag{
 		Name:  "substatedir",
-		Usage: "Data directory for substate recorder/replayer",
+		Usage: "Data directory for substate recorder/replayer, optionally as backend URI (leveldb://path, memory://)",
 		Value: "./substate.fantom",
 	}
+	SubstateCacheFlag = cli.IntFlag{
+		Name:  "substate-cache",
+		Usage: "Cache size of the substate DB backend in MB",
+		Value: DefaultBackendCache,
+	}
+	SubstateHandlesFlag = cli.IntFlag{
+		Name:  "substate-handles",
+		Usage: "Number of open files of the substate DB backend",
+		Value: DefaultBackendHandles,
+	}
 	substateDir      = SubstateDirFlag.Value
+	substateConfig   = BackendConfig{Cache: DefaultBackendCache, Handles: DefaultBackendHandles}
 	staticSubstateDB *SubstateDB
-	RecordReplay bool = false
 )
 
 func OpenSubstateDB() {
 	fmt.Println("record-replay: OpenSubstateDB")
-	backend, err := rawdb.NewLevelDBDatabase(substateDir, 1024, 100, "substatedir", false)
+	backend, err := OpenBackend(substateDir, &substateConfig)
 	if err != nil {
-		panic(fmt.Errorf("error opening substate leveldb %s: %v", substateDir, err))
+		panic(fmt.Errorf("error opening substate DB %s: %v", substateDir, err))
 	}
 	fmt.Println("record-replay: opened successfully")
 	staticSubstateDB = NewSubstateDB(backend)
 }
 
+// OpenSubstateDBReadOnly opens the substate DB without write access. Several
+// processes can open the same substate DB read-only at the same time.
 func OpenSubstateDBReadOnly() {
 	fmt.Println("record-replay: OpenSubstateDB")
-	backend, err := rawdb.NewLevelDBDatabase(substateDir, 1024, 100, "substatedir", true)
+	config := substateConfig
+	config.ReadOnly = true
+	backend, err := OpenBackend(substateDir, &config)
 	if err != nil {
-		panic(fmt.Errorf("error opening substate leveldb %s: %v", substateDir, err))
+		panic(fmt.Errorf("error opening substate DB %s: %v", substateDir, err))
 	}
 	staticSubstateDB = NewSubstateDB(backend)
 }
@@ -43,7 +58,7 @@ func CloseSubstateDB() {
 
 	err := staticSubstateDB.Close()
 	if err != nil {
-		panic(fmt.Errorf("error closing substate leveldb %s: %v", substateDir, err))
+		panic(fmt.Errorf("error closing substate DB %s: %v", substateDir, err))
 	}
 }
 
@@ -53,8 +68,19 @@ func CompactSubstateDB() {
 	// compact entire DB
 	err := staticSubstateDB.Compact(nil, nil)
 	if err != nil {
-		panic(fmt.Errorf("error compacting substate leveldb %s: %v", substateDir, err))
+		panic(fmt.Errorf("error compacting substate DB %s: %v", substateDir, err))
+	}
+}
+
+func UpgradeSubstateDB() {
+	fmt.Println("record-replay: UpgradeSubstateDB")
+
+	// rewrite substates to the latest substate version
+	numUpgraded, err := staticSubstateDB.Upgrade(context.Background())
+	if err != nil {
+		panic(fmt.Errorf("error upgrading substate DB %s: %v", substateDir, err))
 	}
+	fmt.Printf("record-replay: upgraded %v substates to version %v\n", numUpgraded, LatestSubstateVersion)
 }
 
 func OpenFakeSubstateDB() {
@@ -66,9 +92,22 @@ func CloseFakeSubstateDB() {
 	staticSubstateDB.Close()
 }
 
+// StaticSubstateDB returns the substate DB opened by OpenSubstateDB.
+func StaticSubstateDB() *SubstateDB {
+	return staticSubstateDB
+}
+
 func SetSubstateFlags(ctx *cli.Context) {
 	substateDir = ctx.String(SubstateDirFlag.Name)
 	fmt.Printf("record-replay: --substatedir=%s\n", substateDir)
+
+	// the backend options are optional for commands
+	if cache := ctx.Int(SubstateCacheFlag.Name); cache > 0 {
+		substateConfig.Cache = cache
+	}
+	if handles := ctx.Int(SubstateHandlesFlag.Name); handles > 0 {
+		substateConfig.Handles = handles
+	}
 }
 
 func HasCode(codeHash common.Hash) bool {
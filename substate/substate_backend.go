@@ -0,0 +1,165 @@
+package substate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+const (
+	// DefaultBackendCache is the default cache size of a substate DB backend in MB.
+	DefaultBackendCache = 1024
+	// DefaultBackendHandles is the default number of open files of a substate DB backend.
+	DefaultBackendHandles = 100
+
+	// defaultBackendScheme is used for a substate DB location without scheme.
+	defaultBackendScheme = "leveldb"
+)
+
+// errReadOnlyBackend is returned when writing to a backend opened read-only.
+var errReadOnlyBackend = errors.New("substate DB is opened read-only")
+
+// unsupportedBackends explains schemes of well-known databases that have no
+// built-in backend.
+var unsupportedBackends = map[string]string{
+	"pebble": "Pebble is not a dependency of this build, register a backend for it with RegisterBackend",
+}
+
+// BackendConfig holds the options to open a substate DB backend.
+type BackendConfig struct {
+	Cache     int    // cache size in MB
+	Handles   int    // number of open files
+	Namespace string // namespace of the backend metrics
+	ReadOnly  bool   // open the backend without write access, shared with other readers
+}
+
+// BackendOpener opens the backend of a substate DB at path.
+type BackendOpener func(path string, config *BackendConfig) (BackendDatabase, error)
+
+var (
+	backendOpenersLock sync.RWMutex
+	backendOpeners     = map[string]BackendOpener{}
+)
+
+// RegisterBackend makes a substate DB backend available under a URI scheme.
+// Registering an opener for an existing scheme replaces it.
+func RegisterBackend(scheme string, opener BackendOpener) {
+	backendOpenersLock.Lock()
+	defer backendOpenersLock.Unlock()
+
+	backendOpeners[scheme] = opener
+}
+
+// Backends returns the URI schemes of all registered backends.
+func Backends() []string {
+	backendOpenersLock.RLock()
+	defer backendOpenersLock.RUnlock()
+
+	schemes := make([]string, 0, len(backendOpeners))
+	for scheme := range backendOpeners {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+func init() {
+	RegisterBackend("leveldb", func(path string, config *BackendConfig) (BackendDatabase, error) {
+		return rawdb.NewLevelDBDatabase(path, config.Cache, config.Handles, config.Namespace, config.ReadOnly)
+	})
+	RegisterBackend("memory", func(path string, config *BackendConfig) (BackendDatabase, error) {
+		return rawdb.NewMemoryDatabase(), nil
+	})
+}
+
+// ParseBackendURI splits a substate DB location of the form scheme://path
+// into scheme and path. A location without scheme is a LevelDB directory.
+func ParseBackendURI(uri string) (scheme string, path string) {
+	if i := strings.Index(uri, "://"); i >= 0 {
+		return uri[:i], uri[i+3:]
+	}
+	return defaultBackendScheme, uri
+}
+
+// OpenBackend opens the substate DB backend at uri, e.g. leveldb:///data/substate
+// or memory://. Zero values of config are replaced with defaults.
+func OpenBackend(uri string, config *BackendConfig) (BackendDatabase, error) {
+	cfg := BackendConfig{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.Cache <= 0 {
+		cfg.Cache = DefaultBackendCache
+	}
+	if cfg.Handles <= 0 {
+		cfg.Handles = DefaultBackendHandles
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = "substatedir"
+	}
+
+	scheme, path := ParseBackendURI(uri)
+	backendOpenersLock.RLock()
+	opener, found := backendOpeners[scheme]
+	backendOpenersLock.RUnlock()
+	if reason, unsupported := unsupportedBackends[scheme]; !found && unsupported {
+		return nil, fmt.Errorf("substate DB backend %q is not supported: %s", scheme, reason)
+	}
+	if !found {
+		return nil, fmt.Errorf("unsupported substate DB backend %q (available: %s)", scheme, strings.Join(Backends(), ", "))
+	}
+
+	backend, err := opener(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ReadOnly {
+		backend = &readOnlyBackend{backend}
+	}
+	return backend, nil
+}
+
+// OpenSubstateDBURI opens the substate DB at uri with the given backend options.
+func OpenSubstateDBURI(uri string, config *BackendConfig) (*SubstateDB, error) {
+	backend, err := OpenBackend(uri, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewSubstateDB(backend), nil
+}
+
+// readOnlyBackend rejects all writes to a backend opened read-only, also for
+// backends that do not support read-only mode themselves.
+type readOnlyBackend struct {
+	BackendDatabase
+}
+
+func (b *readOnlyBackend) Put(key []byte, value []byte) error {
+	return errReadOnlyBackend
+}
+
+func (b *readOnlyBackend) Delete(key []byte) error {
+	return errReadOnlyBackend
+}
+
+func (b *readOnlyBackend) NewBatch() ethdb.Batch {
+	return &readOnlyBatch{b.BackendDatabase.NewBatch()}
+}
+
+func (b *readOnlyBackend) Compact(start []byte, limit []byte) error {
+	return errReadOnlyBackend
+}
+
+// readOnlyBatch is a batch of a read-only backend that cannot be written.
+type readOnlyBatch struct {
+	ethdb.Batch
+}
+
+func (b *readOnlyBatch) Write() error {
+	return errReadOnlyBackend
+}
@@ -0,0 +1,74 @@
+package substate
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBackendURI(t *testing.T) {
+	tests := []struct {
+		uri, scheme, path string
+	}{
+		{"./substate.ethereum", "leveldb", "./substate.ethereum"},
+		{"leveldb:///data/substate", "leveldb", "/data/substate"},
+		{"pebble://substate", "pebble", "substate"},
+		{"memory://", "memory", ""},
+	}
+	for _, tt := range tests {
+		scheme, path := ParseBackendURI(tt.uri)
+		if scheme != tt.scheme || path != tt.path {
+			t.Errorf("%q: have %q %q, want %q %q", tt.uri, scheme, path, tt.scheme, tt.path)
+		}
+	}
+}
+
+func TestOpenBackend(t *testing.T) {
+	if _, err := OpenBackend("unknown://substate", nil); err == nil {
+		t.Fatalf("opened backend with unknown scheme")
+	}
+	if _, err := OpenBackend("pebble://substate", nil); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatalf("wrong error of the unsupported pebble backend: %v", err)
+	}
+
+	db, err := OpenSubstateDBURI("memory://", nil)
+	if err != nil {
+		t.Fatalf("failed to open memory backend: %v", err)
+	}
+	db.PutSubstate(1, 0, newTestSubstate(1, 0))
+	if !db.HasSubstate(1, 0) {
+		t.Fatalf("substate missing in memory backend")
+	}
+	db.Close()
+
+	// a LevelDB substate DB can be opened read-only by several readers
+	dir := "leveldb://" + filepath.Join(t.TempDir(), "substate")
+	db, err = OpenSubstateDBURI(dir, &BackendConfig{Cache: 16, Handles: 16})
+	if err != nil {
+		t.Fatalf("failed to open leveldb backend: %v", err)
+	}
+	db.PutSubstate(1, 0, newTestSubstate(1, 0))
+	db.Close()
+
+	config := &BackendConfig{Cache: 16, Handles: 16, ReadOnly: true}
+	reader1, err := OpenSubstateDBURI(dir, config)
+	if err != nil {
+		t.Fatalf("failed to open first reader: %v", err)
+	}
+	defer reader1.Close()
+	reader2, err := OpenSubstateDBURI(dir, config)
+	if err != nil {
+		t.Fatalf("failed to open second reader: %v", err)
+	}
+	defer reader2.Close()
+
+	for _, reader := range []*SubstateDB{reader1, reader2} {
+		if have := reader.GetSubstate(1, 0); !have.Equal(newTestSubstate(1, 0)) {
+			t.Fatalf("wrong substate in read-only DB")
+		}
+		if err := reader.TryPutSubstate(context.Background(), 2, 0, newTestSubstate(2, 0)); err == nil {
+			t.Fatalf("wrote substate to read-only DB")
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package substate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	CheckpointFlag = cli.StringFlag{
+		Name:  "checkpoint",
+		Usage: "File recording the highest contiguous completed block of a task pool",
+	}
+	ResumeFlag = cli.BoolFlag{
+		Name:  "resume",
+		Usage: "Resume after the block recorded in the --checkpoint file",
+	}
+	ContinueOnErrorFlag = cli.BoolFlag{
+		Name:  "continue-on-error",
+		Usage: "Log failed transactions to --error-log and continue",
+	}
+	MaxFailuresFlag = cli.IntFlag{
+		Name:  "max-failures",
+		Usage: "Abort after more than this number of failed transactions with --continue-on-error (0 = no limit)",
+	}
+	ErrorLogFlag = cli.StringFlag{
+		Name:  "error-log",
+		Usage: "File failed transactions are written to as JSON lines with --continue-on-error",
+		Value: "substate-errors.jsonl",
+	}
+)
+
+// ErrTooManyFailures is returned by SubstateTaskPool.Execute when more than
+// MaxFailures transactions failed.
+var ErrTooManyFailures = errors.New("too many failed transactions")
+
+// TaskCheckpoint is the progress of a task pool. All blocks from First to
+// Block are completed.
+type TaskCheckpoint struct {
+	Name  string `json:"name"`
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+	Block uint64 `json:"block"` // highest contiguous completed block
+}
+
+// ReadTaskCheckpoint reads the checkpoint at path. It returns nil if the
+// file does not exist.
+func ReadTaskCheckpoint(path string) (*TaskCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp TaskCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", path, err)
+	}
+	return &cp, nil
+}
+
+// WriteTaskCheckpoint replaces the checkpoint at path. The file is replaced
+// atomically, so an interrupted write leaves the previous checkpoint.
+func WriteTaskCheckpoint(path string, cp *TaskCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// TaskFailure is a transaction whose TaskFunc returned an error.
+type TaskFailure struct {
+	Block uint64 `json:"block"`
+	Tx    int    `json:"tx"`
+	Error string `json:"error"`
+}
@@ -0,0 +1,168 @@
+package substate
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSubstateTaskPoolResume(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{1: 1, 2: 2, 4: 1, 5: 1, 7: 1})
+	defer db.Close()
+
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	var (
+		lock     sync.Mutex
+		executed []uint64
+		fail     = true
+	)
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if block == 5 && fail {
+				return errors.New("boom")
+			}
+			executed = append(executed, block)
+			return nil
+		},
+		First:          0,
+		Last:           10,
+		Workers:        1,
+		CheckpointFile: checkpoint,
+		DB:             db,
+	}
+
+	// the run aborts at block 5
+	if err := pool.Execute(); err == nil {
+		t.Fatalf("failed task did not abort")
+	}
+	cp, err := ReadTaskCheckpoint(checkpoint)
+	if err != nil || cp == nil {
+		t.Fatalf("failed to read checkpoint: %v", err)
+	}
+	if cp.Block != 4 {
+		t.Fatalf("wrong checkpoint: have %d, want 4", cp.Block)
+	}
+
+	// the resumed run starts at block 5
+	fail, executed = false, nil
+	pool.Resume = true
+	if err := pool.Execute(); err != nil {
+		t.Fatalf("resumed run failed: %v", err)
+	}
+	if len(executed) != 2 || executed[0] != 5 || executed[1] != 7 {
+		t.Fatalf("wrong blocks executed after resume: %v", executed)
+	}
+	if cp, _ := ReadTaskCheckpoint(checkpoint); cp == nil || cp.Block != 10 {
+		t.Fatalf("completed run not recorded: %+v", cp)
+	}
+
+	// nothing is left to do
+	executed = nil
+	if err := pool.Execute(); err != nil || len(executed) != 0 {
+		t.Fatalf("completed run executed blocks %v: %v", executed, err)
+	}
+}
+
+func TestSubstateTaskPoolResumeRejectsOtherRun(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{1: 1, 150: 1, 250: 1})
+	defer db.Close()
+
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	if err := WriteTaskCheckpoint(checkpoint, &TaskCheckpoint{Name: "test", First: 100, Last: 200, Block: 150}); err != nil {
+		t.Fatalf("failed to write checkpoint: %v", err)
+	}
+	executed := 0
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			executed++
+			return nil
+		},
+		First:          0,
+		Last:           300,
+		Workers:        1,
+		CheckpointFile: checkpoint,
+		Resume:         true,
+		DB:             db,
+	}
+	if err := pool.Execute(); err == nil || executed != 0 {
+		t.Fatalf("resumed a checkpoint of another block range, executed %d transactions", executed)
+	}
+
+	// nor is the checkpoint of another command resumed
+	pool.First, pool.Last, pool.Name = 100, 200, "other"
+	if err := pool.Execute(); err == nil || executed != 0 {
+		t.Fatalf("resumed a checkpoint of another command, executed %d transactions", executed)
+	}
+	if cp, _ := ReadTaskCheckpoint(checkpoint); cp == nil || cp.Name != "test" || cp.Block != 150 {
+		t.Fatalf("rejected checkpoint was replaced: %+v", cp)
+	}
+}
+
+func TestSubstateTaskPoolContinueOnError(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{1: 2, 2: 1, 3: 3})
+	defer db.Close()
+
+	errorLog := filepath.Join(t.TempDir(), "errors.jsonl")
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			if block != 2 {
+				return errors.New("boom")
+			}
+			return nil
+		},
+		First:           0,
+		Last:            10,
+		Workers:         2,
+		ContinueOnError: true,
+		ErrorLogFile:    errorLog,
+		DB:              db,
+	}
+	if err := pool.Execute(); err != nil {
+		t.Fatalf("failed tasks aborted the run: %v", err)
+	}
+	if n := pool.NumFailures(); n != 5 {
+		t.Fatalf("wrong number of failures: have %d, want 5", n)
+	}
+
+	f, err := os.Open(errorLog)
+	if err != nil {
+		t.Fatalf("failed to open error log: %v", err)
+	}
+	defer f.Close()
+	var failures []TaskFailure
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var failure TaskFailure
+		if err := json.Unmarshal(scanner.Bytes(), &failure); err != nil {
+			t.Fatalf("invalid error log line %q: %v", scanner.Text(), err)
+		}
+		failures = append(failures, failure)
+	}
+	if len(failures) != 5 || failures[0].Error != "boom" {
+		t.Fatalf("wrong error log: %+v", failures)
+	}
+
+	// the cutoff aborts the run
+	cutoff := &SubstateTaskPool{
+		Name:            "test",
+		TaskFunc:        pool.TaskFunc,
+		First:           0,
+		Last:            10,
+		Workers:         2,
+		ContinueOnError: true,
+		MaxFailures:     2,
+		DB:              db,
+	}
+	if err := cutoff.Execute(); !errors.Is(err, ErrTooManyFailures) {
+		t.Fatalf("wrong error after too many failures: %v", err)
+	}
+}
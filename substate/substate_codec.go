@@ -0,0 +1,210 @@
+package substate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Versions of the substate encoding. A stored substate starts with its
+// version byte followed by the RLP encoding of the version's layout. Records
+// written before versioning was introduced have no version byte. They always
+// start with an RLP list header (>= 0xc0) and never collide with a version.
+const (
+	UnknownSubstateVersion byte = 0
+	LegacySubstateVersion  byte = 1 // substates before Berlin hard fork
+	BerlinSubstateVersion  byte = 2 // substates between Berlin and London hard forks
+	LondonSubstateVersion  byte = 3 // substates from London hard fork
+
+	LatestSubstateVersion = LondonSubstateVersion
+)
+
+// Names of the substate encodings reported by DecodeError.
+const (
+	UnknownEncoding = "unknown" // matches none of the known layouts
+	LegacyEncoding  = "legacy"
+	BerlinEncoding  = "berlin"
+	LondonEncoding  = "london"
+)
+
+// SubstateCodec decodes and encodes the layout of one substate version.
+type SubstateCodec struct {
+	Name   string
+	Decode func(b []byte) (*SubstateRLP, error)
+	Encode func(substateRLP *SubstateRLP) ([]byte, error) // nil if the layout is read-only
+}
+
+var substateCodecs = map[byte]*SubstateCodec{}
+
+// untaggedVersions lists versions tried for records without version byte,
+// from the latest to the oldest hard fork.
+var untaggedVersions = []byte{LondonSubstateVersion, BerlinSubstateVersion, LegacySubstateVersion}
+
+// RegisterSubstateCodec registers codec for version. Registering a codec
+// for an existing version replaces it.
+func RegisterSubstateCodec(version byte, codec *SubstateCodec) {
+	if version == UnknownSubstateVersion || version >= 0xc0 {
+		panic(fmt.Errorf("record-replay: invalid substate version %d", version))
+	}
+	substateCodecs[version] = codec
+}
+
+// GetSubstateCodec returns the codec registered for version.
+func GetSubstateCodec(version byte) (*SubstateCodec, bool) {
+	codec, found := substateCodecs[version]
+	return codec, found
+}
+
+func init() {
+	RegisterSubstateCodec(LegacySubstateVersion, &SubstateCodec{
+		Name: LegacyEncoding,
+		Decode: func(b []byte) (*SubstateRLP, error) {
+			legacyRLP := legacySubstateRLP{}
+			if err := rlp.DecodeBytes(b, &legacyRLP); err != nil {
+				return nil, err
+			}
+			substateRLP := SubstateRLP{}
+			substateRLP.setLegacyRLP(&legacyRLP)
+			return &substateRLP, nil
+		},
+	})
+	RegisterSubstateCodec(BerlinSubstateVersion, &SubstateCodec{
+		Name: BerlinEncoding,
+		Decode: func(b []byte) (*SubstateRLP, error) {
+			berlinRLP := berlinSubstateRLP{}
+			if err := rlp.DecodeBytes(b, &berlinRLP); err != nil {
+				return nil, err
+			}
+			substateRLP := SubstateRLP{}
+			substateRLP.setBerlinRLP(&berlinRLP)
+			return &substateRLP, nil
+		},
+	})
+	RegisterSubstateCodec(LondonSubstateVersion, &SubstateCodec{
+		Name: LondonEncoding,
+		Decode: func(b []byte) (*SubstateRLP, error) {
+			substateRLP := SubstateRLP{}
+			if err := rlp.DecodeBytes(b, &substateRLP); err != nil {
+				return nil, err
+			}
+			return &substateRLP, nil
+		},
+		Encode: func(substateRLP *SubstateRLP) ([]byte, error) {
+			return rlp.EncodeToBytes(substateRLP)
+		},
+	})
+}
+
+// IsTaggedSubstate reports whether value starts with a version byte.
+func IsTaggedSubstate(value []byte) bool {
+	return len(value) > 0 && value[0] < 0xc0
+}
+
+// DecodeSubstateRLP decodes a stored substate. It returns the decoded
+// substate and the version of the detected layout. Records without version
+// byte are decoded as one of the layouts from the latest to the oldest hard
+// fork.
+func DecodeSubstateRLP(value []byte) (*SubstateRLP, byte, error) {
+	if IsTaggedSubstate(value) {
+		version := value[0]
+		codec, found := substateCodecs[version]
+		if !found {
+			return nil, UnknownSubstateVersion, fmt.Errorf("unknown substate version %d", version)
+		}
+		substateRLP, err := codec.Decode(value[1:])
+		if err != nil {
+			return nil, version, err
+		}
+		return substateRLP, version, nil
+	}
+
+	var err error
+	for _, version := range untaggedVersions {
+		var substateRLP *SubstateRLP
+		substateRLP, err = substateCodecs[version].Decode(value)
+		if err == nil {
+			return substateRLP, version, nil
+		}
+	}
+	return nil, UnknownSubstateVersion, err
+}
+
+// EncodeSubstateRLP encodes substateRLP with the latest substate version.
+func EncodeSubstateRLP(substateRLP *SubstateRLP) ([]byte, error) {
+	codec, found := substateCodecs[LatestSubstateVersion]
+	if !found || codec.Encode == nil {
+		return nil, fmt.Errorf("no encoder for substate version %d", LatestSubstateVersion)
+	}
+	b, err := codec.Encode(substateRLP)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{LatestSubstateVersion}, b...), nil
+}
+
+// substateEncodingName returns the name of the codec of version.
+func substateEncodingName(version byte) string {
+	if codec, found := substateCodecs[version]; found {
+		return codec.Name
+	}
+	return UnknownEncoding
+}
+
+// Upgrade rewrites all substates in the DB that are not encoded with the
+// latest substate version. It returns the number of rewritten substates.
+// Bytecode is not touched because its layout is not versioned.
+func (db *SubstateDB) Upgrade(ctx context.Context) (int, error) {
+	var numUpgraded int
+
+	batch := db.backend.NewBatch()
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return numUpgraded, err
+		}
+
+		key := iter.Key()
+		value := iter.Value()
+		if IsTaggedSubstate(value) && value[0] == LatestSubstateVersion {
+			continue
+		}
+
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return numUpgraded, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+		substateRLP, version, err := DecodeSubstateRLP(value)
+		if err != nil {
+			return numUpgraded, &DecodeError{Block: block, Tx: tx, Version: version, Encoding: substateEncodingName(version), Err: err}
+		}
+		newValue, err := EncodeSubstateRLP(substateRLP)
+		if err != nil {
+			return numUpgraded, err
+		}
+
+		err = batch.Put(common.CopyBytes(key), newValue)
+		if err != nil {
+			return numUpgraded, &BackendError{Op: "put", Key: key, Err: err}
+		}
+		numUpgraded++
+
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return numUpgraded, &BackendError{Op: "write", Key: key, Err: err}
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return numUpgraded, &BackendError{Op: "iterate", Key: []byte(stage1SubstatePrefix), Err: err}
+	}
+	if err := batch.Write(); err != nil {
+		return numUpgraded, &BackendError{Op: "write", Err: err}
+	}
+
+	return numUpgraded, nil
+}
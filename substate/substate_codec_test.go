@@ -0,0 +1,85 @@
+package substate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestSubstateVersionedEncoding(t *testing.T) {
+	backend := rawdb.NewMemoryDatabase()
+	db := NewSubstateDB(backend)
+	defer db.Close()
+
+	// substate 1_0 is written with the latest version
+	want := newTestSubstate(1, 0)
+	db.PutSubstate(1, 0, want)
+	value, err := backend.Get(Stage1SubstateKey(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value[0] != LatestSubstateVersion {
+		t.Fatalf("wrong version byte: have %d, want %d", value[0], LatestSubstateVersion)
+	}
+
+	// substate 2_0 is an untagged record of a Berlin substate DB
+	substateRLP := NewSubstateRLP(newTestSubstate(2, 0))
+	berlinRLP := berlinSubstateRLP{
+		InputAlloc:  substateRLP.InputAlloc,
+		OutputAlloc: substateRLP.OutputAlloc,
+		Env: &legacySubstateEnvRLP{
+			Coinbase:    substateRLP.Env.Coinbase,
+			Difficulty:  substateRLP.Env.Difficulty,
+			GasLimit:    substateRLP.Env.GasLimit,
+			Number:      substateRLP.Env.Number,
+			Timestamp:   substateRLP.Env.Timestamp,
+			BlockHashes: substateRLP.Env.BlockHashes,
+		},
+		Message: &berlinSubstateMessageRLP{
+			GasPrice: substateRLP.Message.GasPrice,
+			Gas:      substateRLP.Message.Gas,
+			To:       substateRLP.Message.To,
+			Value:    substateRLP.Message.Value,
+		},
+		Result: substateRLP.Result,
+	}
+	value, err = rlp.EncodeToBytes(&berlinRLP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Put(Stage1SubstateKey(2, 0), value)
+
+	if _, version, err := DecodeSubstateRLP(value); err != nil || version != BerlinSubstateVersion {
+		t.Fatalf("wrong detected version: have %d (%v), want %d", version, err, BerlinSubstateVersion)
+	}
+	if have := db.GetSubstate(2, 0); !have.Equal(newTestSubstate(2, 0)) {
+		t.Fatalf("untagged substate decoded incorrectly")
+	}
+
+	numUpgraded, err := db.Upgrade(context.Background())
+	if err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+	if numUpgraded != 1 {
+		t.Fatalf("wrong number of upgraded substates: have %d, want 1", numUpgraded)
+	}
+	value, _ = backend.Get(Stage1SubstateKey(2, 0))
+	if value[0] != LatestSubstateVersion {
+		t.Fatalf("substate was not upgraded")
+	}
+	if have := db.GetSubstate(2, 0); !have.Equal(newTestSubstate(2, 0)) {
+		t.Fatalf("upgraded substate decoded incorrectly")
+	}
+	if have := db.GetSubstate(1, 0); !have.Equal(want) {
+		t.Fatalf("tagged substate decoded incorrectly")
+	}
+
+	// unknown versions are reported with a DecodeError
+	backend.Put(Stage1SubstateKey(3, 0), []byte{0x7f, 0xc0})
+	_, err = db.TryGetSubstate(context.Background(), 3, 0)
+	if _, ok := err.(*DecodeError); !ok {
+		t.Fatalf("wrong error for unknown version: %v", err)
+	}
+}
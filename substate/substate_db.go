@@ -1,6 +1,7 @@
 package substate
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -8,7 +9,6 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
-	"github.com/ethereum/go-ethereum/rlp"
 )
 
 const (
@@ -103,180 +103,238 @@ func CodeHash(code []byte) common.Hash {
 var EmptyCodeHash = CodeHash(nil)
 
 func (db *SubstateDB) HasCode(codeHash common.Hash) bool {
-	if codeHash == EmptyCodeHash {
-		return false
-	}
-	key := Stage1CodeKey(codeHash)
-	has, err := db.backend.Has(key)
+	has, err := db.TryHasCode(context.Background(), codeHash)
 	if err != nil {
 		panic(fmt.Errorf("record-replay: error checking bytecode for codeHash %s: %v", codeHash.Hex(), err))
 	}
 	return has
 }
 
-func (db *SubstateDB) GetCode(codeHash common.Hash) []byte {
+// TryHasCode checks whether the bytecode of codeHash exists in the substate DB.
+func (db *SubstateDB) TryHasCode(ctx context.Context, codeHash common.Hash) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 	if codeHash == EmptyCodeHash {
-		return nil
+		return false, nil
 	}
 	key := Stage1CodeKey(codeHash)
-	code, err := db.backend.Get(key)
+	has, err := db.backend.Has(key)
+	if err != nil {
+		return false, &BackendError{Op: "has", Key: key, Err: err}
+	}
+	return has, nil
+}
+
+func (db *SubstateDB) GetCode(codeHash common.Hash) []byte {
+	code, err := db.TryGetCode(context.Background(), codeHash)
 	if err != nil {
 		panic(fmt.Errorf("record-replay: error getting code %s: %v", codeHash.Hex(), err))
 	}
 	return code
 }
 
+// TryGetCode returns the bytecode of codeHash. It returns a NotFoundError if
+// the bytecode is missing in the substate DB.
+func (db *SubstateDB) TryGetCode(ctx context.Context, codeHash common.Hash) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if codeHash == EmptyCodeHash {
+		return nil, nil
+	}
+	key := Stage1CodeKey(codeHash)
+	code, err := db.get(key)
+	if err == ErrNotFound {
+		return nil, &NotFoundError{CodeHash: &codeHash}
+	}
+	return code, err
+}
+
 func (db *SubstateDB) PutCode(code []byte) {
+	err := db.TryPutCode(context.Background(), code)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error putting code %s: %v", CodeHash(code).Hex(), err))
+	}
+}
+
+// TryPutCode stores code in the substate DB. Empty code is never stored.
+func (db *SubstateDB) TryPutCode(ctx context.Context, code []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if len(code) == 0 {
-		return
+		return nil
 	}
 	codeHash := crypto.Keccak256Hash(code)
 	key := Stage1CodeKey(codeHash)
 	err := db.backend.Put(key, code)
 	if err != nil {
-		panic(fmt.Errorf("record-replay: error putting code %s: %v", codeHash.Hex(), err))
+		return &BackendError{Op: "put", Key: key, Err: err}
 	}
+	return nil
 }
 
 func (db *SubstateDB) HasSubstate(block uint64, tx int) bool {
-	key := Stage1SubstateKey(block, tx)
-	has, _ := db.backend.Has(key)
+	has, _ := db.TryHasSubstate(context.Background(), block, tx)
 	return has
 }
 
-func (db *SubstateDB) GetSubstate(block uint64, tx int) *Substate {
-	var err error
-
+// TryHasSubstate checks whether the substate of transaction tx in block
+// exists in the substate DB.
+func (db *SubstateDB) TryHasSubstate(ctx context.Context, block uint64, tx int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 	key := Stage1SubstateKey(block, tx)
-	value, err := db.backend.Get(key)
+	has, err := db.backend.Has(key)
 	if err != nil {
-		panic(fmt.Errorf("record-replay: error getting substate %v_%v from substate DB: %v,", block, tx, err))
+		return false, &BackendError{Op: "has", Key: key, Err: err}
 	}
+	return has, nil
+}
 
-	// try decoding as substates from latest hard forks
-	substateRLP := SubstateRLP{}
-	err = rlp.DecodeBytes(value, &substateRLP)
+// get reads key from the backend. ErrNotFound is returned if key does not
+// exist and a BackendError on any other failure.
+func (db *SubstateDB) get(key []byte) ([]byte, error) {
+	value, err := db.backend.Get(key)
+	if err == nil {
+		return value, nil
+	}
+	// backends report missing keys with their own error values
+	if has, herr := db.backend.Has(key); herr == nil && !has {
+		return nil, ErrNotFound
+	}
+	return nil, &BackendError{Op: "get", Key: key, Err: err}
+}
 
+// decodeSubstate decodes value of substate key (block, tx) and reads all
+// referenced bytecode from the substate DB.
+func (db *SubstateDB) decodeSubstate(ctx context.Context, block uint64, tx int, value []byte) (*Substate, error) {
+	substateRLP, version, err := DecodeSubstateRLP(value)
 	if err != nil {
-		// try decoding as legacy substates between Berlin and London hard forks
-		berlinRLP := berlinSubstateRLP{}
-		err = rlp.DecodeBytes(value, &berlinRLP)
-		if err == nil {
-			substateRLP.setBerlinRLP(&berlinRLP)
-		}
+		return nil, &DecodeError{Block: block, Tx: tx, Version: version, Encoding: substateEncodingName(version), Err: err}
 	}
 
+	substate := Substate{}
+	err = substate.TrySetRLP(ctx, substateRLP, db)
 	if err != nil {
-		// try decoding as legacy substates before Berlin hard fork
-		legacyRLP := legacySubstateRLP{}
-		err = rlp.DecodeBytes(value, &legacyRLP)
-		if err != nil {
-			panic(fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err))
-		}
-		substateRLP.setLegacyRLP(&legacyRLP)
+		return nil, err
 	}
 
-	substate := Substate{}
-	substate.SetRLP(&substateRLP, db)
+	return &substate, nil
+}
 
-	return &substate
+func (db *SubstateDB) GetSubstate(block uint64, tx int) *Substate {
+	substate, err := db.TryGetSubstate(context.Background(), block, tx)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error getting substate %v_%v from substate DB: %v,", block, tx, err))
+	}
+	return substate
+}
+
+// TryGetSubstate returns the substate of transaction tx in block. It returns
+// a NotFoundError if the substate does not exist and a DecodeError if the
+// stored value can not be decoded.
+func (db *SubstateDB) TryGetSubstate(ctx context.Context, block uint64, tx int) (*Substate, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key := Stage1SubstateKey(block, tx)
+	value, err := db.get(key)
+	if err == ErrNotFound {
+		return nil, &NotFoundError{Block: block, Tx: tx}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return db.decodeSubstate(ctx, block, tx, value)
 }
 
 func (db *SubstateDB) GetBlockSubstates(block uint64) map[int]*Substate {
-	var err error
+	txSubstate, err := db.TryGetBlockSubstates(context.Background(), block)
+	if err != nil {
+		panic(err)
+	}
+	return txSubstate
+}
 
+// TryGetBlockSubstates returns all substates of block indexed by transaction
+// index. Iteration stops as soon as ctx is cancelled.
+func (db *SubstateDB) TryGetBlockSubstates(ctx context.Context, block uint64) (map[int]*Substate, error) {
 	txSubstate := make(map[int]*Substate)
 
 	prefix := Stage1SubstateBlockPrefix(block)
 
 	iter := db.backend.NewIterator(prefix, nil)
+	defer iter.Release()
 	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		key := iter.Key()
 		value := iter.Value()
 
 		b, tx, err := DecodeStage1SubstateKey(key)
 		if err != nil {
-			panic(fmt.Errorf("record-replay: invalid substate key found for block %v: %v", block, err))
+			return nil, fmt.Errorf("record-replay: invalid substate key found for block %v: %v", block, err)
 		}
 
 		if block != b {
-			panic(fmt.Errorf("record-replay: GetBlockSubstates(%v) iterated substates from block %v", block, b))
-		}
-
-		// try decoding as substates from latest hard forks
-		substateRLP := SubstateRLP{}
-		err = rlp.DecodeBytes(value, &substateRLP)
-
-		if err != nil {
-			// try decoding as legacy substates between Berlin and London hard forks
-			berlinRLP := berlinSubstateRLP{}
-			err = rlp.DecodeBytes(value, &berlinRLP)
-			if err == nil {
-				substateRLP.setBerlinRLP(&berlinRLP)
-			}
+			return nil, fmt.Errorf("record-replay: GetBlockSubstates(%v) iterated substates from block %v", block, b)
 		}
 
+		substate, err := db.decodeSubstate(ctx, block, tx, value)
 		if err != nil {
-			// try decoding as legacy substates before Berlin hard fork
-			legacyRLP := legacySubstateRLP{}
-			err = rlp.DecodeBytes(value, &legacyRLP)
-			if err != nil {
-				panic(fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err))
-			}
-			substateRLP.setLegacyRLP(&legacyRLP)
+			return nil, err
 		}
 
-		substate := Substate{}
-		substate.SetRLP(&substateRLP, db)
-
-		txSubstate[tx] = &substate
+		txSubstate[tx] = substate
 	}
-	iter.Release()
-	err = iter.Error()
-	if err != nil {
-		panic(err)
+	if err := iter.Error(); err != nil {
+		return nil, &BackendError{Op: "iterate", Key: prefix, Err: err}
 	}
 
-	return txSubstate
+	return txSubstate, nil
 }
 
 func (db *SubstateDB) PutSubstate(block uint64, tx int, substate *Substate) {
-	var err error
-
-	// put deployed/creation code
-	for _, account := range substate.InputAlloc {
-		db.PutCode(account.Code)
-	}
-	for _, account := range substate.OutputAlloc {
-		db.PutCode(account.Code)
-	}
-	if msg := substate.Message; msg.To == nil {
-		db.PutCode(msg.Data)
+	err := db.TryPutSubstate(context.Background(), block, tx, substate)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error putting substate %v_%v into substate DB: %v", block, tx, err))
 	}
+}
 
-	key := Stage1SubstateKey(block, tx)
-	defer func() {
-		if err != nil {
-			panic(fmt.Errorf("record-replay: error putting substate %v_%v into substate DB: %v", block, tx, err))
-		}
-	}()
-
-	substateRLP := NewSubstateRLP(substate)
-	value, err := rlp.EncodeToBytes(substateRLP)
-	if err != nil {
-		panic(err)
+// TryPutSubstate stores substate of transaction tx in block together with
+// all deployed and creation bytecode it references in a single batch.
+func (db *SubstateDB) TryPutSubstate(ctx context.Context, block uint64, tx int, substate *Substate) error {
+	w := db.NewSubstateWriter(0, 0)
+	if err := w.PutSubstate(ctx, block, tx, substate); err != nil {
+		return err
 	}
+	return w.CommitBlock(ctx) // a batch size of 0 writes on each commit
+}
 
-	err = db.backend.Put(key, value)
+func (db *SubstateDB) DeleteSubstate(block uint64, tx int) {
+	err := db.TryDeleteSubstate(context.Background(), block, tx)
 	if err != nil {
 		panic(err)
 	}
 }
 
-func (db *SubstateDB) DeleteSubstate(block uint64, tx int) {
+// TryDeleteSubstate removes the substate of transaction tx in block.
+// Referenced bytecode is kept because other substates may share it.
+func (db *SubstateDB) TryDeleteSubstate(ctx context.Context, block uint64, tx int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	key := Stage1SubstateKey(block, tx)
 	err := db.backend.Delete(key)
 	if err != nil {
-		panic(err)
+		return &BackendError{Op: "delete", Key: key, Err: err}
 	}
+	return nil
 }
@@ -0,0 +1,425 @@
+package substate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// DiffKind is the field of a substate in which a Difference was found.
+type DiffKind string
+
+const (
+	// SubstateAlloc
+	DiffAccount DiffKind = "account" // account exists only on one side
+	DiffNonce   DiffKind = "nonce"
+	DiffBalance DiffKind = "balance"
+	DiffCode    DiffKind = "code" // compared by code hash
+	DiffStorage DiffKind = "storage"
+
+	// SubstateEnv
+	DiffCoinbase   DiffKind = "coinbase"
+	DiffDifficulty DiffKind = "difficulty"
+	DiffGasLimit   DiffKind = "gasLimit"
+	DiffNumber     DiffKind = "number"
+	DiffTimestamp  DiffKind = "timestamp"
+	DiffBlockHash  DiffKind = "blockHash"
+	DiffBaseFee    DiffKind = "baseFee"
+
+	// SubstateMessage, nonce is DiffNonce
+	DiffCheckNonce DiffKind = "checkNonce"
+	DiffGasPrice   DiffKind = "gasPrice"
+	DiffGas        DiffKind = "gas"
+	DiffFrom       DiffKind = "from"
+	DiffTo         DiffKind = "to"
+	DiffValue      DiffKind = "value"
+	DiffData       DiffKind = "data" // compared by data hash
+	DiffAccessList DiffKind = "accessList"
+	DiffGasFeeCap  DiffKind = "gasFeeCap"
+	DiffGasTipCap  DiffKind = "gasTipCap"
+
+	// SubstateResult
+	DiffStatus          DiffKind = "status"
+	DiffBloom           DiffKind = "bloom"
+	DiffLogs            DiffKind = "logs" // number of logs
+	DiffLogAddress      DiffKind = "logAddress"
+	DiffLogTopics       DiffKind = "logTopics"
+	DiffLogData         DiffKind = "logData"
+	DiffContractAddress DiffKind = "contractAddress"
+	DiffGasUsed         DiffKind = "gasUsed"
+)
+
+// Sections of a substate a Difference is found in.
+const (
+	InputAllocSection  = "inputAlloc"
+	OutputAllocSection = "outputAlloc"
+	EnvSection         = "env"
+	MessageSection     = "message"
+	ResultSection      = "result"
+)
+
+// Difference is a mismatch of a single value between an expected and an actual
+// substate. Address, Slot and Index locate the value if Kind needs it: the
+// account of alloc differences, the storage slot, the log index or the block
+// number of a block hash. Values are rendered as strings, absent values as
+// "<nil>".
+type Difference struct {
+	Section  string          `json:"section,omitempty"`
+	Kind     DiffKind        `json:"kind"`
+	Address  *common.Address `json:"address,omitempty"`
+	Slot     *common.Hash    `json:"slot,omitempty"`
+	Index    *uint64         `json:"index,omitempty"`
+	Expected string          `json:"expected"`
+	Actual   string          `json:"actual"`
+}
+
+func (d *Difference) String() string {
+	var b strings.Builder
+	if d.Section != "" {
+		b.WriteString(d.Section)
+		b.WriteString(" ")
+	}
+	if d.Address != nil {
+		b.WriteString(d.Address.Hex())
+		b.WriteString(" ")
+	}
+	b.WriteString(string(d.Kind))
+	if d.Slot != nil {
+		b.WriteString(" ")
+		b.WriteString(d.Slot.Hex())
+	}
+	if d.Index != nil {
+		b.WriteString(" #")
+		b.WriteString(strconv.FormatUint(*d.Index, 10))
+	}
+	fmt.Fprintf(&b, ": expected %s, actual %s", d.Expected, d.Actual)
+	return b.String()
+}
+
+// SubstateDiff is the list of differences between two substates in the order
+// of the substate fields, accounts and storage slots in ascending order.
+type SubstateDiff []Difference
+
+// Empty reports whether no difference was found.
+func (d SubstateDiff) Empty() bool {
+	return len(d) == 0
+}
+
+// String renders the differences as text, one difference per line.
+func (d SubstateDiff) String() string {
+	lines := make([]string, len(d))
+	for i := range d {
+		lines[i] = d[i].String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WriteText writes the differences as text, one difference per line.
+func (d SubstateDiff) WriteText(w io.Writer) error {
+	for i := range d {
+		if _, err := fmt.Fprintln(w, d[i].String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the differences as an indented JSON array.
+func (d SubstateDiff) WriteJSON(w io.Writer) error {
+	if d == nil {
+		d = SubstateDiff{} // [] instead of null
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// inSection sets the section of all differences.
+func (d SubstateDiff) inSection(section string) SubstateDiff {
+	for i := range d {
+		d[i].Section = section
+	}
+	return d
+}
+
+// diffBuilder collects differences of values rendered as strings.
+type diffBuilder struct {
+	diff SubstateDiff
+}
+
+func (b *diffBuilder) add(d Difference) {
+	b.diff = append(b.diff, d)
+}
+
+func (b *diffBuilder) value(kind DiffKind, x, y string) {
+	if x != y {
+		b.add(Difference{Kind: kind, Expected: x, Actual: y})
+	}
+}
+
+func (b *diffBuilder) uint(kind DiffKind, x, y uint64) {
+	if x != y {
+		b.add(Difference{Kind: kind, Expected: strconv.FormatUint(x, 10), Actual: strconv.FormatUint(y, 10)})
+	}
+}
+
+func (b *diffBuilder) big(kind DiffKind, x, y *big.Int) {
+	if x == nil || y == nil {
+		if x != y {
+			b.add(Difference{Kind: kind, Expected: formatBig(x), Actual: formatBig(y)})
+		}
+		return
+	}
+	if x.Cmp(y) != 0 {
+		b.add(Difference{Kind: kind, Expected: formatBig(x), Actual: formatBig(y)})
+	}
+}
+
+func formatBig(x *big.Int) string {
+	if x == nil {
+		return "<nil>"
+	}
+	return x.String()
+}
+
+func formatAddress(x *common.Address) string {
+	if x == nil {
+		return "<nil>"
+	}
+	return x.Hex()
+}
+
+// Diff returns the differences from the expected account x to the actual
+// account y without their address.
+func (x *SubstateAccount) Diff(y *SubstateAccount) SubstateDiff {
+	if x == y {
+		return nil
+	}
+	if x == nil || y == nil {
+		present := func(a *SubstateAccount) string {
+			if a == nil {
+				return "<nil>"
+			}
+			return "exists"
+		}
+		return SubstateDiff{{Kind: DiffAccount, Expected: present(x), Actual: present(y)}}
+	}
+
+	b := &diffBuilder{}
+	b.uint(DiffNonce, x.Nonce, y.Nonce)
+	b.big(DiffBalance, x.Balance, y.Balance)
+	if !bytes.Equal(x.Code, y.Code) {
+		b.value(DiffCode, x.CodeHash().Hex(), y.CodeHash().Hex())
+	}
+
+	slots := make([]common.Hash, 0, len(x.Storage))
+	for slot, xv := range x.Storage {
+		if yv, found := y.Storage[slot]; !found || xv != yv {
+			slots = append(slots, slot)
+		}
+	}
+	for slot := range y.Storage {
+		if _, found := x.Storage[slot]; !found {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return bytes.Compare(slots[i][:], slots[j][:]) < 0
+	})
+	for _, slot := range slots {
+		slot := slot
+		d := Difference{Kind: DiffStorage, Slot: &slot, Expected: "<nil>", Actual: "<nil>"}
+		if xv, found := x.Storage[slot]; found {
+			d.Expected = xv.Hex()
+		}
+		if yv, found := y.Storage[slot]; found {
+			d.Actual = yv.Hex()
+		}
+		b.add(d)
+	}
+	return b.diff
+}
+
+// Diff returns the differences from the expected alloc x to the actual alloc
+// y in ascending order of addresses.
+func (x SubstateAlloc) Diff(y SubstateAlloc) SubstateDiff {
+	addrs := make([]common.Address, 0, len(x))
+	for addr := range x {
+		addrs = append(addrs, addr)
+	}
+	for addr := range y {
+		if _, found := x[addr]; !found {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+
+	var diff SubstateDiff
+	for _, addr := range addrs {
+		addr := addr
+		for _, d := range x[addr].Diff(y[addr]) {
+			d.Address = &addr
+			diff = append(diff, d)
+		}
+	}
+	return diff
+}
+
+// Diff returns the differences from the expected block environment x to the
+// actual block environment y.
+func (x *SubstateEnv) Diff(y *SubstateEnv) SubstateDiff {
+	if x == nil {
+		x = &SubstateEnv{}
+	}
+	if y == nil {
+		y = &SubstateEnv{}
+	}
+
+	b := &diffBuilder{}
+	b.value(DiffCoinbase, x.Coinbase.Hex(), y.Coinbase.Hex())
+	b.big(DiffDifficulty, x.Difficulty, y.Difficulty)
+	b.uint(DiffGasLimit, x.GasLimit, y.GasLimit)
+	b.uint(DiffNumber, x.Number, y.Number)
+	b.uint(DiffTimestamp, x.Timestamp, y.Timestamp)
+
+	numbers := make([]uint64, 0, len(x.BlockHashes))
+	for num, xh := range x.BlockHashes {
+		if yh, found := y.BlockHashes[num]; !found || xh != yh {
+			numbers = append(numbers, num)
+		}
+	}
+	for num := range y.BlockHashes {
+		if _, found := x.BlockHashes[num]; !found {
+			numbers = append(numbers, num)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	for _, num := range numbers {
+		num := num
+		d := Difference{Kind: DiffBlockHash, Index: &num, Expected: "<nil>", Actual: "<nil>"}
+		if xh, found := x.BlockHashes[num]; found {
+			d.Expected = xh.Hex()
+		}
+		if yh, found := y.BlockHashes[num]; found {
+			d.Actual = yh.Hex()
+		}
+		b.add(d)
+	}
+
+	b.big(DiffBaseFee, x.BaseFee, y.BaseFee)
+	return b.diff
+}
+
+// Diff returns the differences from the expected message x to the actual
+// message y. Data is compared by its hash.
+func (x *SubstateMessage) Diff(y *SubstateMessage) SubstateDiff {
+	if x == nil {
+		x = &SubstateMessage{}
+	}
+	if y == nil {
+		y = &SubstateMessage{}
+	}
+
+	b := &diffBuilder{}
+	b.uint(DiffNonce, x.Nonce, y.Nonce)
+	b.value(DiffCheckNonce, strconv.FormatBool(x.CheckNonce), strconv.FormatBool(y.CheckNonce))
+	b.big(DiffGasPrice, x.GasPrice, y.GasPrice)
+	b.uint(DiffGas, x.Gas, y.Gas)
+	b.value(DiffFrom, x.From.Hex(), y.From.Hex())
+	b.value(DiffTo, formatAddress(x.To), formatAddress(y.To))
+	b.big(DiffValue, x.Value, y.Value)
+	if !bytes.Equal(x.Data, y.Data) {
+		b.value(DiffData, crypto.Keccak256Hash(x.Data).Hex(), crypto.Keccak256Hash(y.Data).Hex())
+	}
+	b.value(DiffAccessList, formatAccessList(x.AccessList), formatAccessList(y.AccessList))
+	b.big(DiffGasFeeCap, x.GasFeeCap, y.GasFeeCap)
+	b.big(DiffGasTipCap, x.GasTipCap, y.GasTipCap)
+	return b.diff
+}
+
+// formatAccessList renders nil and empty lists and storage keys the same,
+// like SubstateMessage.Equal compares them.
+func formatAccessList(accessList types.AccessList) string {
+	normalized := make(types.AccessList, len(accessList))
+	for i, tuple := range accessList {
+		normalized[i] = tuple
+		if tuple.StorageKeys == nil {
+			normalized[i].StorageKeys = []common.Hash{}
+		}
+	}
+	enc, _ := json.Marshal(normalized)
+	return string(enc)
+}
+
+// Diff returns the differences from the expected result x to the actual
+// result y. Logs present on both sides are compared field by field.
+func (x *SubstateResult) Diff(y *SubstateResult) SubstateDiff {
+	if x == nil {
+		x = &SubstateResult{}
+	}
+	if y == nil {
+		y = &SubstateResult{}
+	}
+
+	b := &diffBuilder{}
+	b.uint(DiffStatus, x.Status, y.Status)
+	b.value(DiffBloom, hexutil.Encode(x.Bloom[:]), hexutil.Encode(y.Bloom[:]))
+	b.uint(DiffLogs, uint64(len(x.Logs)), uint64(len(y.Logs)))
+	for i := 0; i < len(x.Logs) && i < len(y.Logs); i++ {
+		var (
+			index  = uint64(i)
+			xl, yl = x.Logs[i], y.Logs[i]
+		)
+		if xl.Address != yl.Address {
+			b.add(Difference{Kind: DiffLogAddress, Index: &index, Expected: xl.Address.Hex(), Actual: yl.Address.Hex()})
+		}
+		if xt, yt := formatTopics(xl.Topics), formatTopics(yl.Topics); xt != yt {
+			b.add(Difference{Kind: DiffLogTopics, Index: &index, Expected: xt, Actual: yt})
+		}
+		if !bytes.Equal(xl.Data, yl.Data) {
+			b.add(Difference{Kind: DiffLogData, Index: &index, Expected: hexutil.Encode(xl.Data), Actual: hexutil.Encode(yl.Data)})
+		}
+	}
+	b.value(DiffContractAddress, x.ContractAddress.Hex(), y.ContractAddress.Hex())
+	b.uint(DiffGasUsed, x.GasUsed, y.GasUsed)
+	return b.diff
+}
+
+func formatTopics(topics []common.Hash) string {
+	hexes := make([]string, len(topics))
+	for i, topic := range topics {
+		hexes[i] = topic.Hex()
+	}
+	return "[" + strings.Join(hexes, ",") + "]"
+}
+
+// Diff returns the differences from the expected substate x to the actual
+// substate y. Each difference is labeled with the section it is found in.
+func (x *Substate) Diff(y *Substate) SubstateDiff {
+	if x == nil {
+		x = &Substate{}
+	}
+	if y == nil {
+		y = &Substate{}
+	}
+
+	var diff SubstateDiff
+	diff = append(diff, x.InputAlloc.Diff(y.InputAlloc).inSection(InputAllocSection)...)
+	diff = append(diff, x.OutputAlloc.Diff(y.OutputAlloc).inSection(OutputAllocSection)...)
+	diff = append(diff, x.Env.Diff(y.Env).inSection(EnvSection)...)
+	diff = append(diff, x.Message.Diff(y.Message).inSection(MessageSection)...)
+	diff = append(diff, x.Result.Diff(y.Result).inSection(ResultSection)...)
+	return diff
+}
@@ -0,0 +1,77 @@
+package substate
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestSubstateDiff(t *testing.T) {
+	expected := newTestSubstate(1, 0)
+	if diff := expected.Diff(newTestSubstate(1, 0)); !diff.Empty() {
+		t.Fatalf("equal substates differ:\n%s", diff)
+	}
+
+	actual := newTestSubstate(1, 0)
+	addr := *actual.Message.To
+	slot := common.HexToHash("0x01")
+	account := actual.OutputAlloc[addr]
+	account.Balance = big.NewInt(7)
+	account.Storage[slot] = common.HexToHash("0x02")
+	actual.OutputAlloc[common.HexToAddress("0xff")] = NewSubstateAccount(0, big.NewInt(0), nil)
+	actual.Result.GasUsed = 21001
+	actual.Result.Logs = []*types.Log{{Address: addr}}
+
+	diff := expected.Diff(actual)
+	if expected.Equal(actual) || diff.Empty() {
+		t.Fatalf("different substates are equal")
+	}
+	want := []string{
+		"outputAlloc " + addr.Hex() + " balance: expected 1, actual 7",
+		"outputAlloc " + addr.Hex() + " storage " + slot.Hex() + ": expected <nil>, actual " + common.HexToHash("0x02").Hex(),
+		"outputAlloc " + common.HexToAddress("0xff").Hex() + " account: expected <nil>, actual exists",
+		"result logs: expected 0, actual 1",
+		"result gasUsed: expected 21000, actual 21001",
+	}
+	if have := diff.String(); have != strings.Join(want, "\n") {
+		t.Fatalf("wrong diff:\nhave:\n%s\nwant:\n%s", have, strings.Join(want, "\n"))
+	}
+
+	var buf bytes.Buffer
+	if err := diff.WriteJSON(&buf); err != nil {
+		t.Fatalf("failed to write json: %v", err)
+	}
+	var decoded SubstateDiff
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+	if len(decoded) != len(want) || decoded[1].Kind != DiffStorage || *decoded[1].Slot != slot || *decoded[1].Address != addr {
+		t.Fatalf("wrong json diff: %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := SubstateDiff(nil).WriteJSON(&buf); err != nil || strings.TrimSpace(buf.String()) != "[]" {
+		t.Fatalf("wrong json of empty diff: %q, %v", buf.String(), err)
+	}
+}
+
+func TestSubstateMessageDiffAgreesWithEqual(t *testing.T) {
+	addr := common.HexToAddress("0x01")
+	for _, lists := range [][2]types.AccessList{
+		{nil, {}},
+		{{{Address: addr}}, {{Address: addr, StorageKeys: []common.Hash{}}}},
+		{nil, {{Address: addr}}},
+		{{{Address: addr}}, {{Address: addr, StorageKeys: []common.Hash{{}}}}},
+	} {
+		x, y := newTestSubstate(1, 0).Message, newTestSubstate(1, 0).Message
+		x.AccessList, y.AccessList = lists[0], lists[1]
+		if diff := x.Diff(y); diff.Empty() != x.Equal(y) {
+			t.Errorf("diff of access lists %v and %v disagrees with Equal: %v\n%s", lists[0], lists[1], x.Equal(y), diff)
+		}
+	}
+}
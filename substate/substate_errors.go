@@ -0,0 +1,77 @@
+package substate
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrNotFound is returned (wrapped in a NotFoundError) when a substate or
+// bytecode is missing in a substate DB.
+var ErrNotFound = errors.New("not found")
+
+// NotFoundError reports a missing substate (Block, Tx) or a missing
+// bytecode (CodeHash).
+type NotFoundError struct {
+	Block    uint64
+	Tx       int
+	CodeHash *common.Hash // nil if a substate is missing
+}
+
+func (e *NotFoundError) Error() string {
+	if e.CodeHash != nil {
+		return fmt.Sprintf("record-replay: code %s not found", e.CodeHash.Hex())
+	}
+	return fmt.Sprintf("record-replay: substate %v_%v not found", e.Block, e.Tx)
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return ErrNotFound
+}
+
+// DecodeError reports a substate that can not be decoded. Version and
+// Encoding identify the layout detected for the value, they are
+// UnknownSubstateVersion and UnknownEncoding if the value matches no known
+// layout.
+type DecodeError struct {
+	Block    uint64
+	Tx       int
+	Version  byte
+	Encoding string
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("record-replay: error decoding substate %v_%v (version: %d, encoding: %s): %v", e.Block, e.Tx, e.Version, e.Encoding, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// BackendError reports an I/O error of the backend database.
+type BackendError struct {
+	Op  string // operation such as "get", "put", "has" or "delete"
+	Key []byte
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("record-replay: backend %s %#x: %v", e.Op, e.Key, e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// OverlapError reports a substate that exists in more than one substate DB
+// being merged.
+type OverlapError struct {
+	Block uint64
+	Tx    int
+}
+
+func (e *OverlapError) Error() string {
+	return fmt.Sprintf("record-replay: substate %v_%v exists in more than one substate DB", e.Block, e.Tx)
+}
@@ -0,0 +1,169 @@
+package substate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var errBackendFailure = errors.New("disk failure")
+
+// failingBackend fails all reads and writes of an otherwise empty backend.
+type failingBackend struct {
+	ethdb.Database
+}
+
+func (b failingBackend) Has(key []byte) (bool, error) {
+	return false, errBackendFailure
+}
+
+func (b failingBackend) Get(key []byte) ([]byte, error) {
+	return nil, errBackendFailure
+}
+
+func (b failingBackend) Put(key []byte, value []byte) error {
+	return errBackendFailure
+}
+
+func (b failingBackend) Delete(key []byte) error {
+	return errBackendFailure
+}
+
+func TestSubstateNotFoundError(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSubstateDB(map[uint64]int{1: 1})
+	defer db.Close()
+
+	_, err := db.TryGetSubstate(ctx, 2, 3)
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || notFound.Block != 2 || notFound.Tx != 3 || notFound.CodeHash != nil {
+		t.Fatalf("wrong error of missing substate: %v", err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("error of missing substate does not wrap ErrNotFound: %v", err)
+	}
+
+	// a substate referencing missing bytecode reports the code hash
+	codeHash := CodeHash([]byte{0x60, 0x00, 0x00}) // code of newTestSubstate(1, 0)
+	db.backend.Delete(Stage1CodeKey(codeHash))
+	_, err = db.TryGetSubstate(ctx, 1, 0)
+	if !errors.As(err, &notFound) || notFound.CodeHash == nil || *notFound.CodeHash != codeHash {
+		t.Fatalf("wrong error of missing bytecode: %v", err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("error of missing bytecode does not wrap ErrNotFound: %v", err)
+	}
+	if _, err := db.TryGetCode(ctx, codeHash); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("wrong error of missing bytecode: %v", err)
+	}
+}
+
+func TestSubstateDecodeError(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSubstateDB(nil)
+	defer db.Close()
+
+	tests := []struct {
+		value    []byte
+		version  byte
+		encoding string
+	}{
+		{[]byte{LondonSubstateVersion, 0xc1, 0x01}, LondonSubstateVersion, LondonEncoding},
+		{[]byte{BerlinSubstateVersion, 0xc0}, BerlinSubstateVersion, BerlinEncoding},
+		{[]byte{0x7f, 0xc0}, UnknownSubstateVersion, UnknownEncoding},
+		{[]byte{0xc1, 0x01}, UnknownSubstateVersion, UnknownEncoding},
+	}
+	for i, tt := range tests {
+		db.backend.Put(Stage1SubstateKey(1, i), tt.value)
+		_, err := db.TryGetSubstate(ctx, 1, i)
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Fatalf("%x: wrong error: %v", tt.value, err)
+		}
+		if decodeErr.Block != 1 || decodeErr.Tx != i || decodeErr.Version != tt.version || decodeErr.Encoding != tt.encoding {
+			t.Errorf("%x: have %v_%v version %d %s, want 1_%v version %d %s", tt.value, decodeErr.Block, decodeErr.Tx, decodeErr.Version, decodeErr.Encoding, i, tt.version, tt.encoding)
+		}
+		if decodeErr.Err == nil || errors.Unwrap(err) != decodeErr.Err {
+			t.Errorf("%x: decode error does not wrap the cause: %v", tt.value, err)
+		}
+	}
+	if _, err := db.TryGetBlockSubstates(ctx, 1); !errors.As(err, new(*DecodeError)) {
+		t.Fatalf("wrong error of undecodable block: %v", err)
+	}
+}
+
+func TestSubstateBackendError(t *testing.T) {
+	ctx := context.Background()
+	db := NewSubstateDB(failingBackend{rawdb.NewMemoryDatabase()})
+	defer db.Close()
+
+	codeHash := CodeHash([]byte{0x00})
+	_, hasCodeErr := db.TryHasCode(ctx, codeHash)
+	_, getCodeErr := db.TryGetCode(ctx, codeHash)
+	_, hasErr := db.TryHasSubstate(ctx, 1, 0)
+	_, getErr := db.TryGetSubstate(ctx, 1, 0)
+	tests := []struct {
+		err error
+		op  string
+		key []byte
+	}{
+		{hasCodeErr, "has", Stage1CodeKey(codeHash)},
+		{getCodeErr, "get", Stage1CodeKey(codeHash)},
+		{db.TryPutCode(ctx, []byte{0x00}), "put", Stage1CodeKey(codeHash)},
+		{hasErr, "has", Stage1SubstateKey(1, 0)},
+		{getErr, "get", Stage1SubstateKey(1, 0)},
+		{db.TryDeleteSubstate(ctx, 1, 0), "delete", Stage1SubstateKey(1, 0)},
+	}
+	for i, tt := range tests {
+		var backendErr *BackendError
+		if !errors.As(tt.err, &backendErr) {
+			t.Fatalf("test %d: wrong error: %v", i, tt.err)
+		}
+		if backendErr.Op != tt.op || string(backendErr.Key) != string(tt.key) {
+			t.Errorf("test %d: have %s %x, want %s %x", i, backendErr.Op, backendErr.Key, tt.op, tt.key)
+		}
+		if !errors.Is(tt.err, errBackendFailure) {
+			t.Errorf("test %d: backend error does not wrap the cause: %v", i, tt.err)
+		}
+		if errors.Is(tt.err, ErrNotFound) {
+			t.Errorf("test %d: backend error reported as missing value: %v", i, tt.err)
+		}
+	}
+}
+
+func TestSubstateDBCancelled(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{1: 2})
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	codeHash := CodeHash([]byte{0x60, 0x00, 0x00})
+	_, hasCodeErr := db.TryHasCode(ctx, codeHash)
+	_, getCodeErr := db.TryGetCode(ctx, codeHash)
+	_, hasErr := db.TryHasSubstate(ctx, 1, 0)
+	_, getErr := db.TryGetSubstate(ctx, 1, 0)
+	_, getBlockErr := db.TryGetBlockSubstates(ctx, 1)
+	for i, err := range []error{
+		hasCodeErr,
+		getCodeErr,
+		db.TryPutCode(ctx, []byte{0x00}),
+		hasErr,
+		getErr,
+		getBlockErr,
+		db.TryPutSubstate(ctx, 2, 0, newTestSubstate(2, 0)),
+		db.TryDeleteSubstate(ctx, 1, 0),
+	} {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("test %d: wrong error of cancelled context: %v", i, err)
+		}
+	}
+
+	// nothing is written or deleted with a cancelled context
+	if db.HasCode(CodeHash([]byte{0x00})) || db.HasSubstate(2, 0) || !db.HasSubstate(1, 0) {
+		t.Fatalf("substate DB modified with cancelled context")
+	}
+}
@@ -0,0 +1,398 @@
+package substate
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var FilterFlag = cli.StringFlag{
+	Name:  "filter",
+	Usage: "Execute only transactions matching a filter expression, e.g. 'to=0x..,0x.. && selector=0xa9059cbb && !failed'",
+}
+
+// SubstateFilter selects transaction substates by their input alloc,
+// message and result.
+type SubstateFilter interface {
+	Match(substate *Substate) bool
+}
+
+// FilterFunc is a SubstateFilter implemented by a function.
+type FilterFunc func(substate *Substate) bool
+
+func (f FilterFunc) Match(substate *Substate) bool {
+	return f(substate)
+}
+
+// AllFilter matches substates that match all filters.
+func AllFilter(filters ...SubstateFilter) SubstateFilter {
+	return FilterFunc(func(substate *Substate) bool {
+		for _, f := range filters {
+			if !f.Match(substate) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// AnyFilter matches substates that match at least one of filters.
+func AnyFilter(filters ...SubstateFilter) SubstateFilter {
+	return FilterFunc(func(substate *Substate) bool {
+		for _, f := range filters {
+			if f.Match(substate) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// NotFilter matches substates that do not match filter.
+func NotFilter(filter SubstateFilter) SubstateFilter {
+	return FilterFunc(func(substate *Substate) bool {
+		return !filter.Match(substate)
+	})
+}
+
+func addressSet(addrs []common.Address) map[common.Address]struct{} {
+	set := make(map[common.Address]struct{}, len(addrs))
+	for _, addr := range addrs {
+		set[addr] = struct{}{}
+	}
+	return set
+}
+
+// FromFilter matches transactions sent by one of addrs.
+func FromFilter(addrs ...common.Address) SubstateFilter {
+	set := addressSet(addrs)
+	return FilterFunc(func(substate *Substate) bool {
+		_, found := set[substate.Message.From]
+		return found
+	})
+}
+
+// ToFilter matches transactions to one of addrs. It never matches CREATE
+// transactions.
+func ToFilter(addrs ...common.Address) SubstateFilter {
+	set := addressSet(addrs)
+	return FilterFunc(func(substate *Substate) bool {
+		if substate.Message.To == nil {
+			return false
+		}
+		_, found := set[*substate.Message.To]
+		return found
+	})
+}
+
+// AddressFilter matches transactions sent by or to one of addrs.
+func AddressFilter(addrs ...common.Address) SubstateFilter {
+	return AnyFilter(FromFilter(addrs...), ToFilter(addrs...))
+}
+
+// CodeHashFilter matches transactions accessing an account with bytecode of
+// one of codeHashes, directly or through internal calls, and CREATE
+// transactions with init code of one of codeHashes.
+func CodeHashFilter(codeHashes ...common.Hash) SubstateFilter {
+	set := make(map[common.Hash]struct{}, len(codeHashes))
+	for _, codeHash := range codeHashes {
+		set[codeHash] = struct{}{}
+	}
+	return FilterFunc(func(substate *Substate) bool {
+		for _, account := range substate.InputAlloc {
+			if account == nil || len(account.Code) == 0 {
+				continue
+			}
+			if _, found := set[account.CodeHash()]; found {
+				return true
+			}
+		}
+		if msg := substate.Message; msg.To == nil {
+			_, found := set[msg.DataHash()]
+			return found
+		}
+		return false
+	})
+}
+
+// SelectorFilter matches calls of a function with one of the 4-byte
+// selectors.
+func SelectorFilter(selectors ...[4]byte) SubstateFilter {
+	return FilterFunc(func(substate *Substate) bool {
+		msg := substate.Message
+		if msg.To == nil || len(msg.Data) < 4 {
+			return false
+		}
+		for _, selector := range selectors {
+			if bytes.Equal(msg.Data[:4], selector[:]) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// FailedFilter matches transactions with a failed receipt status.
+func FailedFilter() SubstateFilter {
+	return FilterFunc(func(substate *Substate) bool {
+		return substate.Result.Status == types.ReceiptStatusFailed
+	})
+}
+
+// GasUsedFilter matches transactions that used between min and max gas,
+// inclusive.
+func GasUsedFilter(min, max uint64) SubstateFilter {
+	return FilterFunc(func(substate *Substate) bool {
+		gasUsed := substate.Result.GasUsed
+		return min <= gasUsed && gasUsed <= max
+	})
+}
+
+// TypeFilter matches transactions of one of txTypes.
+func TypeFilter(txTypes ...TransactionType) SubstateFilter {
+	return FilterFunc(func(substate *Substate) bool {
+		txType := ClassifyTransaction(substate)
+		for _, t := range txTypes {
+			if t == txType {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ParseSubstateFilter parses a filter expression. An expression combines
+// terms with && (and), || (or), ! (not) and parentheses; && binds stronger
+// than ||. Terms taking values accept a comma-separated list matching any of
+// the values:
+//
+//	from=ADDR,...     transaction sent by one of the addresses
+//	to=ADDR,...       transaction to one of the addresses
+//	address=ADDR,...  transaction sent by or to one of the addresses
+//	code=HASH,...     transaction accessing bytecode with one of the hashes
+//	selector=0x....   call of a function with one of the 4-byte selectors
+//	type=TYPE,...     transaction of type transfer, call or create
+//	gas=MIN-MAX       gas used in the inclusive range, MIN or MAX may be omitted
+//	failed            transaction with failed receipt status
+func ParseSubstateFilter(expr string) (SubstateFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty filter expression")
+	}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid filter expression: unexpected %q", p.tokens[p.pos])
+	}
+	return filter, nil
+}
+
+// tokenizeFilter splits a filter expression into operators, parentheses and
+// terms.
+func tokenizeFilter(expr string) []string {
+	var (
+		tokens []string
+		term   strings.Builder
+	)
+	endTerm := func() {
+		if term.Len() > 0 {
+			tokens = append(tokens, term.String())
+			term.Reset()
+		}
+	}
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '(' || c == ')' || c == '!':
+			endTerm()
+			tokens = append(tokens, string(c))
+		case (c == '&' || c == '|') && i+1 < len(expr) && expr[i+1] == c:
+			endTerm()
+			tokens = append(tokens, expr[i:i+2])
+			i++
+		case unicode.IsSpace(rune(c)):
+			endTerm()
+		default:
+			term.WriteByte(c)
+		}
+	}
+	endTerm()
+	return tokens
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) parseOr() (SubstateFilter, error) {
+	filters := []SubstateFilter{}
+	for {
+		filter, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+		if p.peek() != "||" {
+			break
+		}
+		p.pos++
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return AnyFilter(filters...), nil
+}
+
+func (p *filterParser) parseAnd() (SubstateFilter, error) {
+	filters := []SubstateFilter{}
+	for {
+		filter, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+		if p.peek() != "&&" {
+			break
+		}
+		p.pos++
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return AllFilter(filters...), nil
+}
+
+func (p *filterParser) parseUnary() (SubstateFilter, error) {
+	switch token := p.peek(); token {
+	case "":
+		return nil, fmt.Errorf("invalid filter expression: unexpected end")
+	case "!":
+		p.pos++
+		filter, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return NotFilter(filter), nil
+	case "(":
+		p.pos++
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("invalid filter expression: missing )")
+		}
+		p.pos++
+		return filter, nil
+	case ")", "&&", "||":
+		return nil, fmt.Errorf("invalid filter expression: unexpected %q", token)
+	default:
+		p.pos++
+		return parseFilterTerm(token)
+	}
+}
+
+// parseFilterTerm parses a single term of a filter expression.
+func parseFilterTerm(term string) (SubstateFilter, error) {
+	if term == "failed" {
+		return FailedFilter(), nil
+	}
+	i := strings.IndexByte(term, '=')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid filter term %q", term)
+	}
+	key, values := term[:i], strings.Split(term[i+1:], ",")
+
+	switch key {
+	case "from", "to", "address":
+		addrs := make([]common.Address, len(values))
+		for i, value := range values {
+			if !common.IsHexAddress(value) {
+				return nil, fmt.Errorf("invalid address %q in filter term %q", value, term)
+			}
+			addrs[i] = common.HexToAddress(value)
+		}
+		switch key {
+		case "from":
+			return FromFilter(addrs...), nil
+		case "to":
+			return ToFilter(addrs...), nil
+		}
+		return AddressFilter(addrs...), nil
+
+	case "code":
+		codeHashes := make([]common.Hash, len(values))
+		for i, value := range values {
+			b, err := hexutil.Decode(value)
+			if err != nil || len(b) != common.HashLength {
+				return nil, fmt.Errorf("invalid code hash %q in filter term %q", value, term)
+			}
+			codeHashes[i] = common.BytesToHash(b)
+		}
+		return CodeHashFilter(codeHashes...), nil
+
+	case "selector":
+		selectors := make([][4]byte, len(values))
+		for i, value := range values {
+			b, err := hexutil.Decode(value)
+			if err != nil || len(b) != 4 {
+				return nil, fmt.Errorf("invalid selector %q in filter term %q", value, term)
+			}
+			copy(selectors[i][:], b)
+		}
+		return SelectorFilter(selectors...), nil
+
+	case "type":
+		txTypes := make([]TransactionType, len(values))
+		for i, value := range values {
+			switch value {
+			case TransferTx.String():
+				txTypes[i] = TransferTx
+			case CallTx.String():
+				txTypes[i] = CallTx
+			case CreateTx.String():
+				txTypes[i] = CreateTx
+			default:
+				return nil, fmt.Errorf("invalid transaction type %q in filter term %q", value, term)
+			}
+		}
+		return TypeFilter(txTypes...), nil
+
+	case "gas":
+		if len(values) != 1 || strings.Count(values[0], "-") != 1 {
+			return nil, fmt.Errorf("invalid gas range in filter term %q", term)
+		}
+		bounds := strings.Split(values[0], "-")
+		min, max := uint64(0), ^uint64(0)
+		var err error
+		if bounds[0] != "" {
+			if min, err = strconv.ParseUint(bounds[0], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid gas range in filter term %q", term)
+			}
+		}
+		if bounds[1] != "" {
+			if max, err = strconv.ParseUint(bounds[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid gas range in filter term %q", term)
+			}
+		}
+		return GasUsedFilter(min, max), nil
+	}
+	return nil, fmt.Errorf("unknown filter %q in filter term %q", key, term)
+}
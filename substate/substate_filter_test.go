@@ -0,0 +1,91 @@
+package substate
+
+import (
+	"math/big"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestParseSubstateFilter(t *testing.T) {
+	call := newTestSubstate(1, 0) // to 0x..01 with code PUSH1 0; STOP
+	call.Message.Data = []byte{0xa9, 0x05, 0x9c, 0xbb, 0x00}
+
+	failed := newTestSubstate(1, 1) // to 0x..02
+	failed.Result.Status = 0
+	failed.Result.GasUsed = 50000
+
+	create := newTestSubstate(1, 2)
+	create.Message.To = nil
+	create.Message.Data = []byte{0x60, 0x00}
+	create.InputAlloc = SubstateAlloc{}
+
+	to1 := common.BigToAddress(big.NewInt(1)).Hex()
+	codeHash := crypto.Keccak256Hash([]byte{0x60, 0x00, 0x00}).Hex()
+	initCodeHash := crypto.Keccak256Hash(create.Message.Data).Hex()
+
+	tests := []struct {
+		expr string
+		want [3]bool // call, failed, create
+	}{
+		{"to=" + to1, [3]bool{true, false, false}},
+		{"address=" + to1 + "," + common.BigToAddress(big.NewInt(2)).Hex(), [3]bool{true, true, false}},
+		{"from=0x0000000000000000000000000000000000000000", [3]bool{true, true, true}},
+		{"code=" + codeHash, [3]bool{true, false, false}},
+		{"code=" + initCodeHash, [3]bool{false, false, true}},
+		{"selector=0xa9059cbb", [3]bool{true, false, false}},
+		{"failed", [3]bool{false, true, false}},
+		{"!failed", [3]bool{true, false, true}},
+		{"gas=30000-", [3]bool{false, true, false}},
+		{"gas=-21000", [3]bool{true, false, true}},
+		{"type=create", [3]bool{false, false, true}},
+		{"type=call && !failed || type=create", [3]bool{true, false, true}},
+		{"type=call && (failed || selector=0xa9059cbb)", [3]bool{true, true, false}},
+		{"!(failed || type=create)", [3]bool{true, false, false}},
+	}
+	for _, test := range tests {
+		filter, err := ParseSubstateFilter(test.expr)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", test.expr, err)
+		}
+		for i, substate := range []*Substate{call, failed, create} {
+			if have := filter.Match(substate); have != test.want[i] {
+				t.Errorf("%q: substate %d: have %v, want %v", test.expr, i, have, test.want[i])
+			}
+		}
+	}
+
+	for _, expr := range []string{"", "to=0x01", "failed &&", "(failed", "failed)", "gas=1", "type=delegatecall", "selector=0x01", "color=red"} {
+		if _, err := ParseSubstateFilter(expr); err == nil {
+			t.Errorf("parsed invalid filter %q", expr)
+		}
+	}
+}
+
+func TestSubstateTaskPoolFilter(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{1: 3, 2: 2})
+	defer db.Close()
+
+	var executed int64
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			atomic.AddInt64(&executed, 1)
+			return nil
+		},
+		First:    0,
+		Last:     2,
+		Workers:  2,
+		Filter:   ToFilter(common.BigToAddress(big.NewInt(2))), // transaction 1 of each block
+		DB:       db,
+		Progress: func(*TaskProgress) {},
+	}
+	if err := pool.Execute(); err != nil {
+		t.Fatalf("failed to execute: %v", err)
+	}
+	if executed != 2 {
+		t.Fatalf("wrong number of executed transactions: have %d, want 2", executed)
+	}
+}
@@ -0,0 +1,206 @@
+package substate
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+)
+
+// Transaction is a substate together with its position in the substate DB.
+type Transaction struct {
+	Block       uint64
+	Transaction int
+	Substate    *Substate
+}
+
+// rawSubstate is a key/value pair read from the backend that is not decoded
+// yet. The decoded substate is sent to result.
+type rawSubstate struct {
+	block  uint64
+	tx     int
+	value  []byte
+	result chan decodedSubstate
+}
+
+// decodedSubstate is delivered by a decoding worker.
+type decodedSubstate struct {
+	tx  *Transaction
+	err error
+}
+
+// SubstateIterator iterates over substates of an inclusive block range in
+// key order, i.e. ordered by block and transaction index. Substates are read
+// sequentially from the backend and decoded by a bounded pool of workers.
+//
+// An iterator must be released after use. It is not safe for concurrent use.
+type SubstateIterator struct {
+	db      *SubstateDB
+	last    uint64
+	workers int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// results delivers one channel per substate in key order,
+	// each channel receives the decoded substate of its position.
+	results chan chan decodedSubstate
+
+	cur *Transaction
+	err error
+}
+
+// NewSubstateIterator returns an iterator over all substates from block first
+// to block last (both inclusive) that decodes with the given number of workers.
+func (db *SubstateDB) NewSubstateIterator(first, last uint64, workers int) *SubstateIterator {
+	if workers < 1 {
+		workers = 1
+	}
+	iter := &SubstateIterator{
+		db:      db,
+		last:    last,
+		workers: workers,
+	}
+	iter.start(first, 0)
+	return iter
+}
+
+// start spawns the reader and decoding workers beginning at (block, tx).
+func (iter *SubstateIterator) start(block uint64, tx int) {
+	iter.ctx, iter.cancel = context.WithCancel(context.Background())
+	iter.results = make(chan chan decodedSubstate, iter.workers*10)
+
+	jobs := make(chan rawSubstate, iter.workers)
+
+	// reader goroutine, the only user of the backend iterator
+	iter.wg.Add(1)
+	go func() {
+		defer iter.wg.Done()
+		defer close(jobs)
+		defer close(iter.results)
+
+		start := make([]byte, 16)
+		binary.BigEndian.PutUint64(start[0:8], block)
+		binary.BigEndian.PutUint64(start[8:16], uint64(tx))
+
+		it := iter.db.backend.NewIterator([]byte(stage1SubstatePrefix), start)
+		defer it.Release()
+		for it.Next() {
+			b, t, err := DecodeStage1SubstateKey(it.Key())
+			if err != nil {
+				iter.deliver(decodedSubstate{err: err})
+				return
+			}
+			if b > iter.last {
+				return
+			}
+
+			// the backend may reuse the value buffer on the next call
+			value := make([]byte, len(it.Value()))
+			copy(value, it.Value())
+
+			result := make(chan decodedSubstate, 1)
+			select {
+			case iter.results <- result:
+			case <-iter.ctx.Done():
+				return
+			}
+			select {
+			case jobs <- rawSubstate{block: b, tx: t, value: value, result: result}:
+			case <-iter.ctx.Done():
+				return
+			}
+		}
+		if err := it.Error(); err != nil {
+			iter.deliver(decodedSubstate{err: &BackendError{Op: "iterate", Key: []byte(stage1SubstatePrefix), Err: err}})
+		}
+	}()
+
+	// decoding workers
+	for i := 0; i < iter.workers; i++ {
+		iter.wg.Add(1)
+		go func() {
+			defer iter.wg.Done()
+			for raw := range jobs {
+				substate, err := iter.db.decodeSubstate(iter.ctx, raw.block, raw.tx, raw.value)
+				if err != nil {
+					raw.result <- decodedSubstate{err: err}
+					continue
+				}
+				raw.result <- decodedSubstate{tx: &Transaction{Block: raw.block, Transaction: raw.tx, Substate: substate}}
+			}
+		}()
+	}
+}
+
+// deliver sends a result that does not need decoding to the consumer.
+func (iter *SubstateIterator) deliver(res decodedSubstate) {
+	result := make(chan decodedSubstate, 1)
+	result <- res
+	select {
+	case iter.results <- result:
+	case <-iter.ctx.Done():
+	}
+}
+
+// stop terminates all goroutines of the iterator and waits until they exit.
+func (iter *SubstateIterator) stop() {
+	if iter.cancel == nil {
+		return
+	}
+	iter.cancel()
+	for range iter.results {
+		// drain results to unblock the reader
+	}
+	iter.wg.Wait()
+	iter.cancel = nil
+}
+
+// Next moves the iterator to the next substate. It returns false if the
+// iterator is exhausted or an error occurred.
+func (iter *SubstateIterator) Next() bool {
+	if iter.err != nil || iter.cancel == nil {
+		return false
+	}
+	result, ok := <-iter.results
+	if !ok {
+		iter.cur = nil
+		return false
+	}
+	res := <-result
+	if res.err != nil {
+		iter.err = res.err
+		iter.cur = nil
+		iter.stop()
+		return false
+	}
+	iter.cur = res.tx
+	return true
+}
+
+// Value returns the current substate, or nil if the iterator is exhausted.
+func (iter *SubstateIterator) Value() *Transaction {
+	return iter.cur
+}
+
+// Seek moves the iterator such that the next call of Next returns the first
+// substate at or after transaction tx of block.
+func (iter *SubstateIterator) Seek(block uint64, tx int) {
+	iter.stop()
+	iter.cur = nil
+	iter.err = nil
+	iter.start(block, tx)
+}
+
+// Error returns any error that stopped the iteration. Reaching the end of
+// the block range is not considered to be an error.
+func (iter *SubstateIterator) Error() error {
+	return iter.err
+}
+
+// Release stops all background goroutines. Release can be called multiple
+// times.
+func (iter *SubstateIterator) Release() {
+	iter.stop()
+	iter.cur = nil
+}
@@ -0,0 +1,115 @@
+package substate
+
+import (
+	"math/big"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+// newTestSubstate returns a minimal substate that calls a contract.
+func newTestSubstate(block uint64, tx int) *Substate {
+	to := common.BigToAddress(big.NewInt(int64(tx + 1)))
+	code := []byte{0x60, byte(tx), 0x00} // PUSH1 tx; STOP
+
+	inputAlloc := SubstateAlloc{
+		to: NewSubstateAccount(1, big.NewInt(int64(block)), code),
+	}
+	outputAlloc := SubstateAlloc{
+		to: NewSubstateAccount(1, big.NewInt(int64(block)), code),
+	}
+	env := &SubstateEnv{
+		Difficulty:  big.NewInt(1),
+		GasLimit:    1000000,
+		Number:      block,
+		Timestamp:   block,
+		BlockHashes: map[uint64]common.Hash{},
+	}
+	msg := &SubstateMessage{
+		GasPrice:  big.NewInt(1),
+		Gas:       21000,
+		To:        &to,
+		Value:     big.NewInt(0),
+		GasFeeCap: big.NewInt(1),
+		GasTipCap: big.NewInt(1),
+	}
+	result := &SubstateResult{Status: 1, GasUsed: 21000}
+
+	return NewSubstate(inputAlloc, outputAlloc, env, msg, result)
+}
+
+func newTestSubstateDB(blocks map[uint64]int) *SubstateDB {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	for block, numTx := range blocks {
+		for tx := 0; tx < numTx; tx++ {
+			db.PutSubstate(block, tx, newTestSubstate(block, tx))
+		}
+	}
+	return db
+}
+
+func TestSubstateIterator(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{1: 3, 5: 1, 10: 12, 11: 2})
+	defer db.Close()
+
+	iter := db.NewSubstateIterator(2, 10, 4)
+	defer iter.Release()
+
+	var got [][2]uint64
+	for iter.Next() {
+		tx := iter.Value()
+		if !tx.Substate.Equal(newTestSubstate(tx.Block, tx.Transaction)) {
+			t.Fatalf("substate %v_%v differs from stored substate", tx.Block, tx.Transaction)
+		}
+		got = append(got, [2]uint64{tx.Block, uint64(tx.Transaction)})
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 13 {
+		t.Fatalf("wrong number of substates: have %d, want 13", len(got))
+	}
+	want := [][2]uint64{{5, 0}}
+	for tx := uint64(0); tx < 12; tx++ {
+		want = append(want, [2]uint64{10, tx})
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("substate %d: have %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	iter.Seek(10, 7)
+	if !iter.Next() {
+		t.Fatalf("no substate after seek: %v", iter.Error())
+	}
+	if tx := iter.Value(); tx.Block != 10 || tx.Transaction != 7 {
+		t.Fatalf("wrong substate after seek: have %v_%v, want 10_7", tx.Block, tx.Transaction)
+	}
+}
+
+func TestSubstateTaskPoolSkipsMissingBlocks(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{3: 2, 1000: 4})
+	defer db.Close()
+
+	var numTx int64
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			atomic.AddInt64(&numTx, 1)
+			return nil
+		},
+		First:   0,
+		Last:    2000,
+		Workers: 3,
+		DB:      db,
+	}
+	if err := pool.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if numTx != 6 {
+		t.Fatalf("wrong number of executed transactions: have %d, want 6", numTx)
+	}
+}
@@ -147,10 +147,8 @@ func (env *SubstateEnv) SetJSON(envJSON *SubstateEnvJSON) {
 		}
 	}
 
+	// a zero base fee is kept, only a missing one means EIP-1559 is not activated
 	env.BaseFee = (*big.Int)(envJSON.BaseFee)
-	if env.BaseFee.Cmp(big.NewInt(0)) == 0 {
-		env.BaseFee = nil
-	}
 }
 
 func (env SubstateEnv) MarshalJSON() ([]byte, error) {
@@ -223,12 +221,13 @@ func (msg *SubstateMessage) SetJSON(msgJSON *SubstateMessageJSON) {
 
 	msg.AccessList = msgJSON.AccessList
 
+	// zero fee caps are kept, missing ones are GasPrice like in legacy substates
 	msg.GasFeeCap = (*big.Int)(msgJSON.GasFeeCap)
-	if msg.GasFeeCap.Cmp(big.NewInt(0)) == 0 {
+	if msg.GasFeeCap == nil {
 		msg.GasFeeCap = msg.GasPrice
 	}
 	msg.GasTipCap = (*big.Int)(msgJSON.GasTipCap)
-	if msg.GasTipCap.Cmp(big.NewInt(0)) == 0 {
+	if msg.GasTipCap == nil {
 		msg.GasTipCap = msg.GasPrice
 	}
 }
@@ -321,6 +320,15 @@ func NewSubstateJSON(substate *Substate) *SubstateJSON {
 }
 
 func (substate *Substate) SetJSON(substateJSON *SubstateJSON) {
+	if substate.Env == nil {
+		substate.Env = &SubstateEnv{}
+	}
+	if substate.Message == nil {
+		substate.Message = &SubstateMessage{}
+	}
+	if substate.Result == nil {
+		substate.Result = &SubstateResult{}
+	}
 	substate.InputAlloc.SetJSON(substateJSON.InputAlloc)
 	substate.OutputAlloc.SetJSON(substateJSON.OutputAlloc)
 	substate.Env.SetJSON(substateJSON.Env)
@@ -0,0 +1,90 @@
+package substate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// TransactionJSON is a line of a substate export in JSON lines format.
+type TransactionJSON struct {
+	Block       uint64        `json:"block"`
+	Transaction int           `json:"tx"`
+	Substate    *SubstateJSON `json:"substate"`
+}
+
+// ExportJSONL writes the substates of blocks first to last to w, one JSON
+// object per line in key order. Substates are decoded with the given number
+// of workers. It returns the number of exported substates.
+func (db *SubstateDB) ExportJSONL(ctx context.Context, w io.Writer, first, last uint64, workers int) (int, error) {
+	var numExported int
+
+	enc := json.NewEncoder(w) // Encode terminates each object with a newline
+	iter := db.NewSubstateIterator(first, last, workers)
+	defer iter.Release()
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return numExported, err
+		}
+		tx := iter.Value()
+		line := TransactionJSON{
+			Block:       tx.Block,
+			Transaction: tx.Transaction,
+			Substate:    NewSubstateJSON(tx.Substate),
+		}
+		if err := enc.Encode(&line); err != nil {
+			return numExported, err
+		}
+		numExported++
+	}
+	if err := iter.Error(); err != nil {
+		return numExported, err
+	}
+	return numExported, nil
+}
+
+// ImportJSONL reads substates in the format of ExportJSONL from r and stores
+// them together with their bytecode. Consecutive substates of a block are
+// committed atomically. It returns the number of imported substates.
+func (db *SubstateDB) ImportJSONL(ctx context.Context, r io.Reader) (int, error) {
+	var (
+		numImported int
+		curBlock    uint64
+	)
+	w := db.NewSubstateWriter(DefaultWriterBatchSize, DefaultWriterCodeCacheSize)
+	dec := json.NewDecoder(r)
+	for {
+		var line TransactionJSON
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return numImported, fmt.Errorf("record-replay: invalid substate after %d imported substates: %v", numImported, err)
+		}
+		if line.Substate == nil {
+			return numImported, fmt.Errorf("record-replay: substate %v_%v has no value", line.Block, line.Transaction)
+		}
+
+		if numImported > 0 && line.Block != curBlock {
+			if err := w.CommitBlock(ctx); err != nil {
+				return numImported, err
+			}
+		}
+		curBlock = line.Block
+
+		substate := &Substate{}
+		substate.SetJSON(line.Substate)
+		if err := w.PutSubstate(ctx, line.Block, line.Transaction, substate); err != nil {
+			return numImported, err
+		}
+		numImported++
+	}
+	if numImported > 0 {
+		if err := w.CommitBlock(ctx); err != nil {
+			return numImported, err
+		}
+	}
+	return numImported, w.Flush()
+}
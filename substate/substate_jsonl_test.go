@@ -0,0 +1,109 @@
+package substate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestSubstateJSONLRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := newTestSubstateDB(map[uint64]int{1: 2, 3: 1, 7: 3})
+
+	var buf bytes.Buffer
+	numExported, err := src.ExportJSONL(ctx, &buf, 0, math.MaxUint64, 2)
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	if numExported != 6 {
+		t.Fatalf("wrong number of exported substates: have %d, want 6", numExported)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 6 {
+		t.Fatalf("wrong number of lines: have %d, want 6", lines)
+	}
+
+	dst := newTestSubstateDB(nil)
+	numImported, err := dst.ImportJSONL(ctx, &buf)
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if numImported != 6 {
+		t.Fatalf("wrong number of imported substates: have %d, want 6", numImported)
+	}
+	for block, numTx := range map[uint64]int{1: 2, 3: 1, 7: 3} {
+		for tx := 0; tx < numTx; tx++ {
+			if have := dst.GetSubstate(block, tx); !have.Equal(newTestSubstate(block, tx)) {
+				t.Fatalf("substate %v_%v not imported correctly", block, tx)
+			}
+		}
+	}
+	if report, err := dst.Verify(ctx); err != nil || !report.OK() {
+		t.Fatalf("imported substate DB is inconsistent: %+v, %v", report, err)
+	}
+
+	if _, err := dst.ImportJSONL(ctx, strings.NewReader(`{"block":1,"tx":0}`)); err == nil {
+		t.Fatalf("imported line without substate")
+	}
+	if _, err := dst.ImportJSONL(ctx, strings.NewReader(`{"block":1,`)); err == nil {
+		t.Fatalf("imported truncated line")
+	}
+}
+
+func TestSubstateJSONLRoundTripKeepsFees(t *testing.T) {
+	ctx := context.Background()
+	src := newTestSubstateDB(nil)
+
+	// legacy transaction before London, fee caps are the gas price
+	legacy := newTestSubstate(1, 0)
+	legacy.Message.GasPrice = big.NewInt(7)
+	legacy.Message.GasFeeCap = big.NewInt(7)
+	legacy.Message.GasTipCap = big.NewInt(7)
+	src.PutSubstate(1, 0, legacy)
+
+	// London transaction without tip, paying the base fee only
+	london := newTestSubstate(2, 0)
+	london.Env.BaseFee = big.NewInt(5)
+	london.Message.GasPrice = big.NewInt(5)
+	london.Message.GasFeeCap = big.NewInt(10)
+	london.Message.GasTipCap = big.NewInt(0)
+	src.PutSubstate(2, 0, london)
+
+	// London transaction in a block with zero base fee
+	free := newTestSubstate(3, 0)
+	free.Env.BaseFee = big.NewInt(0)
+	free.Message.GasPrice = big.NewInt(0)
+	free.Message.GasFeeCap = big.NewInt(0)
+	free.Message.GasTipCap = big.NewInt(0)
+	src.PutSubstate(3, 0, free)
+
+	var buf bytes.Buffer
+	if _, err := src.ExportJSONL(ctx, &buf, 0, math.MaxUint64, 2); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	dst := newTestSubstateDB(nil)
+	if _, err := dst.ImportJSONL(ctx, &buf); err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	for block, want := range map[uint64]*Substate{1: legacy, 2: london, 3: free} {
+		have := dst.GetSubstate(block, 0)
+		if (have.Env.BaseFee == nil) != (want.Env.BaseFee == nil) {
+			t.Fatalf("base fee of block %v not imported correctly: have %v, want %v", block, have.Env.BaseFee, want.Env.BaseFee)
+		}
+		if !have.Equal(want) {
+			t.Fatalf("substate %v_0 not imported correctly:\n%v", block, have.Diff(want))
+		}
+	}
+
+	// fee caps missing in the JSON of legacy substates are the gas price
+	var msg SubstateMessage
+	if err := json.Unmarshal([]byte(`{"gasPrice":"0x7","gas":"0x5208","to":null,"value":"0x0","input":"0x"}`), &msg); err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	if msg.GasFeeCap.Cmp(big.NewInt(7)) != 0 || msg.GasTipCap.Cmp(big.NewInt(7)) != 0 {
+		t.Fatalf("wrong fee caps of legacy message: %v %v", msg.GasFeeCap, msg.GasTipCap)
+	}
+}
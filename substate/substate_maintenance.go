@@ -0,0 +1,317 @@
+package substate
+
+import (
+	"context"
+	"math"
+	"runtime"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// BlockRange is an inclusive range of blocks.
+type BlockRange struct {
+	First uint64
+	Last  uint64
+}
+
+// copySubstates copies all substates of blocks first to last from src. The
+// writer of a substate is selected by dst and each block is committed
+// atomically. check is called for every substate before it is copied and may
+// be nil. On error the uncommitted block is discarded. It returns the number
+// of substates of committed blocks.
+func copySubstates(ctx context.Context, src *SubstateDB, first, last uint64, dst func(block uint64) (*SubstateWriter, error), check func(tx *Transaction) error) (int, error) {
+	var (
+		numCopied  int // substates of committed blocks
+		numPending int // substates of the uncommitted block
+		curBlock   uint64
+		curWriter  *SubstateWriter
+	)
+	commit := func() error {
+		if err := curWriter.CommitBlock(ctx); err != nil {
+			return err
+		}
+		numCopied += numPending
+		numPending = 0
+		return nil
+	}
+	fail := func(err error) (int, error) {
+		if curWriter != nil {
+			curWriter.Discard()
+		}
+		return numCopied, err
+	}
+	iter := src.NewSubstateIterator(first, last, runtime.NumCPU())
+	defer iter.Release()
+	for iter.Next() {
+		tx := iter.Value()
+		if curWriter != nil && tx.Block != curBlock {
+			if err := commit(); err != nil {
+				return fail(err)
+			}
+			curWriter = nil
+		}
+		if curWriter == nil {
+			w, err := dst(tx.Block)
+			if err != nil {
+				return fail(err)
+			}
+			curBlock, curWriter = tx.Block, w
+		}
+		if check != nil {
+			if err := check(tx); err != nil {
+				return fail(err)
+			}
+		}
+		if err := curWriter.PutSubstate(ctx, tx.Block, tx.Transaction, tx.Substate); err != nil {
+			return fail(err)
+		}
+		numPending++
+	}
+	if err := iter.Error(); err != nil {
+		return fail(err)
+	}
+	if curWriter != nil {
+		if err := commit(); err != nil {
+			return fail(err)
+		}
+	}
+	return numCopied, nil
+}
+
+// CloneSubstateDB copies all substates of blocks first to last and the
+// bytecode they reference from src to dst. On error the blocks copied so far
+// are kept. It returns the number of copied substates.
+func CloneSubstateDB(ctx context.Context, src, dst *SubstateDB, first, last uint64) (int, error) {
+	w := dst.NewSubstateWriter(DefaultWriterBatchSize, DefaultWriterCodeCacheSize)
+	numCopied, err := copySubstates(ctx, src, first, last, func(uint64) (*SubstateWriter, error) {
+		return w, nil
+	}, nil)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return numCopied, err
+}
+
+// MergeSubstateDBs copies all substates and the bytecode they reference from
+// srcs to dst, e.g. to combine substate DBs recorded in parallel over disjoint
+// block ranges. It returns an OverlapError if a substate exists in more than
+// one source or already exists in dst; the blocks before the overlapping one
+// are merged then, the overlapping block is not. It returns the number of
+// merged substates.
+func MergeSubstateDBs(ctx context.Context, dst *SubstateDB, srcs ...*SubstateDB) (int, error) {
+	var numMerged int
+
+	w := dst.NewSubstateWriter(DefaultWriterBatchSize, DefaultWriterCodeCacheSize)
+	check := func(tx *Transaction) error {
+		has, err := dst.TryHasSubstate(ctx, tx.Block, tx.Transaction)
+		if err != nil {
+			return err
+		}
+		if has {
+			return &OverlapError{Block: tx.Block, Tx: tx.Transaction}
+		}
+		return nil
+	}
+	for _, src := range srcs {
+		numCopied, err := copySubstates(ctx, src, 0, math.MaxUint64, func(uint64) (*SubstateWriter, error) {
+			return w, nil
+		}, check)
+		numMerged += numCopied
+		// substates of the next source are checked against this source
+		if flushErr := w.Flush(); err == nil {
+			err = flushErr
+		}
+		if err != nil {
+			return numMerged, err
+		}
+	}
+	return numMerged, nil
+}
+
+// SplitSubstateDB shards the substates of blocks first to last in src by
+// block range. Each shard holds blocksPerShard blocks, the first shard starts
+// at block first. open is called to create the substate DB of a shard when
+// its first substate is copied; the shards are closed when the split is done.
+// It returns the block ranges of the created shards.
+func SplitSubstateDB(ctx context.Context, src *SubstateDB, first, last, blocksPerShard uint64, open func(shard BlockRange) (*SubstateDB, error)) ([]BlockRange, error) {
+	if blocksPerShard == 0 {
+		blocksPerShard = 1
+	}
+	var (
+		shards   []BlockRange
+		shardDBs []*SubstateDB
+		writers  = make(map[BlockRange]*SubstateWriter)
+	)
+	closeShards := func() error {
+		var firstErr error
+		for i, shard := range shards {
+			if err := writers[shard].Flush(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if err := shardDBs[i].Close(); err != nil && firstErr == nil {
+				firstErr = &BackendError{Op: "close", Err: err}
+			}
+		}
+		return firstErr
+	}
+
+	_, err := copySubstates(ctx, src, first, last, func(block uint64) (*SubstateWriter, error) {
+		shardFirst := first + (block-first)/blocksPerShard*blocksPerShard
+		shard := BlockRange{First: shardFirst, Last: shardFirst + blocksPerShard - 1}
+		if shard.Last < shard.First || shard.Last > last {
+			shard.Last = last // overflow or last shard
+		}
+		if w, found := writers[shard]; found {
+			return w, nil
+		}
+		db, err := open(shard)
+		if err != nil {
+			return nil, err
+		}
+		w := db.NewSubstateWriter(DefaultWriterBatchSize, DefaultWriterCodeCacheSize)
+		shards = append(shards, shard)
+		shardDBs = append(shardDBs, db)
+		writers[shard] = w
+		return w, nil
+	}, nil)
+	if closeErr := closeShards(); err == nil {
+		err = closeErr
+	}
+	return shards, err
+}
+
+// MissingCode is a bytecode referenced by a substate that does not exist in
+// the substate DB.
+type MissingCode struct {
+	Block    uint64
+	Tx       int
+	CodeHash common.Hash
+}
+
+// TxGap is a transaction index missing in a block with substates.
+type TxGap struct {
+	Block uint64
+	Tx    int
+}
+
+// VerifyReport is the result of a substate DB integrity check.
+type VerifyReport struct {
+	Substates int // number of checked substates
+	Codes     int // number of checked bytecodes
+
+	DecodeErrors []*DecodeError // substates that can not be decoded
+	MissingCodes []MissingCode  // referenced bytecode missing under 1c
+	OrphanCodes  []common.Hash  // bytecode not referenced by any substate
+	BlockGaps    []BlockRange   // blocks without substates between the first and last recorded block
+	TxGaps       []TxGap        // transactions missing in blocks with substates
+}
+
+// OK reports whether the substate DB is consistent. Block gaps do not count
+// as inconsistency because blocks without transactions have no substates.
+func (r *VerifyReport) OK() bool {
+	return len(r.DecodeErrors) == 0 && len(r.MissingCodes) == 0 && len(r.OrphanCodes) == 0 && len(r.TxGaps) == 0
+}
+
+// Verify checks that every substate decodes and every bytecode it references
+// exists in the substate DB. It reports orphaned bytecode and gaps of
+// missing blocks and transactions. Backend errors abort the check.
+func (db *SubstateDB) Verify(ctx context.Context) (*VerifyReport, error) {
+	var (
+		report     = &VerifyReport{}
+		referenced = make(map[common.Hash]struct{})
+		known      = make(map[common.Hash]bool) // existence of checked code hashes
+
+		haveBlock bool
+		lastBlock uint64
+		lastTx    int
+	)
+	checkCode := func(block uint64, tx int, codeHash common.Hash) error {
+		if codeHash == EmptyCodeHash {
+			return nil
+		}
+		referenced[codeHash] = struct{}{}
+		has, checked := known[codeHash]
+		if !checked {
+			var err error
+			if has, err = db.TryHasCode(ctx, codeHash); err != nil {
+				return err
+			}
+			known[codeHash] = has
+		}
+		if !has {
+			report.MissingCodes = append(report.MissingCodes, MissingCode{Block: block, Tx: tx, CodeHash: codeHash})
+		}
+		return nil
+	}
+
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		block, tx, err := DecodeStage1SubstateKey(iter.Key())
+		if err != nil {
+			report.DecodeErrors = append(report.DecodeErrors, &DecodeError{Encoding: UnknownEncoding, Err: err})
+			continue
+		}
+		report.Substates++
+
+		// gaps of blocks and transactions
+		switch {
+		case !haveBlock || block != lastBlock:
+			if haveBlock && block > lastBlock+1 {
+				report.BlockGaps = append(report.BlockGaps, BlockRange{First: lastBlock + 1, Last: block - 1})
+			}
+			for missing := 0; missing < tx; missing++ {
+				report.TxGaps = append(report.TxGaps, TxGap{Block: block, Tx: missing})
+			}
+		default:
+			for missing := lastTx + 1; missing < tx; missing++ {
+				report.TxGaps = append(report.TxGaps, TxGap{Block: block, Tx: missing})
+			}
+		}
+		haveBlock, lastBlock, lastTx = true, block, tx
+
+		substateRLP, version, err := DecodeSubstateRLP(iter.Value())
+		if err != nil {
+			report.DecodeErrors = append(report.DecodeErrors, &DecodeError{Block: block, Tx: tx, Version: version, Encoding: substateEncodingName(version), Err: err})
+			continue
+		}
+		for _, alloc := range []SubstateAllocRLP{substateRLP.InputAlloc, substateRLP.OutputAlloc} {
+			for _, account := range alloc.Accounts {
+				if err := checkCode(block, tx, account.CodeHash); err != nil {
+					return report, err
+				}
+			}
+		}
+		if msg := substateRLP.Message; msg != nil && msg.InitCodeHash != nil {
+			if err := checkCode(block, tx, *msg.InitCodeHash); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return report, &BackendError{Op: "iterate", Key: []byte(stage1SubstatePrefix), Err: err}
+	}
+
+	codeIter := db.backend.NewIterator([]byte(stage1CodePrefix), nil)
+	defer codeIter.Release()
+	for codeIter.Next() {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		codeHash, err := DecodeStage1CodeKey(codeIter.Key())
+		if err != nil {
+			continue // not a bytecode key
+		}
+		report.Codes++
+		if _, found := referenced[codeHash]; !found {
+			report.OrphanCodes = append(report.OrphanCodes, codeHash)
+		}
+	}
+	if err := codeIter.Error(); err != nil {
+		return report, &BackendError{Op: "iterate", Key: []byte(stage1CodePrefix), Err: err}
+	}
+	return report, nil
+}
@@ -0,0 +1,149 @@
+package substate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestMergeSubstateDBs(t *testing.T) {
+	ctx := context.Background()
+	src1 := newTestSubstateDB(map[uint64]int{1: 2, 2: 1})
+	src2 := newTestSubstateDB(map[uint64]int{5: 3})
+	dst := newTestSubstateDB(nil)
+
+	numMerged, err := MergeSubstateDBs(ctx, dst, src1, src2)
+	if err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+	if numMerged != 6 {
+		t.Fatalf("wrong number of merged substates: have %d, want 6", numMerged)
+	}
+	for block, numTx := range map[uint64]int{1: 2, 2: 1, 5: 3} {
+		for tx := 0; tx < numTx; tx++ {
+			if have := dst.GetSubstate(block, tx); !have.Equal(newTestSubstate(block, tx)) {
+				t.Fatalf("substate %v_%v not merged correctly", block, tx)
+			}
+		}
+	}
+
+	// block 5 was recorded twice
+	overlapping := newTestSubstateDB(map[uint64]int{4: 1, 5: 1})
+	_, err = MergeSubstateDBs(ctx, newTestSubstateDB(nil), src2, overlapping)
+	var overlap *OverlapError
+	if !errors.As(err, &overlap) || overlap.Block != 5 || overlap.Tx != 0 {
+		t.Fatalf("wrong error for overlapping substates: %v", err)
+	}
+}
+
+func TestMergeSubstateDBsKeepsBlocksBeforeOverlap(t *testing.T) {
+	ctx := context.Background()
+	first := newTestSubstateDB(map[uint64]int{5: 3})
+	first.DeleteSubstate(5, 0)
+	// substate 5_1 was recorded twice, 5_0 of the same block is new
+	second := newTestSubstateDB(map[uint64]int{3: 1, 4: 2, 5: 2})
+	dst := newTestSubstateDB(nil)
+
+	numMerged, err := MergeSubstateDBs(ctx, dst, first, second)
+	var overlap *OverlapError
+	if !errors.As(err, &overlap) || overlap.Block != 5 || overlap.Tx != 1 {
+		t.Fatalf("wrong error for overlapping substates: %v", err)
+	}
+	if numMerged != 5 {
+		t.Fatalf("wrong number of merged substates: have %d, want 5", numMerged)
+	}
+	for _, key := range [][2]int{{3, 0}, {4, 0}, {4, 1}, {5, 1}, {5, 2}} {
+		block, tx := uint64(key[0]), key[1]
+		if have, err := dst.TryGetSubstate(ctx, block, tx); err != nil || !have.Equal(newTestSubstate(block, tx)) {
+			t.Fatalf("substate %v_%v not merged correctly: %v", block, tx, err)
+		}
+	}
+	// the overlapping block is not merged
+	if dst.HasSubstate(5, 0) {
+		t.Fatalf("substate 5_0 of the overlapping block merged")
+	}
+}
+
+func TestSplitSubstateDB(t *testing.T) {
+	src := newTestSubstateDB(map[uint64]int{10: 1, 11: 2, 25: 1, 40: 1})
+	shardDBs := make(map[BlockRange]*SubstateDB)
+
+	shards, err := SplitSubstateDB(context.Background(), src, 10, 39, 10, func(shard BlockRange) (*SubstateDB, error) {
+		db := NewSubstateDB(rawdb.NewMemoryDatabase())
+		shardDBs[shard] = db
+		return db, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to split: %v", err)
+	}
+	want := []BlockRange{{10, 19}, {20, 29}}
+	if len(shards) != len(want) {
+		t.Fatalf("wrong shards: have %v, want %v", shards, want)
+	}
+	for i := range want {
+		if shards[i] != want[i] {
+			t.Fatalf("wrong shards: have %v, want %v", shards, want)
+		}
+	}
+	// the shards are closed after splitting, the memory backend of a closed
+	// DB rejects all accesses
+	if _, err := shardDBs[want[0]].TryHasSubstate(context.Background(), 10, 0); err == nil {
+		t.Fatalf("shard was not closed")
+	}
+}
+
+func TestSubstateDBVerify(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSubstateDB(map[uint64]int{1: 2, 4: 1})
+
+	report, err := db.Verify(ctx)
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !report.OK() || report.Substates != 3 || report.Codes != 2 {
+		t.Fatalf("wrong report of consistent DB: %+v", report)
+	}
+	if len(report.BlockGaps) != 1 || report.BlockGaps[0] != (BlockRange{2, 3}) {
+		t.Fatalf("wrong block gaps: %v", report.BlockGaps)
+	}
+
+	// tx 1 of block 4 is missing
+	db.PutSubstate(4, 2, newTestSubstate(4, 2))
+	// bytecode of substate 1_1 is missing
+	db.backend.Delete(Stage1CodeKey(CodeHash([]byte{0x60, 0x01, 0x00})))
+	// bytecode is not referenced by any substate
+	orphan := CodeHash([]byte{0x60, 0x07, 0x00})
+	db.PutCode([]byte{0x60, 0x07, 0x00})
+	// substate 6_0 has an unknown version
+	db.backend.Put(Stage1SubstateKey(6, 0), []byte{0x7f, 0xc0})
+
+	report, err = db.Verify(ctx)
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if report.OK() {
+		t.Fatalf("inconsistent DB reported as consistent")
+	}
+	if len(report.DecodeErrors) != 1 || report.DecodeErrors[0].Block != 6 {
+		t.Errorf("wrong decode errors: %v", report.DecodeErrors)
+	}
+	if len(report.MissingCodes) == 0 {
+		t.Errorf("missing bytecode not reported")
+	}
+	for _, missing := range report.MissingCodes {
+		if missing.Block != 1 || missing.Tx != 1 {
+			t.Errorf("wrong missing bytecode: %+v", missing)
+		}
+	}
+	if len(report.OrphanCodes) != 1 || report.OrphanCodes[0] != orphan {
+		t.Errorf("wrong orphaned bytecode: %v", report.OrphanCodes)
+	}
+	if len(report.TxGaps) != 1 || report.TxGaps[0] != (TxGap{Block: 4, Tx: 1}) {
+		t.Errorf("wrong transaction gaps: %v", report.TxGaps)
+	}
+	if len(report.BlockGaps) != 2 || report.BlockGaps[1] != (BlockRange{5, 5}) {
+		t.Errorf("wrong block gaps: %v", report.BlockGaps)
+	}
+}
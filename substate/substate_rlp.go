@@ -1,6 +1,7 @@
 package substate
 
 import (
+	"context"
 	"math/big"
 	"sort"
 
@@ -37,13 +38,27 @@ func NewSubstateAccountRLP(sa *SubstateAccount) *SubstateAccountRLP {
 }
 
 func (sa *SubstateAccount) SetRLP(saRLP *SubstateAccountRLP, db *SubstateDB) {
+	err := sa.TrySetRLP(context.Background(), saRLP, db)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// TrySetRLP is the same as SetRLP but returns an error if the code of the
+// account can not be read from db.
+func (sa *SubstateAccount) TrySetRLP(ctx context.Context, saRLP *SubstateAccountRLP, db *SubstateDB) error {
+	code, err := db.TryGetCode(ctx, saRLP.CodeHash)
+	if err != nil {
+		return err
+	}
 	sa.Balance = saRLP.Balance
 	sa.Nonce = saRLP.Nonce
-	sa.Code = db.GetCode(saRLP.CodeHash)
+	sa.Code = code
 	sa.Storage = make(map[common.Hash]common.Hash)
 	for i := range saRLP.Storage {
 		sa.Storage[saRLP.Storage[i][0]] = saRLP.Storage[i][1]
 	}
+	return nil
 }
 
 type SubstateAllocRLP struct {
@@ -72,21 +87,27 @@ func NewSubstateAllocRLP(alloc SubstateAlloc) SubstateAllocRLP {
 }
 
 func (alloc *SubstateAlloc) SetRLP(allocRLP SubstateAllocRLP, db *SubstateDB) {
+	err := alloc.TrySetRLP(context.Background(), allocRLP, db)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// TrySetRLP is the same as SetRLP but returns an error if the code of an
+// account can not be read from db.
+func (alloc *SubstateAlloc) TrySetRLP(ctx context.Context, allocRLP SubstateAllocRLP, db *SubstateDB) error {
 	*alloc = make(SubstateAlloc)
 	for i, addr := range allocRLP.Addresses {
 		var sa SubstateAccount
 
-		saRLP := allocRLP.Accounts[i]
-		sa.Balance = saRLP.Balance
-		sa.Nonce = saRLP.Nonce
-		sa.Code = db.GetCode(saRLP.CodeHash)
-		sa.Storage = make(map[common.Hash]common.Hash)
-		for i := range saRLP.Storage {
-			sa.Storage[saRLP.Storage[i][0]] = saRLP.Storage[i][1]
+		err := sa.TrySetRLP(ctx, allocRLP.Accounts[i], db)
+		if err != nil {
+			return err
 		}
 
 		(*alloc)[addr] = &sa
 	}
+	return nil
 }
 
 type legacySubstateEnvRLP struct {
@@ -287,6 +308,15 @@ func NewSubstateMessageRLP(msg *SubstateMessage) *SubstateMessageRLP {
 }
 
 func (msg *SubstateMessage) SetRLP(msgRLP *SubstateMessageRLP, db *SubstateDB) {
+	err := msg.TrySetRLP(context.Background(), msgRLP, db)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// TrySetRLP is the same as SetRLP but returns an error if the init code of a
+// contract creation can not be read from db.
+func (msg *SubstateMessage) TrySetRLP(ctx context.Context, msgRLP *SubstateMessageRLP, db *SubstateDB) error {
 	msg.Nonce = msgRLP.Nonce
 	msg.CheckNonce = msgRLP.CheckNonce
 	msg.GasPrice = msgRLP.GasPrice
@@ -298,13 +328,19 @@ func (msg *SubstateMessage) SetRLP(msgRLP *SubstateMessageRLP, db *SubstateDB) {
 	msg.Data = msgRLP.Data
 
 	if msgRLP.To == nil {
-		msg.Data = db.GetCode(*msgRLP.InitCodeHash)
+		var err error
+		msg.Data, err = db.TryGetCode(ctx, *msgRLP.InitCodeHash)
+		if err != nil {
+			return err
+		}
 	}
 
 	msg.AccessList = msgRLP.AccessList
 
 	msg.GasFeeCap = msgRLP.GasFeeCap
 	msg.GasTipCap = msgRLP.GasTipCap
+
+	return nil
 }
 
 type SubstateResultRLP struct {
@@ -395,15 +431,37 @@ func NewSubstateRLP(substate *Substate) *SubstateRLP {
 }
 
 func (substate *Substate) SetRLP(substateRLP *SubstateRLP, db *SubstateDB) {
+	err := substate.TrySetRLP(context.Background(), substateRLP, db)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// TrySetRLP is the same as SetRLP but returns an error if any bytecode
+// referenced by substateRLP can not be read from db.
+func (substate *Substate) TrySetRLP(ctx context.Context, substateRLP *SubstateRLP, db *SubstateDB) error {
+	var err error
+
 	substate.InputAlloc = make(SubstateAlloc)
 	substate.OutputAlloc = make(SubstateAlloc)
 	substate.Env = &SubstateEnv{}
 	substate.Message = &SubstateMessage{}
 	substate.Result = &SubstateResult{}
 
-	substate.InputAlloc.SetRLP(substateRLP.InputAlloc, db)
-	substate.OutputAlloc.SetRLP(substateRLP.OutputAlloc, db)
+	err = substate.InputAlloc.TrySetRLP(ctx, substateRLP.InputAlloc, db)
+	if err != nil {
+		return err
+	}
+	err = substate.OutputAlloc.TrySetRLP(ctx, substateRLP.OutputAlloc, db)
+	if err != nil {
+		return err
+	}
 	substate.Env.SetRLP(substateRLP.Env, db)
-	substate.Message.SetRLP(substateRLP.Message, db)
+	err = substate.Message.TrySetRLP(ctx, substateRLP.Message, db)
+	if err != nil {
+		return err
+	}
 	substate.Result.SetRLP(substateRLP.Result, db)
+
+	return nil
 }
@@ -0,0 +1,359 @@
+package substate
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	SchedulingFlag = cli.StringFlag{
+		Name:  "scheduling",
+		Usage: "Unit of work dispatched to workers: block, or transaction to balance ranges dominated by large blocks",
+		Value: "block",
+	}
+	OrderedOutputFlag = cli.BoolFlag{
+		Name:  "ordered-output",
+		Usage: "Emit task output in block and transaction order, so that the output of runs can be compared",
+	}
+)
+
+// ParseScheduling returns whether the --scheduling value schedules single
+// transactions instead of whole blocks.
+func ParseScheduling(scheduling string) (scheduleTransactions bool, err error) {
+	switch scheduling {
+	case "", "block":
+		return false, nil
+	case "transaction", "tx":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown scheduling %q (block or transaction)", scheduling)
+}
+
+// TaskOutputFunc receives the output a TaskFunc emits with
+// SubstateTaskPool.Output.
+type TaskOutputFunc func(block uint64, tx int, output interface{}) error
+
+// taskOutput is an output buffered until its block is completed.
+type taskOutput struct {
+	tx     int
+	output interface{}
+}
+
+// Output emits the output of transaction tx in block to OutputFunc. Without
+// OrderedOutput, OutputFunc is called immediately. With OrderedOutput, the
+// outputs of a block are buffered and passed to OutputFunc in transaction
+// order once all blocks up to it are completed, so the output is the same
+// for every run. Output is safe for concurrent use; OutputFunc is never
+// called concurrently.
+func (pool *SubstateTaskPool) Output(block uint64, tx int, output interface{}) error {
+	pool.outputLock.Lock()
+	defer pool.outputLock.Unlock()
+
+	if pool.OutputFunc == nil {
+		return nil
+	}
+	if !pool.OrderedOutput {
+		return pool.OutputFunc(block, tx, output)
+	}
+	if pool.outputs == nil {
+		pool.outputs = make(map[uint64][]taskOutput)
+	}
+	pool.outputs[block] = append(pool.outputs[block], taskOutput{tx: tx, output: output})
+	return nil
+}
+
+// flushOutput passes the buffered outputs of a completed block to
+// OutputFunc in transaction order.
+func (pool *SubstateTaskPool) flushOutput(block uint64) error {
+	pool.outputLock.Lock()
+	defer pool.outputLock.Unlock()
+
+	outputs := pool.outputs[block]
+	delete(pool.outputs, block)
+	sort.SliceStable(outputs, func(i, j int) bool {
+		return outputs[i].tx < outputs[j].tx
+	})
+	for _, o := range outputs {
+		if err := pool.OutputFunc(block, o.tx, o.output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// taskRun holds the channels and counters shared by the goroutines of a task
+// pool run.
+type taskRun struct {
+	pool *SubstateTaskPool
+
+	blockChan chan uint64      // scheduled blocks in order
+	doneChan  chan interface{} // completed blocks or errors
+	stopChan  chan struct{}    // closed to stop all goroutines
+	wg        sync.WaitGroup
+
+	numBlock int64 // number of completed blocks
+	numTx    int64 // number of executed transactions
+	busyTime int64 // nanoseconds workers spent executing transactions
+}
+
+func newTaskRun(pool *SubstateTaskPool) *taskRun {
+	return &taskRun{
+		pool:      pool,
+		blockChan: make(chan uint64, pool.Workers*10),
+		doneChan:  make(chan interface{}, pool.Workers*10),
+		stopChan:  make(chan struct{}),
+	}
+}
+
+// stop stops all goroutines and waits until they are finished.
+func (r *taskRun) stop() {
+	close(r.stopChan)
+	r.wg.Wait()
+	close(r.doneChan)
+}
+
+// done reports a completed block or an error to the main thread. It returns
+// false if the run is stopped.
+func (r *taskRun) done(data interface{}) bool {
+	select {
+	case r.doneChan <- data:
+		return true
+	case <-r.stopChan:
+		return false
+	}
+}
+
+// stopped reports whether the run is stopped.
+func (r *taskRun) stopped() bool {
+	select {
+	case <-r.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// execute calls TaskFunc on txs of block and updates the counters.
+func (r *taskRun) execute(block uint64, txs []*Transaction) (time.Duration, error) {
+	start := time.Now()
+	nt, err := r.pool.executeTransactions(block, txs)
+	duration := time.Since(start)
+	atomic.AddInt64(&r.busyTime, int64(duration))
+	atomic.AddInt64(&r.numTx, nt)
+	taskTxCounter.Inc(nt)
+	return duration, err
+}
+
+// completeBlock counts a completed block and reports it to the main thread.
+func (r *taskRun) completeBlock(block uint64) bool {
+	atomic.AddInt64(&r.numBlock, 1)
+	taskBlockCounter.Inc(1)
+	return r.done(block)
+}
+
+// produce reads the substates of blocks first to Last in key order,
+// announces each block to the main thread and passes it to dispatch.
+func (r *taskRun) produce(first uint64, dispatch func(task *blockTask) bool) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(r.blockChan)
+
+		iter := r.pool.DB.NewSubstateIterator(first, r.pool.Last, r.pool.Workers)
+		defer iter.Release()
+
+		// schedule a block and announce it to the main thread in order
+		schedule := func(task *blockTask) bool {
+			select {
+			case r.blockChan <- task.block:
+			case <-r.stopChan:
+				return false
+			}
+			return dispatch(task)
+		}
+
+		var task *blockTask
+		for iter.Next() {
+			t := iter.Value()
+			if task != nil && task.block != t.Block {
+				if !schedule(task) {
+					return
+				}
+				task = nil
+			}
+			if task == nil {
+				task = &blockTask{block: t.Block}
+			}
+			task.txs = append(task.txs, t)
+		}
+		if err := iter.Error(); err != nil {
+			r.done(fmt.Errorf("%s: %v", r.pool.Name, err))
+			return
+		}
+		if task != nil {
+			schedule(task)
+		}
+	}()
+}
+
+// startBlockScheduling starts workers executing one block at a time.
+func (r *taskRun) startBlockScheduling(first uint64) {
+	workChan := make(chan *blockTask, r.pool.Workers*10)
+
+	// dynamically schedule one block per worker
+	for i := 0; i < r.pool.Workers; i++ {
+		r.wg.Add(1)
+		// worker goroutine
+		go func() {
+			defer r.wg.Done()
+
+			for !r.stopped() {
+				select {
+
+				case task := <-workChan:
+					duration, err := r.execute(task.block, task.txs)
+					taskBlockExecutionTimer.Update(duration)
+					if err != nil {
+						r.done(err)
+					} else {
+						r.completeBlock(task.block)
+					}
+
+				case <-r.stopChan:
+					return
+
+				}
+			}
+		}()
+	}
+
+	r.produce(first, func(task *blockTask) bool {
+		select {
+		case workChan <- task:
+			return true
+		case <-r.stopChan:
+			return false
+		}
+	})
+}
+
+// txTask is a single transaction of a block scheduled on its own.
+type txTask struct {
+	tx        *Transaction
+	remaining *int64 // number of unfinished transactions of the block
+}
+
+// txDeque is the local queue of a worker. The owner takes tasks from the
+// front, idle workers steal from the back.
+type txDeque struct {
+	lock  sync.Mutex
+	tasks []*txTask
+}
+
+func (q *txDeque) push(task *txTask) {
+	q.lock.Lock()
+	q.tasks = append(q.tasks, task)
+	q.lock.Unlock()
+}
+
+func (q *txDeque) popFront() *txTask {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.tasks) == 0 {
+		return nil
+	}
+	task := q.tasks[0]
+	q.tasks[0] = nil
+	q.tasks = q.tasks[1:]
+	return task
+}
+
+func (q *txDeque) popBack() *txTask {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n := len(q.tasks)
+	if n == 0 {
+		return nil
+	}
+	task := q.tasks[n-1]
+	q.tasks[n-1] = nil
+	q.tasks = q.tasks[:n-1]
+	return task
+}
+
+// startTransactionScheduling starts workers executing one transaction at a
+// time. The transactions of a block are spread over the local queues of all
+// workers; a worker with an empty queue steals from the others. A block is
+// completed when its last transaction is finished.
+func (r *taskRun) startTransactionScheduling(first uint64) {
+	var (
+		numWorkers = r.pool.Workers
+		deques     = make([]txDeque, numWorkers)
+		// a token for every queued transaction, bounding the queued work
+		tokens = make(chan struct{}, numWorkers*100)
+	)
+
+	// take returns a queued transaction, preferring the local queue of
+	// worker i. The caller must hold a token, so a transaction is queued.
+	take := func(i int) *txTask {
+		for {
+			if task := deques[i].popFront(); task != nil {
+				return task
+			}
+			for j := 1; j < numWorkers; j++ {
+				if task := deques[(i+j)%numWorkers].popBack(); task != nil {
+					return task
+				}
+			}
+		}
+	}
+
+	for i := 0; i < numWorkers; i++ {
+		i := i
+		r.wg.Add(1)
+		// worker goroutine
+		go func() {
+			defer r.wg.Done()
+
+			for !r.stopped() {
+				select {
+
+				case <-tokens:
+					task := take(i)
+					t := task.tx
+					if _, err := r.execute(t.Block, []*Transaction{t}); err != nil {
+						r.done(err)
+					} else if atomic.AddInt64(task.remaining, -1) == 0 {
+						r.completeBlock(t.Block)
+					}
+
+				case <-r.stopChan:
+					return
+
+				}
+			}
+		}()
+	}
+
+	next := 0
+	r.produce(first, func(task *blockTask) bool {
+		remaining := int64(len(task.txs))
+		for _, t := range task.txs {
+			deques[next].push(&txTask{tx: t, remaining: &remaining})
+			next = (next + 1) % numWorkers
+			select {
+			case tokens <- struct{}{}:
+			case <-r.stopChan:
+				return false
+			}
+		}
+		return true
+	})
+}
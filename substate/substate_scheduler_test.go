@@ -0,0 +1,109 @@
+package substate
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubstateTaskPoolTransactionScheduling(t *testing.T) {
+	// a large block followed by small ones
+	db := newTestSubstateDB(map[uint64]int{1: 40, 2: 1, 3: 2, 5: 1})
+	defer db.Close()
+
+	type output struct {
+		block uint64
+		tx    int
+	}
+	var (
+		lock      sync.Mutex
+		executed  = make(map[output]int)
+		outputs   []output
+		completed []uint64
+	)
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			if !substate.Equal(newTestSubstate(block, tx)) {
+				t.Errorf("wrong substate of %v_%v", block, tx)
+			}
+			// finish transactions out of order
+			time.Sleep(time.Duration((block*7+uint64(tx)*13)%5) * time.Millisecond)
+			lock.Lock()
+			executed[output{block, tx}]++
+			lock.Unlock()
+			return taskPool.Output(block, tx, output{block, tx})
+		},
+		First:                0,
+		Last:                 10,
+		Workers:              4,
+		ScheduleTransactions: true,
+		OrderedOutput:        true,
+		OutputFunc: func(block uint64, tx int, o interface{}) error {
+			outputs = append(outputs, o.(output))
+			return nil
+		},
+		DB: db,
+		Progress: func(p *TaskProgress) {
+			if !p.Done {
+				completed = append(completed, p.Block)
+			}
+		},
+		ProgressInterval: 1, // report after every block
+	}
+	if err := pool.Execute(); err != nil {
+		t.Fatalf("failed to execute: %v", err)
+	}
+
+	if len(executed) != 44 {
+		t.Fatalf("wrong number of executed transactions: have %d, want 44", len(executed))
+	}
+	for o, n := range executed {
+		if n != 1 {
+			t.Fatalf("transaction %v_%v executed %d times", o.block, o.tx, n)
+		}
+	}
+	want := []uint64{1, 2, 3, 5}
+	if len(completed) != len(want) {
+		t.Fatalf("wrong completed blocks: have %v, want %v", completed, want)
+	}
+	for i := range want {
+		if completed[i] != want[i] {
+			t.Fatalf("wrong completed blocks: have %v, want %v", completed, want)
+		}
+	}
+	if len(outputs) != 44 {
+		t.Fatalf("wrong number of outputs: have %d, want 44", len(outputs))
+	}
+	for i := 1; i < len(outputs); i++ {
+		prev, cur := outputs[i-1], outputs[i]
+		if prev.block > cur.block || (prev.block == cur.block && prev.tx >= cur.tx) {
+			t.Fatalf("output not ordered: %v before %v", prev, cur)
+		}
+	}
+}
+
+func TestSubstateTaskPoolRequiresWorkers(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{1: 2})
+	defer db.Close()
+
+	for _, workers := range []int{0, -1} {
+		for _, scheduleTransactions := range []bool{false, true} {
+			pool := &SubstateTaskPool{
+				Name: "test",
+				TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+					return nil
+				},
+				First:                0,
+				Last:                 10,
+				Workers:              workers,
+				ScheduleTransactions: scheduleTransactions,
+				DB:                   db,
+				Progress:             func(p *TaskProgress) {},
+			}
+			if err := pool.Execute(); err == nil {
+				t.Errorf("executed with %d workers, transaction scheduling = %v", workers, scheduleTransactions)
+			}
+		}
+	}
+}
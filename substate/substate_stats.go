@@ -0,0 +1,289 @@
+package substate
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var StatsFormatFlag = cli.StringFlag{
+	Name:  "format",
+	Usage: "Output format of substate DB statistics (json or csv)",
+	Value: "json",
+}
+
+// StatsCommand writes the statistics of the substates in a block range to
+// the standard output.
+var StatsCommand = cli.Command{
+	Action:    statsAction,
+	Name:      "stats",
+	Usage:     "writes statistics of the substates in the given block range",
+	ArgsUsage: "<blockNumFirst> <blockNumLast>",
+	Flags: []cli.Flag{
+		WorkersFlag,
+		StatsFormatFlag,
+		SubstateDirFlag,
+		SubstateCacheFlag,
+		SubstateHandlesFlag,
+	},
+	Description: `
+The stats command requires two arguments:
+<blockNumFirst> <blockNumLast>
+
+<blockNumFirst> and <blockNumLast> are the first and
+last block of the inclusive range of blocks to inspect.
+
+The statistics are written as JSON or CSV, selected by --format.`,
+}
+
+// HistogramBucket counts the values in the inclusive range [Min, Max].
+type HistogramBucket struct {
+	Min   uint64 `json:"min"`
+	Max   uint64 `json:"max"`
+	Count uint64 `json:"count"`
+}
+
+// Histogram counts values in buckets of powers of two. Bucket 0 holds zeros,
+// bucket i holds values from 2^(i-1) to 2^i-1.
+type Histogram struct {
+	Count   uint64            `json:"count"`
+	Sum     uint64            `json:"sum"`
+	Max     uint64            `json:"max"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// Add counts value in the histogram.
+func (h *Histogram) Add(value uint64) {
+	i := bits.Len64(value)
+	for len(h.Buckets) <= i {
+		n := len(h.Buckets)
+		bucket := HistogramBucket{}
+		if n > 0 {
+			bucket.Min = 1 << (n - 1)
+			bucket.Max = 1<<n - 1
+		}
+		h.Buckets = append(h.Buckets, bucket)
+	}
+	h.Buckets[i].Count++
+	h.Count++
+	h.Sum += value
+	if value > h.Max {
+		h.Max = value
+	}
+}
+
+// Mean returns the average of all counted values.
+func (h *Histogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.Sum) / float64(h.Count)
+}
+
+// SubstateStats describes the content of a substate DB.
+type SubstateStats struct {
+	First uint64 `json:"first"` // first block of the inspected range
+	Last  uint64 `json:"last"`  // last block of the inspected range
+
+	FirstBlock uint64 `json:"firstBlock"` // first block with substates
+	LastBlock  uint64 `json:"lastBlock"`  // last block with substates
+	Blocks     uint64 `json:"blocks"`     // number of blocks with substates
+
+	Transactions       uint64            `json:"transactions"`
+	TransactionTypes   map[string]uint64 `json:"transactionTypes"` // by ClassifyTransaction
+	FailedTransactions uint64            `json:"failedTransactions"`
+
+	TransactionsPerBlock Histogram `json:"transactionsPerBlock"`
+	InputAllocSize       Histogram `json:"inputAllocSize"`  // accounts per input alloc
+	OutputAllocSize      Histogram `json:"outputAllocSize"` // accounts per output alloc
+	StorageSlots         Histogram `json:"storageSlots"`    // storage slots per input alloc
+
+	// bytecode of the accounts and creations of the inspected range
+	Contracts uint64    `json:"contracts"` // number of unique bytecodes
+	CodeBytes uint64    `json:"codeBytes"`
+	CodeSize  Histogram `json:"codeSize"`
+}
+
+// Stats collects statistics of the substates of blocks first to last,
+// including the bytecode they contain. Substates are decoded with the given
+// number of workers.
+func (db *SubstateDB) Stats(ctx context.Context, first, last uint64, workers int) (*SubstateStats, error) {
+	stats := &SubstateStats{
+		First:            first,
+		Last:             last,
+		TransactionTypes: make(map[string]uint64),
+	}
+	for _, t := range []TransactionType{TransferTx, CallTx, CreateTx} {
+		stats.TransactionTypes[t.String()] = 0
+	}
+
+	var (
+		curBlock uint64
+		numTx    uint64
+		codes    = make(map[common.Hash]struct{})
+	)
+	addCode := func(code []byte) {
+		if len(code) == 0 {
+			return
+		}
+		hash := CodeHash(code)
+		if _, found := codes[hash]; found {
+			return
+		}
+		codes[hash] = struct{}{}
+		stats.Contracts++
+		stats.CodeBytes += uint64(len(code))
+		stats.CodeSize.Add(uint64(len(code)))
+	}
+	endBlock := func() {
+		if numTx > 0 {
+			stats.TransactionsPerBlock.Add(numTx)
+		}
+	}
+
+	iter := db.NewSubstateIterator(first, last, workers)
+	defer iter.Release()
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		tx := iter.Value()
+		if stats.Blocks == 0 || tx.Block != curBlock {
+			endBlock()
+			if stats.Blocks == 0 {
+				stats.FirstBlock = tx.Block
+			}
+			stats.LastBlock = tx.Block
+			stats.Blocks++
+			curBlock, numTx = tx.Block, 0
+		}
+		numTx++
+
+		substate := tx.Substate
+		stats.Transactions++
+		stats.TransactionTypes[ClassifyTransaction(substate).String()]++
+		if substate.Result.Status == 0 {
+			stats.FailedTransactions++
+		}
+		stats.InputAllocSize.Add(uint64(len(substate.InputAlloc)))
+		stats.OutputAllocSize.Add(uint64(len(substate.OutputAlloc)))
+		var slots uint64
+		for _, account := range substate.InputAlloc {
+			slots += uint64(len(account.Storage))
+			addCode(account.Code)
+		}
+		stats.StorageSlots.Add(slots)
+		for _, account := range substate.OutputAlloc {
+			addCode(account.Code)
+		}
+		if substate.Message.To == nil {
+			addCode(substate.Message.Data)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	endBlock()
+
+	return stats, nil
+}
+
+// WriteJSON writes the statistics as an indented JSON object.
+func (s *SubstateStats) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// WriteCSV writes the statistics as metric,value rows. Histogram buckets are
+// written as rows named metric[min-max].
+func (s *SubstateStats) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	write := func(metric string, value uint64) {
+		cw.Write([]string{metric, strconv.FormatUint(value, 10)})
+	}
+	writeHistogram := func(metric string, h *Histogram) {
+		write(metric+".count", h.Count)
+		write(metric+".sum", h.Sum)
+		write(metric+".max", h.Max)
+		for _, bucket := range h.Buckets {
+			write(fmt.Sprintf("%s[%d-%d]", metric, bucket.Min, bucket.Max), bucket.Count)
+		}
+	}
+
+	cw.Write([]string{"metric", "value"})
+	write("first", s.First)
+	write("last", s.Last)
+	write("firstBlock", s.FirstBlock)
+	write("lastBlock", s.LastBlock)
+	write("blocks", s.Blocks)
+	write("transactions", s.Transactions)
+	for _, t := range []TransactionType{TransferTx, CallTx, CreateTx} {
+		write("transactions."+t.String(), s.TransactionTypes[t.String()])
+	}
+	write("failedTransactions", s.FailedTransactions)
+	writeHistogram("transactionsPerBlock", &s.TransactionsPerBlock)
+	writeHistogram("inputAllocSize", &s.InputAllocSize)
+	writeHistogram("outputAllocSize", &s.OutputAllocSize)
+	writeHistogram("storageSlots", &s.StorageSlots)
+	write("contracts", s.Contracts)
+	write("codeBytes", s.CodeBytes)
+	writeHistogram("codeSize", &s.CodeSize)
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteSubstateStats writes stats in the given format, json or csv.
+func WriteSubstateStats(w io.Writer, stats *SubstateStats, format string) error {
+	switch format {
+	case "json":
+		return stats.WriteJSON(w)
+	case "csv":
+		return stats.WriteCSV(w)
+	}
+	return fmt.Errorf("unknown statistics format %q", format)
+}
+
+func statsAction(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("substate-cli stats command requires exactly 2 arguments")
+	}
+	first, ferr := strconv.ParseUint(ctx.Args().Get(0), 10, 64)
+	last, lerr := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	if ferr != nil || lerr != nil {
+		return fmt.Errorf("substate-cli stats: error in parsing parameters: block number not an integer")
+	}
+	if first > last {
+		return fmt.Errorf("substate-cli stats: error: first block has larger number than last block")
+	}
+	format := ctx.String(StatsFormatFlag.Name)
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("substate-cli stats: unknown statistics format %q", format)
+	}
+
+	// the statistics are written to the standard output, nothing else is
+	db, err := OpenSubstateDBURI(ctx.String(SubstateDirFlag.Name), &BackendConfig{
+		Cache:    ctx.Int(SubstateCacheFlag.Name),
+		Handles:  ctx.Int(SubstateHandlesFlag.Name),
+		ReadOnly: true,
+	})
+	if err != nil {
+		return fmt.Errorf("substate-cli stats: %v", err)
+	}
+	defer db.Close()
+
+	stats, err := db.Stats(context.Background(), first, last, ctx.Int(WorkersFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli stats: %v", err)
+	}
+	return WriteSubstateStats(os.Stdout, stats, format)
+}
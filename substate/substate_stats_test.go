@@ -0,0 +1,66 @@
+package substate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSubstateStats(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{1: 3, 4: 1, 9: 1})
+	defer db.Close()
+
+	// substate 4_1 creates a contract
+	create := newTestSubstate(4, 1)
+	create.Message.To = nil
+	create.Message.Data = []byte{0x60, 0x00, 0xf3}
+	create.Result.Status = 0
+	db.PutSubstate(4, 1, create)
+	// bytecode outside of the range is not counted
+	db.PutSubstate(9, 5, newTestSubstate(9, 5))
+
+	stats, err := db.Stats(context.Background(), 0, 8, 2)
+	if err != nil {
+		t.Fatalf("failed to collect stats: %v", err)
+	}
+	if stats.FirstBlock != 1 || stats.LastBlock != 4 || stats.Blocks != 2 {
+		t.Fatalf("wrong block coverage: %d-%d, %d blocks", stats.FirstBlock, stats.LastBlock, stats.Blocks)
+	}
+	if stats.Transactions != 5 || stats.TransactionTypes["call"] != 4 || stats.TransactionTypes["create"] != 1 {
+		t.Fatalf("wrong transaction mix: %d transactions, %v", stats.Transactions, stats.TransactionTypes)
+	}
+	if stats.FailedTransactions != 1 {
+		t.Fatalf("wrong number of failed transactions: %d", stats.FailedTransactions)
+	}
+	if h := stats.TransactionsPerBlock; h.Count != 2 || h.Max != 3 || h.Buckets[2].Count != 2 {
+		t.Fatalf("wrong transactions per block: %+v", h)
+	}
+	// bytecode of tx 0, 1, 2 and the creation code
+	if stats.Contracts != 4 || stats.CodeBytes != 12 {
+		t.Fatalf("wrong bytecode stats: %d contracts, %d bytes", stats.Contracts, stats.CodeBytes)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSubstateStats(&buf, stats, "json"); err != nil {
+		t.Fatalf("failed to write json: %v", err)
+	}
+	var decoded SubstateStats
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if decoded.Transactions != stats.Transactions {
+		t.Fatalf("wrong json output: %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteSubstateStats(&buf, stats, "csv"); err != nil {
+		t.Fatalf("failed to write csv: %v", err)
+	}
+	for _, row := range []string{"metric,value\n", "transactions.create,1\n", "transactionsPerBlock[2-3],2\n"} {
+		if !strings.Contains(buf.String(), row) {
+			t.Fatalf("row %q missing in csv output:\n%s", row, buf.String())
+		}
+	}
+}
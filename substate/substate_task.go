@@ -1,12 +1,20 @@
 package substate
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"os/signal"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/ethereum/go-ethereum/metrics"
+
 	cli "gopkg.in/urfave/cli.v1"
 )
 
@@ -30,6 +38,39 @@ var (
 	}
 )
 
+// TransactionType classifies a transaction substate by its message.
+type TransactionType int
+
+const (
+	TransferTx TransactionType = iota // transaction that only transfers ETH
+	CallTx                            // CALL transaction to an account with contract bytecode
+	CreateTx                          // CREATE transaction
+)
+
+func (t TransactionType) String() string {
+	switch t {
+	case TransferTx:
+		return "transfer"
+	case CallTx:
+		return "call"
+	case CreateTx:
+		return "create"
+	}
+	return fmt.Sprintf("TransactionType(%d)", int(t))
+}
+
+// ClassifyTransaction returns the type of a transaction substate.
+func ClassifyTransaction(substate *Substate) TransactionType {
+	to := substate.Message.To
+	if to == nil {
+		return CreateTx
+	}
+	if account, exist := substate.InputAlloc[*to]; exist && len(account.Code) > 0 {
+		return CallTx
+	}
+	return TransferTx
+}
+
 type SubstateTaskFunc func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error
 
 type SubstateTaskPool struct {
@@ -43,14 +84,36 @@ type SubstateTaskPool struct {
 	SkipTransferTxs bool
 	SkipCallTxs     bool
 	SkipCreateTxs   bool
+	Filter          SubstateFilter // execute only matching transactions if not nil
+
+	CheckpointFile  string // records the highest contiguous completed block, disabled if empty
+	Resume          bool   // start after the block recorded in CheckpointFile
+	ContinueOnError bool   // log failed transactions to ErrorLogFile instead of aborting
+	MaxFailures     int    // abort after more than MaxFailures failed transactions, 0 for no limit
+	ErrorLogFile    string // failed transactions as JSON lines if ContinueOnError, disabled if empty
+
+	ScheduleTransactions bool           // dispatch single transactions with work stealing instead of whole blocks
+	OrderedOutput        bool           // pass the output of TaskFunc to OutputFunc in block and transaction order
+	OutputFunc           TaskOutputFunc // receives the output TaskFunc emits with Output, may be nil
+
+	Progress         TaskProgressFunc // receives progress events, PrintTaskProgress if nil
+	ProgressInterval time.Duration    // time between progress events, a schedule by block numbers if 0
 
 	Ctx *cli.Context // CLI context required to read additional flags
 
 	DB *SubstateDB
+
+	flagErr      error // invalid --filter or --scheduling value
+	numFailures  int64
+	errorLogLock sync.Mutex
+	errorLog     *json.Encoder
+
+	outputLock sync.Mutex
+	outputs    map[uint64][]taskOutput // buffered output of uncompleted blocks with OrderedOutput
 }
 
 func NewSubstateTaskPool(name string, taskFunc SubstateTaskFunc, first, last uint64, ctx *cli.Context) *SubstateTaskPool {
-	return &SubstateTaskPool{
+	pool := &SubstateTaskPool{
 		Name:     name,
 		TaskFunc: taskFunc,
 
@@ -62,183 +125,413 @@ func NewSubstateTaskPool(name string, taskFunc SubstateTaskFunc, first, last uin
 		SkipCallTxs:     ctx.Bool(SkipCallTxsFlag.Name),
 		SkipCreateTxs:   ctx.Bool(SkipCreateTxsFlag.Name),
 
+		CheckpointFile:  ctx.String(CheckpointFlag.Name),
+		Resume:          ctx.Bool(ResumeFlag.Name),
+		ContinueOnError: ctx.Bool(ContinueOnErrorFlag.Name),
+		MaxFailures:     ctx.Int(MaxFailuresFlag.Name),
+		ErrorLogFile:    ctx.String(ErrorLogFlag.Name),
+
+		OrderedOutput: ctx.Bool(OrderedOutputFlag.Name),
+
 		Ctx: ctx,
 
 		DB: staticSubstateDB,
 	}
+	if expr := ctx.String(FilterFlag.Name); expr != "" {
+		// reported by Execute
+		pool.Filter, pool.flagErr = ParseSubstateFilter(expr)
+	}
+	if pool.flagErr == nil {
+		pool.ScheduleTransactions, pool.flagErr = ParseScheduling(ctx.String(SchedulingFlag.Name))
+	}
+	return pool
 }
 
 // ExecuteBlock function iterates on substates of a given block call TaskFunc
 func (pool *SubstateTaskPool) ExecuteBlock(block uint64) (numTx int64, err error) {
-	for tx, substate := range pool.DB.GetBlockSubstates(block) {
-		alloc := substate.InputAlloc
-		msg := substate.Message
-
-		to := msg.To
-		if pool.SkipTransferTxs && to != nil {
-			// skip regular transactions (ETH transfer)
-			if account, exist := alloc[*to]; !exist || len(account.Code) == 0 {
+	blockSubstates := pool.DB.GetBlockSubstates(block)
+
+	txs := make([]*Transaction, 0, len(blockSubstates))
+	for tx, substate := range blockSubstates {
+		txs = append(txs, &Transaction{Block: block, Transaction: tx, Substate: substate})
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		return txs[i].Transaction < txs[j].Transaction
+	})
+
+	return pool.executeTransactions(block, txs)
+}
+
+// executeTransactions calls TaskFunc on substates of a block in the given order
+func (pool *SubstateTaskPool) executeTransactions(block uint64, txs []*Transaction) (numTx int64, err error) {
+	for _, t := range txs {
+		tx := t.Transaction
+		substate := t.Substate
+
+		switch ClassifyTransaction(substate) {
+		case TransferTx:
+			if pool.SkipTransferTxs {
+				// skip regular transactions (ETH transfer)
 				continue
 			}
-		}
-		if pool.SkipCallTxs && to != nil {
-			// skip CALL trasnactions with contract bytecode
-			if account, exist := alloc[*to]; exist && len(account.Code) > 0 {
+		case CallTx:
+			if pool.SkipCallTxs {
+				// skip CALL trasnactions with contract bytecode
+				continue
+			}
+		case CreateTx:
+			if pool.SkipCreateTxs {
+				// skip CREATE transactions
 				continue
 			}
 		}
-		if pool.SkipCreateTxs && to == nil {
-			// skip CREATE transactions
+		if pool.Filter != nil && !pool.Filter.Match(substate) {
 			continue
 		}
 
 		err = pool.TaskFunc(block, tx, substate, pool)
+		numTx++
 		if err != nil {
-			return numTx, fmt.Errorf("%s: %v_%v: %v", pool.Name, block, tx, err)
+			if !pool.ContinueOnError {
+				return numTx, fmt.Errorf("%s: %v_%v: %v", pool.Name, block, tx, err)
+			}
+			if err := pool.logFailure(block, tx, err); err != nil {
+				return numTx, err
+			}
 		}
-
-		numTx++
 	}
 
 	return numTx, nil
 }
 
-// Execute function spawns worker goroutines and schedule tasks.
-func (pool *SubstateTaskPool) Execute() error {
-	start := time.Now()
+// logFailure records a failed transaction with ContinueOnError. It returns an
+// error if the failure exceeds MaxFailures or cannot be logged.
+func (pool *SubstateTaskPool) logFailure(block uint64, tx int, err error) error {
+	numFailures := atomic.AddInt64(&pool.numFailures, 1)
+	taskFailureCounter.Inc(1)
 
-	var totalNumBlock, totalNumTx int64
-	defer func() {
-		duration := time.Since(start) + 1*time.Nanosecond
-		sec := duration.Seconds()
-
-		nb, nt := atomic.LoadInt64(&totalNumBlock), atomic.LoadInt64(&totalNumTx)
-		blkPerSec := float64(nb) / sec
-		txPerSec := float64(nt) / sec
-		fmt.Printf("%s: block range = %v %v\n", pool.Name, pool.First, pool.Last)
-		fmt.Printf("%s: total #block = %v\n", pool.Name, nb)
-		fmt.Printf("%s: total #tx    = %v\n", pool.Name, nt)
-		fmt.Printf("%s: %.2f blk/s, %.2f tx/s\n", pool.Name, blkPerSec, txPerSec)
-		fmt.Printf("%s done in %v\n", pool.Name, duration.Round(1*time.Millisecond))
-	}()
+	pool.errorLogLock.Lock()
+	defer pool.errorLogLock.Unlock()
 
-	// numProcs = numWorker + work producer (1) + main thread (1)
-	numProcs := pool.Workers + 2
-	if goMaxProcs := runtime.GOMAXPROCS(0); goMaxProcs < numProcs {
-		runtime.GOMAXPROCS(numProcs)
+	if pool.errorLog != nil {
+		failure := &TaskFailure{Block: block, Tx: tx, Error: err.Error()}
+		if err := pool.errorLog.Encode(failure); err != nil {
+			return fmt.Errorf("%s: failed to log failure of %v_%v: %v", pool.Name, block, tx, err)
+		}
+	}
+	if pool.MaxFailures > 0 && numFailures > int64(pool.MaxFailures) {
+		return fmt.Errorf("%s: %v_%v: %w (%d): %v", pool.Name, block, tx, ErrTooManyFailures, numFailures, err)
 	}
+	return nil
+}
 
-	fmt.Printf("%s: block range = %v %v\n", pool.Name, pool.First, pool.Last)
-	fmt.Printf("%s: #CPU = %v, #worker = %v\n", pool.Name, runtime.NumCPU(), pool.Workers)
+// NumFailures returns the number of failed transactions with ContinueOnError.
+func (pool *SubstateTaskPool) NumFailures() int64 {
+	return atomic.LoadInt64(&pool.numFailures)
+}
 
-	workChan := make(chan uint64, pool.Workers*10)
-	doneChan := make(chan interface{}, pool.Workers*10)
-	stopChan := make(chan struct{}, pool.Workers)
-	wg := sync.WaitGroup{}
-	defer func() {
-		// stop all workers
-		for i := 0; i < pool.Workers; i++ {
-			stopChan <- struct{}{}
-		}
-		// stop work producer (1)
-		stopChan <- struct{}{}
+// blockTask contains all substates of a block for a worker
+type blockTask struct {
+	block uint64
+	txs   []*Transaction
+}
 
-		wg.Wait()
-		close(workChan)
-		close(doneChan)
-	}()
-	// dynamically schedule one block per worker
-	for i := 0; i < pool.Workers; i++ {
-		wg.Add(1)
-		// worker goroutine
-		go func() {
-			defer wg.Done()
-
-			for {
-				select {
-
-				case block := <-workChan:
-					nt, err := pool.ExecuteBlock(block)
-					atomic.AddInt64(&totalNumTx, nt)
-					atomic.AddInt64(&totalNumBlock, 1)
-					if err != nil {
-						doneChan <- err
-					} else {
-						doneChan <- block
-					}
-
-				case <-stopChan:
-					return
+// TaskProgress is a progress event of a SubstateTaskPool. Rates and the
+// utilization cover the time since the previous event.
+type TaskProgress struct {
+	Name  string
+	First uint64
+	Last  uint64
 
-				}
-			}
-		}()
+	Block        uint64 // highest contiguous completed block
+	Blocks       int64  // number of executed blocks
+	Transactions int64  // number of executed transactions
+	Failures     int64  // number of failed transactions with ContinueOnError
+	Elapsed      time.Duration
+
+	BlocksPerSec float64
+	TxPerSec     float64
+	ETA          time.Duration // estimated time until Last is completed
+	Utilization  float64       // fraction of the worker time spent executing blocks
+
+	Done bool // final event, rates and utilization cover the whole run
+}
+
+// TaskProgressFunc receives the progress events of a SubstateTaskPool. It is
+// called from the goroutine running Execute.
+type TaskProgressFunc func(progress *TaskProgress)
+
+// PrintTaskProgress is the default TaskProgressFunc printing the progress to
+// stdout.
+func PrintTaskProgress(progress *TaskProgress) {
+	name := progress.Name
+	if progress.Done {
+		fmt.Printf("%s: block range = %v %v\n", name, progress.First, progress.Last)
+		fmt.Printf("%s: total #block = %v\n", name, progress.Blocks)
+		fmt.Printf("%s: total #tx    = %v\n", name, progress.Transactions)
+		fmt.Printf("%s: %.2f blk/s, %.2f tx/s\n", name, progress.BlocksPerSec, progress.TxPerSec)
+		if progress.Failures > 0 {
+			fmt.Printf("%s: total #failed tx = %v\n", name, progress.Failures)
+		}
+		fmt.Printf("%s done in %v\n", name, progress.Elapsed.Round(1*time.Millisecond))
+		return
 	}
+	fmt.Printf("%s: elapsed time: %v, number = %v\n", name, progress.Elapsed.Round(1*time.Millisecond), progress.Block)
+	fmt.Printf("%s: %.2f blk/s, %.2f tx/s, eta: %v, utilization: %.0f%%\n", name, progress.BlocksPerSec, progress.TxPerSec, progress.ETA.Round(1*time.Second), progress.Utilization*100)
+}
 
-	// wait until all workers finish all tasks
-	wg.Add(1)
+var (
+	taskBlockCounter        = metrics.NewRegisteredCounter("substate/task/blocks", nil)
+	taskTxCounter           = metrics.NewRegisteredCounter("substate/task/txs", nil)
+	taskFailureCounter      = metrics.NewRegisteredCounter("substate/task/failures", nil)
+	taskBlockGauge          = metrics.NewRegisteredGauge("substate/task/block", nil)
+	taskUtilizationGauge    = metrics.NewRegisteredGaugeFloat64("substate/task/utilization", nil)
+	taskBlockExecutionTimer = metrics.NewRegisteredTimer("substate/task/block/execution", nil)
+)
+
+// Execute runs the pool like ExecuteContext and stops it cleanly on SIGINT
+// or SIGTERM.
+func (pool *SubstateTaskPool) Execute() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
 	go func() {
-		defer wg.Done()
+		select {
+		case <-sigs:
+			fmt.Printf("%s: interrupted, waiting for running blocks\n", pool.Name)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-		for block := pool.First; block <= pool.Last; block++ {
-			select {
+	return pool.ExecuteContext(ctx)
+}
 
-			case workChan <- block:
-				continue
+// ExecuteContext spawns worker goroutines and schedules blocks. When ctx is
+// canceled, no more blocks are scheduled, the running blocks are finished and
+// ctx.Err() is returned; the checkpoint then covers all completed blocks.
+func (pool *SubstateTaskPool) ExecuteContext(ctx context.Context) (err error) {
+	start := time.Now()
 
-			case <-stopChan:
-				return
+	if pool.flagErr != nil {
+		return fmt.Errorf("%s: %v", pool.Name, pool.flagErr)
+	}
+	if pool.Workers < 1 {
+		return fmt.Errorf("%s: #worker = %v, at least 1 worker is required", pool.Name, pool.Workers)
+	}
 
+	progress := pool.Progress
+	if progress == nil {
+		progress = PrintTaskProgress
+	}
+
+	// skip the blocks completed by a previous run
+	first := pool.First
+	if pool.Resume {
+		if pool.CheckpointFile == "" {
+			return fmt.Errorf("%s: resume requires a checkpoint file", pool.Name)
+		}
+		cp, err := ReadTaskCheckpoint(pool.CheckpointFile)
+		if err != nil {
+			return fmt.Errorf("%s: %v", pool.Name, err)
+		}
+		// a checkpoint of another run would skip blocks not completed
+		if cp != nil && (cp.Name != pool.Name || cp.First != pool.First || cp.Last != pool.Last) {
+			return fmt.Errorf("%s: checkpoint of %s with block range = %v %v does not match block range = %v %v", pool.Name, cp.Name, cp.First, cp.Last, pool.First, pool.Last)
+		}
+		if cp != nil && cp.Block >= first {
+			if cp.Block >= pool.Last {
+				if pool.Progress == nil {
+					fmt.Printf("%s: block range = %v %v already completed\n", pool.Name, pool.First, pool.Last)
+				}
+				return nil
+			}
+			first = cp.Block + 1
+			if pool.Progress == nil {
+				fmt.Printf("%s: resume at block %v\n", pool.Name, first)
 			}
 		}
+	}
+
+	if pool.ContinueOnError && pool.ErrorLogFile != "" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if pool.Resume {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		errorLog, err := os.OpenFile(pool.ErrorLogFile, flags, 0644)
+		if err != nil {
+			return fmt.Errorf("%s: %v", pool.Name, err)
+		}
+		pool.errorLog = json.NewEncoder(errorLog)
+		defer func() {
+			pool.errorLog = nil
+			if closeErr := errorLog.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("%s: %v", pool.Name, closeErr)
+			}
+		}()
+	}
+
+	// all blocks up to completed are finished
+	var (
+		completed    uint64
+		hasCompleted bool
+	)
+	if first > pool.First {
+		completed, hasCompleted = first-1, true
+	}
+	writeCheckpoint := func() error {
+		if pool.CheckpointFile == "" || !hasCompleted {
+			return nil
+		}
+		cp := &TaskCheckpoint{Name: pool.Name, First: pool.First, Last: pool.Last, Block: completed}
+		if err := WriteTaskCheckpoint(pool.CheckpointFile, cp); err != nil {
+			return fmt.Errorf("%s: failed to write checkpoint: %v", pool.Name, err)
+		}
+		return nil
+	}
+	defer func() {
+		if cpErr := writeCheckpoint(); cpErr != nil && err == nil {
+			err = cpErr
+		}
 	}()
 
+	pool.outputs = nil // of a previous aborted run
+	run := newTaskRun(pool)
+	// newProgress creates a progress event covering the time since the
+	// previous event at sec seconds
+	newProgress := func(elapsed time.Duration, lastSec float64, lastNumBlock, lastNumTx, lastBusyTime int64) *TaskProgress {
+		sec := elapsed.Seconds()
+		nb, nt, busy := atomic.LoadInt64(&run.numBlock), atomic.LoadInt64(&run.numTx), atomic.LoadInt64(&run.busyTime)
+		p := &TaskProgress{
+			Name:         pool.Name,
+			First:        pool.First,
+			Last:         pool.Last,
+			Block:        completed,
+			Blocks:       nb,
+			Transactions: nt,
+			Failures:     pool.NumFailures(),
+			Elapsed:      elapsed,
+			BlocksPerSec: float64(nb-lastNumBlock) / (sec - lastSec),
+			TxPerSec:     float64(nt-lastNumTx) / (sec - lastSec),
+		}
+		if pool.Workers > 0 {
+			p.Utilization = float64(busy-lastBusyTime) / (float64(pool.Workers) * (sec - lastSec) * float64(time.Second))
+		}
+		if hasCompleted && completed >= first && completed < pool.Last {
+			covered, remaining := float64(completed-first+1), float64(pool.Last-completed)
+			p.ETA = time.Duration(float64(elapsed) * remaining / covered)
+		}
+		return p
+	}
+	defer func() {
+		p := newProgress(time.Since(start)+1*time.Nanosecond, 0, 0, 0, 0)
+		p.Done, p.ETA = true, 0
+		progress(p)
+	}()
+
+	if pool.Progress == nil {
+		fmt.Printf("%s: block range = %v %v\n", pool.Name, pool.First, pool.Last)
+		fmt.Printf("%s: #CPU = %v, #worker = %v\n", pool.Name, runtime.NumCPU(), pool.Workers)
+	}
+
+	defer run.stop()
+	if pool.ScheduleTransactions {
+		run.startTransactionScheduling(first)
+	} else {
+		run.startBlockScheduling(first)
+	}
+
 	// Count finished blocks in order and report execution speed
 	var lastSec float64
-	var lastNumBlock, lastNumTx int64
+	var lastNumBlock, lastNumTx, lastBusyTime int64
 	waitMap := make(map[uint64]struct{})
-	for block := pool.First; block <= pool.Last; {
+	for {
+		var (
+			block uint64
+			ok    bool
+		)
+		select {
+		case block, ok = <-run.blockChan:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !ok {
+			break
+		}
 
-		// Count finshed blocks from waitMap in order
-		if _, ok := waitMap[block]; ok {
-			delete(waitMap, block)
+		// wait until the next scheduled block is finished
+		for {
+			if _, ok := waitMap[block]; ok {
+				delete(waitMap, block)
+				break
+			}
 
-			block++
-			continue
+			var data interface{}
+			select {
+			case data = <-run.doneChan:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			switch t := data.(type) {
+
+			case uint64:
+				waitMap[data.(uint64)] = struct{}{}
+
+			case error:
+				err := data.(error)
+				return err
+
+			default:
+				panic(fmt.Errorf("%s: unknown type %T value from doneChan", pool.Name, t))
+
+			}
+		}
+		completed, hasCompleted = block, true
+		taskBlockGauge.Update(int64(block))
+		if pool.OrderedOutput && pool.OutputFunc != nil {
+			if err := pool.flushOutput(block); err != nil {
+				return err
+			}
 		}
 
 		duration := time.Since(start) + 1*time.Nanosecond
 		sec := duration.Seconds()
-		if block == pool.Last ||
-			(block%10000 == 0 && sec > lastSec+5) ||
-			(block%1000 == 0 && sec > lastSec+10) ||
-			(block%100 == 0 && sec > lastSec+20) ||
-			(block%10 == 0 && sec > lastSec+40) ||
-			(sec > lastSec+60) {
-			nb, nt := atomic.LoadInt64(&totalNumBlock), atomic.LoadInt64(&totalNumTx)
-			blkPerSec := float64(nb-lastNumBlock) / (sec - lastSec)
-			txPerSec := float64(nt-lastNumTx) / (sec - lastSec)
-			fmt.Printf("%s: elapsed time: %v, number = %v\n", pool.Name, duration.Round(1*time.Millisecond), block)
-			fmt.Printf("%s: %.2f blk/s, %.2f tx/s\n", pool.Name, blkPerSec, txPerSec)
-
-			lastSec, lastNumBlock, lastNumTx = sec, nb, nt
+		var report bool
+		if pool.ProgressInterval > 0 {
+			report = block == pool.Last || sec > lastSec+pool.ProgressInterval.Seconds()
+		} else {
+			report = block == pool.Last ||
+				(block%10000 == 0 && sec > lastSec+5) ||
+				(block%1000 == 0 && sec > lastSec+10) ||
+				(block%100 == 0 && sec > lastSec+20) ||
+				(block%10 == 0 && sec > lastSec+40) ||
+				(sec > lastSec+60)
 		}
+		if report {
+			p := newProgress(duration, lastSec, lastNumBlock, lastNumTx, lastBusyTime)
+			taskUtilizationGauge.Update(p.Utilization)
+			progress(p)
+
+			lastSec, lastNumBlock, lastNumTx, lastBusyTime = sec, p.Blocks, p.Transactions, atomic.LoadInt64(&run.busyTime)
+			if err := writeCheckpoint(); err != nil {
+				return err
+			}
+		}
+	}
 
-		data := <-doneChan
-		switch t := data.(type) {
-
-		case uint64:
-			waitMap[data.(uint64)] = struct{}{}
-
-		case error:
-			err := data.(error)
+	// report an error of the substate iterator
+	select {
+	case data := <-run.doneChan:
+		if err, ok := data.(error); ok {
 			return err
-
-		default:
-			panic(fmt.Errorf("%s: unknown type %T value from doneChan", pool.Name, t))
-
 		}
+	default:
 	}
 
+	completed, hasCompleted = pool.Last, true
+	taskBlockGauge.Update(int64(pool.Last))
 	return nil
 }
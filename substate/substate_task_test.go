@@ -0,0 +1,95 @@
+package substate
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSubstateTaskPoolProgress(t *testing.T) {
+	db := newTestSubstateDB(map[uint64]int{1: 2, 2: 1, 3: 3, 8: 1})
+	defer db.Close()
+
+	var events []*TaskProgress
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			return nil
+		},
+		First:            0,
+		Last:             8,
+		Workers:          2,
+		DB:               db,
+		Progress:         func(p *TaskProgress) { events = append(events, p) },
+		ProgressInterval: 1, // report after every block
+	}
+	if err := pool.ExecuteContext(context.Background()); err != nil {
+		t.Fatalf("failed to execute: %v", err)
+	}
+	if len(events) != 5 {
+		t.Fatalf("wrong number of progress events: have %d, want 5", len(events))
+	}
+	for i, block := range []uint64{1, 2, 3, 8} {
+		if events[i].Block != block || events[i].Done {
+			t.Fatalf("wrong progress event %d: %+v", i, events[i])
+		}
+	}
+	if events[2].ETA <= 0 || events[3].ETA != 0 {
+		t.Fatalf("wrong ETA: %v before last block, %v after last block", events[2].ETA, events[3].ETA)
+	}
+	done := events[4]
+	if !done.Done || done.Blocks != 4 || done.Transactions != 7 || done.Block != 8 {
+		t.Fatalf("wrong final progress event: %+v", done)
+	}
+}
+
+func TestSubstateTaskPoolCancel(t *testing.T) {
+	blocks := make(map[uint64]int)
+	for block := uint64(1); block <= 100; block++ {
+		blocks[block] = 1
+	}
+	db := newTestSubstateDB(blocks)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		lock     sync.Mutex
+		executed int
+	)
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			lock.Lock()
+			defer lock.Unlock()
+			executed++
+			if block == 10 {
+				cancel()
+			}
+			return nil
+		},
+		First:          1,
+		Last:           100,
+		Workers:        2,
+		CheckpointFile: checkpoint,
+		DB:             db,
+		Progress:       func(*TaskProgress) {},
+	}
+	if err := pool.ExecuteContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error of canceled run: %v", err)
+	}
+	if executed >= 100 {
+		t.Fatalf("canceled run executed all blocks")
+	}
+	cp, err := ReadTaskCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatalf("failed to read checkpoint: %v", err)
+	}
+	if cp != nil && cp.Block >= 100 {
+		t.Fatalf("canceled run recorded as completed: %+v", cp)
+	}
+}
@@ -0,0 +1,202 @@
+package substate
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// DefaultWriterBatchSize is the batch size that triggers a flush of a
+	// SubstateWriter at the end of a block.
+	DefaultWriterBatchSize = ethdb.IdealBatchSize
+
+	// DefaultWriterCodeCacheSize is the number of code hashes a
+	// SubstateWriter remembers as stored.
+	DefaultWriterCodeCacheSize = 16384
+)
+
+// SubstateWriterStats counts the data written by a SubstateWriter.
+type SubstateWriterStats struct {
+	Blocks        uint64 // number of committed blocks
+	Substates     uint64 // number of written substates
+	SubstateBytes uint64 // size of written substate keys and values
+	Codes         uint64 // number of written bytecodes
+	CodeBytes     uint64 // size of written bytecode keys and values
+	CodeHits      uint64 // number of bytecodes skipped because they were already stored
+	Flushes       uint64 // number of batch writes to the backend
+}
+
+func (s *SubstateWriterStats) add(o *SubstateWriterStats) {
+	s.Blocks += o.Blocks
+	s.Substates += o.Substates
+	s.SubstateBytes += o.SubstateBytes
+	s.Codes += o.Codes
+	s.CodeBytes += o.CodeBytes
+	s.CodeHits += o.CodeHits
+	s.Flushes += o.Flushes
+}
+
+// SubstateWriter collects substates and their bytecode in a batch. Substates
+// of the block in process are moved to the batch when the block is committed
+// and the batch is only written once it exceeds the batch size, so that a
+// block's substates and the bytecode they reference are written atomically.
+// Hashes of stored bytecode are cached to avoid rewriting large contracts for
+// every transaction calling them.
+//
+// A SubstateWriter is not safe for concurrent use.
+type SubstateWriter struct {
+	block     ethdb.Batch // substates of the uncommitted block
+	batch     ethdb.Batch // substates of committed blocks
+	batchSize int
+
+	codeCache   *lru.Cache               // hashes of bytecode stored in the backend, nil if disabled
+	blockCodes  map[common.Hash]struct{} // hashes of bytecode of the uncommitted block
+	stagedCodes map[common.Hash]struct{} // hashes of bytecode in the unwritten batch
+
+	stats      SubstateWriterStats
+	blockStats SubstateWriterStats // stats of the uncommitted block
+	staged     SubstateWriterStats // stats of the unwritten batch
+}
+
+// NewSubstateWriter creates a writer that flushes batches larger than
+// batchSize bytes and remembers the hashes of codeCacheSize stored bytecodes.
+// A codeCacheSize of zero disables the code cache.
+func (db *SubstateDB) NewSubstateWriter(batchSize, codeCacheSize int) *SubstateWriter {
+	w := &SubstateWriter{
+		block:       db.backend.NewBatch(),
+		batch:       db.backend.NewBatch(),
+		batchSize:   batchSize,
+		blockCodes:  make(map[common.Hash]struct{}),
+		stagedCodes: make(map[common.Hash]struct{}),
+	}
+	if codeCacheSize > 0 {
+		w.codeCache, _ = lru.New(codeCacheSize)
+	}
+	return w
+}
+
+// PutSubstate adds substate of transaction tx in block together with all
+// deployed and creation bytecode it references to the uncommitted block.
+func (w *SubstateWriter) PutSubstate(ctx context.Context, block uint64, tx int, substate *Substate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// put deployed/creation code
+	for _, account := range substate.InputAlloc {
+		if err := w.putCode(account.Code); err != nil {
+			return err
+		}
+	}
+	for _, account := range substate.OutputAlloc {
+		if err := w.putCode(account.Code); err != nil {
+			return err
+		}
+	}
+	if msg := substate.Message; msg.To == nil {
+		if err := w.putCode(msg.Data); err != nil {
+			return err
+		}
+	}
+
+	key := Stage1SubstateKey(block, tx)
+	value, err := EncodeSubstateRLP(NewSubstateRLP(substate))
+	if err != nil {
+		return err
+	}
+	if err := w.block.Put(key, value); err != nil {
+		return &BackendError{Op: "put", Key: key, Err: err}
+	}
+	w.blockStats.Substates++
+	w.blockStats.SubstateBytes += uint64(len(key) + len(value))
+	return nil
+}
+
+// putCode adds code to the batch unless it is known to be stored.
+func (w *SubstateWriter) putCode(code []byte) error {
+	if len(code) == 0 {
+		return nil
+	}
+	codeHash := crypto.Keccak256Hash(code)
+	_, inBlock := w.blockCodes[codeHash]
+	_, staged := w.stagedCodes[codeHash]
+	if inBlock || staged || (w.codeCache != nil && w.codeCache.Contains(codeHash)) {
+		w.blockStats.CodeHits++
+		return nil
+	}
+
+	key := Stage1CodeKey(codeHash)
+	if err := w.block.Put(key, code); err != nil {
+		return &BackendError{Op: "put", Key: key, Err: err}
+	}
+	w.blockCodes[codeHash] = struct{}{}
+	w.blockStats.Codes++
+	w.blockStats.CodeBytes += uint64(len(key) + len(code))
+	return nil
+}
+
+// CommitBlock moves the substates of the block in process to the batch. The
+// batch is written if it exceeds the batch size, so a block is never split
+// across batches.
+func (w *SubstateWriter) CommitBlock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := w.block.Replay(w.batch); err != nil {
+		return &BackendError{Op: "put", Err: err}
+	}
+	w.block.Reset()
+	for codeHash := range w.blockCodes {
+		w.stagedCodes[codeHash] = struct{}{}
+	}
+	w.blockCodes = make(map[common.Hash]struct{})
+
+	w.blockStats.Blocks++
+	w.staged.add(&w.blockStats)
+	w.blockStats = SubstateWriterStats{}
+
+	if w.batch.ValueSize() < w.batchSize {
+		return nil
+	}
+	return w.Flush()
+}
+
+// Flush writes the substates of all committed blocks to the backend.
+// Substates of an uncommitted block are kept.
+func (w *SubstateWriter) Flush() error {
+	if w.staged.Blocks == 0 && w.batch.ValueSize() == 0 {
+		return nil
+	}
+	if err := w.batch.Write(); err != nil {
+		return &BackendError{Op: "write", Err: err}
+	}
+	w.batch.Reset()
+
+	if w.codeCache != nil {
+		for codeHash := range w.stagedCodes {
+			w.codeCache.Add(codeHash, struct{}{})
+		}
+	}
+	w.stagedCodes = make(map[common.Hash]struct{})
+
+	w.staged.Flushes++
+	w.stats.add(&w.staged)
+	w.staged = SubstateWriterStats{}
+	return nil
+}
+
+// Discard drops the substates of the uncommitted block.
+func (w *SubstateWriter) Discard() {
+	w.block.Reset()
+	w.blockCodes = make(map[common.Hash]struct{})
+	w.blockStats = SubstateWriterStats{}
+}
+
+// Stats returns the amount of data written to the backend so far.
+func (w *SubstateWriter) Stats() SubstateWriterStats {
+	return w.stats
+}
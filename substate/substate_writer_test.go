@@ -0,0 +1,68 @@
+package substate
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSubstateWriter(t *testing.T) {
+	db := newTestSubstateDB(nil)
+	defer db.Close()
+
+	ctx := context.Background()
+	w := db.NewSubstateWriter(1<<20, 16)
+
+	// tx 0 of both blocks calls the same contract
+	for _, block := range []uint64{1, 2} {
+		for tx := 0; tx < 2; tx++ {
+			if err := w.PutSubstate(ctx, block, tx, newTestSubstate(block, tx)); err != nil {
+				t.Fatalf("failed to put substate %v_%v: %v", block, tx, err)
+			}
+		}
+		if err := w.CommitBlock(ctx); err != nil {
+			t.Fatalf("failed to commit block %v: %v", block, err)
+		}
+	}
+	if db.HasSubstate(1, 0) {
+		t.Fatalf("substate written before batch is flushed")
+	}
+
+	// a discarded block is not written
+	if err := w.PutSubstate(ctx, 3, 0, newTestSubstate(3, 0)); err != nil {
+		t.Fatalf("failed to put substate 3_0: %v", err)
+	}
+	w.Discard()
+
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	for _, block := range []uint64{1, 2} {
+		for tx := 0; tx < 2; tx++ {
+			if have := db.GetSubstate(block, tx); have == nil || !have.Equal(newTestSubstate(block, tx)) {
+				t.Fatalf("substate %v_%v not written correctly", block, tx)
+			}
+		}
+	}
+	if db.HasSubstate(3, 0) {
+		t.Fatalf("discarded substate was written")
+	}
+
+	stats := w.Stats()
+	if stats.Blocks != 2 || stats.Substates != 4 || stats.Flushes != 1 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+	if stats.Codes != 2 || stats.CodeHits != 6 {
+		t.Fatalf("wrong code stats: have %d written and %d skipped, want 2 and 6", stats.Codes, stats.CodeHits)
+	}
+
+	// cached code is not written again after a flush
+	if err := w.PutSubstate(ctx, 4, 1, newTestSubstate(4, 1)); err != nil {
+		t.Fatalf("failed to put substate 4_1: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if stats := w.Stats(); stats.Codes != 2 {
+		t.Fatalf("cached code was written again")
+	}
+}
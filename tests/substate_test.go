@@ -0,0 +1,112 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+// newTransferSubstate returns the substate of a London transfer of value
+// from sender to recipient.
+func newTransferSubstate(value int64) *substate.Substate {
+	var (
+		sender    = common.HexToAddress("0x1000000000000000000000000000000000000001")
+		recipient = common.HexToAddress("0x2000000000000000000000000000000000000002")
+		coinbase  = common.HexToAddress("0x3000000000000000000000000000000000000003")
+
+		balance = big.NewInt(1000000000)
+		baseFee = big.NewInt(10)
+		tip     = big.NewInt(2)
+		gas     = uint64(21000)
+	)
+	fee := new(big.Int).Mul(new(big.Int).Add(baseFee, tip), new(big.Int).SetUint64(gas))
+	senderBalance := new(big.Int).Sub(balance, fee)
+	senderBalance.Sub(senderBalance, big.NewInt(value))
+
+	inputAlloc := substate.SubstateAlloc{
+		sender:    substate.NewSubstateAccount(0, balance, nil),
+		recipient: substate.NewSubstateAccount(0, big.NewInt(0), nil),
+	}
+	outputAlloc := substate.SubstateAlloc{
+		sender:    substate.NewSubstateAccount(1, senderBalance, nil),
+		recipient: substate.NewSubstateAccount(0, big.NewInt(value), nil),
+		coinbase:  substate.NewSubstateAccount(0, new(big.Int).Mul(tip, new(big.Int).SetUint64(gas)), nil),
+	}
+	env := &substate.SubstateEnv{
+		Coinbase:    coinbase,
+		Difficulty:  big.NewInt(1),
+		GasLimit:    30000000,
+		Number:      13000000,
+		Timestamp:   1628166822,
+		BlockHashes: map[uint64]common.Hash{},
+		BaseFee:     baseFee,
+	}
+	msg := &substate.SubstateMessage{
+		Nonce:     0,
+		GasPrice:  new(big.Int).Add(baseFee, tip),
+		Gas:       gas,
+		From:      sender,
+		To:        &recipient,
+		Value:     big.NewInt(value),
+		GasFeeCap: big.NewInt(100),
+		GasTipCap: tip,
+	}
+	result := &substate.SubstateResult{Status: 1, GasUsed: gas}
+	return substate.NewSubstate(inputAlloc, outputAlloc, env, msg, result)
+}
+
+func TestStateTestFromSubstate(t *testing.T) {
+	s := newTransferSubstate(12345)
+	test, err := StateTestFromSubstate(s, "")
+	if err != nil {
+		t.Fatalf("failed to convert substate: %v", err)
+	}
+	subtests := test.Subtests()
+	if len(subtests) != 1 || subtests[0].Fork != "London" {
+		t.Fatalf("wrong subtests: %+v", subtests)
+	}
+
+	// the fixture is run from its JSON encoding like GeneralStateTests
+	enc, err := json.Marshal(map[string]*StateTest{"transfer": test})
+	if err != nil {
+		t.Fatalf("failed to encode state test: %v", err)
+	}
+	var fixtures map[string]StateTest
+	if err := json.Unmarshal(enc, &fixtures); err != nil {
+		t.Fatalf("failed to decode state test: %v", err)
+	}
+	fixture := fixtures["transfer"]
+	if _, _, err := fixture.Run(subtests[0], vm.Config{}, false); err != nil {
+		t.Fatalf("state test of substate failed: %v", err)
+	}
+
+	// a wrong recorded result must fail
+	s.OutputAlloc[*s.Message.To].Balance.SetInt64(1)
+	tampered, err := StateTestFromSubstate(s, "")
+	if err != nil {
+		t.Fatalf("failed to convert substate: %v", err)
+	}
+	if _, _, err := tampered.Run(subtests[0], vm.Config{}, false); err == nil {
+		t.Fatalf("state test of tampered substate passed")
+	}
+}
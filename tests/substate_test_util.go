@@ -0,0 +1,184 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/substate"
+)
+
+// substateTestKey signs the transactions of state tests converted from
+// substates, it replaces the unknown key of the recorded sender.
+var substateTestKey, _ = crypto.HexToECDSA("45a915e4d060149eb4365960e6a7a45f334393093061116b197e3240065ff2d8")
+
+// SubstateFork returns the name of the state test fork of a mainnet block.
+func SubstateFork(number uint64) string {
+	var (
+		config = params.MainnetChainConfig
+		num    = new(big.Int).SetUint64(number)
+	)
+	switch {
+	case config.IsLondon(num):
+		return "London"
+	case config.IsBerlin(num):
+		return "Berlin"
+	case config.IsIstanbul(num):
+		return "Istanbul"
+	case config.IsPetersburg(num):
+		return "ConstantinopleFix"
+	case config.IsConstantinople(num):
+		return "Constantinople"
+	case config.IsByzantium(num):
+		return "Byzantium"
+	case config.IsEIP158(num):
+		return "EIP158"
+	case config.IsEIP150(num):
+		return "EIP150"
+	case config.IsHomestead(num):
+		return "Homestead"
+	}
+	return "Frontier"
+}
+
+// StateTestFromSubstate converts the substate of a transaction into a
+// GeneralStateTest with a single post state for fork. If fork is empty, the
+// fork of the block on mainnet is used. The expected post state and logs are
+// taken from the recorded output alloc and result.
+//
+// The sender is replaced by the account of a well-known test key and BLOCKHASH
+// returns the hashes of state tests, transactions depending on the sender
+// address or on block hashes may therefore not reproduce the recorded result.
+func StateTestFromSubstate(s *substate.Substate, fork string) (*StateTest, error) {
+	if fork == "" {
+		fork = SubstateFork(s.Env.Number)
+	}
+	config, ok := Forks[fork]
+	if !ok {
+		return nil, UnsupportedForkError{fork}
+	}
+
+	var (
+		msg    = s.Message
+		sender = crypto.PubkeyToAddress(substateTestKey.PublicKey)
+		remap  = map[common.Address]common.Address{msg.From: sender}
+	)
+	if msg.To == nil {
+		// the address of a created contract depends on the sender
+		remap[crypto.CreateAddress(msg.From, msg.Nonce)] = crypto.CreateAddress(sender, msg.Nonce)
+	}
+	pre, err := substateGenesisAlloc(s.InputAlloc, remap)
+	if err != nil {
+		return nil, err
+	}
+	post, err := substateGenesisAlloc(s.OutputAlloc, remap)
+	if err != nil {
+		return nil, err
+	}
+
+	// compute the post state root like StateTest.RunNoVerify
+	number := new(big.Int).SetUint64(s.Env.Number)
+	_, statedb := MakePreState(rawdb.NewMemoryDatabase(), post, false)
+	statedb.AddBalance(s.Env.Coinbase, new(big.Int))
+	root := statedb.IntermediateRoot(config.IsEIP158(number))
+
+	logs := s.Result.Logs
+	if logs == nil {
+		logs = []*types.Log{}
+	}
+
+	tx := stTransaction{
+		Nonce:      msg.Nonce,
+		Data:       []string{hexutil.Encode(msg.Data)},
+		GasLimit:   []uint64{msg.Gas},
+		Value:      []string{hexutil.EncodeBig(msg.Value)},
+		PrivateKey: crypto.FromECDSA(substateTestKey),
+	}
+	if msg.To != nil {
+		tx.To = msg.To.Hex()
+	}
+	if config.IsLondon(number) {
+		tx.MaxFeePerGas = msg.GasFeeCap
+		tx.MaxPriorityFeePerGas = msg.GasTipCap
+	} else {
+		tx.GasPrice = msg.GasPrice
+	}
+	if msg.AccessList != nil {
+		accessList := msg.AccessList
+		tx.AccessLists = []*types.AccessList{&accessList}
+	}
+
+	test := &StateTest{}
+	test.json = stJSON{
+		Env: stEnv{
+			Coinbase:   s.Env.Coinbase,
+			Difficulty: s.Env.Difficulty,
+			GasLimit:   s.Env.GasLimit,
+			Number:     s.Env.Number,
+			Timestamp:  s.Env.Timestamp,
+			BaseFee:    s.Env.BaseFee,
+		},
+		Pre: pre,
+		Tx:  tx,
+		Post: map[string][]stPostState{
+			fork: {{
+				Root: common.UnprefixedHash(root),
+				Logs: common.UnprefixedHash(rlpHash(logs)),
+			}},
+		},
+	}
+	return test, nil
+}
+
+// substateGenesisAlloc converts a substate alloc into a genesis alloc and
+// renames the accounts in remap.
+func substateGenesisAlloc(alloc substate.SubstateAlloc, remap map[common.Address]common.Address) (core.GenesisAlloc, error) {
+	genesisAlloc := make(core.GenesisAlloc, len(alloc))
+	for addr, account := range alloc {
+		if account == nil {
+			continue
+		}
+		if newAddr, found := remap[addr]; found {
+			addr = newAddr
+		} else {
+			for _, newAddr := range remap {
+				if addr == newAddr {
+					return nil, fmt.Errorf("account %v is reserved for the state test sender", addr.Hex())
+				}
+			}
+		}
+		storage := make(map[common.Hash]common.Hash, len(account.Storage))
+		for key, value := range account.Storage {
+			storage[key] = value
+		}
+		genesisAlloc[addr] = core.GenesisAccount{
+			Code:    account.Code,
+			Storage: storage,
+			Balance: new(big.Int).Set(account.Balance),
+			Nonce:   account.Nonce,
+		}
+	}
+	return genesisAlloc, nil
+}